@@ -1,19 +1,27 @@
 package tapdance
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	pb "github.com/refraction-networking/gotapdance/protobuf"
+	ps "github.com/refraction-networking/gotapdance/tapdance/phantoms"
 )
 
 type assets struct {
@@ -21,19 +29,87 @@ type assets struct {
 	path string
 
 	config *pb.ClientConf
+	// configSource is where config came from, see ConfigSource.
+	configSource string
 
-	roots *x509.CertPool
+	// defaultDecoys are the decoys the assets started with, see
+	// UsingDefaultDecoys.
+	defaultDecoys []*pb.TLSDecoySpec
 
-	filenameRoots      string
-	filenameClientConf string
+	roots    *x509.CertPool
+	rootsPEM []byte
+
+	filenameRoots              string
+	filenameClientConf         string
+	filenamePreferredTransport string
+	filenameDecoyState         string
+	filenameDecoyTLSProfiles   string
 
 	socksAddr string
+
+	preferredTransport string
+	transportMode      TransportMode
+
+	genWatchers []chan uint32
+	genHistory  []GenChange
+
+	randMu     sync.Mutex
+	randSource RandSource
+
+	decoyIPOverrides map[string]net.IP
+	decoyTLSVersions map[string]TLSVersionRange
+	decoyTLSProfiles map[string]string
+	decoyAllowlist   map[string]bool
+	decoyScorer      func(*pb.TLSDecoySpec) float64
+
+	configKey []byte
+
+	fileLocking    bool
+	strictPubkeys  bool
+	strictDecoyIPs bool
+	readOnly       bool
+
+	ipv6Unavailable bool
+
+	decoyKeysMu sync.Mutex
+	decoyKeys   map[string]*pb.TLSDecoySpec
+
+	clockMu sync.Mutex
+	clock   func() time.Time
+
+	healthMu              sync.Mutex
+	decoyHealth           map[string]*decoyHealth
+	successBias           bool
+	decoySelectionEpsilon float64
+	decoyCooldown         time.Duration
+	decoySelections       uint64
+	failureWatchers       []chan DecoyFailureEvent
+	decoyBlacklist        map[string]bool
+	minUsableDecoys       int
+	onLowDecoys           func()
+	lowDecoysReported     bool
+	persistBlacklist      bool
+	decoyStateFilename    string
+	decoyStateSeq         uint64
+
+	decoyStateMu    sync.Mutex
+	decoyStateSaved uint64
+}
+
+// RandSource provides the randomness used to pick decoys. *math/rand.Rand
+// satisfies it.
+type RandSource interface {
+	Intn(n int) int
 }
 
 // could reset this internally to refresh assets and avoid woes of singleton testing
 var assetsInstance *assets
 var assetsOnce sync.Once
 
+// assetsInstanceMu guards assetsInstance for readers that must not initialize
+// it, such as SetDefaultStationKey.
+var assetsInstanceMu sync.Mutex
+
 // Assets is an access point to asset managing singleton.
 // First access to singleton sets path. Assets(), if called
 // before SetAssetsDir() sets path to "./assets/"
@@ -47,15 +123,18 @@ func Assets() *assets {
 // Functionally equivalent to Assets() after initialization, unless dir changes.
 func AssetsSetDir(dir string) *assets {
 	_initAssets := func() { initAssets(dir) }
-	if assetsInstance != nil {
-		assetsInstance.Lock()
-		defer assetsInstance.Unlock()
-		if dir != assetsInstance.path {
+	assetsInstanceMu.Lock()
+	a := assetsInstance
+	assetsInstanceMu.Unlock()
+	if a != nil {
+		a.Lock()
+		defer a.Unlock()
+		if dir != a.path {
 			Logger().Warnf("Assets path changed %s->%s. (Re)initializing.\n",
-				assetsInstance.path, dir)
-			assetsInstance.path = dir
-			assetsInstance.readConfigs()
-			return assetsInstance
+				a.path, dir)
+			a.path = dir
+			a.readConfigs()
+			return a
 		}
 	}
 	assetsOnce.Do(_initAssets)
@@ -71,29 +150,177 @@ func getDefaultKey() []byte {
 }
 
 func initAssets(path string) {
+	assetsInstanceMu.Lock()
+	defer assetsInstanceMu.Unlock()
+
+	assetsInstance = newAssets(path)
+	assetsInstance.readConfigs()
+}
+
+var customDefaultsMu sync.Mutex
+var customDefaultDecoys []*pb.TLSDecoySpec
+var customDefaultPubkey *pb.PubKey
+
+// SetDefaultStationKey replaces the built-in station key, the fallback used
+// when the ClientConf has no default pubkey, e.g. for a private deployment.
+// It is SetDefaultPubkey with an AES_GCM_128 key of 32 bytes; nil restores
+// the built-in key. Unlike SetDefaultPubkey it may also be called after the
+// assets are initialized: if they still hold the built-in ClientConf, see
+// ConfigSourceDefault, it switches to the new key and is stored to disk. It
+// fails with ErrReadOnly if the assets are read-only, and leaves the fallback
+// as it was if storing fails. A pubkey read from a ClientConf takes
+// precedence.
+func SetDefaultStationKey(key []byte) error {
+	if key != nil && len(key) != pubkeyLen {
+		return fmt.Errorf("station key is %d bytes, expected %d", len(key), pubkeyLen)
+	}
+	keyType := pb.KeyType_AES_GCM_128
+	pubkey := pb.PubKey{Key: key, Type: &keyType}
+
+	// held throughout, so assets initialized meanwhile get the new fallback
+	assetsInstanceMu.Lock()
+	defer assetsInstanceMu.Unlock()
+
+	a := assetsInstance
+	if a == nil {
+		SetDefaultPubkey(pubkey)
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.readOnly {
+		return ErrReadOnly
+	}
+
+	customDefaultsMu.Lock()
+	oldPubkey := customDefaultPubkey
+	customDefaultsMu.Unlock()
+	SetDefaultPubkey(pubkey)
+
+	_, err := a.updateClientConfIf(func(conf *pb.ClientConf) bool {
+		if a.configSource != ConfigSourceDefault {
+			return false
+		}
+		conf.DefaultPubkey = defaultPubkey()
+		return true
+	})
+	if err != nil {
+		customDefaultsMu.Lock()
+		customDefaultPubkey = oldPubkey
+		customDefaultsMu.Unlock()
+	}
+	return err
+}
+
+// SetDefaultDecoys replaces the built-in decoys that are used until a ClientConf
+// file is read, e.g. with the decoys of a private deployment. It only affects
+// assets initialized afterwards, so call it before the first Assets() or
+// AssetsSetDir(). Passing nil restores the built-in decoys.
+func SetDefaultDecoys(decoys []*pb.TLSDecoySpec) {
+	customDefaultsMu.Lock()
+	defer customDefaultsMu.Unlock()
+
+	customDefaultDecoys = nil
+	for _, decoy := range decoys {
+		customDefaultDecoys = append(customDefaultDecoys, proto.Clone(decoy).(*pb.TLSDecoySpec))
+	}
+}
+
+// SetDefaultPubkey replaces the built-in station public key that is used until
+// a ClientConf file is read. Like SetDefaultDecoys, call it before the first
+// Assets() or AssetsSetDir(). Passing a PubKey without a key restores the
+// built-in key.
+func SetDefaultPubkey(pubkey pb.PubKey) {
+	customDefaultsMu.Lock()
+	defer customDefaultsMu.Unlock()
+
+	if pubkey.Key == nil {
+		customDefaultPubkey = nil
+		return
+	}
+	customDefaultPubkey = proto.Clone(&pubkey).(*pb.PubKey)
+}
+
+// defaultPubkey returns a copy of the fallback station pubkey: the one set
+// with SetDefaultPubkey or, if none is, the built-in key.
+func defaultPubkey() *pb.PubKey {
+	customDefaultsMu.Lock()
+	defer customDefaultsMu.Unlock()
+
+	if customDefaultPubkey != nil {
+		return proto.Clone(customDefaultPubkey).(*pb.PubKey)
+	}
+	keyType := pb.KeyType_AES_GCM_128
+	return &pb.PubKey{Key: getDefaultKey(), Type: &keyType}
+}
+
+// newAssets creates an assets instance holding the built-in defaults without
+// reading anything from path.
+func newAssets(path string) *assets {
 	var defaultDecoys = []*pb.TLSDecoySpec{
 		pb.InitTLSDecoySpec("192.122.190.104", "tapdance1.freeaeskey.xyz"),
 		pb.InitTLSDecoySpec("192.122.190.105", "tapdance2.freeaeskey.xyz"),
 		pb.InitTLSDecoySpec("192.122.190.106", "tapdance3.freeaeskey.xyz"),
 	}
 
-	defaultKey := getDefaultKey()
-	defualtKeyType := pb.KeyType_AES_GCM_128
-	defaultPubKey := pb.PubKey{Key: defaultKey, Type: &defualtKeyType}
+	defaultPubKey := *defaultPubkey()
 	defaultGeneration := uint32(0)
+
+	customDefaultsMu.Lock()
+	if customDefaultDecoys != nil {
+		defaultDecoys = make([]*pb.TLSDecoySpec, 0, len(customDefaultDecoys))
+		for _, decoy := range customDefaultDecoys {
+			defaultDecoys = append(defaultDecoys, proto.Clone(decoy).(*pb.TLSDecoySpec))
+		}
+	}
+	customDefaultsMu.Unlock()
 	defaultDecoyList := pb.DecoyList{TlsDecoys: defaultDecoys}
 	defaultClientConf := pb.ClientConf{DecoyList: &defaultDecoyList,
 		DefaultPubkey: &defaultPubKey,
 		Generation:    &defaultGeneration}
 
-	assetsInstance = &assets{
-		path:               path,
-		config:             &defaultClientConf,
-		filenameRoots:      "roots",
-		filenameClientConf: "ClientConf",
-		socksAddr:          "",
+	defaultDecoysCopy := make([]*pb.TLSDecoySpec, 0, len(defaultDecoys))
+	for _, decoy := range defaultDecoys {
+		defaultDecoysCopy = append(defaultDecoysCopy, proto.Clone(decoy).(*pb.TLSDecoySpec))
 	}
-	assetsInstance.readConfigs()
+
+	return &assets{
+		path:                       path,
+		config:                     &defaultClientConf,
+		configSource:               ConfigSourceDefault,
+		defaultDecoys:              defaultDecoysCopy,
+		filenameRoots:              "roots",
+		filenameClientConf:         "ClientConf",
+		filenamePreferredTransport: "PreferredTransport",
+		filenameDecoyState:         "DecoyState",
+		filenameDecoyTLSProfiles:   "DecoyTLSProfiles",
+		socksAddr:                  "",
+	}
+}
+
+// SetRandSource replaces the randomness used by decoy selection, e.g. with a
+// fixed-seed *math/rand.Rand for deterministic tests. Passing nil restores the
+// default, which draws from crypto/rand.
+func (a *assets) SetRandSource(r RandSource) {
+	a.randMu.Lock()
+	defer a.randMu.Unlock()
+	a.randSource = r
+}
+
+// randIndex returns a random index in [0, n) from the configured RandSource.
+func (a *assets) randIndex(n int) int {
+	a.randMu.Lock()
+	defer a.randMu.Unlock()
+	if a.randSource == nil {
+		return getRandInt(0, n-1)
+	}
+	return a.randSource.Intn(n)
+}
+
+// randFloat returns a random number in [0, 1) from the configured RandSource.
+func (a *assets) randFloat() float64 {
+	const precision = 1 << 30
+	return float64(a.randIndex(precision)) / precision
 }
 
 func (a *assets) GetAssetsDir() string {
@@ -102,36 +329,114 @@ func (a *assets) GetAssetsDir() string {
 	return a.path
 }
 
+// AssetsFilesInfo describes the files backing the assets and when they were
+// last modified on disk. Mod times are zero for files that don't exist, e.g.
+// when assets only live in memory.
+type AssetsFilesInfo struct {
+	Dir               string
+	RootsPath         string
+	RootsModTime      time.Time
+	ClientConfPath    string
+	ClientConfModTime time.Time
+}
+
+// AssetsInfo reports the resolved roots and ClientConf paths and their
+// modification times, so callers can tell how stale the config is.
+func (a *assets) AssetsInfo() AssetsFilesInfo {
+	a.RLock()
+	defer a.RUnlock()
+
+	modTime := func(filename string) time.Time {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+
+	info := AssetsFilesInfo{
+		Dir:            a.path,
+		RootsPath:      path.Join(a.path, a.filenameRoots),
+		ClientConfPath: path.Join(a.path, a.filenameClientConf),
+	}
+	info.RootsModTime = modTime(info.RootsPath)
+	info.ClientConfModTime = modTime(info.ClientConfPath)
+	return info
+}
+
+// Summary describes the loaded assets in one line: directory, generation,
+// decoys by family, pubkey fingerprint, whether roots are loaded and the
+// number of phantom subnets. It only reads the assets.
+func (a *assets) Summary() string {
+	a.RLock()
+	defer a.RUnlock()
+
+	roots := "not loaded"
+	if a.roots != nil {
+		roots = "loaded"
+	}
+	v4Only, v6Only, dualStack := a.decoyCountByFamily()
+	return fmt.Sprintf("assets dir %q: generation %d, %d decoys (%d v4 only, %d v6 only, %d dual stack), pubkey %s, roots %s, %d phantom subnets",
+		a.path, a.config.GetGeneration(),
+		len(a.config.GetDecoyList().GetTlsDecoys()), v4Only, v6Only, dualStack,
+		keyFingerprint(a.config.GetDefaultPubkey().GetKey()),
+		roots,
+		len(a.config.GetDarkDecoyBlocks().GetBlocks()))
+}
+
+// keyFingerprint - short hex fingerprint of key, "none" if there is no key.
+func keyFingerprint(key []byte) string {
+	if len(key) == 0 {
+		return "none"
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
 func (a *assets) readConfigs() {
 	readRoots := func(filename string) error {
 		rootCerts, err := ioutil.ReadFile(filename)
 		if err != nil {
 			return err
 		}
-		roots := x509.NewCertPool()
-		ok := roots.AppendCertsFromPEM(rootCerts)
-		if !ok {
-			return errors.New("Failed to parse root certificates")
+		roots, err := parseRoots(rootCerts)
+		if err != nil {
+			return err
 		}
 		a.roots = roots
+		a.rootsPEM = rootCerts
 		return nil
 	}
 
-	readClientConf := func(filename string) error {
-		buf, err := ioutil.ReadFile(filename)
+	readClientConf := func() error {
+		clientConf, err := a.loadClientConf()
 		if err != nil {
 			return err
 		}
-		clientConf := &pb.ClientConf{}
-		err = proto.Unmarshal(buf, clientConf)
-		if err != nil {
-			return err
+		if problems := pubkeyProblems(clientConf); len(problems) > 0 {
+			if a.strictPubkeys {
+				return errors.New("invalid pubkeys: " + strings.Join(problems, "; "))
+			}
+			Logger().Warningln("Assets: ClientConf has invalid pubkeys: " + strings.Join(problems, "; "))
+		}
+		if problems := decoyIPProblems(clientConf); len(problems) > 0 {
+			Logger().Warningln("Assets: ClientConf has malformed decoy addresses: " + strings.Join(problems, "; "))
+			if a.strictDecoyIPs {
+				clientConf.DecoyList.TlsDecoys = wellFormedDecoys(clientConf.DecoyList.TlsDecoys)
+				if len(clientConf.DecoyList.TlsDecoys) == 0 {
+					return errors.New("no decoys with well-formed addresses")
+				}
+			}
 		}
 		a.config = clientConf
+		a.configSource = ConfigSourceFile
+		a.resetDecoyKeys()
 		return nil
 	}
 
 	var err error
+	oldGen := a.config.GetGeneration()
+	defer a.notifyGeneration(oldGen)
 	Logger().Infoln("Assets: reading from folder " + a.path)
 
 	rootsFilename := path.Join(a.path, a.filenameRoots)
@@ -143,221 +448,1584 @@ func (a *assets) readConfigs() {
 	}
 
 	clientConfFilename := path.Join(a.path, a.filenameClientConf)
-	err = readClientConf(clientConfFilename)
+	err = readClientConf()
 	if err != nil {
 		Logger().Warningln("Assets: failed to read ClientConf file: " + err.Error())
 	} else {
 		Logger().Infoln("Client config successfully read from " + clientConfFilename)
+		if migrated, changed := migrateClientConf(a.config); changed {
+			a.config = migrated
+			Logger().Infoln("Assets: migrated ClientConf to the current schema")
+			if err = a.saveClientConf(); err != nil {
+				Logger().Warningln("Assets: failed to save migrated ClientConf: " + err.Error())
+			}
+		}
 	}
-}
 
-// Picks random decoy, returns Server Name Indication and addr in format ipv4:port
-func (a *assets) GetDecoyAddress() (sni string, addr string) {
-	a.RLock()
-	defer a.RUnlock()
+	// the preferred transport is optional, a missing file means auto
+	transport, err := ioutil.ReadFile(path.Join(a.path, a.filenamePreferredTransport))
+	if err == nil {
+		a.preferredTransport = strings.TrimSpace(string(transport))
+	} else if !os.IsNotExist(err) {
+		Logger().Warningln("Assets: failed to read preferred transport: " + err.Error())
+	}
 
-	decoys := a.config.GetDecoyList().GetTlsDecoys()
-	if len(decoys) == 0 {
-		return "", ""
+	// so are the decoy TLS profiles
+	profiles, err := ioutil.ReadFile(path.Join(a.path, a.filenameDecoyTLSProfiles))
+	if err == nil {
+		a.decoyTLSProfiles = nil
+		if err = json.Unmarshal(profiles, &a.decoyTLSProfiles); err != nil {
+			Logger().Warningln("Assets: failed to parse decoy TLS profiles: " + err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		Logger().Warningln("Assets: failed to read decoy TLS profiles: " + err.Error())
 	}
-	decoyIndex := getRandInt(0, len(decoys)-1)
-	ip := make(net.IP, 4)
-	binary.BigEndian.PutUint32(ip, decoys[decoyIndex].GetIpv4Addr())
-	//[TODO]{priority:winter-break}: what checks need to be done, and what's guaranteed?
-	addr = ip.To4().String() + ":443"
-	sni = decoys[decoyIndex].GetHostname()
-	return
-}
 
-// Get all Decoys from ClientConf
-func (a *assets) GetAllDecoys() []*pb.TLSDecoySpec {
-	return a.config.GetDecoyList().GetTlsDecoys()
+	a.healthMu.Lock()
+	if a.persistBlacklist {
+		a.loadDecoyState(path.Join(a.path, a.filenameDecoyState))
+	}
+	a.healthMu.Unlock()
 }
 
-// Get all Decoys from ClientConf that have an IPv6 address
-func (a *assets) GetV6Decoys() []*pb.TLSDecoySpec {
-	v6Decoys := make([]*pb.TLSDecoySpec, 0)
-	allDecoys := a.config.GetDecoyList().GetTlsDecoys()
+// clientConfMigrations upgrade ClientConfs written with older schemas. They
+// run in order, must be idempotent, and report whether they changed anything.
+var clientConfMigrations = []func(*pb.ClientConf) bool{
+	migrateMappedV4Decoys,
+}
 
-	for _, decoy := range allDecoys {
-		if decoy.GetIpv6Addr() != nil {
-			v6Decoys = append(v6Decoys, decoy)
+// migrateClientConf applies clientConfMigrations to a copy of conf. If no
+// migration applies, conf itself is returned and changed is false.
+func migrateClientConf(conf *pb.ClientConf) (migrated *pb.ClientConf, changed bool) {
+	migrated = proto.Clone(conf).(*pb.ClientConf)
+	for _, migrate := range clientConfMigrations {
+		if migrate(migrated) {
+			changed = true
 		}
 	}
+	if !changed {
+		return conf, false
+	}
+	return migrated, true
+}
 
-	return v6Decoys
+// migrateMappedV4Decoys moves IPv4 addresses that older configs stored as
+// IPv4-mapped IPv6 addresses into the ipv4addr field.
+func migrateMappedV4Decoys(conf *pb.ClientConf) bool {
+	changed := false
+	for _, decoy := range conf.GetDecoyList().GetTlsDecoys() {
+		if decoy.Ipv4Addr != nil || len(decoy.Ipv6Addr) != net.IPv6len {
+			continue
+		}
+		ip4 := net.IP(decoy.Ipv6Addr).To4()
+		if ip4 == nil {
+			continue
+		}
+		ipv4Addr := binary.BigEndian.Uint32(ip4)
+		decoy.Ipv4Addr = &ipv4Addr
+		decoy.Ipv6Addr = nil
+		changed = true
+	}
+	return changed
 }
 
-// Get all Decoys from ClientConf that have an IPv6 address
-func (a *assets) GetV4Decoys() []*pb.TLSDecoySpec {
-	v6Decoys := make([]*pb.TLSDecoySpec, 0)
-	allDecoys := a.config.GetDecoyList().GetTlsDecoys()
+func parseRoots(rootCerts []byte) (*x509.CertPool, error) {
+	roots := x509.NewCertPool()
+	ok := roots.AppendCertsFromPEM(rootCerts)
+	if !ok {
+		return nil, errors.New("Failed to parse root certificates")
+	}
+	return roots, nil
+}
 
-	for _, decoy := range allDecoys {
-		if decoy.GetIpv4Addr() != 0 {
-			v6Decoys = append(v6Decoys, decoy)
+// loadClientConf reads and, if needed, decrypts the ClientConf file in the
+// assets dir, without applying it.
+func (a *assets) loadClientConf() (*pb.ClientConf, error) {
+	buf, err := ioutil.ReadFile(path.Join(a.path, a.filenameClientConf))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(buf, encryptedConfMagic) {
+		if a.configKey == nil {
+			return nil, errors.New("ClientConf is encrypted, but no key is set")
+		}
+		buf, err = decryptClientConf(buf, a.configKey)
+		if err != nil {
+			return nil, err
 		}
 	}
+	return parseClientConf(buf)
+}
+
+func parseClientConf(buf []byte) (*pb.ClientConf, error) {
+	clientConf := &pb.ClientConf{}
+	err := proto.Unmarshal(buf, clientConf)
+	if err != nil {
+		return nil, err
+	}
+	return clientConf, nil
+}
 
-	return v6Decoys
+// decoyIPv4 returns the IPv4 address of decoy, 0.0.0.0 if it has none.
+func decoyIPv4(decoy *pb.TLSDecoySpec) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, decoy.GetIpv4Addr())
+	return ip
 }
 
-// GetDecoy - Gets random DecoySpec
-func (a *assets) GetDecoy() *pb.TLSDecoySpec {
+// Picks random decoy, returns Server Name Indication and addr in format ipv4:port
+func (a *assets) GetDecoyAddress() (sni string, addr string) {
 	a.RLock()
 	defer a.RUnlock()
 
-	decoys := a.config.GetDecoyList().GetTlsDecoys()
-	chosenDecoy := &pb.TLSDecoySpec{}
+	decoys := a.allowlistedDecoys(a.reachableDecoys())
 	if len(decoys) == 0 {
-		return chosenDecoy
+		return "", ""
 	}
-	decoyIndex := getRandInt(0, len(decoys)-1)
-	chosenDecoy = decoys[decoyIndex]
-
-	//[TODO]{priority:soon} stop enforcing values >= defaults.
-	// Fix ackhole instead
-	// No value checks when using
-	if chosenDecoy.GetTimeout() < timeoutMin {
-		timeout := uint32(timeoutMax)
-		chosenDecoy.Timeout = &timeout
+	decoyIndex := a.randIndex(len(decoys))
+	ip := decoyIPv4(decoys[decoyIndex])
+	//[TODO]{priority:winter-break}: what checks need to be done, and what's guaranteed?
+	addr = ip.To4().String() + ":443"
+	sni = decoys[decoyIndex].GetHostname()
+	if overrideIP, ok := a.decoyIPOverrides[sni]; ok {
+		addr = net.JoinHostPort(overrideIP.String(), "443")
 	}
-	if chosenDecoy.GetTcpwin() < sendLimitMin {
-		tcpWin := uint32(sendLimitMax)
-		chosenDecoy.Tcpwin = &tcpWin
+	return
+}
+
+// SetDecoyIPOverrides redirects decoys to different IPs by hostname, e.g. to
+// send traffic for real decoy hostnames to a testbed station. GetDecoyAddress
+// keeps returning the decoy hostname as SNI, but the address of the override.
+// Overrides for hostnames not in the decoy list have no effect, and entries
+// that aren't valid IPs are skipped. Passing nil removes all overrides.
+func (a *assets) SetDecoyIPOverrides(overrides map[string]string) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.decoyIPOverrides = make(map[string]net.IP, len(overrides))
+	for hostname, ipStr := range overrides {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			Logger().Warnf("Assets: ignoring invalid override IP %q for decoy %v", ipStr, hostname)
+			continue
+		}
+		a.decoyIPOverrides[hostname] = ip
 	}
-	return chosenDecoy
 }
 
-// GetDecoy - Gets random IPv6 DecoySpec
-func (a *assets) GetV6Decoy() *pb.TLSDecoySpec {
+// maxDecoyKeys bounds the number of GetDecoyForKey mappings kept cached.
+const maxDecoyKeys = 1024
+
+// GetDecoyForKey maps key, such as a covert destination host, to a decoy, so
+// every connection for the same key goes through the same decoy while
+// different keys spread across the decoys. The mapping depends only on the key
+// and the decoy list, and is cached until the decoy list changes or
+// maxDecoyKeys keys are cached. The decoy is a copy with the standard Timeout
+// and Tcpwin defaults applied, and empty if there are no decoys.
+func (a *assets) GetDecoyForKey(key string) pb.TLSDecoySpec {
 	a.RLock()
 	defer a.RUnlock()
 
-	decoys := a.GetV6Decoys()
-	chosenDecoy := &pb.TLSDecoySpec{}
+	a.decoyKeysMu.Lock()
+	defer a.decoyKeysMu.Unlock()
+
+	if decoy, ok := a.decoyKeys[key]; ok {
+		return *proto.Clone(decoy).(*pb.TLSDecoySpec)
+	}
+	decoys := a.sortedDecoys()
 	if len(decoys) == 0 {
-		return chosenDecoy
+		return pb.TLSDecoySpec{}
 	}
-	decoyIndex := getRandInt(0, len(decoys)-1)
-	chosenDecoy = decoys[decoyIndex]
+	hash := sha256.Sum256([]byte(key))
+	i := binary.BigEndian.Uint64(hash[:8]) % uint64(len(decoys))
 
-	// No enforcing TCPWIN etc. values because this is conjure only
-	return chosenDecoy
+	chosenDecoy := proto.Clone(decoys[i]).(*pb.TLSDecoySpec)
+	enforceDecoyDefaults(chosenDecoy)
+	if a.decoyKeys == nil || len(a.decoyKeys) >= maxDecoyKeys {
+		a.decoyKeys = make(map[string]*pb.TLSDecoySpec)
+	}
+	a.decoyKeys[key] = chosenDecoy
+	return *proto.Clone(chosenDecoy).(*pb.TLSDecoySpec)
 }
 
-func (a *assets) GetRoots() *x509.CertPool {
-	a.RLock()
-	defer a.RUnlock()
-
-	return a.roots
+// resetDecoyKeys forgets the GetDecoyForKey mappings after the decoy list
+// changed.
+func (a *assets) resetDecoyKeys() {
+	a.decoyKeysMu.Lock()
+	defer a.decoyKeysMu.Unlock()
+	a.decoyKeys = nil
 }
 
-func (a *assets) GetPubkey() *[32]byte {
+// GetDecoyListCopy returns a copy of the ClientConf decoy list that callers
+// can enumerate and modify freely. The copy is empty if there is no list.
+func (a *assets) GetDecoyListCopy() *pb.DecoyList {
 	a.RLock()
 	defer a.RUnlock()
 
-	var pKey [32]byte
-	copy(pKey[:], a.config.GetDefaultPubkey().GetKey()[:])
-	return &pKey
+	if a.config.GetDecoyList() == nil {
+		return &pb.DecoyList{}
+	}
+	return proto.Clone(a.config.GetDecoyList()).(*pb.DecoyList)
 }
 
-func (a *assets) GetConjurePubkey() *[32]byte {
+// ForEachDecoy calls fn with every decoy of the ClientConf, in order, until
+// fn returns false. Each call gets a copy of the decoy, so fn may keep or
+// modify it, but fn runs with the assets read lock held and must not call
+// methods that modify the assets.
+func (a *assets) ForEachDecoy(fn func(*pb.TLSDecoySpec) bool) {
 	a.RLock()
 	defer a.RUnlock()
 
-	var pKey [32]byte
-	copy(pKey[:], a.config.GetConjurePubkey().GetKey()[:])
-	return &pKey
+	for _, decoy := range a.config.GetDecoyList().GetTlsDecoys() {
+		if !fn(proto.Clone(decoy).(*pb.TLSDecoySpec)) {
+			return
+		}
+	}
 }
 
-func (a *assets) GetGeneration() uint32 {
-	a.RLock()
-	defer a.RUnlock()
-
-	return a.config.GetGeneration()
+// TLSVersionRange is the range of TLS versions a decoy negotiates, using the
+// tls.VersionTLS12 style constants.
+type TLSVersionRange struct {
+	Min, Max uint16
 }
 
-// Set ClientConf generation and store config to disk
-func (a *assets) SetGeneration(gen uint32) (err error) {
+// SetDecoyTLSVersions declares, by hostname, which TLS versions decoys
+// support, for GetDecoyForTLSVersion. The ClientConf has no room for this, so
+// it is kept alongside, like decoy IP overrides. Passing nil removes all
+// declarations.
+func (a *assets) SetDecoyTLSVersions(versions map[string]TLSVersionRange) {
 	a.Lock()
 	defer a.Unlock()
 
-	copyGen := gen
-	a.config.Generation = &copyGen
-	err = a.saveClientConf()
-	return
+	a.decoyTLSVersions = make(map[string]TLSVersionRange, len(versions))
+	for hostname, versionRange := range versions {
+		a.decoyTLSVersions[hostname] = versionRange
+	}
 }
 
-// Set Public key and store config to disk
-func (a *assets) SetPubkey(pubkey *pb.PubKey) (err error) {
-	a.Lock()
-	defer a.Unlock()
+// GetDecoyForTLSVersion picks a random decoy supporting a TLS version in
+// [min, max], as declared with SetDecoyTLSVersions. Decoys without a
+// declaration are skipped, unless no decoy declares versions at all, in which
+// case any decoy is picked. The decoy is a copy with the standard Timeout and
+// Tcpwin defaults applied. ok is false if no decoy is compatible.
+func (a *assets) GetDecoyForTLSVersion(min, max uint16) (decoy pb.TLSDecoySpec, ok bool) {
+	a.RLock()
+	defer a.RUnlock()
 
-	a.config.DefaultPubkey = pubkey
-	err = a.saveClientConf()
-	return
+	decoys := a.config.GetDecoyList().GetTlsDecoys()
+	if len(a.decoyTLSVersions) > 0 {
+		var compatible []*pb.TLSDecoySpec
+		for _, decoy := range decoys {
+			versionRange, declared := a.decoyTLSVersions[decoy.GetHostname()]
+			if declared && versionRange.Min <= max && versionRange.Max >= min {
+				compatible = append(compatible, decoy)
+			}
+		}
+		decoys = compatible
+	}
+	if len(decoys) == 0 {
+		return pb.TLSDecoySpec{}, false
+	}
+
+	chosenDecoy := proto.Clone(decoys[a.randIndex(len(decoys))]).(*pb.TLSDecoySpec)
+	enforceDecoyDefaults(chosenDecoy)
+	return *chosenDecoy, true
 }
 
-// Set ClientConf and store config to disk
-func (a *assets) SetClientConf(conf *pb.ClientConf) (err error) {
+// SetDecoyTLSProfile associates a TLS profile, such as the name of the
+// ClientHello fingerprint to use, with the decoys of hostname, so each decoy
+// can be reached with a fingerprint that blends in. The ClientConf has no
+// room for this, so the profiles are stored in the assets dir next to it and
+// persist across restarts. An empty profile removes the association.
+func (a *assets) SetDecoyTLSProfile(hostname, profile string) error {
 	a.Lock()
 	defer a.Unlock()
 
-	a.config = conf
-	err = a.saveClientConf()
-	return
-}
+	if a.readOnly {
+		return ErrReadOnly
+	}
+	profiles := make(map[string]string, len(a.decoyTLSProfiles)+1)
+	for h, p := range a.decoyTLSProfiles {
+		profiles[h] = p
+	}
+	if profile == "" {
+		delete(profiles, hostname)
+	} else {
+		profiles[hostname] = profile
+	}
 
-// Not goroutine-safe, use at your own risk
-func (a *assets) GetClientConfPtr() *pb.ClientConf {
-	return a.config
+	buf, err := json.Marshal(profiles)
+	if err != nil {
+		return err
+	}
+	if err = a.writeFileAtomic(a.filenameDecoyTLSProfiles, buf); err != nil {
+		return err
+	}
+	a.decoyTLSProfiles = profiles
+	return nil
 }
 
-// Overwrite currently used decoys and store config to disk
-func (a *assets) SetDecoys(decoys []*pb.TLSDecoySpec) (err error) {
-	a.Lock()
-	defer a.Unlock()
+// GetDecoyTLSProfile returns the TLS profile of decoy set with
+// SetDecoyTLSProfile, or an empty string if it has none.
+func (a *assets) GetDecoyTLSProfile(decoy *pb.TLSDecoySpec) string {
+	a.RLock()
+	defer a.RUnlock()
 
-	if a.config.DecoyList == nil {
-		a.config.DecoyList = &pb.DecoyList{}
-	}
-	a.config.DecoyList.TlsDecoys = decoys
-	err = a.saveClientConf()
-	return
+	return a.decoyTLSProfiles[decoy.GetHostname()]
 }
 
-// Checks if decoy is in currently used ClientConf decoys list
-func (a *assets) IsDecoyInList(decoy *pb.TLSDecoySpec) bool {
-	ipv4str := decoy.GetIpAddrStr()
-	hostname := decoy.GetHostname()
+// GetDecoyWithMinTcpwin picks a random decoy whose Tcpwin is at least min,
+// comparing the Tcpwin GetDecoy would return it with, i.e. after the Tapdance
+// defaults in TapdanceMode. If no decoy qualifies, the one with the highest
+// Tcpwin (the first of them on ties) is returned instead and ok is false. The
+// decoy is a copy; it is empty if there are no decoys.
+func (a *assets) GetDecoyWithMinTcpwin(min uint32) (decoy pb.TLSDecoySpec, ok bool) {
 	a.RLock()
 	defer a.RUnlock()
-	for _, d := range a.config.GetDecoyList().GetTlsDecoys() {
-		if strings.Compare(d.GetHostname(), hostname) == 0 &&
-			strings.Compare(d.GetIpAddrStr(), ipv4str) == 0 {
-			return true
+
+	var qualified []*pb.TLSDecoySpec
+	var widest *pb.TLSDecoySpec
+	for _, decoy := range a.config.GetDecoyList().GetTlsDecoys() {
+		decoy = proto.Clone(decoy).(*pb.TLSDecoySpec)
+		if a.transportMode == TapdanceMode {
+			enforceDecoyDefaults(decoy)
+		}
+		if decoy.GetTcpwin() >= min {
+			qualified = append(qualified, decoy)
+		}
+		if widest == nil || decoy.GetTcpwin() > widest.GetTcpwin() {
+			widest = decoy
 		}
 	}
-	return false
-}
-
-func (a *assets) saveClientConf() error {
-	buf, err := proto.Marshal(a.config)
-	if err != nil {
-		return err
+	if len(qualified) > 0 {
+		return *qualified[a.randIndex(len(qualified))], true
 	}
-	filename := path.Join(a.path, a.filenameClientConf)
-	tmpFilename := path.Join(a.path, "."+a.filenameClientConf+"."+getRandString(5)+".tmp")
-	err = ioutil.WriteFile(tmpFilename, buf[:], 0644)
-	if err != nil {
-		return err
+	if widest == nil {
+		return pb.TLSDecoySpec{}, false
 	}
+	return *widest, false
+}
 
-	return os.Rename(tmpFilename, filename)
+// GetDecoyFromSecret picks the decoy determined by the shared secret, so the
+// station can predict which decoy the client uses, and is the entry point for
+// seed-driven decoy selection. 8 bytes are expanded from the secret with
+// phantoms.ExpandSeed and labelDecoySeed, read big endian and reduced modulo
+// the number of decoys to index GetAllDecoysSorted. Blacklists, cooldowns and
+// IPv6 availability are ignored, as the station can't know them. The decoy is
+// a copy with the standard Timeout and Tcpwin defaults applied; it is empty if
+// there are no decoys.
+func (a *assets) GetDecoyFromSecret(secret [32]byte) pb.TLSDecoySpec {
+	decoy, _ := a.GetDecoyFromSeed(secret[:])
+	return decoy
 }
 
-// SetStatsSocksAddr - Provide a socks address for reporting stats from the client in the form "addr:port"
+// UsingDefaultDecoys reports whether the decoy list is still the default one
+// the assets started with, the built-in decoys or those set with
+// SetDefaultDecoys, e.g. because no ClientConf could be read. UIs can use it
+// to warn about a missing or broken config.
+func (a *assets) UsingDefaultDecoys() bool {
+	a.RLock()
+	defer a.RUnlock()
+
+	decoys := a.config.GetDecoyList().GetTlsDecoys()
+	if len(decoys) != len(a.defaultDecoys) {
+		return false
+	}
+	for i, decoy := range decoys {
+		if !proto.Equal(decoy, a.defaultDecoys[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get copies of all Decoys from ClientConf
+func (a *assets) GetAllDecoys() []*pb.TLSDecoySpec {
+	a.RLock()
+	defer a.RUnlock()
+
+	return cloneDecoys(a.allDecoys())
+}
+
+// allDecoys is GetAllDecoys without locking or copying.
+func (a *assets) allDecoys() []*pb.TLSDecoySpec {
+	return a.config.GetDecoyList().GetTlsDecoys()
+}
+
+func cloneDecoys(decoys []*pb.TLSDecoySpec) []*pb.TLSDecoySpec {
+	clones := make([]*pb.TLSDecoySpec, len(decoys))
+	for i, decoy := range decoys {
+		clones[i] = proto.Clone(decoy).(*pb.TLSDecoySpec)
+	}
+	return clones
+}
+
+// GetDecoysForIPVersion returns copies of the decoys of the ClientConf usable
+// on IP version v, 4 or 6: those with an address of that family, including
+// dual stack decoys. For any other v it returns an empty slice.
+func (a *assets) GetDecoysForIPVersion(v int) []*pb.TLSDecoySpec {
+	a.RLock()
+	defer a.RUnlock()
+
+	return cloneDecoys(a.decoysForIPVersion(v))
+}
+
+// decoysForIPVersion is GetDecoysForIPVersion without locking or copying.
+func (a *assets) decoysForIPVersion(v int) []*pb.TLSDecoySpec {
+	decoys := make([]*pb.TLSDecoySpec, 0)
+	for _, decoy := range a.config.GetDecoyList().GetTlsDecoys() {
+		if (v == 4 && decoy.GetIpv4Addr() != 0) || (v == 6 && decoy.GetIpv6Addr() != nil) {
+			decoys = append(decoys, decoy)
+		}
+	}
+	return decoys
+}
+
+// Get copies of all Decoys from ClientConf that have an IPv6 address,
+// including dual stack decoys that also have an IPv4 address
+func (a *assets) GetV6Decoys() []*pb.TLSDecoySpec {
+	return a.GetDecoysForIPVersion(6)
+}
+
+// Get copies of all Decoys from ClientConf that have an IPv4 address,
+// including dual stack decoys that also have an IPv6 address
+func (a *assets) GetV4Decoys() []*pb.TLSDecoySpec {
+	return a.GetDecoysForIPVersion(4)
+}
+
+// Get copies of all Decoys from ClientConf that have an IPv4 address and no
+// IPv6 address
+func (a *assets) GetV4OnlyDecoys() []*pb.TLSDecoySpec {
+	a.RLock()
+	defer a.RUnlock()
+
+	v4Decoys := make([]*pb.TLSDecoySpec, 0)
+	allDecoys := a.config.GetDecoyList().GetTlsDecoys()
+
+	for _, decoy := range allDecoys {
+		if decoy.GetIpv4Addr() != 0 && decoy.GetIpv6Addr() == nil {
+			v4Decoys = append(v4Decoys, proto.Clone(decoy).(*pb.TLSDecoySpec))
+		}
+	}
+
+	return v4Decoys
+}
+
+// Get copies of all Decoys from ClientConf that have an IPv6 address and no
+// IPv4 address
+func (a *assets) GetV6OnlyDecoys() []*pb.TLSDecoySpec {
+	a.RLock()
+	defer a.RUnlock()
+
+	v6Decoys := make([]*pb.TLSDecoySpec, 0)
+	allDecoys := a.config.GetDecoyList().GetTlsDecoys()
+
+	for _, decoy := range allDecoys {
+		if decoy.GetIpv6Addr() != nil && decoy.GetIpv4Addr() == 0 {
+			v6Decoys = append(v6Decoys, proto.Clone(decoy).(*pb.TLSDecoySpec))
+		}
+	}
+
+	return v6Decoys
+}
+
+// DecoyCountByFamily counts the decoys of the ClientConf by the address
+// families they have: IPv4 only, IPv6 only, or both. Decoys without any
+// address are not counted.
+func (a *assets) DecoyCountByFamily() (v4Only, v6Only, dualStack int) {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.decoyCountByFamily()
+}
+
+func (a *assets) decoyCountByFamily() (v4Only, v6Only, dualStack int) {
+	for _, decoy := range a.config.GetDecoyList().GetTlsDecoys() {
+		hasV4 := decoy.GetIpv4Addr() != 0
+		hasV6 := decoy.GetIpv6Addr() != nil
+		switch {
+		case hasV4 && hasV6:
+			dualStack++
+		case hasV4:
+			v4Only++
+		case hasV6:
+			v6Only++
+		}
+	}
+	return
+}
+
+// SetIPv6Available tells decoy selection whether this host has IPv6
+// connectivity. Without it, GetDecoy and GetDecoyAddress skip IPv6 only
+// decoys, unless there are no decoys with an IPv4 address. IPv6 is assumed to
+// be available until this or ProbeIPv6 says otherwise.
+func (a *assets) SetIPv6Available(available bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.ipv6Unavailable = !available
+}
+
+// ipv6ProbeAddr is any global IPv6 address; probing never sends to it.
+const ipv6ProbeAddr = "[2001:4860:4860::8888]:53"
+
+// ProbeIPv6 checks for IPv6 connectivity by asking the OS for a route to a
+// global IPv6 address, which sends no packets, and applies the result with
+// SetIPv6Available. It reports whether IPv6 is available.
+func (a *assets) ProbeIPv6() bool {
+	conn, err := net.Dial("udp6", ipv6ProbeAddr)
+	if err == nil {
+		conn.Close()
+	}
+	a.SetIPv6Available(err == nil)
+	return err == nil
+}
+
+// reachableDecoys returns the decoys usable given IPv6 connectivity: all of
+// them, or without IPv6 the ones with an IPv4 address. If there are none of
+// those, all decoys are returned anyway.
+func (a *assets) reachableDecoys() []*pb.TLSDecoySpec {
+	if !a.ipv6Unavailable {
+		return a.allDecoys()
+	}
+	if decoys := a.decoysForIPVersion(4); len(decoys) > 0 {
+		return decoys
+	}
+	Logger().Warningln("Assets: IPv6 is unavailable, but there are no decoys with an IPv4 address")
+	return a.allDecoys()
+}
+
+// SetDecoyHostnameAllowlist restricts GetDecoy, GetDecoyAddress and
+// GetDecoyErr to the decoys whose hostname is in hostnames, compared case
+// insensitively, whatever the ClientConf contains. If no decoy is allowed,
+// that is logged and all decoys are considered. An empty allowlist, the
+// default, removes the restriction.
+func (a *assets) SetDecoyHostnameAllowlist(hostnames []string) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.decoyAllowlist = nil
+	if len(hostnames) == 0 {
+		return
+	}
+	a.decoyAllowlist = make(map[string]bool, len(hostnames))
+	for _, hostname := range hostnames {
+		a.decoyAllowlist[strings.ToLower(hostname)] = true
+	}
+}
+
+// allowlistedDecoys returns the decoys allowed by SetDecoyHostnameAllowlist
+// or, if it allows none of them, all decoys.
+func (a *assets) allowlistedDecoys(decoys []*pb.TLSDecoySpec) []*pb.TLSDecoySpec {
+	if len(a.decoyAllowlist) == 0 {
+		return decoys
+	}
+	allowed := make([]*pb.TLSDecoySpec, 0, len(decoys))
+	for _, decoy := range decoys {
+		if a.decoyAllowlist[strings.ToLower(decoy.GetHostname())] {
+			allowed = append(allowed, decoy)
+		}
+	}
+	if len(allowed) == 0 && len(decoys) > 0 {
+		Logger().Warningln("Assets: the decoy hostname allowlist matches none of the decoys, using all of them")
+		return decoys
+	}
+	return allowed
+}
+
+// GetDecoy - Gets random DecoySpec
+func (a *assets) GetDecoy() *pb.TLSDecoySpec {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.getDecoy()
+}
+
+// GetDecoyWithTLSProfile picks a decoy like GetDecoy and returns it with its
+// TLS profile, see SetDecoyTLSProfile.
+func (a *assets) GetDecoyWithTLSProfile() (decoy *pb.TLSDecoySpec, profile string) {
+	a.RLock()
+	defer a.RUnlock()
+
+	decoy = a.getDecoy()
+	return decoy, a.decoyTLSProfiles[decoy.GetHostname()]
+}
+
+// getDecoy is GetDecoy with the read lock held.
+func (a *assets) getDecoy() *pb.TLSDecoySpec {
+	decoys := a.eligibleDecoys(a.allowlistedDecoys(a.reachableDecoys()))
+	chosenDecoy := &pb.TLSDecoySpec{}
+	if len(decoys) == 0 {
+		return chosenDecoy
+	}
+	// a copy, so enforcing the Tapdance defaults leaves the ClientConf as
+	// configured
+	decoyIndex := a.pickDecoyIndex(decoys)
+	chosenDecoy = proto.Clone(decoys[decoyIndex]).(*pb.TLSDecoySpec)
+
+	if a.transportMode == TapdanceMode {
+		enforceDecoyDefaults(chosenDecoy)
+	}
+	return chosenDecoy
+}
+
+// ErrNoUsableDecoys is returned by GetDecoyErr when no decoy can be selected:
+// the decoy list is empty, or every decoy is blacklisted or in cooldown.
+var ErrNoUsableDecoys = errors.New("no usable decoys")
+
+// GetDecoyErr - Gets random DecoySpec like GetDecoy, but fails with
+// ErrNoUsableDecoys instead of returning an empty spec when there is no decoy
+// to select. Unlike GetDecoy, it doesn't fall back to decoys in cooldown.
+func (a *assets) GetDecoyErr() (pb.TLSDecoySpec, error) {
+	a.RLock()
+	defer a.RUnlock()
+
+	decoys := a.allowlistedDecoys(a.reachableDecoys())
+	if len(decoys) == 0 {
+		return pb.TLSDecoySpec{}, fmt.Errorf("%w: the decoy list is empty", ErrNoUsableDecoys)
+	}
+	allowed, usable := a.filterDecoys(decoys)
+	if len(allowed) == 0 {
+		return pb.TLSDecoySpec{}, fmt.Errorf("%w: all %d decoys are blacklisted", ErrNoUsableDecoys, len(decoys))
+	}
+	if len(usable) == 0 {
+		return pb.TLSDecoySpec{}, fmt.Errorf("%w: all %d decoys that aren't blacklisted are in cooldown", ErrNoUsableDecoys, len(allowed))
+	}
+
+	chosenDecoy := *usable[a.pickDecoyIndex(usable)]
+	if a.transportMode == TapdanceMode {
+		enforceDecoyDefaults(&chosenDecoy)
+	}
+	return chosenDecoy, nil
+}
+
+// TransportMode - which transport decoys are selected for.
+type TransportMode int
+
+const (
+	// TapdanceMode raises decoy Timeout and Tcpwin to the Tapdance minimums.
+	TapdanceMode TransportMode = iota
+	// ConjureMode leaves decoys as configured, as Conjure registration
+	// doesn't depend on them (see GetV6Decoy).
+	ConjureMode
+)
+
+// SetTransportMode selects whether GetDecoy serves Tapdance or Conjure. The
+// ClientConf carries a single decoy list, so both modes draw from it; the mode
+// decides whether the Tapdance Timeout and Tcpwin minimums are enforced.
+// Defaults to TapdanceMode.
+func (a *assets) SetTransportMode(mode TransportMode) {
+	a.Lock()
+	defer a.Unlock()
+	a.transportMode = mode
+}
+
+// GetTransportMode returns the mode set with SetTransportMode.
+func (a *assets) GetTransportMode() TransportMode {
+	a.RLock()
+	defer a.RUnlock()
+	return a.transportMode
+}
+
+// enforceDecoyDefaults raises Timeout and Tcpwin of a Tapdance decoy to the
+// defaults if they are set too low.
+func enforceDecoyDefaults(decoy *pb.TLSDecoySpec) {
+	//[TODO]{priority:soon} stop enforcing values >= defaults.
+	// Fix ackhole instead
+	// No value checks when using
+	if decoy.GetTimeout() < timeoutMin {
+		timeout := uint32(timeoutMax)
+		decoy.Timeout = &timeout
+	}
+	if decoy.GetTcpwin() < sendLimitMin {
+		tcpWin := uint32(sendLimitMax)
+		decoy.Tcpwin = &tcpWin
+	}
+}
+
+// GetAllDecoysSorted returns all Decoys from ClientConf ordered by hostname
+// and then by address, giving every decoy a stable index.
+func (a *assets) GetAllDecoysSorted() []*pb.TLSDecoySpec {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.sortedDecoys()
+}
+
+func (a *assets) sortedDecoys() []*pb.TLSDecoySpec {
+	allDecoys := a.config.GetDecoyList().GetTlsDecoys()
+	decoys := make([]*pb.TLSDecoySpec, len(allDecoys))
+	copy(decoys, allDecoys)
+	sort.SliceStable(decoys, func(i, j int) bool {
+		if decoys[i].GetHostname() != decoys[j].GetHostname() {
+			return decoys[i].GetHostname() < decoys[j].GetHostname()
+		}
+		return decoys[i].GetIpAddrStr() < decoys[j].GetIpAddrStr()
+	})
+	return decoys
+}
+
+// GetDecoyByIndex returns a copy of the decoy at index i of
+// GetAllDecoysSorted, with the standard Timeout and Tcpwin defaults applied.
+// ok is false if i is out of range.
+func (a *assets) GetDecoyByIndex(i int) (decoy pb.TLSDecoySpec, ok bool) {
+	a.RLock()
+	defer a.RUnlock()
+
+	decoys := a.sortedDecoys()
+	if i < 0 || i >= len(decoys) {
+		return pb.TLSDecoySpec{}, false
+	}
+	chosenDecoy := proto.Clone(decoys[i]).(*pb.TLSDecoySpec)
+	enforceDecoyDefaults(chosenDecoy)
+	return *chosenDecoy, true
+}
+
+// labelDecoySeed is the HKDF label GetDecoyFromSecret derives its index with.
+// It differs from every phantom selection label, so a decoy and a phantom
+// derived from the same secret are independent.
+const labelDecoySeed = "tapdance-decoy-from-seed"
+
+// GetDecoyFromSeed is GetDecoyFromSecret for a seed of any length, with ok
+// false if there are no decoys to pick from.
+func (a *assets) GetDecoyFromSeed(seed []byte) (decoy pb.TLSDecoySpec, ok bool) {
+	a.RLock()
+	defer a.RUnlock()
+
+	decoys := a.sortedDecoys()
+	if len(decoys) == 0 {
+		return pb.TLSDecoySpec{}, false
+	}
+	indexBytes, err := ps.ExpandSeed(seed, labelDecoySeed, 8)
+	if err != nil {
+		return pb.TLSDecoySpec{}, false
+	}
+	i := binary.BigEndian.Uint64(indexBytes) % uint64(len(decoys))
+
+	chosenDecoy := proto.Clone(decoys[i]).(*pb.TLSDecoySpec)
+	enforceDecoyDefaults(chosenDecoy)
+	return *chosenDecoy, true
+}
+
+// SetDecoyScorer sets a function rating decoys, e.g. from RTT or success
+// rates the client measured itself. GetBestDecoy and GetTopNDecoys prefer
+// decoys with higher scores. The scorer is called with the assets read lock
+// held, so it must not call back into assets. Passing nil removes the scorer.
+func (a *assets) SetDecoyScorer(scorer func(*pb.TLSDecoySpec) float64) {
+	a.Lock()
+	defer a.Unlock()
+	a.decoyScorer = scorer
+}
+
+// GetBestDecoy returns a copy of the highest-scoring decoy according to the
+// decoy scorer, or of a random decoy if no scorer is set.
+func (a *assets) GetBestDecoy() *pb.TLSDecoySpec {
+	decoys := a.GetTopNDecoys(1)
+	if len(decoys) == 0 {
+		return &pb.TLSDecoySpec{}
+	}
+	return decoys[0]
+}
+
+// GetTopNDecoys returns copies of up to n decoys ordered by descending score. Decoys
+// with equal scores keep their ClientConf order. If no scorer is set, n
+// distinct decoys are picked at random.
+func (a *assets) GetTopNDecoys(n int) []*pb.TLSDecoySpec {
+	a.RLock()
+	defer a.RUnlock()
+
+	allDecoys := a.config.GetDecoyList().GetTlsDecoys()
+	decoys := make([]*pb.TLSDecoySpec, len(allDecoys))
+	copy(decoys, allDecoys)
+	if n > len(decoys) {
+		n = len(decoys)
+	}
+	if n <= 0 {
+		return []*pb.TLSDecoySpec{}
+	}
+
+	if a.decoyScorer == nil {
+		// partial Fisher-Yates shuffle of the first n decoys
+		for i := 0; i < n; i++ {
+			j := i + a.randIndex(len(decoys)-i)
+			decoys[i], decoys[j] = decoys[j], decoys[i]
+		}
+		return cloneDecoys(decoys[:n])
+	}
+
+	scores := make(map[*pb.TLSDecoySpec]float64, len(decoys))
+	for _, decoy := range decoys {
+		scores[decoy] = a.decoyScorer(decoy)
+	}
+	sort.SliceStable(decoys, func(i, j int) bool {
+		return scores[decoys[i]] > scores[decoys[j]]
+	})
+	return cloneDecoys(decoys[:n])
+}
+
+// DecoyDedupe selects what GetNDecoys treats as duplicate decoys. The values
+// can be combined with |.
+type DecoyDedupe int
+
+const (
+	// DedupeByIP picks at most one decoy per IP address.
+	DedupeByIP DecoyDedupe = 1 << iota
+	// DedupeBySNI picks at most one decoy per hostname, so decoys raced
+	// together each use a different SNI.
+	DedupeBySNI
+)
+
+// GetNDecoys returns copies of up to n decoys picked at random, no two of
+// them duplicates according to dedupe. If there are fewer than n distinct
+// decoys, all of them are returned.
+func (a *assets) GetNDecoys(n int, dedupe DecoyDedupe) []*pb.TLSDecoySpec {
+	a.RLock()
+	defer a.RUnlock()
+
+	allDecoys := a.config.GetDecoyList().GetTlsDecoys()
+	decoys := make([]*pb.TLSDecoySpec, len(allDecoys))
+	copy(decoys, allDecoys)
+
+	picked := []*pb.TLSDecoySpec{}
+	seenIPs := make(map[string]bool)
+	seenSNIs := make(map[string]bool)
+	for i := 0; i < len(decoys) && len(picked) < n; i++ {
+		// Fisher-Yates shuffle, one decoy at a time
+		j := i + a.randIndex(len(decoys)-i)
+		decoys[i], decoys[j] = decoys[j], decoys[i]
+
+		decoy := decoys[i]
+		ip, sni := decoy.GetIpAddrStr(), decoy.GetHostname()
+		if (dedupe&DedupeByIP != 0 && seenIPs[ip]) || (dedupe&DedupeBySNI != 0 && seenSNIs[sni]) {
+			continue
+		}
+		seenIPs[ip] = true
+		seenSNIs[sni] = true
+		picked = append(picked, proto.Clone(decoy).(*pb.TLSDecoySpec))
+	}
+	return picked
+}
+
+// GetDecoy - Gets random IPv6 DecoySpec
+func (a *assets) GetV6Decoy() *pb.TLSDecoySpec {
+	a.RLock()
+	defer a.RUnlock()
+
+	decoys := a.decoysForIPVersion(6)
+	chosenDecoy := &pb.TLSDecoySpec{}
+	if len(decoys) == 0 {
+		return chosenDecoy
+	}
+	decoyIndex := a.randIndex(len(decoys))
+	chosenDecoy = proto.Clone(decoys[decoyIndex]).(*pb.TLSDecoySpec)
+
+	// No enforcing TCPWIN etc. values because this is conjure only
+	return chosenDecoy
+}
+
+func (a *assets) GetRoots() *x509.CertPool {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.roots
+}
+
+// GetPubkey returns the default station pubkey of the ClientConf or, if it
+// has none, the fallback station key, see SetDefaultStationKey.
+func (a *assets) GetPubkey() *[32]byte {
+	a.RLock()
+	defer a.RUnlock()
+
+	var pKey [32]byte
+	key := a.config.GetDefaultPubkey().GetKey()
+	if len(key) == 0 {
+		key = defaultPubkey().GetKey()
+	}
+	copy(pKey[:], key)
+	return &pKey
+}
+
+func (a *assets) GetConjurePubkey() *[32]byte {
+	a.RLock()
+	defer a.RUnlock()
+
+	var pKey [32]byte
+	copy(pKey[:], a.config.GetConjurePubkey().GetKey()[:])
+	return &pKey
+}
+
+// GetPhantomSubnets returns the phantom subnets of the current ClientConf,
+// see phantoms.SubnetConfigFromClientConf. As the config is read on every
+// call, the result follows ClientConf reloads and updates.
+func (a *assets) GetPhantomSubnets() (ps.SubnetConfig, error) {
+	a.RLock()
+	defer a.RUnlock()
+
+	return ps.SubnetConfigFromClientConf(a.config)
+}
+
+func (a *assets) GetGeneration() uint32 {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.config.GetGeneration()
+}
+
+// Where the current ClientConf came from, as reported by ConfigSource.
+const (
+	// ConfigSourceDefault - the built-in defaults, nothing was loaded yet.
+	ConfigSourceDefault = "default"
+	// ConfigSourceFile - read from the ClientConf file in the assets dir.
+	ConfigSourceFile = "file"
+	// ConfigSourceBytes - handed over in memory, by SetClientConf or
+	// SetAssets.
+	ConfigSourceBytes = "bytes"
+	// ConfigSourceFetch - fetched from the network, see
+	// SetFetchedClientConf.
+	ConfigSourceFetch = "fetch"
+	// ConfigSourceBundle - loaded from an assets bundle.
+	ConfigSourceBundle = "bundle"
+)
+
+// ConfigSource returns the generation of the current ClientConf along with
+// where it came from, one of the ConfigSource constants, for telling apart
+// configs from several sources when reconciling them. The source is set
+// whenever the ClientConf is replaced; changes through Update, SetGeneration,
+// SetDecoys and the like keep the source of the config they change.
+func (a *assets) ConfigSource() (generation uint32, source string) {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.config.GetGeneration(), a.configSource
+}
+
+// SetClock replaces the clock every time dependent feature of the assets
+// reads, such as decoy failure timestamps, cooldowns, bundle entry times and
+// GenerationHistory, e.g. with a fake one for tests. Passing nil restores
+// time.Now.
+func (a *assets) SetClock(now func() time.Time) {
+	a.clockMu.Lock()
+	defer a.clockMu.Unlock()
+
+	a.clock = now
+}
+
+// now reads the clock set by SetClock. clockMu is taken last, so it may be
+// called with any other lock held.
+func (a *assets) now() time.Time {
+	a.clockMu.Lock()
+	clock := a.clock
+	a.clockMu.Unlock()
+
+	if clock == nil {
+		return time.Now()
+	}
+	return clock()
+}
+
+// ErrReadOnly is returned by the assets mutators, such as SetClientConf,
+// SetDecoys, SetGeneration and SetPubkey, while the assets are read-only.
+var ErrReadOnly = errors.New("assets are read-only")
+
+// SetReadOnly makes the assets read-only, pinning the loaded config: until it
+// is called with false, everything that would change the assets or save them
+// to disk fails with ErrReadOnly and leaves them as they are. Reads, and
+// reloading the assets dir, work as usual.
+func (a *assets) SetReadOnly(readOnly bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.readOnly = readOnly
+}
+
+// Set ClientConf generation and store config to disk
+func (a *assets) SetGeneration(gen uint32) (err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	oldGen := a.config.GetGeneration()
+	defer a.notifyGeneration(oldGen)
+	err = a.updateClientConf(func(conf *pb.ClientConf) {
+		copyGen := gen
+		conf.Generation = &copyGen
+	})
+	return
+}
+
+// CompareAndSetGeneration sets the ClientConf generation to new and stores the
+// config to disk, but only if the current generation is expected. swapped
+// reports whether it was set. With file locking enabled, the generation is
+// compared to that of the ClientConf on disk, so this also coordinates
+// updaters in different processes.
+func (a *assets) CompareAndSetGeneration(expected, new uint32) (swapped bool, err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	oldGen := a.config.GetGeneration()
+	defer a.notifyGeneration(oldGen)
+	return a.updateClientConfIf(func(conf *pb.ClientConf) bool {
+		if conf.GetGeneration() != expected {
+			return false
+		}
+		copyGen := new
+		conf.Generation = &copyGen
+		return true
+	})
+}
+
+// Set Public key and store config to disk
+func (a *assets) SetPubkey(pubkey *pb.PubKey) (err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	err = a.updateClientConf(func(conf *pb.ClientConf) {
+		conf.DefaultPubkey = pubkey
+	})
+	return
+}
+
+// Set ClientConf and store config to disk
+func (a *assets) SetClientConf(conf *pb.ClientConf) (err error) {
+	return a.setClientConf(conf, ConfigSourceBytes)
+}
+
+// SetFetchedClientConf is SetClientConf for a ClientConf fetched from the
+// network, which ConfigSource then reports as ConfigSourceFetch.
+func (a *assets) SetFetchedClientConf(conf *pb.ClientConf) error {
+	return a.setClientConf(conf, ConfigSourceFetch)
+}
+
+func (a *assets) setClientConf(conf *pb.ClientConf, source string) (err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.readOnly {
+		return ErrReadOnly
+	}
+
+	oldGen := a.config.GetGeneration()
+	a.config = conf
+	a.configSource = source
+	a.resetDecoyKeys()
+	a.notifyGeneration(oldGen)
+	err = a.saveClientConf()
+	return
+}
+
+// SetAssets replaces the ClientConf and the roots as a unit: both are
+// validated first, then stored to disk and applied together. If storing
+// either fails, the old files are restored and the current assets are kept.
+// Only a crash between the two final renames can leave them mismatched.
+func (a *assets) SetAssets(conf *pb.ClientConf, rootsPEM []byte) error {
+	if err := ValidateClientConf(conf); err != nil {
+		return err
+	}
+	roots, err := parseRoots(rootsPEM)
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.readOnly {
+		return ErrReadOnly
+	}
+	confBytes, err := a.marshalClientConf(conf)
+	if err != nil {
+		return err
+	}
+	unlock, err := a.lockDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	rootsTmp, err := a.writeTempFile(a.filenameRoots, rootsPEM)
+	if err != nil {
+		return err
+	}
+	confTmp, err := a.writeTempFile(a.filenameClientConf, confBytes)
+	if err != nil {
+		os.Remove(rootsTmp)
+		return err
+	}
+	rootsFilename := path.Join(a.path, a.filenameRoots)
+	oldRootsPEM, oldRootsErr := ioutil.ReadFile(rootsFilename)
+	if err = os.Rename(rootsTmp, rootsFilename); err != nil {
+		os.Remove(rootsTmp)
+		os.Remove(confTmp)
+		return err
+	}
+	if err = os.Rename(confTmp, path.Join(a.path, a.filenameClientConf)); err != nil {
+		os.Remove(confTmp)
+		if oldRootsErr == nil {
+			if restoreErr := a.writeFileAtomic(a.filenameRoots, oldRootsPEM); restoreErr != nil {
+				Logger().Warningln("Assets: failed to restore roots: " + restoreErr.Error())
+			}
+		} else if os.IsNotExist(oldRootsErr) {
+			os.Remove(rootsFilename)
+		}
+		return err
+	}
+
+	oldGen := a.config.GetGeneration()
+	a.roots = roots
+	a.rootsPEM = rootsPEM
+	a.config = conf
+	a.configSource = ConfigSourceBytes
+	a.resetDecoyKeys()
+	a.notifyGeneration(oldGen)
+	return nil
+}
+
+// Not goroutine-safe, use at your own risk
+func (a *assets) GetClientConfPtr() *pb.ClientConf {
+	return a.config
+}
+
+// Overwrite currently used decoys and store config to disk
+func (a *assets) SetDecoys(decoys []*pb.TLSDecoySpec) (err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	err = a.updateClientConf(func(conf *pb.ClientConf) {
+		if conf.DecoyList == nil {
+			conf.DecoyList = &pb.DecoyList{}
+		}
+		conf.DecoyList.TlsDecoys = decoys
+		a.resetDecoyKeys()
+	})
+	return
+}
+
+// AddDecoysFromFile appends the decoys of a supplemental file, holding either a
+// ClientConf or a bare DecoyList, to the current decoy list and stores the
+// config to disk once. Decoys already in the list (same hostname and address)
+// are skipped. It returns how many decoys were added.
+func (a *assets) AddDecoysFromFile(filename string) (added int, err error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	decoys, err := parseDecoys(buf)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse decoys from %v: %v", filename, err)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	_, err = a.updateClientConfIf(func(conf *pb.ClientConf) bool {
+		if conf.DecoyList == nil {
+			conf.DecoyList = &pb.DecoyList{}
+		}
+		known := make(map[string]bool)
+		for _, decoy := range conf.DecoyList.TlsDecoys {
+			known[decoyKey(decoy)] = true
+		}
+		for _, decoy := range decoys {
+			if known[decoyKey(decoy)] {
+				continue
+			}
+			known[decoyKey(decoy)] = true
+			conf.DecoyList.TlsDecoys = append(conf.DecoyList.TlsDecoys, decoy)
+			added++
+		}
+		if added == 0 {
+			return false
+		}
+		a.resetDecoyKeys()
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// SetDecoysFromFile replaces the current decoys with those of a file holding
+// either a bare DecoyList or a full ClientConf, see SetDecoys. Duplicate
+// decoys (same hostname and address) in the file are only used once.
+func (a *assets) SetDecoysFromFile(filename string) error {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	decoys, err := parseDecoys(buf)
+	if err != nil {
+		return fmt.Errorf("failed to parse decoys from %v: %v", filename, err)
+	}
+
+	var unique []*pb.TLSDecoySpec
+	known := make(map[string]bool)
+	for _, decoy := range decoys {
+		if known[decoyKey(decoy)] {
+			continue
+		}
+		known[decoyKey(decoy)] = true
+		unique = append(unique, decoy)
+	}
+	return a.SetDecoys(unique)
+}
+
+// parseDecoys reads the decoys of a marshalled ClientConf or, failing that, of
+// a marshalled DecoyList. Every decoy must have a hostname, which also tells a
+// DecoyList apart from a ClientConf that happens to parse.
+func parseDecoys(buf []byte) ([]*pb.TLSDecoySpec, error) {
+	hasHostnames := func(decoys []*pb.TLSDecoySpec) bool {
+		for _, decoy := range decoys {
+			if decoy.GetHostname() == "" {
+				return false
+			}
+		}
+		return len(decoys) > 0
+	}
+
+	if conf, err := parseClientConf(buf); err == nil && hasHostnames(conf.GetDecoyList().GetTlsDecoys()) {
+		return conf.GetDecoyList().GetTlsDecoys(), nil
+	}
+	decoyList := &pb.DecoyList{}
+	if err := proto.Unmarshal(buf, decoyList); err != nil {
+		return nil, err
+	}
+	if !hasHostnames(decoyList.GetTlsDecoys()) {
+		return nil, errors.New("no decoys with a hostname")
+	}
+	return decoyList.GetTlsDecoys(), nil
+}
+
+// Checks if decoy is in currently used ClientConf decoys list
+func (a *assets) IsDecoyInList(decoy *pb.TLSDecoySpec) bool {
+	ipv4str := decoy.GetIpAddrStr()
+	hostname := decoy.GetHostname()
+	a.RLock()
+	defer a.RUnlock()
+	for _, d := range a.config.GetDecoyList().GetTlsDecoys() {
+		if strings.Compare(d.GetHostname(), hostname) == 0 &&
+			strings.Compare(d.GetIpAddrStr(), ipv4str) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// saveClientConf stores the ClientConf to disk, holding the assets dir lock
+// if file locking is enabled.
+func (a *assets) saveClientConf() error {
+	if a.readOnly {
+		return ErrReadOnly
+	}
+	unlock, err := a.lockDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return a.writeClientConf()
+}
+
+// updateClientConf applies update to the ClientConf and stores it to disk. With
+// file locking enabled, the ClientConf is first reloaded from disk under the
+// assets dir lock, so changes saved meanwhile by another process aren't lost.
+// update works on a copy, which only replaces the ClientConf once stored, so
+// a failed save leaves it as it was.
+func (a *assets) updateClientConf(update func(conf *pb.ClientConf)) error {
+	_, err := a.updateClientConfIf(func(conf *pb.ClientConf) bool {
+		update(conf)
+		return true
+	})
+	return err
+}
+
+// updateClientConfIf is updateClientConf for updates that may decline to
+// apply: the ClientConf is only stored if update returns true, which is
+// reported as updated.
+func (a *assets) updateClientConfIf(update func(conf *pb.ClientConf) bool) (updated bool, err error) {
+	if a.readOnly {
+		return false, ErrReadOnly
+	}
+	unlock, err := a.lockDir()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if err = a.reloadForUpdate(); err != nil {
+		return false, err
+	}
+	conf := proto.Clone(a.config).(*pb.ClientConf)
+	if !update(conf) {
+		return false, nil
+	}
+	buf, err := a.marshalClientConf(conf)
+	if err != nil {
+		return false, err
+	}
+	if err = a.writeFileAtomic(a.filenameClientConf, buf); err != nil {
+		return false, err
+	}
+	a.config = conf
+	return true, nil
+}
+
+// reloadForUpdate reloads the ClientConf from disk before an update if file
+// locking is enabled, see updateClientConf. The assets dir lock must be held.
+func (a *assets) reloadForUpdate() error {
+	if !a.fileLocking {
+		return nil
+	}
+	conf, err := a.loadClientConf()
+	if err == nil {
+		a.config = conf
+		a.configSource = ConfigSourceFile
+		a.resetDecoyKeys()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Update applies fn to a copy of the ClientConf and, if fn succeeds and the
+// result passes ValidateClientConf, stores it to disk and swaps it in, all
+// under one lock. Several fields can thus be changed at once, with a single
+// save, and no reader ever sees some changes without the others. If anything
+// fails, the ClientConf is left as it was.
+func (a *assets) Update(fn func(conf *pb.ClientConf) error) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.readOnly {
+		return ErrReadOnly
+	}
+	unlock, err := a.lockDir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err = a.reloadForUpdate(); err != nil {
+		return err
+	}
+	conf := proto.Clone(a.config).(*pb.ClientConf)
+	if err = fn(conf); err != nil {
+		return err
+	}
+	if err = ValidateClientConf(conf); err != nil {
+		return err
+	}
+	buf, err := a.marshalClientConf(conf)
+	if err != nil {
+		return err
+	}
+	if err = a.writeFileAtomic(a.filenameClientConf, buf); err != nil {
+		return err
+	}
+
+	oldGen := a.config.GetGeneration()
+	a.config = conf
+	a.resetDecoyKeys()
+	a.notifyGeneration(oldGen)
+	return nil
+}
+
+func (a *assets) writeClientConf() error {
+	buf, err := a.marshalClientConf(a.config)
+	if err != nil {
+		return err
+	}
+	return a.writeFileAtomic(a.filenameClientConf, buf)
+}
+
+// marshalClientConf returns conf as stored on disk, encrypted if a config key
+// is set.
+func (a *assets) marshalClientConf(conf *pb.ClientConf) ([]byte, error) {
+	buf, err := proto.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	if a.configKey != nil {
+		return encryptClientConf(buf, a.configKey)
+	}
+	return buf, nil
+}
+
+// writeFileAtomic replaces the file in the assets dir by writing a temporary
+// file and renaming it over the old one, so readers never see a partial file.
+func (a *assets) writeFileAtomic(filename string, buf []byte) error {
+	tmpFilename, err := a.writeTempFile(filename, buf)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFilename, path.Join(a.path, filename))
+}
+
+// writeTempFile writes buf to a temporary file in the assets dir, to be
+// renamed over filename.
+func (a *assets) writeTempFile(filename string, buf []byte) (string, error) {
+	tmpFilename := path.Join(a.path, "."+filename+"."+getRandString(5)+".tmp")
+	if err := ioutil.WriteFile(tmpFilename, buf, 0644); err != nil {
+		os.Remove(tmpFilename)
+		return "", err
+	}
+	return tmpFilename, nil
+}
+
+// GetPreferredTransport returns the transport the client chose to use, such
+// as "min" or "obfs4". An empty string means no preference: pick one
+// automatically.
+func (a *assets) GetPreferredTransport() string {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.preferredTransport
+}
+
+// SetPreferredTransport sets the transport the client prefers and stores it
+// in the assets dir next to the ClientConf, so it persists across restarts.
+// An empty name resets it to automatic.
+func (a *assets) SetPreferredTransport(name string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.readOnly {
+		return ErrReadOnly
+	}
+	name = strings.TrimSpace(name)
+	if err := a.writeFileAtomic(a.filenamePreferredTransport, []byte(name)); err != nil {
+		return err
+	}
+	a.preferredTransport = name
+	return nil
+}
+
+// encryptedConfMagic starts every ClientConf file encrypted at rest. It is
+// followed by the AES-GCM nonce and the sealed marshalled ClientConf. Files
+// without it are read as plaintext.
+var encryptedConfMagic = []byte("TDCCENC1")
+
+const encryptedConfNonceLen = 12
+
+// SetConfigEncryptionKey enables encryption of the ClientConf file at rest
+// with AES-GCM. The key must be 16 or 32 bytes. Plaintext ClientConf files can
+// still be read, and are encrypted the next time the config is saved. Passing
+// nil disables encryption for subsequent saves.
+func (a *assets) SetConfigEncryptionKey(key []byte) error {
+	if key != nil && len(key) != 16 && len(key) != 32 {
+		return fmt.Errorf("invalid ClientConf encryption key length %d", len(key))
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	if key == nil {
+		a.configKey = nil
+		return nil
+	}
+	a.configKey = make([]byte, len(key))
+	copy(a.configKey, key)
+	return nil
+}
+
+func encryptClientConf(plaintext []byte, key []byte) ([]byte, error) {
+	nonce := make([]byte, encryptedConfNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ciphertext, err := aesGcmEncrypt(plaintext, key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(encryptedConfMagic)+len(nonce)+len(ciphertext))
+	out = append(out, encryptedConfMagic...)
+	out = append(out, nonce...)
+	return append(out, ciphertext...), nil
+}
+
+func decryptClientConf(buf []byte, key []byte) ([]byte, error) {
+	buf = buf[len(encryptedConfMagic):]
+	if len(buf) < encryptedConfNonceLen {
+		return nil, errors.New("encrypted ClientConf is truncated")
+	}
+	plaintext, err := aesGcmDecrypt(buf[encryptedConfNonceLen:], key, buf[:encryptedConfNonceLen])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt ClientConf: %v", err)
+	}
+	return plaintext, nil
+}
+
+// SetStatsSocksAddr - Provide a socks address for reporting stats from the client in the form "addr:port"
 func (a *assets) SetStatsSocksAddr(addr string) {
 	a.socksAddr = addr
 }
+
+// WatchGeneration returns a channel that receives the new ClientConf generation
+// whenever it changes, whether through SetGeneration, SetClientConf or a reload.
+// The channel holds at most one value: if the consumer lags behind, only the
+// latest generation is kept. Call UnwatchGeneration to release the channel.
+func (a *assets) WatchGeneration() <-chan uint32 {
+	a.Lock()
+	defer a.Unlock()
+
+	ch := make(chan uint32, 1)
+	a.genWatchers = append(a.genWatchers, ch)
+	return ch
+}
+
+// UnwatchGeneration stops delivery to a channel returned by WatchGeneration
+// and closes it.
+func (a *assets) UnwatchGeneration(watcher <-chan uint32) {
+	a.Lock()
+	defer a.Unlock()
+
+	for i, ch := range a.genWatchers {
+		if ch == watcher {
+			a.genWatchers = append(a.genWatchers[:i], a.genWatchers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+// maxGenerationHistory is the number of changes GenerationHistory keeps.
+const maxGenerationHistory = 32
+
+// GenChange records a change of the ClientConf generation.
+type GenChange struct {
+	Time   time.Time
+	OldGen uint32
+	NewGen uint32
+}
+
+// GenerationHistory returns the latest generation changes, oldest first, to
+// diagnose flapping updates. Only the last maxGenerationHistory changes are
+// kept, timestamped with the clock set by SetClock.
+func (a *assets) GenerationHistory() []GenChange {
+	a.RLock()
+	defer a.RUnlock()
+
+	return append([]GenChange{}, a.genHistory...)
+}
+
+// notifyGeneration pushes the current generation to all watchers if it differs
+// from oldGen. Must be called with the write lock held.
+func (a *assets) notifyGeneration(oldGen uint32) {
+	newGen := a.config.GetGeneration()
+	if newGen == oldGen {
+		return
+	}
+	if len(a.genHistory) >= maxGenerationHistory {
+		copy(a.genHistory, a.genHistory[1:])
+		a.genHistory = a.genHistory[:len(a.genHistory)-1]
+	}
+	a.genHistory = append(a.genHistory, GenChange{Time: a.now(), OldGen: oldGen, NewGen: newGen})
+
+	for _, ch := range a.genWatchers {
+		// drop a stale value nobody has read yet, so the send below never blocks
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- newGen
+	}
+}
@@ -0,0 +1,243 @@
+package tapdance
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+var zipMagic = []byte("PK\x03\x04")
+
+// maxAssetsBundleSize bounds the size of an assets bundle, and of the files
+// unpacked from it, that LoadAssetsBundle accepts.
+const maxAssetsBundleSize = 16 << 20
+
+// LoadAssetsBundle reads a tar or zip archive holding the roots and ClientConf
+// files (named the same way as in the assets directory) and applies them in
+// memory. Entries with absolute paths, parent directory references or unknown
+// names are rejected, as are bundles larger than maxAssetsBundleSize, and
+// nothing is applied unless the whole bundle is valid, including the
+// ClientConf by ValidateClientConf.
+func (a *assets) LoadAssetsBundle(r io.Reader) error {
+	buf, err := readLimited(r)
+	if err != nil {
+		return err
+	}
+
+	var files map[string][]byte
+	if bytes.HasPrefix(buf, zipMagic) {
+		files, err = a.readZipBundle(buf)
+	} else {
+		files, err = a.readTarBundle(buf)
+	}
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("assets bundle contains neither roots nor ClientConf")
+	}
+
+	var roots *x509.CertPool
+	rootsPEM, hasRoots := files[a.filenameRoots]
+	if hasRoots {
+		roots, err = parseRoots(rootsPEM)
+		if err != nil {
+			return err
+		}
+	}
+	var conf *pb.ClientConf
+	if confBytes, ok := files[a.filenameClientConf]; ok {
+		conf, err = parseClientConf(confBytes)
+		if err != nil {
+			return err
+		}
+		if err = ValidateClientConf(conf); err != nil {
+			return err
+		}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.readOnly {
+		return ErrReadOnly
+	}
+	oldGen := a.config.GetGeneration()
+	if roots != nil {
+		a.roots = roots
+		a.rootsPEM = rootsPEM
+	}
+	if conf != nil {
+		a.config = conf
+		a.configSource = ConfigSourceBundle
+		a.resetDecoyKeys()
+	}
+	a.notifyGeneration(oldGen)
+	Logger().Infoln("Assets: loaded bundle with", len(files), "file(s)")
+	return nil
+}
+
+// bundleEntryName validates the name of an archive entry and returns it in
+// its cleaned form. Directories ("" after cleaning) are allowed and skipped.
+func (a *assets) bundleEntryName(name string) (string, error) {
+	if path.IsAbs(name) {
+		return "", fmt.Errorf("assets bundle: absolute path %q", name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("assets bundle: path traversal in %q", name)
+		}
+	}
+	cleaned := strings.TrimPrefix(path.Clean(name), "./")
+	if cleaned == "." {
+		return "", nil
+	}
+	if cleaned != a.filenameRoots && cleaned != a.filenameClientConf {
+		return "", fmt.Errorf("assets bundle: unexpected entry %q", name)
+	}
+	return cleaned, nil
+}
+
+func (a *assets) readTarBundle(buf []byte) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(buf))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name, err := a.bundleEntryName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeDir && name == "" {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return nil, fmt.Errorf("assets bundle: %q is not a regular file", hdr.Name)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = content
+	}
+	return files, nil
+}
+
+func (a *assets) readZipBundle(buf []byte) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		name, err := a.bundleEntryName(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if f.FileInfo().IsDir() && name == "" {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			return nil, fmt.Errorf("assets bundle: %q is not a regular file", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := readLimited(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[name] = content
+	}
+	return files, nil
+}
+
+// readLimited reads all of r, failing if it holds more than
+// maxAssetsBundleSize bytes.
+func readLimited(r io.Reader) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, maxAssetsBundleSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > maxAssetsBundleSize {
+		return nil, fmt.Errorf("assets bundle: larger than %d bytes", maxAssetsBundleSize)
+	}
+	return buf, nil
+}
+
+// SaveAssetsBundle writes the current roots PEM and marshalled ClientConf into
+// a tar stream that LoadAssetsBundle accepts. Roots are omitted if none were
+// ever loaded.
+func (a *assets) SaveAssetsBundle(w io.Writer) error {
+	a.RLock()
+	rootsPEM := a.rootsPEM
+	confBytes, err := proto.Marshal(a.config)
+	a.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	modTime := a.now()
+	tw := tar.NewWriter(w)
+	writeEntry := func(name string, content []byte) error {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: modTime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+	if len(rootsPEM) != 0 {
+		if err = writeEntry(a.filenameRoots, rootsPEM); err != nil {
+			return err
+		}
+	}
+	if err = writeEntry(a.filenameClientConf, confBytes); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// SaveAssetsBundleFile writes the bundle produced by SaveAssetsBundle to
+// filename. The file is written to a temporary file first and renamed into
+// place, so readers never observe a partially written bundle.
+func (a *assets) SaveAssetsBundleFile(filename string) error {
+	tmpFilename := path.Join(path.Dir(filename),
+		"."+path.Base(filename)+"."+getRandString(5)+".tmp")
+	f, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = a.SaveAssetsBundle(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
@@ -0,0 +1,173 @@
+package tapdance
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+type bundleEntry struct {
+	name    string
+	content []byte
+}
+
+func buildTarBundle(t *testing.T, entries []bundleEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestAssets_LoadBundle(t *testing.T) {
+	var b bytes.Buffer
+	logHolder := bufio.NewWriter(&b)
+	oldLoggerOut := Logger().Out
+	Logger().Out = logHolder
+	defer func() {
+		Logger().Out = oldLoggerOut
+		if t.Failed() {
+			logHolder.Flush()
+			fmt.Printf("TapDance log was:\n%s\n", b.String())
+		}
+	}()
+
+	oldpath := Assets().path
+	dir1, err := ioutil.TempDir("/tmp/", "bundle1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+	AssetsSetDir(dir1)
+	defer AssetsSetDir(oldpath)
+
+	rootsPEM, err := ioutil.ReadFile("../assets/roots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := uint32(4242)
+	conf := &pb.ClientConf{
+		Generation: &gen,
+		DecoyList: &pb.DecoyList{TlsDecoys: []*pb.TLSDecoySpec{
+			pb.InitTLSDecoySpec("4.8.15.16", "bundle.decoy"),
+		}},
+	}
+	confBytes, err := proto.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := buildTarBundle(t, []bundleEntry{
+		{"roots", rootsPEM},
+		{"./ClientConf", confBytes},
+	})
+	err = Assets().LoadAssetsBundle(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Assets().GetGeneration() != gen {
+		t.Fatalf("generation %v was not applied from bundle, got %v", gen, Assets().GetGeneration())
+	}
+	if !Assets().IsDecoyInList(pb.InitTLSDecoySpec("4.8.15.16", "bundle.decoy")) {
+		t.Fatal("decoy from bundle is not in Decoy List!")
+	}
+	if Assets().GetRoots() == nil {
+		t.Fatal("roots from bundle were not applied")
+	}
+
+	for _, badName := range []string{"../ClientConf", "/etc/ClientConf", "keys/ClientConf", "unexpected"} {
+		bundle = buildTarBundle(t, []bundleEntry{{badName, confBytes}})
+		if err = Assets().LoadAssetsBundle(bundle); err == nil {
+			t.Fatalf("bundle with entry %q was accepted", badName)
+		}
+	}
+
+	// a ClientConf failing ValidateClientConf is not applied
+	invalidConf := &pb.ClientConf{
+		DecoyList: &pb.DecoyList{TlsDecoys: []*pb.TLSDecoySpec{pb.InitTLSDecoySpec("4.8.15.23", "")}},
+	}
+	invalidBytes, err := proto.Marshal(invalidConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Assets().LoadAssetsBundle(buildTarBundle(t, []bundleEntry{{"ClientConf", invalidBytes}})); err == nil {
+		t.Fatal("bundle with an invalid ClientConf was accepted")
+	} else if Assets().GetGeneration() != gen {
+		t.Fatalf("invalid bundle changed the generation to %v", Assets().GetGeneration())
+	}
+
+	oversized := bytes.NewReader(make([]byte, maxAssetsBundleSize+1))
+	if err = Assets().LoadAssetsBundle(oversized); err == nil {
+		t.Fatal("oversized bundle was accepted")
+	}
+}
+
+func TestAssets_SaveBundleRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	logHolder := bufio.NewWriter(&b)
+	oldLoggerOut := Logger().Out
+	Logger().Out = logHolder
+	defer func() {
+		Logger().Out = oldLoggerOut
+		if t.Failed() {
+			logHolder.Flush()
+			fmt.Printf("TapDance log was:\n%s\n", b.String())
+		}
+	}()
+
+	dir1, err := ioutil.TempDir("/tmp/", "bundle2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+
+	src := newAssets("../assets")
+	src.readConfigs()
+	if len(src.rootsPEM) == 0 {
+		t.Fatal("source assets have no roots to bundle")
+	}
+
+	bundleFilename := path.Join(dir1, "bundle.tar")
+	err = src.SaveAssetsBundleFile(bundleFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(bundleFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dst := newAssets(dir1)
+	err = dst.LoadAssetsBundle(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(src.config, dst.config) {
+		t.Fatalf("ClientConf differs after round trip:\n%v\n%v", src.config, dst.config)
+	}
+	if !bytes.Equal(src.rootsPEM, dst.rootsPEM) {
+		t.Fatal("roots differ after round trip")
+	}
+	if dst.GetRoots() == nil {
+		t.Fatal("roots were not parsed after round trip")
+	}
+}
@@ -0,0 +1,145 @@
+package tapdance
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// decoyState is the runtime decoy state persisted with SetPersistBlacklist:
+// the blacklisted decoys and the last failure of each decoy, which its
+// cooldown is timed from. Decoys are identified by decoyKey.
+type decoyState struct {
+	Blacklist    []string             `json:"blacklist,omitempty"`
+	LastFailures map[string]time.Time `json:"last_failures,omitempty"`
+}
+
+// SetPersistBlacklist makes the runtime decoy blacklist and cooldown state
+// survive restarts. While enabled, the state is saved to the DecoyState file
+// in the assets dir whenever a decoy is (un)blacklisted or a failure is
+// reported, and read back when enabling it and whenever the assets dir is
+// read. State read from the file is merged with the state in memory.
+// Disabled by default.
+func (a *assets) SetPersistBlacklist(persist bool) {
+	a.RLock()
+	filename := path.Join(a.path, a.filenameDecoyState)
+	a.RUnlock()
+
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	a.persistBlacklist = persist
+	if persist {
+		a.loadDecoyState(filename)
+	}
+}
+
+// loadDecoyState merges the decoy state saved in filename into the health
+// state and saves further changes there. A missing file is no error.
+// healthMu must be held.
+func (a *assets) loadDecoyState(filename string) {
+	a.decoyStateFilename = filename
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Logger().Warningln("Assets: failed to read decoy state: " + err.Error())
+		}
+		return
+	}
+	var state decoyState
+	if err = json.Unmarshal(buf, &state); err != nil {
+		Logger().Warningln("Assets: failed to parse decoy state: " + err.Error())
+		return
+	}
+
+	if a.decoyBlacklist == nil {
+		a.decoyBlacklist = make(map[string]bool)
+	}
+	for _, key := range state.Blacklist {
+		a.decoyBlacklist[key] = true
+	}
+	if a.decoyHealth == nil {
+		a.decoyHealth = make(map[string]*decoyHealth)
+	}
+	for key, lastFailure := range state.LastFailures {
+		health, ok := a.decoyHealth[key]
+		if !ok {
+			health = &decoyHealth{}
+			a.decoyHealth[key] = health
+		}
+		if health.failures == 0 {
+			health.failures = 1
+		}
+		if lastFailure.After(health.lastFailure) {
+			health.lastFailure = lastFailure
+		}
+	}
+}
+
+// decoyStateSnapshot is the decoy state marshalled for saveDecoyState. seq
+// orders snapshots, so an older one never overwrites a newer one.
+type decoyStateSnapshot struct {
+	seq uint64
+	buf []byte
+}
+
+// snapshotDecoyState marshals the decoy state to be saved with saveDecoyState
+// once healthMu is released, or returns nil if SetPersistBlacklist is
+// disabled. healthMu must be held.
+func (a *assets) snapshotDecoyState() *decoyStateSnapshot {
+	if !a.persistBlacklist || a.decoyStateFilename == "" {
+		return nil
+	}
+
+	state := decoyState{LastFailures: make(map[string]time.Time)}
+	for key, blacklisted := range a.decoyBlacklist {
+		if blacklisted {
+			state.Blacklist = append(state.Blacklist, key)
+		}
+	}
+	sort.Strings(state.Blacklist)
+	for key, health := range a.decoyHealth {
+		if health.failures > 0 {
+			state.LastFailures[key] = health.lastFailure
+		}
+	}
+	buf, err := json.Marshal(state)
+	if err != nil {
+		Logger().Warningln("Assets: failed to marshal decoy state: " + err.Error())
+		return nil
+	}
+	a.decoyStateSeq++
+	return &decoyStateSnapshot{seq: a.decoyStateSeq, buf: buf}
+}
+
+// saveDecoyState atomically writes snapshot to the DecoyState file in the
+// assets dir, unless it is nil, the assets are read-only or a later snapshot
+// was saved already. Failing to save is logged, as it mustn't get in the way
+// of selecting decoys. It takes the assets lock, so healthMu mustn't be held.
+func (a *assets) saveDecoyState(snapshot *decoyStateSnapshot) {
+	if snapshot == nil {
+		return
+	}
+
+	a.decoyStateMu.Lock()
+	defer a.decoyStateMu.Unlock()
+
+	if snapshot.seq <= a.decoyStateSaved {
+		return
+	}
+	a.RLock()
+	defer a.RUnlock()
+
+	if a.readOnly {
+		return
+	}
+	if err := a.writeFileAtomic(a.filenameDecoyState, snapshot.buf); err != nil {
+		Logger().Warningln("Assets: failed to save decoy state: " + err.Error())
+		return
+	}
+	a.decoyStateSaved = snapshot.seq
+}
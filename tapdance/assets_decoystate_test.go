@@ -0,0 +1,68 @@
+package tapdance
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAssets_PersistBlacklist(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "decoystate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1600000000, 0)
+	clock := func() time.Time { return now }
+
+	a := newAssets(dir)
+	a.SetPersistBlacklist(true)
+	a.readConfigs()
+	a.SetClock(clock)
+	decoys := a.GetAllDecoys()
+	a.BlacklistDecoy(decoys[0])
+	a.BlacklistDecoy(decoys[1])
+	a.UnblacklistDecoy(decoys[1])
+	a.ReportDecoyFailure(decoys[2])
+
+	// "restart" on the same dir
+	b := newAssets(dir)
+	b.SetPersistBlacklist(true)
+	b.readConfigs()
+	b.SetClock(clock)
+	b.SetDecoyCooldown(time.Minute)
+	if !b.IsDecoyBlacklisted(decoys[0]) {
+		t.Fatal("blacklisted decoy not blacklisted after restart")
+	}
+	if b.IsDecoyBlacklisted(decoys[1]) {
+		t.Fatal("unblacklisted decoy blacklisted after restart")
+	}
+	now = now.Add(20 * time.Second)
+	if remaining := b.DecoyCooldownRemaining(*decoys[2]); remaining != 40*time.Second {
+		t.Fatalf("%v cooldown remaining after restart, expected 40s", remaining)
+	}
+
+	// read-only assets keep changes in memory only
+	b.SetReadOnly(true)
+	b.BlacklistDecoy(decoys[1])
+	if !b.IsDecoyBlacklisted(decoys[1]) {
+		t.Fatal("decoy not blacklisted by read-only assets")
+	}
+	d := newAssets(dir)
+	d.SetPersistBlacklist(true)
+	d.readConfigs()
+	if d.IsDecoyBlacklisted(decoys[1]) {
+		t.Fatal("decoy state saved by read-only assets")
+	} else if !d.IsDecoyBlacklisted(decoys[0]) {
+		t.Fatal("saved decoy state lost")
+	}
+
+	// without persistence nothing is read
+	c := newAssets(dir)
+	c.readConfigs()
+	if c.IsDecoyBlacklisted(decoys[0]) {
+		t.Fatal("blacklist read without SetPersistBlacklist")
+	}
+}
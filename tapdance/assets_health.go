@@ -0,0 +1,538 @@
+package tapdance
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	tls "github.com/refraction-networking/utls"
+)
+
+// decoyHealth tracks how connections to a single decoy went.
+type decoyHealth struct {
+	failures    int
+	successes   int
+	lastFailure time.Time
+}
+
+// successRatio estimates how likely a connection to the decoy is to succeed.
+// The counts are smoothed with one success and one failure, so a decoy with
+// no history gets a neutral 0.5 and a single outcome doesn't decide it.
+func (health *decoyHealth) successRatio() float64 {
+	if health == nil {
+		return 0.5
+	}
+	return float64(health.successes+1) / float64(health.successes+health.failures+2)
+}
+
+// decoyKey identifies a decoy for health tracking.
+func decoyKey(decoy *pb.TLSDecoySpec) string {
+	return decoy.GetHostname() + "@" + decoy.GetIpAddrStr()
+}
+
+// ReportDecoyFailure records a failed connection attempt to decoy.
+func (a *assets) ReportDecoyFailure(decoy *pb.TLSDecoySpec) {
+	a.ReportDecoyFailureReason(decoy, nil)
+}
+
+// ReportDecoyFailureReason is ReportDecoyFailure with the error the connection
+// attempt failed with, which is passed on to WatchDecoyFailures.
+func (a *assets) ReportDecoyFailureReason(decoy *pb.TLSDecoySpec, reason error) {
+	a.healthMu.Lock()
+
+	if a.decoyHealth == nil {
+		a.decoyHealth = make(map[string]*decoyHealth)
+	}
+	key := decoyKey(decoy)
+	health, ok := a.decoyHealth[key]
+	if !ok {
+		health = &decoyHealth{}
+		a.decoyHealth[key] = health
+	}
+	health.failures++
+	health.lastFailure = a.now()
+	snapshot := a.snapshotDecoyState()
+
+	event := DecoyFailureEvent{Decoy: *proto.Clone(decoy).(*pb.TLSDecoySpec), Time: health.lastFailure, Reason: reason}
+	for _, ch := range a.failureWatchers {
+		// never block reporting on a slow consumer
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	a.healthMu.Unlock()
+
+	a.saveDecoyState(snapshot)
+}
+
+// DecoyFailureEvent describes a decoy failure reported to the assets.
+type DecoyFailureEvent struct {
+	Decoy pb.TLSDecoySpec
+	Time  time.Time
+	// Reason is the error the connection failed with, if it was reported.
+	Reason error
+}
+
+// decoyFailureBuffer is the number of events a WatchDecoyFailures channel
+// holds before further events are dropped.
+const decoyFailureBuffer = 16
+
+// WatchDecoyFailures returns a channel that receives an event whenever a decoy
+// failure is reported, e.g. so a supervisor can refresh the config after
+// repeated failures. Events that don't fit the channel buffer, because the
+// consumer lags behind, are dropped. Call UnwatchDecoyFailures to release the
+// channel.
+func (a *assets) WatchDecoyFailures() <-chan DecoyFailureEvent {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	ch := make(chan DecoyFailureEvent, decoyFailureBuffer)
+	a.failureWatchers = append(a.failureWatchers, ch)
+	return ch
+}
+
+// UnwatchDecoyFailures stops delivery to a channel returned by
+// WatchDecoyFailures and closes it.
+func (a *assets) UnwatchDecoyFailures(watcher <-chan DecoyFailureEvent) {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	for i, ch := range a.failureWatchers {
+		if ch == watcher {
+			a.failureWatchers = append(a.failureWatchers[:i], a.failureWatchers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+// ReportDecoySuccess records a successful connection to decoy.
+func (a *assets) ReportDecoySuccess(decoy *pb.TLSDecoySpec) {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	if a.decoyHealth == nil {
+		a.decoyHealth = make(map[string]*decoyHealth)
+	}
+	key := decoyKey(decoy)
+	health, ok := a.decoyHealth[key]
+	if !ok {
+		health = &decoyHealth{}
+		a.decoyHealth[key] = health
+	}
+	health.successes++
+}
+
+// DecoySuccesses returns the number of successes reported for decoy.
+func (a *assets) DecoySuccesses(decoy *pb.TLSDecoySpec) int {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	if health, ok := a.decoyHealth[decoyKey(decoy)]; ok {
+		return health.successes
+	}
+	return 0
+}
+
+// SetDecoySelectionEpsilon makes GetDecoy favor decoys by their reported
+// success ratio (see ReportDecoySuccess and ReportDecoyFailure). With
+// probability epsilon a decoy is picked uniformly at random to keep probing
+// the others; otherwise decoys are picked with probability proportional to
+// their success ratio. A negative epsilon turns success bias off again, which
+// is the default. Values above 1 are treated as 1.
+func (a *assets) SetDecoySelectionEpsilon(epsilon float64) {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	if epsilon > 1 {
+		epsilon = 1
+	}
+	a.successBias = epsilon >= 0
+	a.decoySelectionEpsilon = epsilon
+}
+
+// pickDecoyIndex returns the index of the decoy GetDecoy should use.
+func (a *assets) pickDecoyIndex(decoys []*pb.TLSDecoySpec) int {
+	a.healthMu.Lock()
+	a.decoySelections++
+	successBias, epsilon := a.successBias, a.decoySelectionEpsilon
+	var ratios []float64
+	total := 0.0
+	if successBias {
+		ratios = make([]float64, len(decoys))
+		for i, decoy := range decoys {
+			ratios[i] = a.decoyHealth[decoyKey(decoy)].successRatio()
+			total += ratios[i]
+		}
+	}
+	a.healthMu.Unlock()
+
+	if !successBias || a.randFloat() < epsilon {
+		return a.randIndex(len(decoys))
+	}
+	r := a.randFloat() * total
+	for i, ratio := range ratios {
+		if r < ratio {
+			return i
+		}
+		r -= ratio
+	}
+	return len(decoys) - 1
+}
+
+// SetDecoyCooldown makes GetDecoy avoid a decoy for cooldown after each failure
+// reported for it, as long as other decoys are eligible. Zero, the default,
+// disables cooldowns.
+func (a *assets) SetDecoyCooldown(cooldown time.Duration) {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	a.decoyCooldown = cooldown
+}
+
+// DecoyCooldownRemaining returns how long until decoy is eligible again after
+// its last reported failure, see SetDecoyCooldown. It is zero for eligible
+// decoys.
+func (a *assets) DecoyCooldownRemaining(decoy pb.TLSDecoySpec) time.Duration {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	return a.cooldownRemaining(&decoy)
+}
+
+// cooldownRemaining is DecoyCooldownRemaining with healthMu held.
+func (a *assets) cooldownRemaining(decoy *pb.TLSDecoySpec) time.Duration {
+	health, ok := a.decoyHealth[decoyKey(decoy)]
+	if !ok || health.failures == 0 || a.decoyCooldown <= 0 {
+		return 0
+	}
+	remaining := health.lastFailure.Add(a.decoyCooldown).Sub(a.now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// eligibleDecoys returns the decoys that are neither blacklisted nor in
+// cooldown or, if all of those left are in cooldown, all that aren't
+// blacklisted. It checks the usable decoys against SetMinUsableDecoys.
+func (a *assets) eligibleDecoys(decoys []*pb.TLSDecoySpec) []*pb.TLSDecoySpec {
+	allowed, usable := a.filterDecoys(decoys)
+	if len(usable) == 0 {
+		return allowed
+	}
+	return usable
+}
+
+// filterDecoys splits decoys into those that aren't blacklisted and, of
+// those, the usable ones that aren't in cooldown either. It checks the
+// usable decoys against SetMinUsableDecoys.
+func (a *assets) filterDecoys(decoys []*pb.TLSDecoySpec) (allowed, usable []*pb.TLSDecoySpec) {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	allowed = make([]*pb.TLSDecoySpec, 0, len(decoys))
+	usable = make([]*pb.TLSDecoySpec, 0, len(decoys))
+	for _, decoy := range decoys {
+		if a.decoyBlacklist[decoyKey(decoy)] {
+			continue
+		}
+		allowed = append(allowed, decoy)
+		if a.cooldownRemaining(decoy) == 0 {
+			usable = append(usable, decoy)
+		}
+	}
+	a.checkLowDecoys(len(usable))
+	return allowed, usable
+}
+
+// BlacklistDecoy stops GetDecoy from selecting decoy until it is removed with
+// UnblacklistDecoy.
+func (a *assets) BlacklistDecoy(decoy *pb.TLSDecoySpec) {
+	a.healthMu.Lock()
+	if a.decoyBlacklist == nil {
+		a.decoyBlacklist = make(map[string]bool)
+	}
+	a.decoyBlacklist[decoyKey(decoy)] = true
+	snapshot := a.snapshotDecoyState()
+	a.healthMu.Unlock()
+
+	a.saveDecoyState(snapshot)
+}
+
+// UnblacklistDecoy removes decoy from the blacklist, see BlacklistDecoy.
+func (a *assets) UnblacklistDecoy(decoy *pb.TLSDecoySpec) {
+	a.healthMu.Lock()
+	delete(a.decoyBlacklist, decoyKey(decoy))
+	snapshot := a.snapshotDecoyState()
+	a.healthMu.Unlock()
+
+	a.saveDecoyState(snapshot)
+}
+
+// IsDecoyBlacklisted reports whether decoy is blacklisted, see BlacklistDecoy.
+func (a *assets) IsDecoyBlacklisted(decoy *pb.TLSDecoySpec) bool {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	return a.decoyBlacklist[decoyKey(decoy)]
+}
+
+// SetMinUsableDecoys sets the number of usable decoys, neither blacklisted
+// nor in cooldown, below which selection calls the SetOnLowDecoys callback.
+// Zero, the default, disables the check.
+func (a *assets) SetMinUsableDecoys(n int) {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	a.minUsableDecoys = n
+	a.lowDecoysReported = false
+}
+
+// SetOnLowDecoys registers a callback for when selection finds fewer usable
+// decoys than SetMinUsableDecoys, e.g. to fetch a new ClientConf. It is called
+// once each time the pool drops below the minimum, in its own goroutine so it
+// never blocks selection. Passing nil removes the callback.
+func (a *assets) SetOnLowDecoys(onLowDecoys func()) {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	a.onLowDecoys = onLowDecoys
+}
+
+// checkLowDecoys calls onLowDecoys when the number of usable decoys crosses
+// below minUsableDecoys. healthMu must be held.
+func (a *assets) checkLowDecoys(usable int) {
+	if usable >= a.minUsableDecoys {
+		a.lowDecoysReported = false
+		return
+	}
+	if a.lowDecoysReported || a.onLowDecoys == nil {
+		return
+	}
+	a.lowDecoysReported = true
+	go a.onLowDecoys()
+}
+
+// DecoyFailures returns the number of failures reported for decoy.
+func (a *assets) DecoyFailures(decoy *pb.TLSDecoySpec) int {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	if health, ok := a.decoyHealth[decoyKey(decoy)]; ok {
+		return health.failures
+	}
+	return 0
+}
+
+// AssetsMetrics is a snapshot of the assets stats, see RegisterMetrics.
+type AssetsMetrics struct {
+	// Decoys is the number of decoys of the ClientConf.
+	Decoys int
+	// Generation is the ClientConf generation.
+	Generation uint32
+	// DecoySelections counts the decoys returned by GetDecoy.
+	DecoySelections uint64
+	// DecoyFailures counts the failures reported with ReportDecoyFailure.
+	DecoyFailures uint64
+}
+
+// Metrics returns the current AssetsMetrics.
+func (a *assets) Metrics() AssetsMetrics {
+	a.RLock()
+	metrics := AssetsMetrics{
+		Decoys:     len(a.config.GetDecoyList().GetTlsDecoys()),
+		Generation: a.config.GetGeneration(),
+	}
+	a.RUnlock()
+
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	metrics.DecoySelections = a.decoySelections
+	for _, health := range a.decoyHealth {
+		metrics.DecoyFailures += uint64(health.failures)
+	}
+	return metrics
+}
+
+const defaultHealthCheckConcurrency = 16
+
+// DecoyHealthCheck configures HealthCheckDecoysWith.
+type DecoyHealthCheck struct {
+	// Timeout bounds each probe. Zero means only ctx bounds it.
+	Timeout time.Duration
+
+	// TLSHandshake additionally requires a TLS handshake using the decoy
+	// hostname as SNI for the probe to succeed.
+	TLSHandshake bool
+
+	// ReportFailures feeds failed probes into ReportDecoyFailure.
+	ReportFailures bool
+
+	// Concurrency caps the number of probes in flight.
+	// Defaults to defaultHealthCheckConcurrency.
+	Concurrency int
+
+	// TcpDialer is used to connect to decoys. Defaults to net.Dialer.
+	TcpDialer func(context.Context, string, string) (net.Conn, error)
+
+	// RootCAs verifies decoy certificates when TLSHandshake is set. nil
+	// means the assets roots (GetRoots) if there are any, or else the system
+	// roots.
+	RootCAs *x509.CertPool
+}
+
+// HealthCheckDecoys attempts a TCP connection to every decoy and returns the
+// outcome keyed by decoy hostname and address ("hostname@ip:port"), as decoys
+// may share an address. A nil error means the decoy was reachable.
+func (a *assets) HealthCheckDecoys(ctx context.Context, timeout time.Duration) map[string]error {
+	return a.HealthCheckDecoysWith(ctx, DecoyHealthCheck{Timeout: timeout})
+}
+
+// HealthCheckDecoysWith probes every decoy as configured by check and returns
+// the outcome keyed by decoy hostname and address ("hostname@ip:port"). Like
+// ProbeDecoyWith, it connects to the override of a decoy if it has one.
+func (a *assets) HealthCheckDecoysWith(ctx context.Context, check DecoyHealthCheck) map[string]error {
+	a.RLock()
+	allDecoys := a.config.GetDecoyList().GetTlsDecoys()
+	decoys := make([]*pb.TLSDecoySpec, len(allDecoys))
+	copy(decoys, allDecoys)
+	addrs := make([]string, len(decoys))
+	for i, decoy := range decoys {
+		addrs[i] = a.probeAddr(decoy)
+	}
+	check = a.probeCheck(check)
+	a.RUnlock()
+
+	concurrency := check.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultHealthCheckConcurrency
+	}
+
+	results := make(map[string]error, len(decoys))
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i, decoy := range decoys {
+		wg.Add(1)
+		go func(decoy *pb.TLSDecoySpec, addr string) {
+			defer wg.Done()
+
+			var err error
+			select {
+			case sem <- struct{}{}:
+				err = probeDecoyAddr(ctx, decoy, addr, check)
+				<-sem
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			if err != nil && check.ReportFailures {
+				a.ReportDecoyFailureReason(decoy, err)
+			}
+
+			resultsMu.Lock()
+			results[decoyKey(decoy)] = err
+			resultsMu.Unlock()
+		}(decoy, addrs[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// ProbeDecoy checks that decoy completes a TLS handshake with its hostname as
+// SNI, so a client can verify a decoy before committing to it. It connects to
+// the decoy address, or to its override (see SetDecoyIPOverrides), and
+// verifies the certificate against the assets roots or, if there are none,
+// the system roots. Cancelling ctx or reaching its deadline aborts the probe.
+// A failed probe returns a wrapped error and isn't reported as a decoy
+// failure, see ProbeDecoyWith.
+func (a *assets) ProbeDecoy(ctx context.Context, decoy pb.TLSDecoySpec) error {
+	return a.ProbeDecoyWith(ctx, decoy, DecoyHealthCheck{TLSHandshake: true})
+}
+
+// ProbeDecoyWith probes a single decoy as configured by check, see
+// ProbeDecoy. Concurrency is ignored.
+func (a *assets) ProbeDecoyWith(ctx context.Context, decoy pb.TLSDecoySpec, check DecoyHealthCheck) error {
+	a.RLock()
+	addr := a.probeAddr(&decoy)
+	check = a.probeCheck(check)
+	a.RUnlock()
+
+	err := probeDecoyAddr(ctx, &decoy, addr, check)
+	if err == nil {
+		return nil
+	}
+	if check.ReportFailures {
+		a.ReportDecoyFailureReason(&decoy, err)
+	}
+	return fmt.Errorf("probing decoy %v at %v: %w", decoy.GetHostname(), addr, err)
+}
+
+// probeAddr returns the address to probe decoy at: its override, see
+// SetDecoyIPOverrides, or else its own. The assets lock must be held.
+func (a *assets) probeAddr(decoy *pb.TLSDecoySpec) string {
+	if overrideIP, ok := a.decoyIPOverrides[decoy.GetHostname()]; ok {
+		return net.JoinHostPort(overrideIP.String(), "443")
+	}
+	return decoy.GetIpAddrStr()
+}
+
+// probeCheck returns check with the assets roots filled in if it has no
+// RootCAs. The assets lock must be held.
+func (a *assets) probeCheck(check DecoyHealthCheck) DecoyHealthCheck {
+	if check.RootCAs == nil {
+		check.RootCAs = a.roots
+	}
+	return check
+}
+
+// probeDecoyAddr probes decoy at addr, see DecoyHealthCheck.
+func probeDecoyAddr(ctx context.Context, decoy *pb.TLSDecoySpec, addr string, check DecoyHealthCheck) error {
+	if check.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, check.Timeout)
+		defer cancel()
+	}
+
+	tcpDialer := check.TcpDialer
+	if tcpDialer == nil {
+		tcpDialer = (&net.Dialer{}).DialContext
+	}
+	dialConn, err := tcpDialer(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer dialConn.Close()
+	if !check.TLSHandshake {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		dialConn.SetDeadline(deadline)
+	}
+	// the handshake doesn't take a context, so abort it by closing the
+	// connection once ctx is done
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			dialConn.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	config := tls.Config{ServerName: decoy.GetHostname(), RootCAs: check.RootCAs}
+	tlsConn := tls.UClient(dialConn, &config, tls.HelloChrome_62)
+	if err = tlsConn.Handshake(); err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
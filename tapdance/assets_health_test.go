@@ -0,0 +1,449 @@
+package tapdance
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+func TestAssets_HealthCheckDecoys(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// grab a free port and close it again, so that connecting is refused
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusedAddr := refused.Addr().String()
+	refused.Close()
+
+	upDecoy := pb.InitTLSDecoySpec("10.0.0.1", "up.decoy")
+	downDecoy := pb.InitTLSDecoySpec("10.0.0.2", "down.decoy")
+	// shares the address of upDecoy, but is a decoy of its own
+	sharedDecoy := pb.InitTLSDecoySpec("10.0.0.1", "shared.decoy")
+	localAddrs := map[string]string{
+		upDecoy.GetIpAddrStr():   listener.Addr().String(),
+		downDecoy.GetIpAddrStr(): refusedAddr,
+	}
+
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{upDecoy, downDecoy, sharedDecoy}
+	results := a.HealthCheckDecoysWith(context.Background(), DecoyHealthCheck{
+		Timeout:        time.Second,
+		ReportFailures: true,
+		Concurrency:    1,
+		TcpDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, localAddrs[addr])
+		},
+	})
+
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %v", results)
+	}
+	for _, decoy := range []*pb.TLSDecoySpec{upDecoy, sharedDecoy} {
+		if err, ok := results[decoyKey(decoy)]; !ok || err != nil {
+			t.Fatalf("reachable decoy %v reported as failed: %v", decoy.GetHostname(), err)
+		}
+	}
+	if err := results[decoyKey(downDecoy)]; err == nil {
+		t.Fatal("unreachable decoy reported as healthy")
+	}
+	if a.DecoyFailures(downDecoy) != 1 || a.DecoyFailures(upDecoy) != 0 {
+		t.Fatalf("unexpected failure counts: down=%d up=%d",
+			a.DecoyFailures(downDecoy), a.DecoyFailures(upDecoy))
+	}
+
+	// decoys with an override are probed at the override
+	a.SetDecoyIPOverrides(map[string]string{"down.decoy": "10.0.0.3"})
+	localAddrs["10.0.0.3:443"] = listener.Addr().String()
+	results = a.HealthCheckDecoysWith(context.Background(), DecoyHealthCheck{
+		Timeout: time.Second,
+		TcpDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, localAddrs[addr])
+		},
+	})
+	if err := results[decoyKey(downDecoy)]; err != nil {
+		t.Fatalf("decoy probed at its override failed: %v", err)
+	}
+}
+
+func TestAssets_ProbeDecoy(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// accepts connections, but never answers the handshake
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusedAddr := refused.Addr().String()
+	refused.Close()
+
+	a := newAssets("")
+	a.roots = x509.NewCertPool()
+	a.roots.AddCert(server.Certificate())
+	probe := func(ctx context.Context, localAddr string) error {
+		return a.ProbeDecoyWith(ctx, *pb.InitTLSDecoySpec("10.0.0.1", "example.com"), DecoyHealthCheck{
+			TLSHandshake: true,
+			TcpDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, localAddr)
+			},
+		})
+	}
+
+	if err := probe(context.Background(), server.Listener.Addr().String()); err != nil {
+		t.Fatalf("probing a TLS listener failed: %v", err)
+	}
+	if err := probe(context.Background(), refusedAddr); err == nil {
+		t.Fatal("probing a refused port succeeded")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := probe(ctx, silent.Addr().String()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled probe: %v, expected context.Canceled", err)
+	}
+
+	// health checks verify against the assets roots too
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{pb.InitTLSDecoySpec("10.0.0.1", "example.com")}
+	results := a.HealthCheckDecoysWith(context.Background(), DecoyHealthCheck{
+		TLSHandshake: true,
+		TcpDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	})
+	for key, err := range results {
+		if err != nil {
+			t.Fatalf("health check of %v failed: %v", key, err)
+		}
+	}
+
+	// without the assets roots the certificate doesn't verify
+	a.roots = nil
+	if err := probe(context.Background(), server.Listener.Addr().String()); err == nil {
+		t.Fatal("probing an untrusted TLS listener succeeded")
+	}
+}
+
+func TestAssets_DecoySelectionEpsilon(t *testing.T) {
+	good := pb.InitTLSDecoySpec("11.22.33.44", "good.decoy")
+	bad := pb.InitTLSDecoySpec("8.255.255.8", "bad.decoy")
+	fresh := pb.InitTLSDecoySpec("0.1.2.3", "fresh.decoy")
+
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{good, bad, fresh}
+	a.SetRandSource(mrand.New(mrand.NewSource(1337)))
+	for i := 0; i < 18; i++ {
+		a.ReportDecoySuccess(good)
+		a.ReportDecoyFailure(bad)
+	}
+	if a.DecoySuccesses(good) != 18 || a.DecoyFailures(bad) != 18 {
+		t.Fatalf("unexpected history: %d successes, %d failures", a.DecoySuccesses(good), a.DecoyFailures(bad))
+	}
+
+	pick := func(n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			counts[a.GetDecoy().GetHostname()]++
+		}
+		return counts
+	}
+
+	a.SetDecoySelectionEpsilon(0.1)
+	counts := pick(3000)
+	// expected shares are about 0.6 good, 0.05 bad and 0.35 fresh
+	if counts["good.decoy"] < counts["fresh.decoy"] || counts["good.decoy"] < 5*counts["bad.decoy"] {
+		t.Fatalf("reliable decoy not favored: %v", counts)
+	} else if counts["bad.decoy"] == 0 || counts["fresh.decoy"] == 0 {
+		t.Fatalf("other decoys never probed: %v", counts)
+	}
+
+	// turning the bias off again picks uniformly
+	a.SetDecoySelectionEpsilon(-1)
+	counts = pick(3000)
+	for _, decoy := range []string{"good.decoy", "bad.decoy", "fresh.decoy"} {
+		if counts[decoy] < 800 {
+			t.Fatalf("uniform selection skewed: %v", counts)
+		}
+	}
+}
+
+func TestAssets_DecoyCooldownRemaining(t *testing.T) {
+	a := newAssets("")
+	now := time.Unix(1600000000, 0)
+	a.SetClock(func() time.Time { return now })
+	a.SetDecoyCooldown(time.Minute)
+
+	decoys := a.config.DecoyList.TlsDecoys
+	failed := decoys[0]
+	if remaining := a.DecoyCooldownRemaining(*failed); remaining != 0 {
+		t.Fatalf("decoy without failures has %v cooldown remaining", remaining)
+	}
+
+	a.ReportDecoyFailure(failed)
+	if remaining := a.DecoyCooldownRemaining(*failed); remaining != time.Minute {
+		t.Fatalf("%v cooldown remaining right after failure, expected %v", remaining, time.Minute)
+	}
+	now = now.Add(18 * time.Second)
+	if remaining := a.DecoyCooldownRemaining(*failed); remaining != 42*time.Second {
+		t.Fatalf("%v cooldown remaining after 18s, expected 42s", remaining)
+	}
+
+	// the decoy isn't selected while cooling down
+	a.SetRandSource(mrand.New(mrand.NewSource(1)))
+	for i := 0; i < 50; i++ {
+		if a.GetDecoy().GetHostname() == failed.GetHostname() {
+			t.Fatal("decoy in cooldown selected")
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if remaining := a.DecoyCooldownRemaining(*failed); remaining != 0 {
+		t.Fatalf("%v cooldown remaining after it ended", remaining)
+	}
+	if remaining := a.DecoyCooldownRemaining(*decoys[1]); remaining != 0 {
+		t.Fatalf("decoy without failures has %v cooldown remaining", remaining)
+	}
+}
+
+func TestAssets_SetClock(t *testing.T) {
+	a := newAssets("")
+	now := time.Unix(1600000000, 0)
+	a.SetClock(func() time.Time { return now })
+	a.SetDecoyCooldown(time.Minute)
+	failures := a.WatchDecoyFailures()
+
+	decoy := a.GetAllDecoys()[0]
+	a.ReportDecoyFailure(decoy)
+	if event := <-failures; !event.Time.Equal(now) {
+		t.Fatalf("failure reported at %v, expected %v", event.Time, now)
+	}
+
+	bundleTime := func() time.Time {
+		var b bytes.Buffer
+		if err := a.SaveAssetsBundle(&b); err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := tar.NewReader(&b).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hdr.ModTime
+	}
+
+	// every feature follows the clock as it advances
+	for _, step := range []time.Duration{0, 30 * time.Second, 29 * time.Second, time.Second, time.Hour} {
+		now = now.Add(step)
+		if mod := bundleTime(); !mod.Equal(now) {
+			t.Fatalf("bundle written at %v, expected %v", mod, now)
+		}
+	}
+	if remaining := a.DecoyCooldownRemaining(*decoy); remaining != 0 {
+		t.Fatalf("%v cooldown remaining after it ended", remaining)
+	}
+
+	now = now.Add(time.Hour)
+	a.ReportDecoyFailure(decoy)
+	now = now.Add(59 * time.Second)
+	if remaining := a.DecoyCooldownRemaining(*decoy); remaining != time.Second {
+		t.Fatalf("%v cooldown remaining, expected 1s", remaining)
+	}
+
+	// the clock covers writes too, and nil restores time.Now
+	a.SetClock(func() time.Time { return time.Unix(0, 0) })
+	if mod := bundleTime(); !mod.Equal(time.Unix(0, 0)) {
+		t.Fatalf("bundle written at %v with the test clock", mod)
+	}
+	a.SetClock(nil)
+	if mod := bundleTime(); time.Since(mod) > time.Minute {
+		t.Fatalf("bundle written at %v with the real clock", mod)
+	}
+}
+
+func TestAssets_Metrics(t *testing.T) {
+	a := newAssets("")
+	for i := 0; i < 3; i++ {
+		a.GetDecoy()
+	}
+	decoys := a.GetAllDecoys()
+	a.ReportDecoyFailure(decoys[0])
+	a.ReportDecoyFailure(decoys[0])
+	a.ReportDecoyFailure(decoys[1])
+
+	metrics := a.Metrics()
+	expected := AssetsMetrics{Decoys: len(decoys), Generation: a.GetGeneration(), DecoySelections: 3, DecoyFailures: 3}
+	if metrics != expected {
+		t.Fatalf("metrics %+v, expected %+v", metrics, expected)
+	}
+}
+
+func TestAssets_WatchDecoyFailures(t *testing.T) {
+	a := newAssets("")
+	now := time.Unix(1600000000, 0)
+	a.SetClock(func() time.Time { return now })
+	watcher := a.WatchDecoyFailures()
+
+	decoy := a.GetAllDecoys()[0]
+	reason := errors.New("connection reset")
+	a.ReportDecoyFailureReason(decoy, reason)
+	select {
+	case event := <-watcher:
+		if event.Decoy.GetHostname() != decoy.GetHostname() || !event.Time.Equal(now) || event.Reason != reason {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event delivered for the reported failure")
+	}
+
+	// a lagging consumer doesn't block reporting
+	for i := 0; i < 2*decoyFailureBuffer; i++ {
+		a.ReportDecoyFailure(decoy)
+	}
+	if len(watcher) != decoyFailureBuffer {
+		t.Fatalf("%d events buffered, expected %d", len(watcher), decoyFailureBuffer)
+	}
+
+	a.UnwatchDecoyFailures(watcher)
+	for range watcher {
+	}
+	a.ReportDecoyFailure(decoy)
+}
+
+func TestAssets_OnLowDecoys(t *testing.T) {
+	a := newAssets("")
+	decoys := a.GetAllDecoys()
+	lowDecoys := make(chan struct{}, 10)
+	a.SetOnLowDecoys(func() { lowDecoys <- struct{}{} })
+	a.SetMinUsableDecoys(2)
+
+	expectCalls := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			select {
+			case <-lowDecoys:
+			case <-time.After(time.Second):
+				t.Fatalf("low decoys callback called %d times, expected %d", i, n)
+			}
+		}
+		select {
+		case <-lowDecoys:
+			t.Fatalf("low decoys callback called more than %d times", n)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	a.BlacklistDecoy(decoys[0])
+	a.GetDecoy()
+	expectCalls(0)
+
+	// dropping below the minimum calls it once, however often decoys are
+	// selected
+	a.BlacklistDecoy(decoys[1])
+	if !a.IsDecoyBlacklisted(decoys[1]) {
+		t.Fatal("decoy not blacklisted")
+	}
+	for i := 0; i < 20; i++ {
+		if hostname := a.GetDecoy().GetHostname(); hostname != decoys[2].GetHostname() {
+			t.Fatalf("selected %v, expected the only decoy that isn't blacklisted", hostname)
+		}
+	}
+	expectCalls(1)
+
+	// and again after recovering
+	a.UnblacklistDecoy(decoys[1])
+	a.GetDecoy()
+	a.BlacklistDecoy(decoys[1])
+	a.GetDecoy()
+	expectCalls(1)
+}
+
+func TestAssets_GetDecoyErr(t *testing.T) {
+	a := newAssets("")
+	now := time.Unix(1600000000, 0)
+	a.SetClock(func() time.Time { return now })
+	a.SetDecoyCooldown(time.Minute)
+	decoys := a.GetAllDecoys()
+
+	decoy, err := a.GetDecoyErr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoy.GetHostname() == "" || decoy.GetTimeout() < timeoutMin {
+		t.Fatalf("unexpected decoy %v", decoy.String())
+	}
+
+	// all in cooldown
+	for _, decoy := range decoys {
+		a.ReportDecoyFailure(decoy)
+	}
+	if _, err := a.GetDecoyErr(); !errors.Is(err, ErrNoUsableDecoys) {
+		t.Fatalf("all decoys in cooldown: %v, expected ErrNoUsableDecoys", err)
+	}
+	if a.GetDecoy().GetHostname() == "" {
+		t.Fatal("GetDecoy no longer falls back to decoys in cooldown")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := a.GetDecoyErr(); err != nil {
+		t.Fatalf("cooldowns ended: %v", err)
+	}
+
+	// all blacklisted
+	for _, decoy := range decoys {
+		a.BlacklistDecoy(decoy)
+	}
+	if _, err := a.GetDecoyErr(); !errors.Is(err, ErrNoUsableDecoys) {
+		t.Fatalf("all decoys blacklisted: %v, expected ErrNoUsableDecoys", err)
+	}
+	a.UnblacklistDecoy(decoys[1])
+	if decoy, err := a.GetDecoyErr(); err != nil || decoy.GetHostname() != decoys[1].GetHostname() {
+		t.Fatalf("got %v, %v, expected the only decoy that isn't blacklisted", decoy.GetHostname(), err)
+	}
+
+	// empty list
+	a.config.DecoyList.TlsDecoys = nil
+	if _, err := a.GetDecoyErr(); !errors.Is(err, ErrNoUsableDecoys) {
+		t.Fatalf("empty decoy list: %v, expected ErrNoUsableDecoys", err)
+	}
+}
@@ -0,0 +1,43 @@
+package tapdance
+
+import (
+	"os"
+	"path"
+)
+
+// filenameLock is the file in the assets dir that processes sharing the dir
+// lock while saving the ClientConf, see SetFileLocking.
+const filenameLock = ".lock"
+
+// SetFileLocking enables advisory locking of the assets dir, for processes
+// sharing one assets dir. With it, ClientConf saves are serialized across
+// processes, and updates such as SetGeneration reload the ClientConf from disk
+// first, so they don't overwrite each other's changes. It is off by default.
+// Locking is not supported on Windows, where this has no effect.
+func (a *assets) SetFileLocking(enabled bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.fileLocking = enabled
+}
+
+// lockDir takes the assets dir lock if file locking is enabled, and returns
+// the function releasing it.
+func (a *assets) lockDir() (unlock func(), err error) {
+	if !a.fileLocking {
+		return func() {}, nil
+	}
+
+	f, err := os.OpenFile(path.Join(a.path, filenameLock), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
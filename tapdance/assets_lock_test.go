@@ -0,0 +1,83 @@
+package tapdance
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+func TestAssets_FileLocking(t *testing.T) {
+	var b bytes.Buffer
+	logHolder := bufio.NewWriter(&b)
+	oldLoggerOut := Logger().Out
+	Logger().Out = logHolder
+	defer func() {
+		Logger().Out = oldLoggerOut
+		if t.Failed() {
+			logHolder.Flush()
+			fmt.Printf("TapDance log was:\n%s\n", b.String())
+		}
+	}()
+
+	dir, err := ioutil.TempDir("/tmp/", "filelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// two instances sharing one dir stand in for two processes
+	a1 := newAssets(dir)
+	a2 := newAssets(dir)
+	a1.SetFileLocking(true)
+	a2.SetFileLocking(true)
+
+	const rounds = 50
+	var lastKey []byte
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= rounds; i++ {
+			if err := a1.SetGeneration(uint32(i)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= rounds; i++ {
+			keyType := pb.KeyType_AES_GCM_128
+			lastKey = []byte{byte(i)}
+			if err := a2.SetPubkey(&pb.PubKey{Key: lastKey, Type: &keyType}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// whichever saved last must have kept the other's latest change
+	conf, err := newAssets(dir).loadClientConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.GetGeneration() != rounds {
+		t.Fatalf("generation on disk is %v, expected %v", conf.GetGeneration(), rounds)
+	}
+	if !bytes.Equal(conf.GetDefaultPubkey().GetKey(), lastKey) {
+		t.Fatalf("pubkey on disk is %v, expected %v", conf.GetDefaultPubkey().GetKey(), lastKey)
+	}
+	if _, err := os.Stat(dir + "/" + filenameLock); err != nil {
+		t.Fatalf("lock file missing: %v", err)
+	}
+}
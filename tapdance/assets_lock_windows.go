@@ -0,0 +1,13 @@
+package tapdance
+
+import "os"
+
+// Advisory locking isn't implemented on Windows, see SetFileLocking.
+
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
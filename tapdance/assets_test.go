@@ -3,15 +3,24 @@ package tapdance
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	mrand "math/rand"
 	"net"
 	"os"
 	"path"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	pb "github.com/refraction-networking/gotapdance/protobuf"
+	ps "github.com/refraction-networking/gotapdance/tapdance/phantoms"
 )
 
 func TestAssets_Decoys(t *testing.T) {
@@ -187,3 +196,1880 @@ func TestAssets_Pubkey(t *testing.T) {
 	os.Remove(dir2)
 	AssetsSetDir(oldpath)
 }
+
+func TestAssets_WatchGeneration(t *testing.T) {
+	var b bytes.Buffer
+	logHolder := bufio.NewWriter(&b)
+	oldLoggerOut := Logger().Out
+	Logger().Out = logHolder
+	defer func() {
+		Logger().Out = oldLoggerOut
+		if t.Failed() {
+			logHolder.Flush()
+			fmt.Printf("TapDance log was:\n%s\n", b.String())
+		}
+	}()
+
+	oldpath := Assets().path
+	dir1, err := ioutil.TempDir("/tmp/", "watchgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+	AssetsSetDir(dir1)
+	defer AssetsSetDir(oldpath)
+
+	watcher := Assets().WatchGeneration()
+	newGen := Assets().GetGeneration() + 1
+	err = Assets().SetGeneration(newGen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case gen := <-watcher:
+		if gen != newGen {
+			t.Fatalf("watcher received generation %v, expected %v", gen, newGen)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watcher did not receive the generation update")
+	}
+
+	// lagging consumers only see the latest generation
+	Assets().SetGeneration(newGen + 1)
+	Assets().SetGeneration(newGen + 2)
+	if gen := <-watcher; gen != newGen+2 {
+		t.Fatalf("watcher received generation %v, expected %v", gen, newGen+2)
+	}
+
+	Assets().UnwatchGeneration(watcher)
+	if _, ok := <-watcher; ok {
+		t.Fatal("watcher channel was not closed by UnwatchGeneration")
+	}
+}
+
+func TestAssets_GenerationHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "genhistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newAssets(dir)
+	now := time.Unix(1600000000, 0)
+	a.SetClock(func() time.Time { return now })
+	if history := a.GenerationHistory(); len(history) != 0 {
+		t.Fatalf("history before any change: %v", history)
+	}
+
+	start := a.GetGeneration()
+	gens := []uint32{start + 1, start + 2, start + 2, start + 1}
+	for _, gen := range gens {
+		now = now.Add(time.Minute)
+		if err = a.SetGeneration(gen); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// setting the same generation again isn't a change
+	expected := []GenChange{
+		{Time: time.Unix(1600000060, 0), OldGen: start, NewGen: start + 1},
+		{Time: time.Unix(1600000120, 0), OldGen: start + 1, NewGen: start + 2},
+		{Time: time.Unix(1600000240, 0), OldGen: start + 2, NewGen: start + 1},
+	}
+	if history := a.GenerationHistory(); !reflect.DeepEqual(history, expected) {
+		t.Fatalf("history %v, expected %v", history, expected)
+	}
+
+	// only the latest changes are kept
+	for i := 0; i < maxGenerationHistory+5; i++ {
+		if err = a.SetGeneration(start + 10 + uint32(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history := a.GenerationHistory()
+	if len(history) != maxGenerationHistory {
+		t.Fatalf("%d changes kept, expected %d", len(history), maxGenerationHistory)
+	}
+	last := start + 10 + maxGenerationHistory + 4
+	if history[len(history)-1].NewGen != last || history[0].NewGen != last-maxGenerationHistory+1 {
+		t.Fatalf("kept changes from %v to %v", history[0], history[len(history)-1])
+	}
+	for i := 1; i < len(history); i++ {
+		if history[i].OldGen != history[i-1].NewGen {
+			t.Fatalf("history out of order at %d: %v", i, history)
+		}
+	}
+}
+
+func TestAssets_CompareAndSetGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "casgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newAssets(dir)
+	if err = a.SetGeneration(10); err != nil {
+		t.Fatal(err)
+	}
+	if swapped, err := a.CompareAndSetGeneration(9, 11); err != nil {
+		t.Fatal(err)
+	} else if swapped || a.GetGeneration() != 10 {
+		t.Fatalf("swapped from a stale generation: swapped %v, generation %d", swapped, a.GetGeneration())
+	}
+
+	// contending updaters each try to bump the generation they read; every
+	// bump must be applied exactly once
+	const bumps = 50
+	var wg sync.WaitGroup
+	var swaps [2]int
+	for i := range swaps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				gen := a.GetGeneration()
+				if gen >= 10+bumps {
+					return
+				}
+				swapped, err := a.CompareAndSetGeneration(gen, gen+1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if swapped {
+					swaps[i]++
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if swaps[0]+swaps[1] != bumps || a.GetGeneration() != 10+bumps {
+		t.Fatalf("%d + %d swaps left generation %d, expected %d swaps and generation %d",
+			swaps[0], swaps[1], a.GetGeneration(), bumps, 10+bumps)
+	}
+
+	reloaded := newAssets(dir)
+	reloaded.readConfigs()
+	if reloaded.GetGeneration() != 10+bumps {
+		t.Fatalf("stored generation %d, expected %d", reloaded.GetGeneration(), 10+bumps)
+	}
+}
+
+func TestAssets_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "readonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newAssets(dir)
+	if err = a.SetGeneration(5); err != nil {
+		t.Fatal(err)
+	}
+	a.SetReadOnly(true)
+	before := proto.Clone(a.GetClientConfPtr())
+	confBefore, err := ioutil.ReadFile(path.Join(dir, "ClientConf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootsPEM, err := ioutil.ReadFile("../assets/roots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoys := []*pb.TLSDecoySpec{pb.InitTLSDecoySpec("0.1.2.3", "whatever.cn")}
+	decoysFile := path.Join(dir, "decoys")
+	buf, err := proto.Marshal(&pb.DecoyList{TlsDecoys: decoys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(decoysFile, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, mutate := range map[string]func() error{
+		"SetClientConf": func() error { return a.SetClientConf(&pb.ClientConf{}) },
+		"SetDecoys":     func() error { return a.SetDecoys(decoys) },
+		"SetGeneration": func() error { return a.SetGeneration(6) },
+		"CompareAndSetGeneration": func() error {
+			_, err := a.CompareAndSetGeneration(5, 6)
+			return err
+		},
+		"SetPubkey": func() error { return a.SetPubkey(&pb.PubKey{Key: make([]byte, 32)}) },
+		"SetAssets": func() error { return a.SetAssets(before.(*pb.ClientConf), rootsPEM) },
+		"AddDecoysFromFile": func() error {
+			_, err := a.AddDecoysFromFile(decoysFile)
+			return err
+		},
+		"SetDecoysFromFile":     func() error { return a.SetDecoysFromFile(decoysFile) },
+		"SetPreferredTransport": func() error { return a.SetPreferredTransport("min") },
+		"saveClientConf":        a.saveClientConf,
+		"Update":                func() error { return a.Update(func(*pb.ClientConf) error { return nil }) },
+	} {
+		if err := mutate(); err != ErrReadOnly {
+			t.Fatalf("%s: got error %v, expected ErrReadOnly", name, err)
+		}
+	}
+
+	if !proto.Equal(a.GetClientConfPtr(), before) {
+		t.Fatal("read-only ClientConf was changed")
+	}
+	if confAfter, err := ioutil.ReadFile(path.Join(dir, "ClientConf")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(confAfter, confBefore) {
+		t.Fatal("read-only ClientConf file was changed")
+	}
+	if a.GetGeneration() != 5 || a.GetPreferredTransport() != "" {
+		t.Fatalf("reads returned generation %d, transport %q", a.GetGeneration(), a.GetPreferredTransport())
+	}
+
+	a.SetReadOnly(false)
+	if err = a.SetGeneration(6); err != nil || a.GetGeneration() != 6 {
+		t.Fatalf("writable again: got error %v, generation %d", err, a.GetGeneration())
+	}
+}
+
+func TestAssets_Update(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newAssets(dir)
+	if err = a.SetGeneration(1); err != nil {
+		t.Fatal(err)
+	}
+	confFile := path.Join(dir, "ClientConf")
+	saved, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := a.WatchGeneration()
+	defer a.UnwatchGeneration(watcher)
+
+	decoys := []*pb.TLSDecoySpec{pb.InitTLSDecoySpec("0.1.2.3", "whatever.cn")}
+	pubkey := &pb.PubKey{Key: bytes.Repeat([]byte{7}, 32)}
+	err = a.Update(func(conf *pb.ClientConf) error {
+		conf.DecoyList.TlsDecoys = decoys
+		conf.DefaultPubkey = pubkey
+		gen := uint32(2)
+		conf.Generation = &gen
+
+		// nothing is saved or visible before fn returns
+		if onDisk, err := ioutil.ReadFile(confFile); err != nil || !bytes.Equal(onDisk, saved) {
+			t.Errorf("ClientConf saved during the update (%v)", err)
+		}
+		if a.config.GetGeneration() != 1 || len(a.config.GetDecoyList().GetTlsDecoys()) == 1 {
+			t.Error("ClientConf changed during the update")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.GetGeneration() != 2 || len(a.GetAllDecoys()) != 1 || !bytes.Equal(a.GetPubkey()[:], pubkey.Key) {
+		t.Fatalf("update not applied: %v", a.GetClientConfPtr())
+	}
+	if gen := <-watcher; gen != 2 {
+		t.Fatalf("watcher received generation %d, expected 2", gen)
+	}
+	select {
+	case gen := <-watcher:
+		t.Fatalf("watcher received a second generation %d", gen)
+	default:
+	}
+	reloaded := newAssets(dir)
+	reloaded.readConfigs()
+	if !proto.Equal(reloaded.GetClientConfPtr(), a.GetClientConfPtr()) {
+		t.Fatalf("stored %v, expected %v", reloaded.GetClientConfPtr(), a.GetClientConfPtr())
+	}
+
+	// failing and invalid updates leave everything as it was
+	before := proto.Clone(a.GetClientConfPtr())
+	errFn := errors.New("fn failed")
+	if err = a.Update(func(conf *pb.ClientConf) error {
+		conf.DecoyList.TlsDecoys = nil
+		return errFn
+	}); err != errFn {
+		t.Fatalf("got error %v, expected %v", err, errFn)
+	}
+	if err = a.Update(func(conf *pb.ClientConf) error {
+		conf.DecoyList.TlsDecoys = nil
+		return nil
+	}); err == nil || !strings.Contains(err.Error(), "no decoys") {
+		t.Fatalf("update without decoys: got error %v", err)
+	}
+	if !proto.Equal(a.GetClientConfPtr(), before) {
+		t.Fatal("ClientConf changed by failed updates")
+	}
+	reloaded.readConfigs()
+	if !proto.Equal(reloaded.GetClientConfPtr(), before) {
+		t.Fatal("stored ClientConf changed by failed updates")
+	}
+}
+
+func TestAssets_IPv6Available(t *testing.T) {
+	var b bytes.Buffer
+	oldLoggerOut := Logger().Out
+	Logger().Out = &b
+	defer func() { Logger().Out = oldLoggerOut }()
+
+	a := newAssets("")
+	v6Only := pb.InitTLSDecoySpec("2001:48a8:687f:1::1", "v6only")
+	dualStack := pb.InitTLSDecoySpec("192.122.190.2", "dualstack")
+	dualStack.Ipv6Addr = net.ParseIP("2001:48a8:687f:1::2")
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{
+		v6Only,
+		pb.InitTLSDecoySpec("192.122.190.1", "v4only"),
+		dualStack,
+	}
+	a.SetRandSource(mrand.New(mrand.NewSource(1)))
+
+	selected := func() map[string]bool {
+		hostnames := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			hostnames[a.GetDecoy().GetHostname()] = true
+			sni, _ := a.GetDecoyAddress()
+			hostnames[sni] = true
+		}
+		return hostnames
+	}
+
+	if !selected()["v6only"] {
+		t.Fatal("IPv6 only decoy not selected while IPv6 is available")
+	}
+
+	a.SetIPv6Available(false)
+	if hostnames := selected(); hostnames["v6only"] || len(hostnames) != 2 {
+		t.Fatalf("selected %v without IPv6, expected v4only and dualstack", hostnames)
+	}
+
+	// with only IPv6 only decoys left, they are used anyway
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{v6Only}
+	if hostnames := selected(); !hostnames["v6only"] {
+		t.Fatalf("selected %v without IPv4 decoys, expected v6only", hostnames)
+	}
+	if !strings.Contains(b.String(), "no decoys with an IPv4 address") {
+		t.Fatalf("no warning logged: %s", b.String())
+	}
+
+	a.SetIPv6Available(true)
+	if a.ipv6Unavailable {
+		t.Fatal("IPv6 still unavailable")
+	}
+}
+
+func TestAssets_Info(t *testing.T) {
+	dir1, err := ioutil.TempDir("/tmp/", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+
+	a := newAssets(dir1)
+	info := a.AssetsInfo()
+	if info.ClientConfPath != path.Join(dir1, "ClientConf") {
+		t.Fatalf("unexpected ClientConf path %v", info.ClientConfPath)
+	}
+	if !info.ClientConfModTime.IsZero() || !info.RootsModTime.IsZero() {
+		t.Fatalf("expected zero mod times for memory-only assets, got %v", info)
+	}
+
+	err = a.saveClientConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info = a.AssetsInfo()
+	if info.ClientConfModTime.IsZero() {
+		t.Fatal("ClientConf mod time is zero after save")
+	}
+	if !info.RootsModTime.IsZero() {
+		t.Fatal("roots mod time is non-zero, but no roots file exists")
+	}
+}
+
+func TestAssets_RandSource(t *testing.T) {
+	var testDecoys = []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("0.1.2.3", "whatever.cn"),
+		pb.InitTLSDecoySpec("255.254.253.252", "particular.ir"),
+		pb.InitTLSDecoySpec("11.22.33.44", "what.is.up"),
+		pb.InitTLSDecoySpec("8.255.255.8", "heh.meh"),
+	}
+
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = testDecoys
+	a.SetRandSource(mrand.New(mrand.NewSource(1337)))
+
+	expected := mrand.New(mrand.NewSource(1337))
+	for i := 0; i < 20; i++ {
+		want := testDecoys[expected.Intn(len(testDecoys))]
+		if i%2 == 0 {
+			got := a.GetDecoy()
+			if got.GetHostname() != want.GetHostname() {
+				t.Fatalf("selection %d: got %v, expected %v", i, got.GetHostname(), want.GetHostname())
+			}
+		} else {
+			sni, _ := a.GetDecoyAddress()
+			if sni != want.GetHostname() {
+				t.Fatalf("selection %d: got %v, expected %v", i, sni, want.GetHostname())
+			}
+		}
+	}
+}
+
+func TestAssets_GetDecoyByIndex(t *testing.T) {
+	var testDecoys = []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("11.22.33.44", "what.is.up"),
+		pb.InitTLSDecoySpec("0.1.2.3", "whatever.cn"),
+		pb.InitTLSDecoySpec("8.255.255.8", "heh.meh"),
+	}
+
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = testDecoys
+
+	expectedOrder := []string{"heh.meh", "what.is.up", "whatever.cn"}
+	for i, hostname := range expectedOrder {
+		decoy, ok := a.GetDecoyByIndex(i)
+		if !ok {
+			t.Fatalf("index %d reported out of range", i)
+		}
+		if decoy.GetHostname() != hostname {
+			t.Fatalf("index %d: got %v, expected %v", i, decoy.GetHostname(), hostname)
+		}
+		if decoy.GetTimeout() < timeoutMin || decoy.GetTcpwin() < sendLimitMin {
+			t.Fatalf("index %d: defaults were not applied: %v", i, decoy)
+		}
+	}
+	if testDecoys[0].Timeout != nil {
+		t.Fatal("GetDecoyByIndex modified the stored decoy")
+	}
+
+	for _, i := range []int{-1, len(testDecoys), len(testDecoys) + 10} {
+		if _, ok := a.GetDecoyByIndex(i); ok {
+			t.Fatalf("index %d reported in range", i)
+		}
+	}
+}
+
+func TestAssets_DecoyIPOverrides(t *testing.T) {
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("11.22.33.44", "what.is.up"),
+	}
+	a.SetDecoyIPOverrides(map[string]string{
+		"what.is.up":   "127.0.0.1",
+		"not.a.decoy":  "127.0.0.2",
+		"bad.override": "not-an-ip",
+	})
+
+	sni, addr := a.GetDecoyAddress()
+	if sni != "what.is.up" {
+		t.Fatalf("SNI was not preserved: %v", sni)
+	}
+	if addr != "127.0.0.1:443" {
+		t.Fatalf("override was not applied: %v", addr)
+	}
+
+	a.SetDecoyIPOverrides(nil)
+	_, addr = a.GetDecoyAddress()
+	if addr != "11.22.33.44:443" {
+		t.Fatalf("override was not removed: %v", addr)
+	}
+}
+
+func TestAssets_EncryptedClientConf(t *testing.T) {
+	dir1, err := ioutil.TempDir("/tmp/", "encconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+
+	key := []byte("0123456789abcdef")
+	gen := uint32(77)
+
+	a := newAssets(dir1)
+	err = a.SetConfigEncryptionKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.SetGeneration(gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk, err := ioutil.ReadFile(path.Join(dir1, a.filenameClientConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(onDisk, encryptedConfMagic) {
+		t.Fatal("ClientConf was not encrypted on disk")
+	}
+	if bytes.Contains(onDisk, []byte("freeaeskey")) {
+		t.Fatal("encrypted ClientConf leaks decoy hostnames")
+	}
+
+	// round trip with the right key
+	b := newAssets(dir1)
+	b.SetConfigEncryptionKey(key)
+	b.config = &pb.ClientConf{}
+	b.readConfigs()
+	if b.GetGeneration() != gen {
+		t.Fatalf("decrypted generation %v, expected %v", b.GetGeneration(), gen)
+	}
+
+	// wrong key and missing key leave the config untouched
+	for _, wrongKey := range [][]byte{[]byte("fedcba9876543210"), nil} {
+		c := newAssets(dir1)
+		c.SetConfigEncryptionKey(wrongKey)
+		c.config = &pb.ClientConf{}
+		c.readConfigs()
+		if c.GetGeneration() == gen {
+			t.Fatalf("ClientConf was read with key %v", wrongKey)
+		}
+	}
+
+	// plaintext configs still load with a key set
+	plain := newAssets(dir1)
+	err = plain.SetGeneration(gen + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newAssets(dir1)
+	d.SetConfigEncryptionKey(key)
+	d.config = &pb.ClientConf{}
+	d.readConfigs()
+	if d.GetGeneration() != gen+1 {
+		t.Fatalf("plaintext generation %v, expected %v", d.GetGeneration(), gen+1)
+	}
+
+	if err = a.SetConfigEncryptionKey([]byte("short")); err == nil {
+		t.Fatal("short key was accepted")
+	}
+}
+
+func TestAssets_MigrateClientConf(t *testing.T) {
+	gen := uint32(5)
+	oldDecoy := &pb.TLSDecoySpec{
+		Hostname: proto.String("old.decoy"),
+		Ipv6Addr: net.ParseIP("10.11.12.13").To16(),
+	}
+	v6Decoy := pb.InitTLSDecoySpec("2001:db8::1", "v6.decoy")
+	oldConf := &pb.ClientConf{
+		Generation: &gen,
+		DecoyList:  &pb.DecoyList{TlsDecoys: []*pb.TLSDecoySpec{oldDecoy, v6Decoy}},
+	}
+
+	migrated, changed := migrateClientConf(oldConf)
+	if !changed {
+		t.Fatal("old ClientConf was not migrated")
+	}
+	decoys := migrated.GetDecoyList().GetTlsDecoys()
+	if decoys[0].GetIpAddrStr() != "10.11.12.13:443" || decoys[0].Ipv6Addr != nil {
+		t.Fatalf("mapped IPv4 decoy was not migrated: %v", decoys[0])
+	}
+	if !proto.Equal(decoys[1], v6Decoy) {
+		t.Fatalf("IPv6 decoy was changed by migration: %v", decoys[1])
+	}
+	if oldConf.GetDecoyList().GetTlsDecoys()[0].Ipv4Addr != nil {
+		t.Fatal("migration modified its input")
+	}
+
+	again, changed := migrateClientConf(migrated)
+	if changed || again != migrated {
+		t.Fatal("migration is not idempotent")
+	}
+
+	dir1, err := ioutil.TempDir("/tmp/", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+	a := newAssets(dir1)
+	a.config = oldConf
+	if err = a.saveClientConf(); err != nil {
+		t.Fatal(err)
+	}
+	b := newAssets(dir1)
+	b.readConfigs()
+	if !b.IsDecoyInList(pb.InitTLSDecoySpec("10.11.12.13", "old.decoy")) {
+		t.Fatal("migrated decoy not found after load")
+	}
+	onDisk, err := ioutil.ReadFile(path.Join(dir1, b.filenameClientConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedConf, err := parseClientConf(onDisk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(savedConf, b.config) {
+		t.Fatal("migrated ClientConf was not saved")
+	}
+}
+
+func TestAssets_CustomDefaults(t *testing.T) {
+	dir1, err := ioutil.TempDir("/tmp/", "defaults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+
+	customDecoy := pb.InitTLSDecoySpec("10.20.30.40", "private.decoy")
+	customKeyType := pb.KeyType_AES_GCM_128
+	customKey := bytes.Repeat([]byte{7}, 32)
+	SetDefaultDecoys([]*pb.TLSDecoySpec{customDecoy})
+	SetDefaultPubkey(pb.PubKey{Key: customKey, Type: &customKeyType})
+	defer SetDefaultDecoys(nil)
+	defer SetDefaultPubkey(pb.PubKey{})
+
+	a := newAssets(dir1)
+	a.readConfigs()
+	if len(a.config.GetDecoyList().GetTlsDecoys()) != 1 || !a.IsDecoyInList(customDecoy) {
+		t.Fatalf("custom default decoys were not used: %v", a.config.GetDecoyList())
+	}
+	if pubkey := a.GetPubkey(); !bytes.Equal(pubkey[:], customKey) {
+		t.Fatalf("custom default pubkey was not used: %v", pubkey)
+	}
+
+	// a config file on disk still wins over the custom defaults
+	fileDecoy := pb.InitTLSDecoySpec("1.2.3.4", "file.decoy")
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{fileDecoy}
+	if err = a.saveClientConf(); err != nil {
+		t.Fatal(err)
+	}
+	b := newAssets(dir1)
+	b.readConfigs()
+	if b.IsDecoyInList(customDecoy) || !b.IsDecoyInList(fileDecoy) {
+		t.Fatalf("custom defaults overrode the config file: %v", b.config.GetDecoyList())
+	}
+
+	SetDefaultDecoys(nil)
+	SetDefaultPubkey(pb.PubKey{})
+	c := newAssets("")
+	if c.IsDecoyInList(customDecoy) {
+		t.Fatal("built-in defaults were not restored")
+	}
+	if pubkey := c.GetPubkey(); !bytes.Equal(pubkey[:], getDefaultKey()) {
+		t.Fatal("built-in pubkey was not restored")
+	}
+}
+
+func TestAssets_SetDefaultStationKey(t *testing.T) {
+	if err := SetDefaultStationKey(bytes.Repeat([]byte{9}, 16)); err == nil {
+		t.Fatal("16 byte station key accepted")
+	}
+
+	dir, err := ioutil.TempDir("/tmp/", "stationkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// already initialized assets switch to the new fallback and store it
+	initialized := newAssets(dir)
+	oldInstance := assetsInstance
+	assetsInstance = initialized
+	defer func() { assetsInstance = oldInstance }()
+
+	stationKey := bytes.Repeat([]byte{9}, 32)
+	if err := SetDefaultStationKey(stationKey); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDefaultStationKey(nil)
+	if pubkey := initialized.GetPubkey(); !bytes.Equal(pubkey[:], stationKey) {
+		t.Fatalf("initialized assets kept the old station key: %v", pubkey)
+	}
+	reloaded := newAssets(dir)
+	reloaded.readConfigs()
+	if pubkey := reloaded.GetPubkey(); !bytes.Equal(pubkey[:], stationKey) {
+		t.Fatalf("station key not stored to disk: %v", pubkey)
+	}
+
+	// a ClientConf read from a file keeps its pubkey, even the old fallback
+	assetsInstance = reloaded
+	if err := SetDefaultStationKey(bytes.Repeat([]byte{7}, 32)); err != nil {
+		t.Fatal(err)
+	} else if pubkey := reloaded.GetPubkey(); !bytes.Equal(pubkey[:], stationKey) {
+		t.Fatalf("pubkey of a ClientConf file replaced by %v", pubkey)
+	}
+	if err := SetDefaultStationKey(stationKey); err != nil {
+		t.Fatal(err)
+	}
+	assetsInstance = initialized
+
+	// read-only assets keep their key, and so does the fallback
+	initialized.SetReadOnly(true)
+	if err := SetDefaultStationKey(bytes.Repeat([]byte{8}, 32)); err != ErrReadOnly {
+		t.Fatalf("changed the station key of read-only assets: %v", err)
+	} else if pubkey := initialized.GetPubkey(); !bytes.Equal(pubkey[:], stationKey) {
+		t.Fatalf("read-only assets switched to station key %v", pubkey)
+	} else if pubkey := newAssets("").GetPubkey(); !bytes.Equal(pubkey[:], stationKey) {
+		t.Fatalf("refused station key used as the fallback: %v", pubkey)
+	}
+	initialized.SetReadOnly(false)
+
+	// the override is used when the ClientConf has no default pubkey
+	a := newAssets("")
+	if pubkey := a.GetPubkey(); !bytes.Equal(pubkey[:], stationKey) {
+		t.Fatalf("station key override not used by default: %v", pubkey)
+	}
+	a.config.DefaultPubkey = nil
+	if pubkey := a.GetPubkey(); !bytes.Equal(pubkey[:], stationKey) {
+		t.Fatalf("station key override not used without a default pubkey: %v", pubkey)
+	}
+
+	// but not instead of a configured pubkey
+	configuredKey := bytes.Repeat([]byte{3}, 32)
+	keyType := pb.KeyType_AES_GCM_128
+	a.config.DefaultPubkey = &pb.PubKey{Key: configuredKey, Type: &keyType}
+	if pubkey := a.GetPubkey(); !bytes.Equal(pubkey[:], configuredKey) {
+		t.Fatalf("station key override replaced the configured pubkey: %v", pubkey)
+	}
+
+	if err := SetDefaultStationKey(nil); err != nil {
+		t.Fatal(err)
+	}
+	if pubkey := newAssets("").GetPubkey(); !bytes.Equal(pubkey[:], getDefaultKey()) {
+		t.Fatal("built-in station key was not restored")
+	}
+}
+
+func TestAssets_DecoyScorer(t *testing.T) {
+	var testDecoys = []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("0.1.2.3", "whatever.cn"),
+		pb.InitTLSDecoySpec("255.254.253.252", "particular.ir"),
+		pb.InitTLSDecoySpec("11.22.33.44", "what.is.up"),
+		pb.InitTLSDecoySpec("8.255.255.8", "heh.meh"),
+	}
+	rtts := map[string]float64{
+		"whatever.cn":   120,
+		"particular.ir": 30,
+		"what.is.up":    80,
+		"heh.meh":       30,
+	}
+
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = testDecoys
+
+	// without a scorer selection is random, but still distinct
+	top := a.GetTopNDecoys(len(testDecoys) + 1)
+	if len(top) != len(testDecoys) {
+		t.Fatalf("expected %d decoys, got %d", len(testDecoys), len(top))
+	}
+	seen := make(map[string]bool)
+	for _, decoy := range top {
+		if seen[decoy.GetHostname()] {
+			t.Fatalf("decoy %v returned twice", decoy.GetHostname())
+		}
+		seen[decoy.GetHostname()] = true
+	}
+
+	a.SetDecoyScorer(func(decoy *pb.TLSDecoySpec) float64 {
+		return -rtts[decoy.GetHostname()]
+	})
+	if best := a.GetBestDecoy(); best.GetHostname() != "particular.ir" {
+		t.Fatalf("best decoy is %v, expected particular.ir", best.GetHostname())
+	}
+	expectedOrder := []string{"particular.ir", "heh.meh", "what.is.up"}
+	top = a.GetTopNDecoys(3)
+	for i, hostname := range expectedOrder {
+		if top[i].GetHostname() != hostname {
+			t.Fatalf("rank %d: got %v, expected %v", i, top[i].GetHostname(), hostname)
+		}
+	}
+	if len(a.GetTopNDecoys(0)) != 0 {
+		t.Fatal("GetTopNDecoys(0) returned decoys")
+	}
+
+	// the decoys returned are copies
+	a.GetBestDecoy().Hostname = proto.String("changed")
+	a.GetTopNDecoys(1)[0].Hostname = proto.String("changed")
+	if testDecoys[1].GetHostname() != "particular.ir" {
+		t.Fatalf("changing the best decoy renamed the decoy list entry to %v", testDecoys[1].GetHostname())
+	}
+}
+
+func TestAssets_GetPhantomSubnets(t *testing.T) {
+	var b bytes.Buffer
+	logHolder := bufio.NewWriter(&b)
+	oldLoggerOut := Logger().Out
+	Logger().Out = logHolder
+	defer func() {
+		Logger().Out = oldLoggerOut
+		if t.Failed() {
+			logHolder.Flush()
+			fmt.Printf("TapDance log was:\n%s\n", b.String())
+		}
+	}()
+
+	dir, err := ioutil.TempDir("/tmp/", "phantoms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newAssets(dir)
+	if _, err := a.GetPhantomSubnets(); err != ps.ErrNoPhantomSubnets {
+		t.Fatalf("ClientConf without phantoms: got error %v, expected %v", err, ps.ErrNoPhantomSubnets)
+	}
+
+	gen := uint32(1234)
+	blocks := []string{"192.122.190.0/24", "2001:48a8:687f:1::/64"}
+	err = a.SetClientConf(&pb.ClientConf{
+		Generation:      &gen,
+		DarkDecoyBlocks: &pb.DarkDecoyBlocks{Blocks: blocks},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnets, err := a.GetPhantomSubnets()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(subnets.WeightedSubnets) != 1 || strings.Join(subnets.WeightedSubnets[0].Subnets, ",") != strings.Join(blocks, ",") {
+		t.Fatalf("got phantom subnets %+v, expected %v", subnets.WeightedSubnets, blocks)
+	}
+
+	// a reload from disk is reflected too
+	reloaded := newAssets(dir)
+	reloaded.readConfigs()
+	subnets, err = reloaded.GetPhantomSubnets()
+	if err != nil {
+		t.Fatal(err)
+	} else if strings.Join(subnets.WeightedSubnets[0].Subnets, ",") != strings.Join(blocks, ",") {
+		t.Fatalf("reloaded phantom subnets %+v, expected %v", subnets.WeightedSubnets, blocks)
+	}
+}
+
+func TestAssets_GetDecoyFromSeed(t *testing.T) {
+	var testDecoys = []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("0.1.2.3", "whatever.cn"),
+		pb.InitTLSDecoySpec("255.254.253.252", "particular.ir"),
+		pb.InitTLSDecoySpec("11.22.33.44", "what.is.up"),
+		pb.InitTLSDecoySpec("8.255.255.8", "heh.meh"),
+	}
+
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = testDecoys
+
+	seen := make(map[string]bool)
+	for i := 0; i < 64; i++ {
+		seed := []byte(fmt.Sprintf("seedseedseedse%02d", i))
+		decoy, ok := a.GetDecoyFromSeed(seed)
+		if !ok {
+			t.Fatal("no decoy selected")
+		}
+		again, _ := a.GetDecoyFromSeed(seed)
+		if decoy.GetHostname() != again.GetHostname() {
+			t.Fatalf("same seed selected %v then %v", decoy.GetHostname(), again.GetHostname())
+		}
+		if decoy.GetTimeout() < timeoutMin || decoy.GetTcpwin() < sendLimitMin {
+			t.Fatalf("decoy defaults not applied: %v", decoy.String())
+		}
+		seen[decoy.GetHostname()] = true
+	}
+	if len(seen) != len(testDecoys) {
+		t.Fatalf("64 seeds selected only %d of %d decoys", len(seen), len(testDecoys))
+	}
+
+	// reordering the ClientConf doesn't change the choice
+	seed := []byte("seedseedseedseed")
+	before, _ := a.GetDecoyFromSeed(seed)
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{testDecoys[3], testDecoys[1], testDecoys[0], testDecoys[2]}
+	after, _ := a.GetDecoyFromSeed(seed)
+	if before.GetHostname() != after.GetHostname() {
+		t.Fatalf("reordered decoys selected %v, expected %v", after.GetHostname(), before.GetHostname())
+	}
+
+	a.config.DecoyList.TlsDecoys = nil
+	if _, ok := a.GetDecoyFromSeed(seed); ok {
+		t.Fatal("decoy selected from an empty list")
+	}
+}
+
+func TestAssets_PreferredTransport(t *testing.T) {
+	var b bytes.Buffer
+	logHolder := bufio.NewWriter(&b)
+	oldLoggerOut := Logger().Out
+	Logger().Out = logHolder
+	defer func() {
+		Logger().Out = oldLoggerOut
+		if t.Failed() {
+			logHolder.Flush()
+			fmt.Printf("TapDance log was:\n%s\n", b.String())
+		}
+	}()
+
+	dir, err := ioutil.TempDir("/tmp/", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newAssets(dir)
+	a.readConfigs()
+	if transport := a.GetPreferredTransport(); transport != "" {
+		t.Fatalf("default preferred transport is %q, expected automatic", transport)
+	}
+
+	if err = a.SetPreferredTransport("obfs4"); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newAssets(dir)
+	reloaded.readConfigs()
+	if transport := reloaded.GetPreferredTransport(); transport != "obfs4" {
+		t.Fatalf("reloaded preferred transport is %q, expected obfs4", transport)
+	}
+
+	if err = reloaded.SetPreferredTransport(""); err != nil {
+		t.Fatal(err)
+	}
+	reloaded = newAssets(dir)
+	reloaded.readConfigs()
+	if transport := reloaded.GetPreferredTransport(); transport != "" {
+		t.Fatalf("reset preferred transport reloaded as %q", transport)
+	}
+}
+
+func TestAssets_TransportMode(t *testing.T) {
+	newDecoys := func() []*pb.TLSDecoySpec {
+		timeout := uint32(1)
+		tcpwin := uint32(1)
+		decoy := pb.InitTLSDecoySpec("11.22.33.44", "what.is.up")
+		decoy.Timeout = &timeout
+		decoy.Tcpwin = &tcpwin
+		return []*pb.TLSDecoySpec{decoy}
+	}
+
+	a := newAssets("")
+	if a.GetTransportMode() != TapdanceMode {
+		t.Fatal("default transport mode is not TapdanceMode")
+	}
+
+	a.config.DecoyList.TlsDecoys = newDecoys()
+	a.SetTransportMode(ConjureMode)
+	decoy := a.GetDecoy()
+	if decoy.GetHostname() != "what.is.up" {
+		t.Fatalf("got decoy %v, expected what.is.up", decoy.GetHostname())
+	} else if decoy.GetTimeout() != 1 || decoy.GetTcpwin() != 1 {
+		t.Fatalf("Conjure decoy clamped to timeout %v, tcpwin %v", decoy.GetTimeout(), decoy.GetTcpwin())
+	}
+
+	a.SetTransportMode(TapdanceMode)
+	decoy = a.GetDecoy()
+	if decoy.GetTimeout() < timeoutMin || decoy.GetTcpwin() < sendLimitMin {
+		t.Fatalf("Tapdance decoy not clamped: timeout %v, tcpwin %v", decoy.GetTimeout(), decoy.GetTcpwin())
+	}
+
+	// clamping for Tapdance leaves the configured decoy alone, so Conjure
+	// still gets it as configured afterwards
+	if configured := a.config.DecoyList.TlsDecoys[0]; configured.GetTimeout() != 1 || configured.GetTcpwin() != 1 {
+		t.Fatalf("ClientConf decoy clamped to timeout %v, tcpwin %v", configured.GetTimeout(), configured.GetTcpwin())
+	}
+	a.SetTransportMode(ConjureMode)
+	decoy = a.GetDecoy()
+	if decoy.GetTimeout() != 1 || decoy.GetTcpwin() != 1 {
+		t.Fatalf("Conjure decoy after Tapdance clamped to timeout %v, tcpwin %v", decoy.GetTimeout(), decoy.GetTcpwin())
+	}
+}
+
+func TestAssets_GetDecoyListCopy(t *testing.T) {
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("11.22.33.44", "what.is.up"),
+		pb.InitTLSDecoySpec("8.255.255.8", "heh.meh"),
+	}
+
+	list := a.GetDecoyListCopy()
+	if !proto.Equal(list, a.config.DecoyList) {
+		t.Fatalf("copy %v differs from %v", list, a.config.DecoyList)
+	}
+	hostname := "changed.example"
+	list.TlsDecoys[0].Hostname = &hostname
+	list.TlsDecoys = list.TlsDecoys[:1]
+	if len(a.config.DecoyList.TlsDecoys) != 2 || a.config.DecoyList.TlsDecoys[0].GetHostname() != "what.is.up" {
+		t.Fatalf("modifying the copy changed the ClientConf: %v", a.config.DecoyList)
+	}
+
+	a.config.DecoyList = nil
+	if list := a.GetDecoyListCopy(); list == nil || len(list.GetTlsDecoys()) != 0 {
+		t.Fatalf("ClientConf without decoy list: got %v", list)
+	}
+}
+
+func TestAssets_AddDecoysFromFile(t *testing.T) {
+	var b bytes.Buffer
+	logHolder := bufio.NewWriter(&b)
+	oldLoggerOut := Logger().Out
+	Logger().Out = logHolder
+	defer func() {
+		Logger().Out = oldLoggerOut
+		if t.Failed() {
+			logHolder.Flush()
+			fmt.Printf("TapDance log was:\n%s\n", b.String())
+		}
+	}()
+
+	dir, err := ioutil.TempDir("/tmp/", "decoys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newAssets(dir)
+	err = a.SetDecoys([]*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("11.22.33.44", "what.is.up"),
+		pb.InitTLSDecoySpec("8.255.255.8", "heh.meh"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	supplemental := []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("8.255.255.8", "heh.meh"),
+		pb.InitTLSDecoySpec("8.255.255.9", "heh.meh"),
+		pb.InitTLSDecoySpec("0.1.2.3", "whatever.cn"),
+		pb.InitTLSDecoySpec("0.1.2.3", "whatever.cn"),
+	}
+	confFile := path.Join(dir, "supplemental.conf")
+	buf, err := proto.Marshal(&pb.ClientConf{DecoyList: &pb.DecoyList{TlsDecoys: supplemental}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(confFile, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	added, err := a.AddDecoysFromFile(confFile)
+	if err != nil {
+		t.Fatal(err)
+	} else if added != 2 {
+		t.Fatalf("added %d decoys, expected 2", added)
+	}
+	if decoys := a.GetAllDecoys(); len(decoys) != 4 {
+		t.Fatalf("expected 4 decoys after adding, got %d", len(decoys))
+	}
+
+	// it was stored to disk
+	reloaded := newAssets(dir)
+	reloaded.readConfigs()
+	if decoys := reloaded.GetAllDecoys(); len(decoys) != 4 {
+		t.Fatalf("expected 4 decoys after reload, got %d", len(decoys))
+	}
+
+	// a bare DecoyList works too
+	listFile := path.Join(dir, "supplemental.list")
+	buf, err = proto.Marshal(&pb.DecoyList{TlsDecoys: []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("0.1.2.3", "whatever.cn"),
+		pb.InitTLSDecoySpec("255.254.253.252", "particular.ir"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(listFile, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	added, err = a.AddDecoysFromFile(listFile)
+	if err != nil {
+		t.Fatal(err)
+	} else if added != 1 {
+		t.Fatalf("added %d decoys from DecoyList, expected 1", added)
+	}
+
+	// decoys that can't be stored aren't added
+	extraFile := path.Join(dir, "extra.list")
+	buf, err = proto.Marshal(&pb.DecoyList{TlsDecoys: []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("8.8.4.4", "extra.decoy"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(extraFile, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	a.path = path.Join(dir, "missing")
+	if _, err = a.AddDecoysFromFile(extraFile); err == nil {
+		t.Fatal("added decoys to an assets dir that doesn't exist")
+	} else if decoys := a.GetAllDecoys(); len(decoys) != 5 {
+		t.Fatalf("expected 5 decoys after a failed save, got %d", len(decoys))
+	}
+	a.path = dir
+
+	garbage := path.Join(dir, "garbage")
+	if err = ioutil.WriteFile(garbage, []byte{0xff, 0xff, 0xff}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.AddDecoysFromFile(garbage); err == nil {
+		t.Fatal("malformed decoy file accepted")
+	}
+}
+
+func TestAssets_SetDecoysFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "setdecoys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newAssets(dir)
+
+	// a bare DecoyList replaces the decoys, duplicates and all
+	listFile := path.Join(dir, "decoys.list")
+	buf, err := proto.Marshal(&pb.DecoyList{TlsDecoys: []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("0.1.2.3", "whatever.cn"),
+		pb.InitTLSDecoySpec("255.254.253.252", "particular.ir"),
+		pb.InitTLSDecoySpec("0.1.2.3", "whatever.cn"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(listFile, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetDecoysFromFile(listFile); err != nil {
+		t.Fatal(err)
+	}
+	if decoys := a.GetAllDecoys(); len(decoys) != 2 || decoys[1].GetHostname() != "particular.ir" {
+		t.Fatalf("expected the 2 distinct decoys of the DecoyList, got %v", decoys)
+	}
+
+	// so does the decoy list of a full ClientConf
+	confFile := path.Join(dir, "decoys.conf")
+	gen := uint32(99)
+	buf, err = proto.Marshal(&pb.ClientConf{
+		Generation: &gen,
+		DecoyList: &pb.DecoyList{TlsDecoys: []*pb.TLSDecoySpec{
+			pb.InitTLSDecoySpec("11.22.33.44", "what.is.up"),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(confFile, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetDecoysFromFile(confFile); err != nil {
+		t.Fatal(err)
+	}
+	if decoys := a.GetAllDecoys(); len(decoys) != 1 || decoys[0].GetHostname() != "what.is.up" {
+		t.Fatalf("expected the decoy of the ClientConf, got %v", decoys)
+	}
+	if a.GetGeneration() == gen {
+		t.Fatal("only the decoys of the ClientConf should be used")
+	}
+
+	// and was stored to disk
+	reloaded := newAssets(dir)
+	reloaded.readConfigs()
+	if decoys := reloaded.GetAllDecoys(); len(decoys) != 1 {
+		t.Fatalf("expected 1 decoy after reload, got %d", len(decoys))
+	}
+
+	if err = a.SetDecoysFromFile(path.Join(dir, "missing")); err == nil {
+		t.Fatal("missing decoy file accepted")
+	}
+}
+
+func TestAssets_GetDecoyForKey(t *testing.T) {
+	var b bytes.Buffer
+	logHolder := bufio.NewWriter(&b)
+	oldLoggerOut := Logger().Out
+	Logger().Out = logHolder
+	defer func() {
+		Logger().Out = oldLoggerOut
+		if t.Failed() {
+			logHolder.Flush()
+			fmt.Printf("TapDance log was:\n%s\n", b.String())
+		}
+	}()
+
+	dir, err := ioutil.TempDir("/tmp/", "stickydecoys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newAssets(dir)
+	var decoys []*pb.TLSDecoySpec
+	for i := 0; i < 8; i++ {
+		decoys = append(decoys, pb.InitTLSDecoySpec(fmt.Sprintf("10.0.0.%d", i+1), fmt.Sprintf("decoy%d.example", i)))
+	}
+	if err = a.SetDecoys(decoys); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 64; i++ {
+		key := fmt.Sprintf("covert%d.example:443", i)
+		decoy := a.GetDecoyForKey(key)
+		for j := 0; j < 3; j++ {
+			if again := a.GetDecoyForKey(key); again.GetHostname() != decoy.GetHostname() {
+				t.Fatalf("key %v mapped to %v then %v", key, decoy.GetHostname(), again.GetHostname())
+			}
+		}
+		seen[decoy.GetHostname()] = true
+	}
+	if len(seen) < len(decoys)/2 {
+		t.Fatalf("64 keys mapped to only %d of %d decoys", len(seen), len(decoys))
+	}
+
+	// the cache is bounded, and keys map the same once they drop out of it
+	first := a.GetDecoyForKey("covert0.example:443")
+	for i := 0; i < 2*maxDecoyKeys; i++ {
+		a.GetDecoyForKey(fmt.Sprintf("other%d.example:443", i))
+	}
+	a.decoyKeysMu.Lock()
+	cached := len(a.decoyKeys)
+	a.decoyKeysMu.Unlock()
+	if cached > maxDecoyKeys {
+		t.Fatalf("%d keys cached, at most %d expected", cached, maxDecoyKeys)
+	} else if again := a.GetDecoyForKey("covert0.example:443"); again.GetHostname() != first.GetHostname() {
+		t.Fatalf("key mapped to %v, then %v after leaving the cache", first.GetHostname(), again.GetHostname())
+	}
+
+	// replacing the decoys drops the cached mappings
+	key := "covert0.example:443"
+	if err = a.SetDecoys(decoys[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if decoy := a.GetDecoyForKey(key); decoy.GetHostname() != decoys[0].GetHostname() {
+		t.Fatalf("key mapped to %v after the decoy list changed, expected %v", decoy.GetHostname(), decoys[0].GetHostname())
+	}
+
+	if err = a.SetDecoys(nil); err != nil {
+		t.Fatal(err)
+	}
+	if decoy := a.GetDecoyForKey(key); decoy.GetHostname() != "" {
+		t.Fatalf("key mapped to %v without decoys", decoy.GetHostname())
+	}
+}
+
+func TestAssets_ForEachDecoy(t *testing.T) {
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("0.1.2.3", "whatever.cn"),
+		pb.InitTLSDecoySpec("255.254.253.252", "particular.ir"),
+		pb.InitTLSDecoySpec("11.22.33.44", "what.is.up"),
+	}
+
+	var visited []string
+	a.ForEachDecoy(func(decoy *pb.TLSDecoySpec) bool {
+		visited = append(visited, decoy.GetHostname())
+		hostname := "changed.example"
+		decoy.Hostname = &hostname
+		return len(visited) < 2
+	})
+	if len(visited) != 2 || visited[0] != "whatever.cn" || visited[1] != "particular.ir" {
+		t.Fatalf("visited %v, expected to stop after the first two decoys", visited)
+	}
+	if a.config.DecoyList.TlsDecoys[0].GetHostname() != "whatever.cn" {
+		t.Fatal("modifying the decoy passed to fn changed the ClientConf")
+	}
+
+	count := 0
+	a.ForEachDecoy(func(*pb.TLSDecoySpec) bool {
+		count++
+		return true
+	})
+	if count != 3 {
+		t.Fatalf("visited %d decoys, expected 3", count)
+	}
+}
+
+func TestAssets_DecoyTLSProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "tlsprofiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newAssets(dir)
+	a.readConfigs()
+	decoys := a.GetAllDecoys()
+	if profile := a.GetDecoyTLSProfile(decoys[0]); profile != "" {
+		t.Fatalf("decoy has profile %q before any was set", profile)
+	}
+
+	profiles := map[string]string{
+		decoys[0].GetHostname(): "chrome_62",
+		decoys[1].GetHostname(): "firefox_63",
+		decoys[2].GetHostname(): "ios_11",
+	}
+	for hostname, profile := range profiles {
+		if err = a.SetDecoyTLSProfile(hostname, profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.SetDecoyTLSProfile(decoys[2].GetHostname(), ""); err != nil {
+		t.Fatal(err)
+	}
+	delete(profiles, decoys[2].GetHostname())
+
+	reloaded := newAssets(dir)
+	reloaded.readConfigs()
+	for _, decoy := range decoys {
+		if profile := reloaded.GetDecoyTLSProfile(decoy); profile != profiles[decoy.GetHostname()] {
+			t.Fatalf("%v reloaded with profile %q, expected %q", decoy.GetHostname(), profile, profiles[decoy.GetHostname()])
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		decoy, profile := reloaded.GetDecoyWithTLSProfile()
+		if profile != profiles[decoy.GetHostname()] {
+			t.Fatalf("%v selected with profile %q, expected %q", decoy.GetHostname(), profile, profiles[decoy.GetHostname()])
+		}
+	}
+}
+
+func TestAssets_GetDecoyForTLSVersion(t *testing.T) {
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("0.1.2.3", "tls12.only"),
+		pb.InitTLSDecoySpec("255.254.253.252", "tls13.only"),
+		pb.InitTLSDecoySpec("11.22.33.44", "undeclared"),
+	}
+
+	// nothing declared: any decoy will do
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		decoy, ok := a.GetDecoyForTLSVersion(tls.VersionTLS13, tls.VersionTLS13)
+		if !ok {
+			t.Fatal("no decoy selected without declarations")
+		}
+		seen[decoy.GetHostname()] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("fallback selected only %v", seen)
+	}
+
+	a.SetDecoyTLSVersions(map[string]TLSVersionRange{
+		"tls12.only": {Min: tls.VersionTLS12, Max: tls.VersionTLS12},
+		"tls13.only": {Min: tls.VersionTLS13, Max: tls.VersionTLS13},
+	})
+	for i := 0; i < 20; i++ {
+		decoy, ok := a.GetDecoyForTLSVersion(tls.VersionTLS13, tls.VersionTLS13)
+		if !ok || decoy.GetHostname() != "tls13.only" {
+			t.Fatalf("TLS 1.3 selected %v, %v", decoy.GetHostname(), ok)
+		}
+		decoy, ok = a.GetDecoyForTLSVersion(tls.VersionTLS10, tls.VersionTLS12)
+		if !ok || decoy.GetHostname() != "tls12.only" {
+			t.Fatalf("TLS 1.0-1.2 selected %v, %v", decoy.GetHostname(), ok)
+		}
+	}
+
+	if decoy, ok := a.GetDecoyForTLSVersion(tls.VersionTLS10, tls.VersionTLS11); ok {
+		t.Fatalf("incompatible versions selected %v", decoy.GetHostname())
+	}
+}
+
+func TestAssets_SetAssets(t *testing.T) {
+	var b bytes.Buffer
+	logHolder := bufio.NewWriter(&b)
+	oldLoggerOut := Logger().Out
+	Logger().Out = logHolder
+	defer func() {
+		Logger().Out = oldLoggerOut
+		if t.Failed() {
+			logHolder.Flush()
+			fmt.Printf("TapDance log was:\n%s\n", b.String())
+		}
+	}()
+
+	rootsPEM, err := ioutil.ReadFile("../assets/roots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("/tmp/", "setassets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	confWithGen := func(gen uint32) *pb.ClientConf {
+		return &pb.ClientConf{
+			Generation: &gen,
+			DecoyList: &pb.DecoyList{TlsDecoys: []*pb.TLSDecoySpec{
+				pb.InitTLSDecoySpec("192.122.190.104", "tapdance1.freeaeskey.xyz"),
+			}},
+		}
+	}
+
+	a := newAssets(dir)
+	if err = a.SetAssets(confWithGen(10), rootsPEM); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newAssets(dir)
+	reloaded.readConfigs()
+	if reloaded.GetGeneration() != 10 || !bytes.Equal(reloaded.rootsPEM, rootsPEM) {
+		t.Fatalf("reloaded generation %v and %v bytes of roots", reloaded.GetGeneration(), len(reloaded.rootsPEM))
+	}
+
+	// invalid input is rejected before anything is touched
+	if err = a.SetAssets(confWithGen(11), []byte("not a certificate")); err == nil {
+		t.Fatal("invalid roots accepted")
+	}
+	if err = a.SetAssets(&pb.ClientConf{}, rootsPEM); err == nil {
+		t.Fatal("ClientConf without decoys accepted")
+	}
+	if a.GetGeneration() != 10 {
+		t.Fatalf("rejected assets changed generation to %v", a.GetGeneration())
+	}
+
+	// a non-empty directory in place of the ClientConf makes its rename fail
+	// after the new roots were moved in place
+	confPath := path.Join(dir, a.filenameClientConf)
+	if err = os.Remove(confPath); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(path.Join(confPath, "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	newRootsPEM := append(append([]byte{}, rootsPEM...), '\n')
+	if err = a.SetAssets(confWithGen(12), newRootsPEM); err == nil {
+		t.Fatal("SetAssets succeeded despite the ClientConf not being writable")
+	}
+	if a.GetGeneration() != 10 || !bytes.Equal(a.rootsPEM, rootsPEM) {
+		t.Fatalf("failed SetAssets changed the assets in memory")
+	}
+	onDisk, err := ioutil.ReadFile(path.Join(dir, a.filenameRoots))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(onDisk, rootsPEM) {
+		t.Fatal("failed SetAssets left the new roots on disk")
+	}
+}
+
+func TestAssets_DecoysByFamily(t *testing.T) {
+	dualStack := pb.InitTLSDecoySpec("192.122.190.104", "dual.stack")
+	dualStack.Ipv6Addr = net.ParseIP("2001:48a8:687f:1::104")
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("192.122.190.105", "v4.only"),
+		pb.InitTLSDecoySpec("2001:48a8:687f:1::105", "v6.only"),
+		dualStack,
+	}
+
+	hostnames := func(decoys []*pb.TLSDecoySpec) string {
+		var names []string
+		for _, decoy := range decoys {
+			names = append(names, decoy.GetHostname())
+		}
+		return strings.Join(names, ",")
+	}
+	for name, c := range map[string]struct {
+		decoys   []*pb.TLSDecoySpec
+		expected string
+	}{
+		"v4":      {a.GetV4Decoys(), "v4.only,dual.stack"},
+		"v6":      {a.GetV6Decoys(), "v6.only,dual.stack"},
+		"v4 only": {a.GetV4OnlyDecoys(), "v4.only"},
+		"v6 only": {a.GetV6OnlyDecoys(), "v6.only"},
+	} {
+		if got := hostnames(c.decoys); got != c.expected {
+			t.Fatalf("%v decoys: got %v, expected %v", name, got, c.expected)
+		}
+	}
+
+	// the lists are copies, safe to use without the lock
+	a.GetV4OnlyDecoys()[0].Hostname = proto.String("changed")
+	a.GetV6OnlyDecoys()[0].Hostname = proto.String("changed")
+	a.GetV4Decoys()[0].Hostname = proto.String("changed")
+	a.GetV6Decoys()[0].Hostname = proto.String("changed")
+	a.GetAllDecoys()[2].Hostname = proto.String("changed")
+	if got := hostnames(a.GetAllDecoys()); got != "v4.only,v6.only,dual.stack" {
+		t.Fatalf("changing returned decoys changed the decoy list to %v", got)
+	}
+}
+
+func TestAssets_GetDecoysForIPVersion(t *testing.T) {
+	a := newAssets("")
+	dualStack := pb.InitTLSDecoySpec("192.122.190.3", "dualstack")
+	dualStack.Ipv6Addr = net.ParseIP("2001:48a8:687f:1::3")
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("192.122.190.1", "v4only"),
+		pb.InitTLSDecoySpec("2001:48a8:687f:1::2", "v6only"),
+		dualStack,
+	}
+
+	hostnames := func(decoys []*pb.TLSDecoySpec) string {
+		var names []string
+		for _, decoy := range decoys {
+			names = append(names, decoy.GetHostname())
+		}
+		return strings.Join(names, ",")
+	}
+	if got := hostnames(a.GetDecoysForIPVersion(4)); got != "v4only,dualstack" {
+		t.Fatalf("IPv4 decoys %v, expected v4only,dualstack", got)
+	}
+	if got := hostnames(a.GetDecoysForIPVersion(6)); got != "v6only,dualstack" {
+		t.Fatalf("IPv6 decoys %v, expected v6only,dualstack", got)
+	}
+	if got := a.GetDecoysForIPVersion(5); got == nil || len(got) != 0 {
+		t.Fatalf("decoys for IP version 5 %v, expected an empty slice", got)
+	}
+
+	// they are copies
+	a.GetDecoysForIPVersion(6)[1].Hostname = proto.String("changed")
+	if dualStack.GetHostname() != "dualstack" {
+		t.Fatal("decoy of the ClientConf changed through its copy")
+	}
+}
+
+func TestAssets_GetNDecoys(t *testing.T) {
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("192.122.190.1", "cdn.example"),
+		pb.InitTLSDecoySpec("192.122.190.2", "cdn.example"),
+		pb.InitTLSDecoySpec("192.122.190.3", "cdn.example"),
+		pb.InitTLSDecoySpec("192.122.190.4", "other.example"),
+		pb.InitTLSDecoySpec("192.122.190.4", "third.example"),
+	}
+	a.SetRandSource(mrand.New(mrand.NewSource(1)))
+
+	for i := 0; i < 20; i++ {
+		// by SNI, only 3 distinct hostnames are available
+		decoys := a.GetNDecoys(4, DedupeBySNI)
+		if len(decoys) != 3 {
+			t.Fatalf("got %d decoys deduped by SNI, expected 3", len(decoys))
+		}
+		snis := make(map[string]bool)
+		for _, decoy := range decoys {
+			if snis[decoy.GetHostname()] {
+				t.Fatalf("SNI %v picked twice", decoy.GetHostname())
+			}
+			snis[decoy.GetHostname()] = true
+		}
+
+		// by IP, 4 distinct addresses are available
+		if decoys = a.GetNDecoys(5, DedupeByIP); len(decoys) != 4 {
+			t.Fatalf("got %d decoys deduped by IP, expected 4", len(decoys))
+		}
+		// by both, only one decoy per hostname and address
+		if decoys = a.GetNDecoys(5, DedupeByIP|DedupeBySNI); len(decoys) != 2 {
+			t.Fatalf("got %d decoys deduped by IP and SNI, expected 2", len(decoys))
+		}
+		// without deduping, all of them
+		if decoys = a.GetNDecoys(5, 0); len(decoys) != 5 {
+			t.Fatalf("got %d decoys, expected 5", len(decoys))
+		}
+	}
+
+	if decoys := a.GetNDecoys(2, DedupeBySNI); len(decoys) != 2 {
+		t.Fatalf("got %d decoys, expected 2", len(decoys))
+	}
+	if decoys := a.GetNDecoys(0, DedupeBySNI); len(decoys) != 0 {
+		t.Fatalf("got %d decoys, expected none", len(decoys))
+	}
+
+	// the decoys returned are copies
+	for _, decoy := range a.GetNDecoys(5, 0) {
+		decoy.Hostname = proto.String("changed")
+	}
+	for _, decoy := range a.config.DecoyList.TlsDecoys {
+		if decoy.GetHostname() == "changed" {
+			t.Fatalf("changing a picked decoy changed the decoy list: %v", decoy)
+		}
+	}
+}
+
+func TestAssets_DecoyCountByFamily(t *testing.T) {
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = nil
+	for i, ip := range []string{"192.122.190.1", "192.122.190.2", "192.122.190.3", "2001:48a8:687f:1::1", "192.122.190.4", "192.122.190.5"} {
+		decoy := pb.InitTLSDecoySpec(ip, fmt.Sprintf("decoy%d", i))
+		if i >= 4 {
+			// the last two are dual stack
+			decoy.Ipv6Addr = net.ParseIP(fmt.Sprintf("2001:48a8:687f:1::%d", 100+i))
+		}
+		a.config.DecoyList.TlsDecoys = append(a.config.DecoyList.TlsDecoys, decoy)
+	}
+	// a decoy without addresses counts towards no family
+	a.config.DecoyList.TlsDecoys = append(a.config.DecoyList.TlsDecoys, &pb.TLSDecoySpec{})
+
+	v4Only, v6Only, dualStack := a.DecoyCountByFamily()
+	if v4Only != 3 || v6Only != 1 || dualStack != 2 {
+		t.Fatalf("counted %d v4 only, %d v6 only and %d dual stack decoys, expected 3, 1 and 2", v4Only, v6Only, dualStack)
+	}
+	if len(a.GetV4OnlyDecoys()) != v4Only || len(a.GetV6OnlyDecoys()) != v6Only {
+		t.Fatal("counts disagree with the single family decoy lists")
+	}
+}
+
+func TestAssets_Summary(t *testing.T) {
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = nil
+	for i, ip := range []string{"192.122.190.1", "192.122.190.2", "2001:48a8:687f:1::1"} {
+		a.config.DecoyList.TlsDecoys = append(a.config.DecoyList.TlsDecoys, pb.InitTLSDecoySpec(ip, fmt.Sprintf("decoy%d", i)))
+	}
+	gen := uint32(1234)
+	a.config.Generation = &gen
+	a.config.DarkDecoyBlocks = &pb.DarkDecoyBlocks{Blocks: []string{"192.122.190.0/24", "2001:48a8:687f:1::/64"}}
+
+	summary := a.Summary()
+	for _, want := range []string{
+		"generation 1234",
+		"3 decoys (2 v4 only, 1 v6 only, 0 dual stack)",
+		"pubkey " + keyFingerprint(a.config.GetDefaultPubkey().GetKey()),
+		"2 phantom subnets",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Fatalf("summary %q doesn't mention %q", summary, want)
+		}
+	}
+	if a.Summary() != summary {
+		t.Fatal("summary changed without changes to the assets")
+	}
+}
+
+func TestAssets_GetDecoyFromSecret(t *testing.T) {
+	a := newAssets("")
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("10.0.0.3", "decoy3.example.com"),
+		pb.InitTLSDecoySpec("10.0.0.1", "decoy1.example.com"),
+		pb.InitTLSDecoySpec("10.0.0.5", "decoy5.example.com"),
+		pb.InitTLSDecoySpec("10.0.0.2", "decoy2.example.com"),
+		pb.InitTLSDecoySpec("10.0.0.4", "decoy4.example.com"),
+	}
+
+	// HKDF-SHA256(ikm = secret, salt = none, info = labelDecoySeed), first 8
+	// bytes big endian, modulo 5, indexing the decoys sorted by hostname
+	vectors := []struct {
+		secret   string
+		hostname string
+	}{
+		{"0000000000000000000000000000000000000000000000000000000000000000", "decoy3.example.com"},
+		{"5a87133b68da3468988a21659a12ed2ece07345c8c1a5b08459ffdea4218d12f", "decoy4.example.com"},
+		{"0101010101010101010101010101010101010101010101010101010101010101", "decoy5.example.com"},
+		{"0202020202020202020202020202020202020202020202020202020202020202", "decoy2.example.com"},
+		{"0606060606060606060606060606060606060606060606060606060606060606", "decoy1.example.com"},
+	}
+	for _, v := range vectors {
+		var secret [32]byte
+		if _, err := hex.Decode(secret[:], []byte(v.secret)); err != nil {
+			t.Fatal(err)
+		}
+		decoy := a.GetDecoyFromSecret(secret)
+		if decoy.GetHostname() != v.hostname {
+			t.Fatalf("secret %v selected %v, expected %v", v.secret, decoy.GetHostname(), v.hostname)
+		}
+		if decoy.GetTimeout() < timeoutMin {
+			t.Fatalf("Tapdance defaults not applied: %v", decoy.String())
+		}
+	}
+	if a.config.DecoyList.TlsDecoys[0].Timeout != nil {
+		t.Fatal("selecting a decoy modified the decoy list")
+	}
+
+	a.config.DecoyList.TlsDecoys = nil
+	if decoy := a.GetDecoyFromSecret([32]byte{}); decoy.GetHostname() != "" {
+		t.Fatalf("selected %v from an empty decoy list", decoy.GetHostname())
+	}
+}
+
+func TestAssets_GetDecoyWithMinTcpwin(t *testing.T) {
+	withTcpwin := func(ip, hostname string, tcpwin uint32) *pb.TLSDecoySpec {
+		decoy := pb.InitTLSDecoySpec(ip, hostname)
+		decoy.Tcpwin = &tcpwin
+		return decoy
+	}
+	a := newAssets("")
+	a.SetTransportMode(ConjureMode)
+	a.config.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{
+		withTcpwin("10.0.0.1", "narrow.decoy", 1000),
+		withTcpwin("10.0.0.2", "wide.decoy", 20000),
+		withTcpwin("10.0.0.3", "widest.decoy", 30000),
+		withTcpwin("10.0.0.4", "also.widest.decoy", 30000),
+	}
+
+	// match
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		decoy, ok := a.GetDecoyWithMinTcpwin(15000)
+		if !ok || decoy.GetTcpwin() < 15000 {
+			t.Fatalf("selected %v with Tcpwin %d, ok %v", decoy.GetHostname(), decoy.GetTcpwin(), ok)
+		}
+		seen[decoy.GetHostname()] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("not all qualifying decoys selected: %v", seen)
+	}
+
+	// fallback to the widest
+	decoy, ok := a.GetDecoyWithMinTcpwin(50000)
+	if ok || decoy.GetHostname() != "widest.decoy" {
+		t.Fatalf("fallback selected %v, ok %v, expected widest.decoy", decoy.GetHostname(), ok)
+	}
+
+	// in TapdanceMode small windows are raised to the default first
+	a.SetTransportMode(TapdanceMode)
+	a.config.DecoyList.TlsDecoys = a.config.DecoyList.TlsDecoys[:1]
+	if decoy, ok := a.GetDecoyWithMinTcpwin(sendLimitMax); !ok || decoy.GetTcpwin() != sendLimitMax {
+		t.Fatalf("selected Tcpwin %d, ok %v, expected the default %d", decoy.GetTcpwin(), ok, sendLimitMax)
+	}
+	if a.config.DecoyList.TlsDecoys[0].GetTcpwin() != 1000 {
+		t.Fatal("selecting a decoy modified the decoy list")
+	}
+
+	// empty
+	a.config.DecoyList.TlsDecoys = nil
+	if decoy, ok := a.GetDecoyWithMinTcpwin(0); ok || decoy.GetHostname() != "" {
+		t.Fatalf("selected %v, ok %v from an empty decoy list", decoy.GetHostname(), ok)
+	}
+}
+
+func TestAssets_DecoyHostnameAllowlist(t *testing.T) {
+	var b bytes.Buffer
+	oldLoggerOut := Logger().Out
+	Logger().Out = &b
+	defer func() { Logger().Out = oldLoggerOut }()
+
+	a := newAssets("")
+	decoys := a.GetAllDecoys()
+	a.SetDecoyHostnameAllowlist([]string{strings.ToUpper(decoys[0].GetHostname()), decoys[2].GetHostname(), "unknown.decoy"})
+
+	// restricted
+	for i := 0; i < 30; i++ {
+		if hostname := a.GetDecoy().GetHostname(); hostname == decoys[1].GetHostname() {
+			t.Fatalf("selected %v, which isn't allowlisted", hostname)
+		}
+		if sni, _ := a.GetDecoyAddress(); sni == decoys[1].GetHostname() {
+			t.Fatalf("GetDecoyAddress selected %v, which isn't allowlisted", sni)
+		}
+	}
+
+	// fallback
+	a.SetDecoyHostnameAllowlist([]string{"unknown.decoy"})
+	seen := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		seen[a.GetDecoy().GetHostname()] = true
+	}
+	if len(seen) != len(decoys) {
+		t.Fatalf("fallback selected %v, expected all %d decoys", seen, len(decoys))
+	}
+	if !strings.Contains(b.String(), "allowlist matches none") {
+		t.Fatalf("no warning about the allowlist logged: %s", b.String())
+	}
+
+	// an empty allowlist removes the restriction
+	a.SetDecoyHostnameAllowlist([]string{decoys[0].GetHostname()})
+	a.SetDecoyHostnameAllowlist(nil)
+	seen = make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		seen[a.GetDecoy().GetHostname()] = true
+	}
+	if len(seen) != len(decoys) {
+		t.Fatalf("selected %v after removing the allowlist, expected all %d decoys", seen, len(decoys))
+	}
+}
+
+func TestAssets_UsingDefaultDecoys(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "defaultdecoys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newAssets(dir)
+	if !a.UsingDefaultDecoys() {
+		t.Fatal("not using the default decoys before loading a config")
+	}
+	// a missing ClientConf leaves the defaults in place
+	a.readConfigs()
+	if !a.UsingDefaultDecoys() {
+		t.Fatal("not using the default decoys without a ClientConf")
+	}
+
+	conf := newAssets("").config
+	conf.DecoyList.TlsDecoys = []*pb.TLSDecoySpec{pb.InitTLSDecoySpec("1.2.3.4", "file.decoy")}
+	buf, err := proto.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(dir, "ClientConf"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	a.readConfigs()
+	if a.UsingDefaultDecoys() {
+		t.Fatal("using the default decoys after loading a ClientConf")
+	}
+}
+
+func TestAssets_ConfigSource(t *testing.T) {
+	var b bytes.Buffer
+	oldLoggerOut := Logger().Out
+	Logger().Out = &b
+	defer func() { Logger().Out = oldLoggerOut }()
+
+	dir, err := ioutil.TempDir("/tmp/", "configsource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	checkSource := func(expectedGen uint32, expectedSource string) {
+		t.Helper()
+		gen, source := Assets().ConfigSource()
+		if gen != expectedGen || source != expectedSource {
+			t.Fatalf("config source is (%d, %q), expected (%d, %q)", gen, source, expectedGen, expectedSource)
+		}
+	}
+
+	a := newAssets(dir)
+	if gen, source := a.ConfigSource(); gen != 0 || source != ConfigSourceDefault {
+		t.Fatalf("new assets report (%d, %q), expected (0, %q)", gen, source, ConfigSourceDefault)
+	}
+
+	conf := newAssets("").config
+	fileGen := uint32(10)
+	conf.Generation = &fileGen
+	buf, err := proto.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(dir, "ClientConf"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldpath := Assets().path
+	AssetsSetDir(dir)
+	defer AssetsSetDir(oldpath)
+	checkSource(10, ConfigSourceFile)
+
+	// changing the config keeps its source
+	if err = Assets().SetGeneration(11); err != nil {
+		t.Fatal(err)
+	}
+	checkSource(11, ConfigSourceFile)
+
+	bytesConf := proto.Clone(conf).(*pb.ClientConf)
+	bytesGen := uint32(12)
+	bytesConf.Generation = &bytesGen
+	if err = Assets().SetClientConf(bytesConf); err != nil {
+		t.Fatal(err)
+	}
+	checkSource(12, ConfigSourceBytes)
+
+	fetchedConf := proto.Clone(conf).(*pb.ClientConf)
+	fetchedGen := uint32(13)
+	fetchedConf.Generation = &fetchedGen
+	if err = Assets().SetFetchedClientConf(fetchedConf); err != nil {
+		t.Fatal(err)
+	}
+	checkSource(13, ConfigSourceFetch)
+
+	bundleConf := proto.Clone(conf).(*pb.ClientConf)
+	bundleGen := uint32(14)
+	bundleConf.Generation = &bundleGen
+	if buf, err = proto.Marshal(bundleConf); err != nil {
+		t.Fatal(err)
+	}
+	if err = Assets().LoadAssetsBundle(buildTarBundle(t, []bundleEntry{{"ClientConf", buf}})); err != nil {
+		t.Fatal(err)
+	}
+	checkSource(14, ConfigSourceBundle)
+
+	// a failed load leaves the source alone
+	if err = Assets().LoadAssetsBundle(buildTarBundle(t, []bundleEntry{{"unexpected", buf}})); err == nil {
+		t.Fatal("bundle with an unexpected entry was accepted")
+	}
+	checkSource(14, ConfigSourceBundle)
+}
@@ -0,0 +1,150 @@
+package tapdance
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	ps "github.com/refraction-networking/gotapdance/tapdance/phantoms"
+)
+
+// pubkeyLen is the length of the station public keys, see GetPubkey.
+const pubkeyLen = 32
+
+// pubkeyProblems lists the station public keys of conf that are set but not
+// pubkeyLen bytes long.
+func pubkeyProblems(conf *pb.ClientConf) []string {
+	var problems []string
+	for _, pubkey := range []struct {
+		name string
+		key  *pb.PubKey
+	}{
+		{"default pubkey", conf.GetDefaultPubkey()},
+		{"conjure pubkey", conf.GetConjurePubkey()},
+	} {
+		if pubkey.key != nil && len(pubkey.key.GetKey()) != pubkeyLen {
+			problems = append(problems, fmt.Sprintf("%s is %d bytes, expected %d", pubkey.name, len(pubkey.key.GetKey()), pubkeyLen))
+		}
+	}
+	return problems
+}
+
+// decoyAddrProblem describes what is wrong with the addresses of decoy, or is
+// empty if they are well-formed: an IPv4 address of 0.0.0.0, or an IPv6
+// address that isn't 16 bytes or is unspecified. Missing addresses aren't
+// checked here.
+func decoyAddrProblem(decoy *pb.TLSDecoySpec) string {
+	var problems []string
+	if decoy.Ipv4Addr != nil && decoyIPv4(decoy).IsUnspecified() {
+		problems = append(problems, "IPv4 address is 0.0.0.0")
+	}
+	if ipv6 := decoy.GetIpv6Addr(); ipv6 != nil {
+		if len(ipv6) != net.IPv6len {
+			problems = append(problems, fmt.Sprintf("IPv6 address is %d bytes, expected %d", len(ipv6), net.IPv6len))
+		} else if net.IP(ipv6).IsUnspecified() {
+			problems = append(problems, "IPv6 address is ::")
+		}
+	}
+	return strings.Join(problems, ", ")
+}
+
+// decoyIPProblems lists the decoys of conf with malformed addresses, see
+// decoyAddrProblem.
+func decoyIPProblems(conf *pb.ClientConf) []string {
+	var problems []string
+	for i, decoy := range conf.GetDecoyList().GetTlsDecoys() {
+		if problem := decoyAddrProblem(decoy); problem != "" {
+			problems = append(problems, fmt.Sprintf("decoy %d (%v): %s", i, decoy.GetHostname(), problem))
+		}
+	}
+	return problems
+}
+
+// wellFormedDecoys returns the decoys without malformed addresses.
+func wellFormedDecoys(decoys []*pb.TLSDecoySpec) []*pb.TLSDecoySpec {
+	wellFormed := make([]*pb.TLSDecoySpec, 0, len(decoys))
+	for _, decoy := range decoys {
+		if decoyAddrProblem(decoy) == "" {
+			wellFormed = append(wellFormed, decoy)
+		}
+	}
+	return wellFormed
+}
+
+// clientConfProblems lists everything wrong with the decoys and pubkeys of
+// conf.
+func clientConfProblems(conf *pb.ClientConf) []string {
+	problems := pubkeyProblems(conf)
+
+	decoys := conf.GetDecoyList().GetTlsDecoys()
+	if len(decoys) == 0 {
+		problems = append(problems, "no decoys")
+	}
+	for i, decoy := range decoys {
+		if decoy.GetHostname() == "" {
+			problems = append(problems, fmt.Sprintf("decoy %d has no hostname", i))
+		}
+		if decoy.GetIpv4Addr() == 0 && decoy.GetIpv6Addr() == nil {
+			problems = append(problems, fmt.Sprintf("decoy %d (%v) has no address", i, decoy.GetHostname()))
+		}
+	}
+	return append(problems, decoyIPProblems(conf)...)
+}
+
+// ValidateClientConf checks that every decoy of conf is usable and that its
+// pubkeys have the right length, reporting all problems found at once.
+func ValidateClientConf(conf *pb.ClientConf) error {
+	if problems := clientConfProblems(conf); len(problems) > 0 {
+		return fmt.Errorf("invalid ClientConf: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ValidateAll checks the current ClientConf before it is deployed: its decoys
+// with ValidateClientConf, and its phantom subnets, if it has any, with
+// phantoms.SubnetConfig.Validate, treating overlapping subnets as a problem.
+// Problems with both are reported together.
+func (a *assets) ValidateAll() error {
+	a.RLock()
+	defer a.RUnlock()
+
+	problems := clientConfProblems(a.config)
+
+	subnets, err := ps.SubnetConfigFromClientConf(a.config)
+	if err == nil {
+		subnets.Strict = true
+		err = subnets.Validate()
+	}
+	if err != nil && !errors.Is(err, ps.ErrNoPhantomSubnets) {
+		problems = append(problems, "phantom subnets: "+err.Error())
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid ClientConf: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// SetStrictPubkeys makes reading a ClientConf whose default or conjure pubkey
+// isn't 32 bytes long fail, keeping the current config. Otherwise, which is
+// the default, such a ClientConf is loaded with a warning and reported as
+// invalid by ValidateAll.
+func (a *assets) SetStrictPubkeys(strict bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.strictPubkeys = strict
+}
+
+// SetStrictDecoyIPs makes reading a ClientConf drop the decoys with malformed
+// addresses, such as an IPv4 address of 0 or an IPv6 address that isn't 16
+// bytes, failing if none are left. Otherwise, which is the default, such
+// decoys are loaded with a warning and reported as invalid by ValidateAll.
+func (a *assets) SetStrictDecoyIPs(strict bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.strictDecoyIPs = strict
+}
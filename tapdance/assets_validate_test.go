@@ -0,0 +1,175 @@
+package tapdance
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+func TestValidateClientConf(t *testing.T) {
+	conf := &pb.ClientConf{DecoyList: &pb.DecoyList{TlsDecoys: []*pb.TLSDecoySpec{
+		pb.InitTLSDecoySpec("192.122.190.104", "tapdance1.freeaeskey.xyz"),
+		pb.InitTLSDecoySpec("2001:48a8:687f:1::105", "tapdance2.freeaeskey.xyz"),
+	}}}
+	if err := ValidateClientConf(conf); err != nil {
+		t.Fatalf("valid ClientConf rejected: %v", err)
+	}
+
+	conf.DecoyList.TlsDecoys = append(conf.DecoyList.TlsDecoys, &pb.TLSDecoySpec{}, pb.InitTLSDecoySpec("192.122.190.106", ""))
+	err := ValidateClientConf(conf)
+	if err == nil {
+		t.Fatal("invalid decoys accepted")
+	}
+	for _, problem := range []string{"decoy 2 has no hostname", "decoy 2 () has no address", "decoy 3 has no hostname"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("%q missing from error: %v", problem, err)
+		}
+	}
+
+	if err := ValidateClientConf(&pb.ClientConf{}); err == nil || !strings.Contains(err.Error(), "no decoys") {
+		t.Fatalf("ClientConf without decoys: got error %v", err)
+	}
+}
+
+func TestAssets_ShortPubkey(t *testing.T) {
+	var b bytes.Buffer
+	oldLoggerOut := Logger().Out
+	Logger().Out = &b
+	defer func() { Logger().Out = oldLoggerOut }()
+
+	dir, err := ioutil.TempDir("/tmp/", "shortkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyType := pb.KeyType_AES_GCM_128
+	gen := uint32(17)
+	conf := newAssets("").config
+	conf.DefaultPubkey = &pb.PubKey{Key: bytes.Repeat([]byte{1}, 16), Type: &keyType}
+	conf.Generation = &gen
+	buf, err := proto.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "ClientConf"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateClientConf(conf); err == nil || !strings.Contains(err.Error(), "default pubkey is 16 bytes, expected 32") {
+		t.Fatalf("short pubkey: got error %v", err)
+	}
+
+	// by default the ClientConf is loaded, but flagged
+	a := newAssets(dir)
+	a.readConfigs()
+	if a.GetGeneration() != gen {
+		t.Fatalf("ClientConf with a short pubkey wasn't loaded")
+	}
+	if !strings.Contains(b.String(), "invalid pubkeys") {
+		t.Fatalf("no warning about the short pubkey logged: %s", b.String())
+	}
+	if err := a.ValidateAll(); err == nil || !strings.Contains(err.Error(), "default pubkey") {
+		t.Fatalf("ValidateAll of a short pubkey: got error %v", err)
+	}
+
+	// in strict mode it is rejected
+	a = newAssets(dir)
+	a.SetStrictPubkeys(true)
+	a.readConfigs()
+	if a.GetGeneration() == gen {
+		t.Fatalf("ClientConf with a short pubkey was loaded in strict mode")
+	}
+	if len(a.config.GetDefaultPubkey().GetKey()) != pubkeyLen {
+		t.Fatalf("default pubkey replaced by a %d byte key", len(a.config.GetDefaultPubkey().GetKey()))
+	}
+}
+
+func TestAssets_MalformedDecoyIPs(t *testing.T) {
+	var b bytes.Buffer
+	oldLoggerOut := Logger().Out
+	Logger().Out = &b
+	defer func() { Logger().Out = oldLoggerOut }()
+
+	dir, err := ioutil.TempDir("/tmp/", "decoyips")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zero := uint32(0)
+	gen := uint32(18)
+	conf := newAssets("").config
+	conf.Generation = &gen
+	conf.DecoyList.TlsDecoys = append(conf.DecoyList.TlsDecoys,
+		&pb.TLSDecoySpec{Hostname: proto.String("zero.example.com"), Ipv4Addr: &zero},
+		&pb.TLSDecoySpec{Hostname: proto.String("short.example.com"), Ipv6Addr: bytes.Repeat([]byte{0x20}, 15)})
+	buf, err := proto.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "ClientConf"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = ValidateClientConf(conf)
+	for _, problem := range []string{"decoy 3 (zero.example.com): IPv4 address is 0.0.0.0", "decoy 4 (short.example.com): IPv6 address is 15 bytes, expected 16"} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Fatalf("%q missing from error: %v", problem, err)
+		}
+	}
+
+	// by default the decoys are loaded, but flagged
+	a := newAssets(dir)
+	a.readConfigs()
+	if len(a.GetAllDecoys()) != 5 {
+		t.Fatalf("%d decoys loaded, expected all 5", len(a.GetAllDecoys()))
+	}
+	if !strings.Contains(b.String(), "malformed decoy addresses") {
+		t.Fatalf("no warning about the malformed decoys logged: %s", b.String())
+	}
+
+	// in strict mode they are dropped
+	a = newAssets(dir)
+	a.SetStrictDecoyIPs(true)
+	a.readConfigs()
+	if a.GetGeneration() != gen {
+		t.Fatal("ClientConf with malformed decoys wasn't loaded in strict mode")
+	}
+	if err := ValidateClientConf(a.config); err != nil {
+		t.Fatalf("malformed decoys left in strict mode: %v", err)
+	}
+	if len(a.GetAllDecoys()) != 3 {
+		t.Fatalf("%d decoys loaded in strict mode, expected 3", len(a.GetAllDecoys()))
+	}
+}
+
+func TestAssets_ValidateAll(t *testing.T) {
+	a := newAssets("")
+	if err := a.ValidateAll(); err != nil {
+		t.Fatalf("default ClientConf without phantoms rejected: %v", err)
+	}
+
+	a.config.DecoyList.TlsDecoys = append(a.config.DecoyList.TlsDecoys, pb.InitTLSDecoySpec("192.122.190.107", ""))
+	a.config.DarkDecoyBlocks = &pb.DarkDecoyBlocks{Blocks: []string{"192.122.190.0/24", "192.122.190.128/25"}}
+	err := a.ValidateAll()
+	if err == nil {
+		t.Fatal("invalid ClientConf accepted")
+	}
+	for _, problem := range []string{"decoy 3 has no hostname", "192.122.190.0/24 and 192.122.190.128/25"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("%q missing from error: %v", problem, err)
+		}
+	}
+
+	a.config.DarkDecoyBlocks.Blocks = []string{"192.122.190.0/33"}
+	if err = a.ValidateAll(); err == nil || !strings.Contains(err.Error(), "192.122.190.0/33") {
+		t.Fatalf("malformed phantom subnet: got error %v", err)
+	}
+}
@@ -910,9 +910,9 @@ func SelectDecoys(sharedSecret []byte, version uint, width uint) ([]*pb.TLSDecoy
 	var allDecoys []*pb.TLSDecoySpec
 	switch version {
 	case v6:
-		allDecoys = Assets().GetV6Decoys()
+		allDecoys = Assets().GetDecoysForIPVersion(6)
 	case v4:
-		allDecoys = Assets().GetV4Decoys()
+		allDecoys = Assets().GetDecoysForIPVersion(4)
 	case both:
 		allDecoys = Assets().GetAllDecoys()
 	default:
@@ -985,6 +985,78 @@ func SelectPhantom(seed []byte, support uint) (*net.IP, *net.IP, error) {
 	}
 }
 
+// SelectDecoyAndPhantom - select the decoy to register through and the
+//		phantom to connect to, both derived from the shared secret so they
+//		are reproducible. The decoy comes from Assets().GetDecoyFromSeed and
+//		the phantom from ps.SelectPhantomFromSecret using weighted selection;
+//		the two derivations use distinct HKDF labels, so the choices do not
+//		correlate.
+func SelectDecoyAndPhantom(secret [32]byte, transform ps.SubnetFilter) (pb.TLSDecoySpec, net.IP, error) {
+	decoy, ok := Assets().GetDecoyFromSeed(secret[:])
+	if !ok {
+		return pb.TLSDecoySpec{}, nil, fmt.Errorf("no decoys to select from")
+	}
+	phantom, err := ps.SelectPhantomFromSecret(secret, phantomSubnets, transform, true)
+	if err != nil {
+		return pb.TLSDecoySpec{}, nil, err
+	}
+	return decoy, *phantom, nil
+}
+
+// Registration - the values a Conjure registration is assembled from, all
+//		derived from the shared secret, see BuildRegistration.
+type Registration struct {
+	Decoy       pb.TLSDecoySpec
+	Phantom     net.IP
+	PhantomPort uint16
+	CovertKey   []byte
+}
+
+// Range of phantom ports BuildRegistration selects from.
+const (
+	MinPhantomPort = 1024
+	MaxPhantomPort = 65535
+)
+
+// labelCovertKey is the HKDF label BuildRegistration derives the covert key
+// with, distinct from the decoy and phantom selection labels.
+const labelCovertKey = "conjure-covert-key"
+
+// covertKeyLen is the length of the covert key BuildRegistration derives.
+const covertKeyLen = 32
+
+// BuildRegistration - derive everything a Conjure registration needs from
+//		secret, so that it is reproducible and the station can derive the
+//		same values: the decoy from a.GetDecoyFromSeed, the phantom from
+//		subnets with ps.SelectPhantomFromSecret using weighted selection,
+//		the phantom port in [MinPhantomPort, MaxPhantomPort] with
+//		ps.SelectPhantomPort, and a covert key expanded with its own label.
+//		Each uses a distinct HKDF label, so the values do not correlate.
+func BuildRegistration(secret [32]byte, a *assets, subnets ps.SubnetConfig) (*Registration, error) {
+	if a == nil {
+		return nil, fmt.Errorf("no assets to select a decoy from")
+	}
+	decoy, ok := a.GetDecoyFromSeed(secret[:])
+	if !ok {
+		return nil, fmt.Errorf("no decoys to select from")
+	}
+	phantom, err := ps.SelectPhantomFromSecret(secret, subnets, nil, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select phantom: %w", err)
+	}
+	covertKey, err := ps.ExpandSeed(secret[:], labelCovertKey, covertKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive covert key: %w", err)
+	}
+
+	return &Registration{
+		Decoy:       decoy,
+		Phantom:     *phantom,
+		PhantomPort: ps.SelectPhantomPort(secret[:], MinPhantomPort, MaxPhantomPort),
+		CovertKey:   covertKey,
+	}, nil
+}
+
 func getStationKey() [32]byte {
 	return *Assets().GetConjurePubkey()
 }
@@ -1074,6 +1146,25 @@ func conjureHMAC(key []byte, str string) []byte {
 	return hash.Sum(nil)
 }
 
+// Labels for DeriveSelectionSeed, giving decoy and phantom selection
+// independent seeds from the same session secret.
+const (
+	DecoySelectionLabel   = "conjure-decoy-selection"
+	PhantomSelectionLabel = "conjure-phantom-selection"
+)
+
+// DeriveSelectionSeed - derive a 32 byte selection seed from the station
+//		public key and a per-session shared secret using HKDF-SHA256, with
+//		the secret as input keying material, the station key as salt and
+//		label as info. Client and station both hold these, so they derive
+//		identical seeds.
+func DeriveSelectionSeed(stationPubkey [32]byte, sharedSecret []byte, label string) []byte {
+	seed := make([]byte, 32)
+	// reading 32 bytes from HKDF-SHA256 can not fail
+	_, _ = io.ReadFull(hkdf.New(sha256.New, sharedSecret, stationPubkey[:], []byte(label)), seed)
+	return seed
+}
+
 // RegError - Registration Error passed during registration to indicate failure mode
 type RegError struct {
 	code uint
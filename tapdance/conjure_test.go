@@ -14,6 +14,7 @@ import (
 
 	"github.com/golang/protobuf/proto"
 	pb "github.com/refraction-networking/gotapdance/protobuf"
+	ps "github.com/refraction-networking/gotapdance/tapdance/phantoms"
 	tls "github.com/refraction-networking/utls"
 	"github.com/stretchr/testify/assert"
 )
@@ -67,13 +68,95 @@ func TestSelectBoth(t *testing.T) {
 		t.Fatalf("Failed to select IPv4 address (support: both): %v", err)
 	} else if phantomIPAddr6 == nil {
 		t.Fatalf("Failed to select IPv6 address (support: both): %v", err)
-	} else if phantomIPAddr6.String() != "2001:48a8:687f:1:41d3:ff12:45b:73c8" {
+	} else if phantomIPAddr6.String() != "2001:48a8:687f:1:18b:4a7c:32c9:4da7" {
 		t.Fatalf("Incorrect Address chosen: %s", phantomIPAddr6.String())
-	} else if phantomIPAddr4.String() != "192.122.190.194" {
+	} else if phantomIPAddr4.String() != "192.122.190.1" {
 		t.Fatalf("Incorrect Address chosen: %v", phantomIPAddr4.String())
 	}
 }
 
+func TestSelectDecoyAndPhantom(t *testing.T) {
+	var secret [32]byte
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+
+	decoy, phantom, err := SelectDecoyAndPhantom(secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if phantom.String() != "2001:48a8:687f:1:51:dfb8:7d6f:af66" {
+		t.Fatalf("Incorrect Address chosen: %v", phantom)
+	}
+	again, phantomAgain, err := SelectDecoyAndPhantom(secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if !proto.Equal(&decoy, &again) || !phantom.Equal(phantomAgain) {
+		t.Fatalf("same secret selected %v, %v then %v, %v", decoy.GetHostname(), phantom, again.GetHostname(), phantomAgain)
+	}
+
+	fromSeed, ok := Assets().GetDecoyFromSeed(secret[:])
+	if !ok || !proto.Equal(&decoy, &fromSeed) {
+		t.Fatalf("selected decoy %v, GetDecoyFromSeed returned %v", decoy.GetHostname(), fromSeed.GetHostname())
+	}
+
+	_, phantom4, err := SelectDecoyAndPhantom(secret, ps.V4Only)
+	if err != nil {
+		t.Fatal(err)
+	} else if phantom4.String() != "192.122.190.84" {
+		t.Fatalf("Incorrect Address chosen: %v", phantom4)
+	}
+}
+
+func TestBuildRegistration(t *testing.T) {
+	var secret [32]byte
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+
+	reg, err := BuildRegistration(secret, Assets(), phantomSubnets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoy, phantom, err := SelectDecoyAndPhantom(secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(&reg.Decoy, &decoy) || !reg.Phantom.Equal(phantom) {
+		t.Fatalf("registration selected %v, %v, expected %v, %v", reg.Decoy.GetHostname(), reg.Phantom, decoy.GetHostname(), phantom)
+	}
+	if reg.PhantomPort != 61533 {
+		t.Fatalf("registration selected port %d, expected 61533", reg.PhantomPort)
+	}
+	if hex.EncodeToString(reg.CovertKey) != "4500782d4704005a59c8aaed723ae3e4e0d44e5d421d03f8f7fb02151cf02845" {
+		t.Fatalf("unexpected covert key %x", reg.CovertKey)
+	}
+
+	again, err := BuildRegistration(secret, Assets(), phantomSubnets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(&reg.Decoy, &again.Decoy) || !reg.Phantom.Equal(again.Phantom) ||
+		reg.PhantomPort != again.PhantomPort || !bytes.Equal(reg.CovertKey, again.CovertKey) {
+		t.Fatalf("same secret built %+v then %+v", reg, again)
+	}
+
+	secret[0] ^= 1
+	other, err := BuildRegistration(secret, Assets(), phantomSubnets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(reg.CovertKey, other.CovertKey) {
+		t.Fatal("different secrets derived the same covert key")
+	}
+
+	if _, err := BuildRegistration(secret, nil, phantomSubnets); err == nil {
+		t.Fatal("registration built without assets")
+	}
+	if _, err := BuildRegistration(secret, Assets(), ps.SubnetConfig{}); err == nil {
+		t.Fatal("registration built without phantom subnets")
+	}
+}
+
 func TestConjureHMAC(t *testing.T) {
 	// generated using
 	// echo "customString" | hmac256 "1abcd2efgh3ijkl4"
@@ -96,6 +179,26 @@ func TestConjureHMAC(t *testing.T) {
 	}
 }
 
+func TestDeriveSelectionSeed(t *testing.T) {
+	var stationPubkey [32]byte
+	sharedSecret := make([]byte, 32)
+	for i := range stationPubkey {
+		stationPubkey[i] = byte(i)
+		sharedSecret[i] = byte(0x20 + i)
+	}
+
+	vectors := map[string]string{
+		DecoySelectionLabel:   "58a31f309af7857b78e0abbb0bec63e375f29b97c24dc74a420270e7622fd345",
+		PhantomSelectionLabel: "2437ee6af20fd60bed6ae4fa47e51ac4091565b9ae6d6b23874f1bb2b620e1df",
+	}
+	for label, expected := range vectors {
+		seed := DeriveSelectionSeed(stationPubkey, sharedSecret, label)
+		if hex.EncodeToString(seed) != expected {
+			t.Fatalf("%v: derived %x, expected %v", label, seed, expected)
+		}
+	}
+}
+
 func TestGenerateKeys(t *testing.T) {
 	fakePubkey := [32]byte{0}
 	keys, err := generateSharedKeys(fakePubkey)
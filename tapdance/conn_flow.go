@@ -554,7 +554,7 @@ func (flowConn *TapdanceFlowConn) processProto(msg *pb.StationToClient) error {
 			return
 		}
 
-		_err := Assets().SetClientConf(conf)
+		_err := Assets().SetFetchedClientConf(conf)
 		if _err != nil {
 			Logger().Warningln(flowConn.idStr() +
 				" could not persistently set ClientConf: " + _err.Error())
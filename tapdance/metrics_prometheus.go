@@ -0,0 +1,40 @@
+//go:build prometheus
+// +build prometheus
+
+package tapdance
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterMetrics registers gauges for the decoy count and ClientConf
+// generation, and counters for decoy selections and failures, with reg. They
+// read Metrics whenever they are collected. RegisterMetrics is only built
+// with the prometheus build tag, so other builds don't depend on the
+// Prometheus client.
+func (a *assets) RegisterMetrics(reg prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tapdance_decoys",
+			Help: "Number of decoys in the ClientConf.",
+		}, func() float64 { return float64(a.Metrics().Decoys) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tapdance_clientconf_generation",
+			Help: "Generation of the ClientConf.",
+		}, func() float64 { return float64(a.Metrics().Generation) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "tapdance_decoy_selections_total",
+			Help: "Decoys selected for connections.",
+		}, func() float64 { return float64(a.Metrics().DecoySelections) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "tapdance_decoy_failures_total",
+			Help: "Failed connections to decoys.",
+		}, func() float64 { return float64(a.Metrics().DecoyFailures) }),
+	}
+	for _, collector := range collectors {
+		if err := reg.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
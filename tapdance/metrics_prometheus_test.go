@@ -0,0 +1,54 @@
+//go:build prometheus
+// +build prometheus
+
+package tapdance
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAssets_RegisterMetrics(t *testing.T) {
+	a := newAssets("")
+	reg := prometheus.NewRegistry()
+	if err := a.RegisterMetrics(reg); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		a.GetDecoy()
+	}
+	a.ReportDecoyFailure(a.GetDecoy())
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if metric.GetGauge() != nil {
+				values[family.GetName()] = metric.GetGauge().GetValue()
+			} else if metric.GetCounter() != nil {
+				values[family.GetName()] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	for name, expected := range map[string]float64{
+		"tapdance_decoys":                 float64(len(a.GetAllDecoys())),
+		"tapdance_clientconf_generation":  float64(a.GetGeneration()),
+		"tapdance_decoy_selections_total": 6,
+		"tapdance_decoy_failures_total":   1,
+	} {
+		if value, ok := values[name]; !ok {
+			t.Fatalf("metric %v not registered", name)
+		} else if value != expected {
+			t.Fatalf("metric %v is %v, expected %v", name, value, expected)
+		}
+	}
+
+	// registering twice fails
+	if err := a.RegisterMetrics(reg); err == nil {
+		t.Fatal("metrics registered twice")
+	}
+}
@@ -0,0 +1,384 @@
+package phantoms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// labelCandidate prefixes the label used to derive the seed of every phantom
+// candidate after the first. The first candidate uses the seed itself, so it
+// is always the address SelectPhantom returns.
+const labelCandidate = "phantom-candidate-"
+
+// maxCandidateAttemptsPerAddr bounds how many derivations SelectPhantomsN
+// tries per requested address before giving up on finding distinct ones.
+const maxCandidateAttemptsPerAddr = 64
+
+// candidateSeed - derive the seed for the i-th selection attempt.
+func candidateSeed(seed []byte, i int) ([]byte, error) {
+	if i == 0 {
+		return seed, nil
+	}
+	return ExpandSeed(seed, fmt.Sprintf("%s%d", labelCandidate, i), 32)
+}
+
+// subnetAddresses - every address in the subnets, subnet by subnet in the
+//		order given, and within each subnet in ascending order as
+//		IterateSubnet walks them. Only meant for subnets already known to
+//		be small.
+func subnetAddresses(subnets []*net.IPNet) []net.IP {
+	var out []net.IP
+	for _, _net := range subnets {
+		size := addressCount([]*net.IPNet{_net}).Int64()
+		for i := int64(0); i < size; i++ {
+			out = append(out, addrAtOffset(_net, big.NewInt(i)))
+		}
+	}
+	return out
+}
+
+// AddrFilter - reports whether a selected phantom address may be used, for
+//		rejecting single addresses after selection, such as a deny-list of
+//		hosts, which a SubnetFilter can only do by splitting subnets.
+type AddrFilter func(net.IP) bool
+
+// ExcludeIPs - an AddrFilter rejecting the given addresses, for phantoms that
+//		got blocked while the rest of their subnet is still usable. Use it
+//		with SelectPhantomFiltered, which then never returns an excluded
+//		address and moves past it deterministically. IPv4 addresses match
+//		in 4 and 16 byte form alike.
+func ExcludeIPs(ips []net.IP) AddrFilter {
+	excluded := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		excluded[ip.String()] = true
+	}
+	return func(addr net.IP) bool {
+		return !excluded[addr.String()]
+	}
+}
+
+// MaxSelectionRetries bounds how many further addresses SelectPhantomFiltered
+// derives once the first one is rejected.
+const MaxSelectionRetries = 16
+
+// ErrSelectionRetriesExhausted is returned by SelectPhantomFiltered when the
+// address of every attempt was rejected.
+var ErrSelectionRetriesExhausted = errors.New("every derived phantom address was rejected")
+
+// SelectPhantomFiltered - SelectPhantom, deriving another address whenever
+//		accept rejects the selected one. Attempt i selects from the i-th
+//		candidate seed, as SelectPhantomCandidates does, so the first
+//		attempt is the SelectPhantom address and both ends reproduce the
+//		same retries. Attempts whose weighted group the transform empties
+//		are skipped. After MaxSelectionRetries retries it gives up with
+//		ErrSelectionRetriesExhausted. A nil accept takes every address.
+func SelectPhantomFiltered(seed []byte, subnets SubnetConfig, transform SubnetFilter, weighted bool, accept AddrFilter) (*net.IP, error) {
+	if accept == nil {
+		return SelectPhantom(seed, subnets, transform, weighted)
+	}
+	addr, err := selectAccepted(seed, subnets, transform, weighted, accept, MaxSelectionRetries+1)
+	if err != nil || addr != nil {
+		return addr, err
+	}
+	return nil, fmt.Errorf("%w after %d retries", ErrSelectionRetriesExhausted, MaxSelectionRetries)
+}
+
+// selectAccepted - the address of the first of attempts candidate seeds that
+//		accept takes, skipping those whose weighted group the transform
+//		empties, or nil if there is none.
+func selectAccepted(seed []byte, subnets SubnetConfig, transform SubnetFilter, weighted bool, accept AddrFilter, attempts int) (*net.IP, error) {
+	for i := 0; i < attempts; i++ {
+		attemptSeed, err := candidateSeed(seed, i)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := SelectPhantom(attemptSeed, subnets, transform, weighted)
+		if errors.Is(err, ErrNoSubnetsAfterFilter) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if accept(*addr) {
+			return addr, nil
+		}
+	}
+	return nil, nil
+}
+
+// MaxIterateSubnetAddrs caps the number of addresses IterateSubnet will walk,
+// so a /8 or a /64 isn't enumerated by mistake.
+var MaxIterateSubnetAddrs int64 = 1 << 16
+
+// IterateSubnet - call fn with every address in net1 until fn returns
+//		false. Addresses are walked in strictly ascending numeric order,
+//		reading them as big endian integers, from the network address
+//		(host bits of net1.IP are ignored) to the last address of the
+//		subnet, for IPv4 and IPv6 alike. Subnets holding more than
+//		MaxIterateSubnetAddrs addresses are refused with an error before
+//		fn is called.
+func IterateSubnet(net1 *net.IPNet, fn func(net.IP) bool) error {
+	if net1 == nil {
+		return fmt.Errorf("no subnet to iterate")
+	}
+	size := addressCount([]*net.IPNet{net1})
+	if size.Cmp(big.NewInt(MaxIterateSubnetAddrs)) > 0 {
+		return fmt.Errorf("subnet %v has %v addresses, more than the %d allowed for iteration", net1, size, MaxIterateSubnetAddrs)
+	}
+
+	for i := int64(0); i < size.Int64(); i++ {
+		if !fn(addrAtOffset(net1, big.NewInt(i))) {
+			break
+		}
+	}
+	return nil
+}
+
+// SelectPhantomsN - select n distinct phantom addresses based on shared secret.
+//		The first address is the one SelectPhantom would return, later ones
+//		are selected from seeds derived from the secret, skipping addresses
+//		already selected. If the (filtered) config has n addresses or fewer
+//		all of them are returned, the ones the derivation did not reach
+//		appended in config order.
+func SelectPhantomsN(seed []byte, n int, subnets SubnetConfig, transform SubnetFilter, weighted bool) ([]net.IP, error) {
+	return SelectPhantomsNContext(context.Background(), seed, n, subnets, transform, weighted)
+}
+
+// SelectPhantomsNContext - SelectPhantomsN, giving up with ctx.Err() once
+//		ctx is done. ctx is checked before every selection attempt.
+func SelectPhantomsNContext(ctx context.Context, seed []byte, n int, subnets SubnetConfig, transform SubnetFilter, weighted bool) ([]net.IP, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of phantoms %d", n)
+	}
+
+	all, err := subnets.ParsedSubnets()
+	if err != nil {
+		return nil, err
+	}
+	if transform != nil {
+		all, err = transform(all)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(all) == 0 {
+		return nil, ErrNoSubnetsAfterFilter
+	}
+	smallSpace := addressCount(all).Cmp(big.NewInt(int64(n))) <= 0
+
+	selected := make([]net.IP, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(selected) < n && i < n*maxCandidateAttemptsPerAddr; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		attemptSeed, err := candidateSeed(seed, i)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := SelectPhantom(attemptSeed, subnets, transform, weighted)
+		if errors.Is(err, ErrNoSubnetsAfterFilter) {
+			// the weighted group chosen for this attempt was filtered out
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !seen[addr.String()] {
+			seen[addr.String()] = true
+			selected = append(selected, *addr)
+		}
+	}
+
+	if smallSpace {
+		for _, addr := range subnetAddresses(all) {
+			if !seen[addr.String()] {
+				seen[addr.String()] = true
+				selected = append(selected, addr)
+			}
+		}
+	} else if len(selected) < n {
+		return nil, fmt.Errorf("only found %d of %d distinct phantoms", len(selected), n)
+	}
+	return selected, nil
+}
+
+// SelectPhantomsFromSubnet - select n distinct addresses within net1 based on
+//		shared secret, with SelectAddrFromSubnet over the seeds SelectPhantomsN
+//		derives, skipping addresses already selected. n is capped at the size
+//		of the subnet; if the derivation doesn't reach n distinct addresses
+//		in a subnet that small, the rest are appended in subnet order.
+func SelectPhantomsFromSubnet(seed []byte, net1 *net.IPNet, n int) ([]net.IP, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of phantoms %d", n)
+	} else if net1 == nil {
+		return nil, fmt.Errorf("%w: nil subnet", ErrInvalidSubnet)
+	}
+	size := addressCount([]*net.IPNet{net1})
+	smallSpace := size.Cmp(big.NewInt(int64(n))) <= 0
+	if smallSpace {
+		n = int(size.Int64())
+	}
+
+	selected := make([]net.IP, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(selected) < n && i < n*maxCandidateAttemptsPerAddr; i++ {
+		attemptSeed, err := candidateSeed(seed, i)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := SelectAddrFromSubnet(attemptSeed, net1)
+		if err != nil {
+			return nil, err
+		}
+
+		if !seen[addr.String()] {
+			seen[addr.String()] = true
+			selected = append(selected, addr)
+		}
+	}
+
+	if smallSpace {
+		for _, addr := range subnetAddresses([]*net.IPNet{net1}) {
+			if len(selected) == n {
+				break
+			} else if !seen[addr.String()] {
+				seen[addr.String()] = true
+				selected = append(selected, addr)
+			}
+		}
+	} else if len(selected) < n {
+		return nil, fmt.Errorf("only found %d of %d distinct addresses in %v", len(selected), n, net1)
+	}
+	return selected, nil
+}
+
+// SelectPhantomCandidates - select an ordered list of n distinct phantom
+//		addresses based on shared secret, using weighted selection. Clients
+//		try them in order, and as both ends derive the same list, the
+//		station knows which phantom comes next. The order contract is that
+//		of SelectPhantomsN: the first candidate is the SelectPhantom result
+//		and each following one comes from the next derived seed yielding an
+//		address not already in the list.
+func SelectPhantomCandidates(seed []byte, n int, subnets SubnetConfig, transform SubnetFilter) ([]net.IP, error) {
+	return SelectPhantomsN(seed, n, subnets, transform, true)
+}
+
+// SelectPhantomBatch - select one phantom per seed using weighted selection.
+//		The result for each seed is identical to that of SelectPhantom, but
+//		subnets are parsed and filtered, and their id ranges computed, only
+//		once per subnet group, or per subnet of groups with SubnetWeights, for
+//		the whole batch.
+func SelectPhantomBatch(seeds [][]byte, subnets SubnetConfig, transform SubnetFilter) ([]net.IP, error) {
+	return SelectPhantomBatchContext(context.Background(), seeds, subnets, transform)
+}
+
+// SelectPhantomBatchContext - SelectPhantomBatch, giving up with ctx.Err()
+//		once ctx is done. ctx is checked before every seed.
+func SelectPhantomBatchContext(ctx context.Context, seeds [][]byte, subnets SubnetConfig, transform SubnetFilter) ([]net.IP, error) {
+	version, err := subnets.algVersion()
+	if err != nil {
+		return nil, err
+	}
+	if subnets.Strict {
+		if err := subnets.ValidateNoOverlap(); err != nil {
+			return nil, err
+		}
+	}
+
+	// selectors by group and, for groups with subnet weights, subnet
+	selectors := make(map[[2]int]*addrSelector)
+	out := make([]net.IP, 0, len(seeds))
+	for i, seed := range seeds {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if len(seed) < MinSeedLen {
+			return nil, fmt.Errorf("seed %d: %w", i, shortSeedError(seed))
+		}
+
+		exp := hkdfExpander(seed)
+		group, err := subnets.groupIndex(exp, nil)
+		if err != nil {
+			return nil, fmt.Errorf("seed %d: %w", i, err)
+		}
+		subnetIndex, err := subnets.subnetIndex(exp, group)
+		if err != nil {
+			return nil, fmt.Errorf("seed %d: %w", i, err)
+		}
+		key := [2]int{group, subnetIndex}
+		sel, ok := selectors[key]
+		if !ok {
+			s, err := filteredSubnets(subnets.weightedGroupSubnets(group, subnetIndex), transform)
+			if err != nil {
+				return nil, fmt.Errorf("seed %d: %w", i, err)
+			}
+			sel, err = newAddrSelector(s, subnets.subnetWidth())
+			if err != nil {
+				return nil, fmt.Errorf("seed %d: %w", i, err)
+			}
+			selectors[key] = sel
+		}
+
+		addr, subnet, err := sel.selectAddrAlg(exp, version, nil)
+		if err != nil {
+			return nil, fmt.Errorf("seed %d: %w", i, err)
+		}
+		addr, err = subnets.alignV6(exp, addr, subnet)
+		if err != nil {
+			return nil, fmt.Errorf("seed %d: %w", i, err)
+		}
+		addr, err = subnets.usableHost(exp, addr, subnet)
+		if err != nil {
+			return nil, fmt.Errorf("seed %d: %w", i, err)
+		}
+		out = append(out, *addr)
+	}
+	return out, nil
+}
+
+// ErrPhantomSpaceExhausted is returned by SelectPhantomExcluding when every
+// address the config can produce has been excluded.
+var ErrPhantomSpaceExhausted = errors.New("every phantom address is excluded")
+
+// SelectPhantomExcluding - select a phantom address based on shared secret,
+//		using weighted selection, that is not in exclude. Attempts follow the
+//		SelectPhantomCandidates order, so with nothing excluded the result is
+//		the SelectPhantom address and the choice is reproducible for a given
+//		(seed, exclude) pair. If the derivation keeps landing on excluded
+//		addresses in a (filtered) config small enough to enumerate, the first
+//		address not excluded in config order is returned instead.
+func SelectPhantomExcluding(seed []byte, subnets SubnetConfig, transform SubnetFilter, exclude []net.IP) (*net.IP, error) {
+	accept := ExcludeIPs(exclude)
+
+	maxAttempts := (len(exclude) + 1) * maxCandidateAttemptsPerAddr
+	addr, err := selectAccepted(seed, subnets, transform, true, accept, maxAttempts)
+	if err != nil || addr != nil {
+		return addr, err
+	}
+
+	all, err := subnets.ParsedSubnets()
+	if err != nil {
+		return nil, err
+	}
+	if transform != nil {
+		all, err = transform(all)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(all) == 0 {
+		return nil, ErrNoSubnetsAfterFilter
+	}
+	if addressCount(all).Cmp(big.NewInt(int64(maxAttempts))) > 0 {
+		return nil, fmt.Errorf("no phantom outside %d excluded addresses after %d attempts", len(exclude), maxAttempts)
+	}
+	for _, addr := range subnetAddresses(all) {
+		if accept(addr) {
+			return &addr, nil
+		}
+	}
+	return nil, ErrPhantomSpaceExhausted
+}
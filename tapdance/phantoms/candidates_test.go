@@ -0,0 +1,533 @@
+package phantoms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelectPhantomsN(t *testing.T) {
+	seed := []byte("seedseedseedseed")
+
+	addrs, err := SelectPhantomsN(seed, 20, phantomSubnets, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(addrs) != 20 {
+		t.Fatalf("selected %d phantoms, expected 20", len(addrs))
+	}
+
+	first, err := SelectPhantom(seed, phantomSubnets, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if !first.Equal(addrs[0]) {
+		t.Fatalf("first of n phantoms %v differs from SelectPhantom %v", addrs[0], first)
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr.String()] {
+			t.Fatalf("phantom %v selected twice", addr)
+		}
+		seen[addr.String()] = true
+	}
+
+	again, err := SelectPhantomsN(seed, 20, phantomSubnets, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range addrs {
+		if !addrs[i].Equal(again[i]) {
+			t.Fatalf("phantom %d changed between runs: %v -> %v", i, addrs[i], again[i])
+		}
+	}
+}
+
+func TestSelectPhantomsNSmallSpace(t *testing.T) {
+	small := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: []string{"192.122.190.0/30", "2001:48a8:687f:1::/127"}},
+		},
+	}
+	seed := []byte("seedseedseedseed")
+
+	addrs, err := SelectPhantomsN(seed, 10, small, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(addrs) != 6 {
+		t.Fatalf("selected %v, expected all 6 addresses", addrs)
+	}
+
+	addrs, err = SelectPhantomsN(seed, 5, small, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(addrs) != 5 {
+		t.Fatalf("selected %v, expected 5 addresses", addrs)
+	}
+	_, v4, _ := net.ParseCIDR("192.122.190.0/30")
+	_, v6, _ := net.ParseCIDR("2001:48a8:687f:1::/127")
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr.String()] {
+			t.Fatalf("phantom %v selected twice", addr)
+		} else if !v4.Contains(addr) && !v6.Contains(addr) {
+			t.Fatalf("phantom %v is not in the config", addr)
+		}
+		seen[addr.String()] = true
+	}
+
+	addrs, err = SelectPhantomsN(seed, 3, small, V6Only, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(addrs) != 2 {
+		t.Fatalf("selected %v, expected the 2 IPv6 addresses", addrs)
+	}
+}
+
+func TestSelectPhantomsFromSubnet(t *testing.T) {
+	seed := []byte("seedseedseedseed")
+
+	for _, c := range []struct {
+		subnet   string
+		n        int
+		expected int
+	}{
+		{"192.122.190.0/24", 200, 200},
+		{"192.122.190.0/24", 256, 256},
+		{"192.122.190.0/28", 100, 16},
+		{"192.122.190.9/32", 3, 1},
+		{"2001:48a8:687f:1::/64", 1000, 1000},
+		{"2001:48a8:687f:1::/126", 4, 4},
+	} {
+		subnet := mustParseSubnets(c.subnet)[0]
+		addrs, err := SelectPhantomsFromSubnet(seed, subnet, c.n)
+		if err != nil {
+			t.Fatalf("%v: %v", c.subnet, err)
+		} else if len(addrs) != c.expected {
+			t.Fatalf("%v: selected %d addresses, expected %d", c.subnet, len(addrs), c.expected)
+		}
+
+		seen := make(map[string]bool)
+		for _, addr := range addrs {
+			if !subnet.Contains(addr) {
+				t.Fatalf("%v: selected %v outside of the subnet", c.subnet, addr)
+			} else if seen[addr.String()] {
+				t.Fatalf("%v: selected %v twice", c.subnet, addr)
+			}
+			seen[addr.String()] = true
+		}
+
+		first, err := SelectAddrFromSubnet(seed, subnet)
+		if err != nil {
+			t.Fatal(err)
+		} else if !first.Equal(addrs[0]) {
+			t.Fatalf("%v: first address %v differs from SelectAddrFromSubnet %v", c.subnet, addrs[0], first)
+		}
+	}
+
+	if _, err := SelectPhantomsFromSubnet(seed, nil, 1); !errors.Is(err, ErrInvalidSubnet) {
+		t.Fatalf("nil subnet: got error %v, expected %v", err, ErrInvalidSubnet)
+	}
+	if _, err := SelectPhantomsFromSubnet(seed, mustParseSubnets("192.122.190.0/24")[0], 0); err == nil {
+		t.Fatal("selecting no addresses did not fail")
+	}
+}
+
+func TestSelectPhantomCandidates(t *testing.T) {
+	seed := []byte("seedseedseedseed")
+
+	candidates, err := SelectPhantomCandidates(seed, 8, phantomSubnets, V4Only)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(candidates) != 8 {
+		t.Fatalf("selected %d candidates, expected 8", len(candidates))
+	}
+
+	first, err := SelectPhantom(seed, phantomSubnets, V4Only, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if !first.Equal(candidates[0]) {
+		t.Fatalf("first candidate %v differs from SelectPhantom %v", candidates[0], first)
+	}
+
+	// asking for fewer candidates gives a prefix of the same order
+	fewer, err := SelectPhantomCandidates(seed, 3, phantomSubnets, V4Only)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range fewer {
+		if !fewer[i].Equal(candidates[i]) {
+			t.Fatalf("candidate %d is %v, expected %v", i, fewer[i], candidates[i])
+		}
+	}
+
+	// the order of a small space starts with the derived candidates
+	small := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.122.190.0/30"}}}}
+	all, err := SelectPhantomCandidates(seed, 4, small, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(all) != 4 {
+		t.Fatalf("selected %v, expected all 4 addresses", all)
+	}
+	first, err = SelectPhantom(seed, small, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if !first.Equal(all[0]) {
+		t.Fatalf("first candidate %v differs from SelectPhantom %v", all[0], first)
+	}
+}
+
+func TestSelectPhantomBatch(t *testing.T) {
+	r := rand.New(rand.NewSource(6060))
+	seeds := make([][]byte, 500)
+	for i := range seeds {
+		seeds[i] = make([]byte, 16)
+		r.Read(seeds[i])
+	}
+
+	// V6Only is left out as the lighter group has no IPv6 subnets
+	for _, filter := range []SubnetFilter{nil, V4Only} {
+		batch, err := SelectPhantomBatch(seeds, phantomSubnets, filter)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(batch) != len(seeds) {
+			t.Fatalf("selected %d phantoms for %d seeds", len(batch), len(seeds))
+		}
+		for i, seed := range seeds {
+			addr, err := SelectPhantom(seed, phantomSubnets, filter, true)
+			if err != nil {
+				t.Fatal(err)
+			} else if !addr.Equal(batch[i]) {
+				t.Fatalf("seed %x: batch selected %v, SelectPhantom %v", seed, batch[i], addr)
+			}
+		}
+	}
+
+	_, err := SelectPhantomBatch([][]byte{seeds[0], {1}}, phantomSubnets, nil)
+	if !errors.Is(err, ErrSeedTooShort) {
+		t.Fatalf("short seed in batch returned %v", err)
+	}
+}
+
+func BenchmarkSelectPhantomBatch(b *testing.B) {
+	r := rand.New(rand.NewSource(6161))
+	seeds := make([][]byte, 1000)
+	for i := range seeds {
+		seeds[i] = make([]byte, 16)
+		r.Read(seeds[i])
+	}
+
+	b.Run("per-seed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, seed := range seeds {
+				if _, err := SelectPhantom(seed, phantomSubnets, V4Only, true); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := SelectPhantomBatch(seeds, phantomSubnets, V4Only); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// cancelAfter is a context reporting context.Canceled once Err has been
+// called more than checks times, to cancel a loop at a known point.
+type cancelAfter struct {
+	context.Context
+	checks int
+}
+
+func (c *cancelAfter) Err() error {
+	if c.checks <= 0 {
+		return context.Canceled
+	}
+	c.checks--
+	return nil
+}
+
+func TestSelectionContextCancel(t *testing.T) {
+	r := rand.New(rand.NewSource(6161))
+	seeds := make([][]byte, 1000)
+	for i := range seeds {
+		seeds[i] = make([]byte, 16)
+		r.Read(seeds[i])
+	}
+	seed := []byte("seedseedseedseed")
+
+	for name, run := range map[string]func(ctx context.Context) error{
+		"batch": func(ctx context.Context) error {
+			_, err := SelectPhantomBatchContext(ctx, seeds, phantomSubnets, nil)
+			return err
+		},
+		"n": func(ctx context.Context) error {
+			_, err := SelectPhantomsNContext(ctx, seed, 1000, phantomSubnets, nil, true)
+			return err
+		},
+		"histogram": func(ctx context.Context) error {
+			_, err := SelectionHistogramContext(ctx, phantomSubnets, nil, 1000)
+			return err
+		},
+	} {
+		if err := run(context.Background()); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+
+		// cancelled mid-run, after 100 selections
+		if err := run(&cancelAfter{context.Background(), 100}); err != context.Canceled {
+			t.Fatalf("%v: cancelled run returned %v, expected %v", name, err, context.Canceled)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := run(ctx); err != context.Canceled {
+			t.Fatalf("%v: cancelled run returned %v, expected %v", name, err, context.Canceled)
+		}
+	}
+
+	// a real cancellation stops a long batch promptly
+	long := make([][]byte, 0, 1000000)
+	for len(long) < cap(long) {
+		long = append(long, seeds...)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := SelectPhantomBatchContext(ctx, long, phantomSubnets, nil); err != context.Canceled {
+		t.Fatalf("long batch returned %v, expected %v", err, context.Canceled)
+	} else if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("long batch took %v to notice cancellation", elapsed)
+	}
+}
+
+func TestSelectPhantomExcluding(t *testing.T) {
+	seed := []byte("seedseedseedseed")
+
+	first, err := SelectPhantom(seed, phantomSubnets, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := SelectPhantomExcluding(seed, phantomSubnets, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if !same.Equal(*first) {
+		t.Fatalf("nothing excluded selected %v, SelectPhantom selected %v", same, first)
+	}
+
+	next, err := SelectPhantomExcluding(seed, phantomSubnets, nil, []net.IP{*first})
+	if err != nil {
+		t.Fatal(err)
+	} else if next.Equal(*first) {
+		t.Fatalf("excluded phantom %v selected again", first)
+	}
+	again, err := SelectPhantomExcluding(seed, phantomSubnets, nil, []net.IP{*first})
+	if err != nil {
+		t.Fatal(err)
+	} else if !again.Equal(*next) {
+		t.Fatalf("same seed and exclusions selected %v then %v", next, again)
+	}
+
+	small := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: []string{"192.122.190.0/31"}},
+		},
+	}
+	all := []net.IP{net.ParseIP("192.122.190.0"), net.ParseIP("192.122.190.1")}
+	last, err := SelectPhantomExcluding(seed, small, nil, all[:1])
+	if err != nil {
+		t.Fatal(err)
+	} else if !last.Equal(all[1]) {
+		t.Fatalf("selected %v, expected the only address not excluded", last)
+	}
+	_, err = SelectPhantomExcluding(seed, small, nil, all)
+	if err != ErrPhantomSpaceExhausted {
+		t.Fatalf("expected ErrPhantomSpaceExhausted, got %v", err)
+	}
+}
+
+func TestSelectPhantomFiltered(t *testing.T) {
+	seed := []byte("seedseedseedseed")
+
+	first, err := SelectPhantom(seed, phantomSubnets, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := SelectPhantomFiltered(seed, phantomSubnets, nil, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if !same.Equal(*first) {
+		t.Fatalf("nil filter selected %v, SelectPhantom selected %v", same, first)
+	}
+
+	// the first derived address is rejected, the retry comes from the next
+	// candidate seed every time
+	notFirst := func(addr net.IP) bool { return !addr.Equal(*first) }
+	retrySeed, err := candidateSeed(seed, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := SelectPhantom(retrySeed, phantomSubnets, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		retried, err := SelectPhantomFiltered(seed, phantomSubnets, nil, true, notFirst)
+		if err != nil {
+			t.Fatal(err)
+		} else if !retried.Equal(*expected) {
+			t.Fatalf("run %d: retry selected %v, expected %v", i, retried, expected)
+		}
+	}
+
+	rejectAll := func(net.IP) bool { return false }
+	if _, err := SelectPhantomFiltered(seed, phantomSubnets, nil, true, rejectAll); !errors.Is(err, ErrSelectionRetriesExhausted) {
+		t.Fatalf("everything rejected: got error %v, expected %v", err, ErrSelectionRetriesExhausted)
+	}
+	if _, err := SelectPhantomFiltered([]byte("short"), phantomSubnets, nil, true, rejectAll); !errors.Is(err, ErrSeedTooShort) {
+		t.Fatalf("short seed: got error %v, expected %v", err, ErrSeedTooShort)
+	}
+
+	// an attempt whose group the transform empties is skipped, as by
+	// SelectPhantomExcluding
+	split := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{"2001:48a8:687f:1::/64"}},
+		{Weight: 1, Subnets: []string{"192.122.190.0/24"}},
+	}}
+	for i := 0; i < 64; i++ {
+		seed := []byte(fmt.Sprintf("seedseedseedse%02d", i))
+		if _, err := SelectPhantom(seed, split, V4Only, true); !errors.Is(err, ErrNoSubnetsAfterFilter) {
+			continue
+		}
+		filtered, err := SelectPhantomFiltered(seed, split, V4Only, true, ExcludeIPs(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		excluding, err := SelectPhantomExcluding(seed, split, V4Only, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if !filtered.Equal(*excluding) {
+			t.Fatalf("SelectPhantomFiltered selected %v, SelectPhantomExcluding %v", filtered, excluding)
+		}
+		return
+	}
+	t.Fatal("no seed chose the filtered out group")
+}
+
+func TestExcludeIPs(t *testing.T) {
+	seed := []byte("seedseedseedseed")
+	first, err := SelectPhantom(seed, phantomSubnets, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exclude := []net.IP{*first, net.ParseIP("2001:48a8:687f:1::1")}
+	skipped, err := SelectPhantomFiltered(seed, phantomSubnets, nil, true, ExcludeIPs(exclude))
+	if err != nil {
+		t.Fatal(err)
+	} else if skipped.Equal(*first) {
+		t.Fatalf("excluded phantom %v selected", first)
+	}
+	again, err := SelectPhantomFiltered(seed, phantomSubnets, nil, true, ExcludeIPs(exclude))
+	if err != nil {
+		t.Fatal(err)
+	} else if !again.Equal(*skipped) {
+		t.Fatalf("same seed and exclusions selected %v then %v", skipped, again)
+	}
+	excluding, err := SelectPhantomExcluding(seed, phantomSubnets, nil, exclude)
+	if err != nil {
+		t.Fatal(err)
+	} else if !excluding.Equal(*skipped) {
+		t.Fatalf("SelectPhantomExcluding selected %v, SelectPhantomFiltered %v", excluding, skipped)
+	}
+
+	accept := ExcludeIPs([]net.IP{net.ParseIP("192.122.190.7")})
+	if accept(net.IPv4(192, 122, 190, 7).To4()) || accept(net.IPv4(192, 122, 190, 7).To16()) {
+		t.Fatal("excluded IPv4 address accepted")
+	} else if !accept(net.IPv4(192, 122, 190, 8)) {
+		t.Fatal("address not excluded was rejected")
+	}
+}
+
+func TestIterateSubnet(t *testing.T) {
+	_, net1, _ := net.ParseCIDR("192.122.190.0/30")
+
+	var addrs []string
+	err := IterateSubnet(net1, func(addr net.IP) bool {
+		addrs = append(addrs, addr.String())
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"192.122.190.0", "192.122.190.1", "192.122.190.2", "192.122.190.3"}
+	if len(addrs) != len(expected) {
+		t.Fatalf("iterated %v, expected %v", addrs, expected)
+	}
+	for i := range expected {
+		if addrs[i] != expected[i] {
+			t.Fatalf("iterated %v, expected %v", addrs, expected)
+		}
+	}
+
+	calls := 0
+	err = IterateSubnet(net1, func(addr net.IP) bool {
+		calls++
+		return calls < 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if calls != 2 {
+		t.Fatalf("iteration continued for %d calls after fn returned false", calls)
+	}
+
+	// host bits are ignored and v6 addresses ascend like big endian
+	// integers, carrying into the upper bytes
+	_, v6net, _ := net.ParseCIDR("2001:db8::fff8/125")
+	v6net.IP = net.ParseIP("2001:db8::fffb")
+	addrs = nil
+	err = IterateSubnet(v6net, func(addr net.IP) bool {
+		addrs = append(addrs, addr.String())
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"2001:db8::fff8", "2001:db8::fff9", "2001:db8::fffa", "2001:db8::fffb",
+		"2001:db8::fffc", "2001:db8::fffd", "2001:db8::fffe", "2001:db8::ffff",
+	}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("iterated %v, expected %v", addrs, expected)
+	}
+	_, carry, _ := net.ParseCIDR("2001:db8::1:fe00/119")
+	var prev *big.Int
+	err = IterateSubnet(carry, func(addr net.IP) bool {
+		n := big.NewInt(0).SetBytes(addr.To16())
+		if prev != nil && n.Cmp(big.NewInt(0).Add(prev, big.NewInt(1))) != 0 {
+			t.Fatalf("%v doesn't follow %x", addr, prev)
+		}
+		prev = n
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, wide, _ := net.ParseCIDR("10.0.0.0/8")
+	err = IterateSubnet(wide, func(addr net.IP) bool {
+		t.Fatalf("fn called for oversized subnet with %v", addr)
+		return false
+	})
+	if err == nil {
+		t.Fatal("expected an error iterating a /8")
+	}
+}
@@ -0,0 +1,52 @@
+package phantoms
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// ErrNoPhantomSubnets is returned when a ClientConf carries no phantom subnets.
+var ErrNoPhantomSubnets = errors.New("ClientConf carries no phantom subnets")
+
+// SubnetConfigFromClientConf - build a SubnetConfig from the phantom subnets
+//		(dark decoy blocks) of a ClientConf. The ClientConf lists the blocks
+//		without weights, so they form a single group of weight 1, and the
+//		config applies to the ClientConf generation, see conf.GetGeneration.
+//		The result is checked with Validate.
+func SubnetConfigFromClientConf(conf *pb.ClientConf) (SubnetConfig, error) {
+	blocks := conf.GetDarkDecoyBlocks().GetBlocks()
+	if len(blocks) == 0 {
+		return SubnetConfig{}, ErrNoPhantomSubnets
+	}
+
+	sc := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: append([]string{}, blocks...)},
+		},
+	}
+	if err := sc.Validate(); err != nil {
+		return SubnetConfig{}, err
+	}
+	return sc, nil
+}
+
+// LoadPhantomSubnetsFromClientConf - read a marshalled ClientConf file and
+//		build a SubnetConfig from it, see SubnetConfigFromClientConf. This
+//		suits tools that don't need the rest of the tapdance assets; a
+//		ClientConf encrypted at rest by the assets can't be read this way.
+func LoadPhantomSubnetsFromClientConf(path string) (SubnetConfig, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return SubnetConfig{}, err
+	}
+
+	conf := &pb.ClientConf{}
+	if err := proto.Unmarshal(buf, conf); err != nil {
+		return SubnetConfig{}, fmt.Errorf("failed to unmarshal ClientConf %v: %w", path, err)
+	}
+	return SubnetConfigFromClientConf(conf)
+}
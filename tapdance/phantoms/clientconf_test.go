@@ -0,0 +1,100 @@
+package phantoms
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+func TestSubnetConfigFromClientConf(t *testing.T) {
+	gen := uint32(1153)
+	conf := &pb.ClientConf{
+		Generation: &gen,
+		DarkDecoyBlocks: &pb.DarkDecoyBlocks{
+			Blocks: []string{"192.122.190.0/24", "2001:48a8:687f:1::/64", "141.219.0.0/16"},
+		},
+	}
+
+	sc, err := SubnetConfigFromClientConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(sc.WeightedSubnets) != 1 || sc.WeightedSubnets[0].Weight != 1 {
+		t.Fatalf("expected a single group of weight 1, got %+v", sc.WeightedSubnets)
+	}
+	for i, block := range conf.GetDarkDecoyBlocks().GetBlocks() {
+		if sc.WeightedSubnets[0].Subnets[i] != block {
+			t.Fatalf("subnets %v differ from ClientConf blocks %v", sc.WeightedSubnets[0].Subnets, conf.GetDarkDecoyBlocks().GetBlocks())
+		}
+	}
+
+	// the config must not alias the ClientConf
+	conf.DarkDecoyBlocks.Blocks[0] = "35.8.0.0/16"
+	if sc.WeightedSubnets[0].Subnets[0] != "192.122.190.0/24" {
+		t.Fatal("changing the ClientConf changed the subnet config")
+	}
+
+	if _, err := SelectPhantom([]byte("seedseedseedseed"), sc, nil, true); err != nil {
+		t.Fatalf("selection from converted config failed: %v", err)
+	}
+
+	for _, empty := range []*pb.ClientConf{nil, {Generation: &gen}, {DarkDecoyBlocks: &pb.DarkDecoyBlocks{}}} {
+		if _, err := SubnetConfigFromClientConf(empty); err != ErrNoPhantomSubnets {
+			t.Fatalf("ClientConf without phantoms: got error %v, expected %v", err, ErrNoPhantomSubnets)
+		}
+	}
+
+	bad := &pb.ClientConf{DarkDecoyBlocks: &pb.DarkDecoyBlocks{Blocks: []string{"192.122.190.0/33"}}}
+	if _, err := SubnetConfigFromClientConf(bad); err == nil {
+		t.Fatal("malformed block accepted")
+	}
+}
+
+func TestLoadPhantomSubnetsFromClientConf(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "phantoms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gen := uint32(1153)
+	blocks := []string{"192.122.190.0/24", "2001:48a8:687f:1::/64"}
+	buf, err := proto.Marshal(&pb.ClientConf{
+		Generation:      &gen,
+		DecoyList:       &pb.DecoyList{TlsDecoys: []*pb.TLSDecoySpec{pb.InitTLSDecoySpec("192.122.190.104", "tapdance1.freeaeskey.xyz")}},
+		DarkDecoyBlocks: &pb.DarkDecoyBlocks{Blocks: blocks},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	confPath := path.Join(dir, "ClientConf")
+	if err = ioutil.WriteFile(confPath, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sc, err := LoadPhantomSubnetsFromClientConf(confPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(sc.WeightedSubnets) != 1 || len(sc.WeightedSubnets[0].Subnets) != len(blocks) {
+		t.Fatalf("loaded %+v, expected one group of %v", sc.WeightedSubnets, blocks)
+	}
+	for i := range blocks {
+		if sc.WeightedSubnets[0].Subnets[i] != blocks[i] {
+			t.Fatalf("loaded %v, expected %v", sc.WeightedSubnets[0].Subnets, blocks)
+		}
+	}
+
+	if _, err = LoadPhantomSubnetsFromClientConf(path.Join(dir, "missing")); err == nil {
+		t.Fatal("missing file loaded")
+	}
+	garbage := path.Join(dir, "garbage")
+	if err = ioutil.WriteFile(garbage, []byte{0xff, 0xff, 0xff}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadPhantomSubnetsFromClientConf(garbage); err == nil {
+		t.Fatal("malformed ClientConf loaded")
+	}
+}
@@ -2,234 +2,2706 @@ package phantoms
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"math/big"
 	"math/rand"
 	"net"
+	"sort"
+	"strings"
+	"sync"
 
-	wr "github.com/mroth/weightedrand"
+	"golang.org/x/crypto/hkdf"
 )
 
+// Phantom selection must give identical results on the client and the
+// station, regardless of language or toolchain version, so all pseudorandom
+// bytes are derived from the seed as
+//
+//	HKDF-SHA256(ikm = seed, salt = none, info = label)
+//
+// with a distinct label for each use:
+//
+//	labelSubnetGroup - 8 bytes, read as a big endian uint64 and reduced
+//		modulo the total weight to choose the weighted subnet group. The
+//		groups take consecutive ranges of [0, total weight) in config
+//		order, each as wide as its weight, so there are no ties: groups
+//		of equal weight get equal shares and the earlier group the lower
+//		range (groupIndex). If any weight is fractional, all are first
+//		normalized to integers summing to about WeightPrecision, 65536 by
+//		default (NormalizeWeights).
+//	labelAddressID - the number of bytes needed to hold the total number of
+//		addresses in the group's (filtered) subnets plus 8, read big endian
+//		and reduced modulo that total. The result indexes the addresses of
+//		all the subnets taken in order (selectIPAddr).
+//	labelAddress - one byte per byte of address (4 or 16), read big endian,
+//		masked to the host bits of the subnet and added to its base address.
+//		Only used by SelectAddrFromSubnet.
+//	labelPort - 8 bytes, read as a big endian uint64 and reduced modulo the
+//		size of the port range (SelectPhantomPort).
+//	labelFamily - 8 bytes, read as a big endian uint64 and divided by 2^64,
+//		IPv6 is chosen if the result is below the requested fraction
+//		(SelectPhantomWithFamilyBias).
+//	labelPrefix64 - like labelAddressID, over the /64s of an IPv6 subnet
+//		shorter than /64 (SelectSlash64).
+//	labelHost64 - 8 bytes, read big endian, the host within that /64.
+//		Both are only used with SubnetConfig.AlignV6To64.
+//	labelUsableHost - 8 bytes, read big endian and reduced modulo the number
+//		of usable hosts of the subnet, replacing a selected network,
+//		broadcast or subnet-router anycast address. Only used with
+//		SubnetConfig.SkipNetworkAndBroadcast.
+//	labelPairV4, labelPairV6 - 32 bytes each, the seeds of the IPv4 and IPv6
+//		selections of SelectPhantomPair.
+//	labelSubnet - 8 bytes, read as a big endian uint64 and reduced modulo
+//		the total of the chosen group's SubnetWeights, normalized like
+//		fractional group weights, to choose one of its subnets the same
+//		way groups are chosen (subnetIndex). Only drawn for groups with
+//		SubnetWeights.
+//	labelUniformSubnet - 8 bytes, read as a big endian uint64 and reduced
+//		modulo the number of (filtered) subnets to pick one regardless of
+//		its size (SelectPhantomAddressUniform).
+//
+// That is SubnetConfig.AlgVersion 2, the latest. Version 1 is the original
+// derivation, which uses none of these labels but math/rand seeded from the
+// seed, see AlgVersion1.
+//
+// No runtime pseudorandom generator such as math/rand is involved (except in
+// SelectPhantomWithRand, where the caller supplies the source, and under
+// AlgVersion1), so selection does not change between Go releases.
+// testdata/selection_vectors.json pins the expansion for each label and whole
+// selections for several configs and seeds, for checking other
+// implementations, like the station's, against.
+const (
+	labelSubnetGroup = "phantom-subnet-group"
+	labelAddressID   = "phantom-address-id"
+	labelAddress     = "phantom-address"
+	labelPort        = "phantom-port"
+	labelFamily      = "phantom-family"
+	labelPrefix64    = "phantom-v6-prefix64"
+	labelHost64      = "phantom-v6-host64"
+	labelUsableHost  = "phantom-usable-host"
+	labelPairV4      = "phantom-pair-v4"
+	labelPairV6      = "phantom-pair-v6"
+	labelSubnet      = "phantom-subnet"
+
+	labelUniformSubnet = "phantom-uniform-subnet"
+)
+
+// ExpandSeed - derive n pseudorandom bytes from the secret for the given label
+//		using HKDF-SHA256 with no salt. Distinct labels give independent
+//		outputs. At most 255*32 bytes can be derived for a label.
+func ExpandSeed(secret []byte, label string, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("invalid expansion length %d", n)
+	}
+	out := make([]byte, n)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(label)), out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// seedExpander - supplies the pseudorandom bytes selection consumes, n bytes
+//		for the given label at a time.
+type seedExpander func(label string, n int) ([]byte, error)
+
+// rawSeed - not a HKDF label: asks an expander for the seed itself, which
+//		only hkdfExpander has. Used by AlgVersion1.
+const rawSeed = ""
+
+// errNoRawSeed is returned by expanders that don't select from a seed when
+// asked for rawSeed.
+var errNoRawSeed = fmt.Errorf("%w %d without a seed", ErrUnsupportedAlgVersion, AlgVersion1)
+
+// hkdfExpander - the default expander, ExpandSeed over the seed.
+func hkdfExpander(seed []byte) seedExpander {
+	return func(label string, n int) ([]byte, error) {
+		if label == rawSeed {
+			return append([]byte{}, seed...), nil
+		}
+		return ExpandSeed(seed, label, n)
+	}
+}
+
+// sourceExpander - an expander reading bytes from src in order of use,
+//		ignoring labels. (*rand.Rand).Read always fills the buffer and never
+//		fails, whatever the source, so this expander doesn't either, except
+//		when asked for rawSeed.
+func sourceExpander(src rand.Source) seedExpander {
+	rng := rand.New(src)
+	return func(label string, n int) ([]byte, error) {
+		if label == rawSeed {
+			return nil, errNoRawSeed
+		}
+		out := make([]byte, n)
+		rng.Read(out)
+		return out, nil
+	}
+}
+
+// readerExpander - an expander reading bytes from r in order of use, ignoring
+//		labels. Reads returning fewer bytes than asked are retried until n
+//		bytes are read; running out of bytes or any read error is returned,
+//		noting what the bytes were for. There is no rawSeed to return.
+func readerExpander(r io.Reader) seedExpander {
+	return func(label string, n int) ([]byte, error) {
+		if label == rawSeed {
+			return nil, errNoRawSeed
+		}
+		out := make([]byte, n)
+		if _, err := io.ReadFull(r, out); err != nil {
+			return nil, fmt.Errorf("failed to read %d bytes of selection entropy for %v: %w", n, label, err)
+		}
+		return out, nil
+	}
+}
+
+// MinSeedLen is the shortest seed phantom selection accepts, the length of the
+// Conjure seed derived for each registration.
+const MinSeedLen = 16
+
+// ErrSeedTooShort is returned when selecting from a seed shorter than
+// MinSeedLen.
+var ErrSeedTooShort = fmt.Errorf("phantom selection seed must be at least %d bytes", MinSeedLen)
+
+// ErrNoSubnetsAfterFilter is returned when a SubnetFilter removes every subnet
+// that selection could choose from.
+var ErrNoSubnetsAfterFilter = errors.New("no subnets remain after filtering")
+
+// ErrNoSubnetsForFamily is returned by SelectPhantomV4 and SelectPhantomV6
+// when the config has no subnets of the requested address family.
+var ErrNoSubnetsForFamily = errors.New("no phantom subnets of the requested address family")
+
+// ErrNoSubnets is returned when there is nothing to select from to begin
+// with, before any SubnetFilter is applied. Compare ErrNoSubnetsAfterFilter.
+var ErrNoSubnets = errors.New("no subnets to select from")
+
+// ErrEmptySubnetConfig is returned when selecting from a config without any
+// group that has subnets and a positive weight. It wraps ErrNoSubnets.
+var ErrEmptySubnetConfig = fmt.Errorf("subnet config has no subnets to select from: %w", ErrNoSubnets)
+
+// ErrOutsideSubnet is returned if arithmetic ever yields an address outside
+// the subnet it was meant to be selected from, rather than returning it.
+var ErrOutsideSubnet = errors.New("selected address outside of its subnet")
+
+// ErrInvalidSubnet is returned when selecting from a subnet without a usable
+// mask, such as a zero value net.IPNet.
+var ErrInvalidSubnet = errors.New("invalid phantom subnet")
+
+// shortSeedError - ErrSeedTooShort, noting the length of the seed given.
+func shortSeedError(seed []byte) error {
+	return fmt.Errorf("%w, got %d", ErrSeedTooShort, len(seed))
+}
+
 type ConjurePhantomSubnet struct {
 	Weight  float32
 	Subnets []string
+
+	// SubnetWeights - optionally weighs the subnets of the group
+	//		individually, parallel to Subnets. For weighted selection, one
+	//		subnet of the chosen group is then picked by these weights and
+	//		the address is selected from it alone, rather than uniformly
+	//		from all addresses of the group. Without them, the group weight
+	//		applies to all of its subnets as before.
+	SubnetWeights []float32
+
+	// Tags optionally label the group, e.g. by provider. See FilterByTag.
+	Tags []string
+
+	// AlwaysInclude - for weighted selection, the subnets of the group are
+	//		always selected from, and the group is left out of the weighted
+	//		choice among the other groups. An excluded group is still never
+	//		selected from.
+	AlwaysInclude bool
 }
 
-type SubnetConfig struct {
-	WeightedSubnets []ConjurePhantomSubnet
+// Excluded - a group with weight 0 (or less), or without any subnets, is
+//		never selected from, weighted or not.
+func (cjSubnet *ConjurePhantomSubnet) Excluded() bool {
+	return !(cjSubnet.Weight > 0) || len(cjSubnet.Subnets) == 0
 }
 
-// getSubnets - return EITHER all subnet strings as one composite array if we are
-//		selecting unweighted, or return the array associated with the (seed) selected
-//		array of subnet strings based on the associated weights
-func (sc *SubnetConfig) getSubnets(seed []byte, weighted bool) []string {
+// DefaultWeightPrecision - the total fractional group weights are normalized
+//		to when SubnetConfig.WeightPrecision is unset, see NormalizeWeights.
+const DefaultWeightPrecision = 1 << 16
 
-	var out []string = []string{}
+// NormalizeWeights - scale weights to integers summing to about precision,
+//		preserving their ratios, so proportions such as 0.1, 0.2 and 0.7 can
+//		be drawn from exactly. Each weight is divided by the sum of the
+//		positive weights, multiplied by precision and rounded; a positive
+//		weight never becomes 0 and weights of 0 or less stay 0. If no weight
+//		is positive every entry gets weight 1, so a draw over them is
+//		uniform. This never applies to group weights, as groups of weight 0
+//		are excluded, but SubnetWeights that are all 0 select the subnets of
+//		their group uniformly (subnetIndex). A precision of 0 means
+//		DefaultWeightPrecision.
+func NormalizeWeights(weights []float32, precision uint64) []uint64 {
+	if precision == 0 {
+		precision = DefaultWeightPrecision
+	}
+	out := make([]uint64, len(weights))
 
-	if weighted {
-		// seed random with hkdf derived seed provided by client
-		seedInt, err := binary.ReadVarint(bytes.NewBuffer(seed))
-		if err != nil {
-			return nil
+	var sum float64
+	for _, w := range weights {
+		if w > 0 {
+			sum += float64(w)
 		}
-		rand.Seed(seedInt)
+	}
+	if !(sum > 0) {
+		for i := range out {
+			out[i] = 1
+		}
+		return out
+	}
 
-		choices := make([]wr.Choice, 0, len(sc.WeightedSubnets))
-		for _, cjSubnet := range sc.WeightedSubnets {
-			choices = append(choices, wr.Choice{Item: cjSubnet.Subnets, Weight: uint(cjSubnet.Weight)})
+	for i, w := range weights {
+		if !(w > 0) {
+			continue
 		}
-		c, _ := wr.NewChooser(choices...)
-		out = c.Pick().([]string)
-	} else {
+		out[i] = uint64(math.Round(float64(w) / sum * float64(precision)))
+		if out[i] == 0 {
+			out[i] = 1
+		}
+	}
+	return out
+}
 
-		// Use unweighted config for subnets, concat all into one array and return.
-		for _, cjSubnet := range sc.WeightedSubnets {
-			for _, subnet := range cjSubnet.Subnets {
-				out = append(out, subnet)
-			}
+// groupWeights - the weight of each group for weighted group selection, 0
+//		for excluded and AlwaysInclude groups. If every selectable weight is
+//		whole, weights are used as they are, keeping the selections of such
+//		configs unchanged. Otherwise they are normalized to WeightPrecision
+//		(NormalizeWeights), so weights below 1 and fractional differences
+//		keep their proportions.
+func (sc *SubnetConfig) groupWeights() []uint64 {
+	raw := make([]float32, len(sc.WeightedSubnets))
+	fractional := false
+	for i, cjSubnet := range sc.WeightedSubnets {
+		if cjSubnet.Excluded() || cjSubnet.AlwaysInclude {
+			continue
+		}
+		raw[i] = cjSubnet.Weight
+		if w := float64(cjSubnet.Weight); w != math.Trunc(w) {
+			fractional = true
 		}
 	}
 
+	if fractional {
+		return NormalizeWeights(raw, sc.WeightPrecision)
+	}
+	out := make([]uint64, len(raw))
+	for i, w := range raw {
+		out[i] = uint64(w)
+	}
 	return out
 }
 
-// SubnetFilter - Filter IP subnets based on whatever to prevent specific subnets from
-//		inclusion in choice. See v4Only and v6Only for reference.
-type SubnetFilter func([]*net.IPNet) ([]*net.IPNet, error)
+// Phantom selection algorithm versions. The client and the station must
+// derive the phantom of a registration with the same version, so older ones
+// are kept for stations that have not moved on yet.
+const (
+	// AlgVersion1 - the original derivation, kept for stations that still
+	//	use it. The seed is read as a varint to seed math/rand, which
+	//	draws the group from the whole group weights sorted ascending
+	//	(groupIndexV1). Every subnet of the group covers 2^h-1 ids, h
+	//	being its host bits, after those before it; the seed read as a
+	//	big endian integer, reduced modulo the total only if larger, is
+	//	the id picking the subnet (subnetForSeedV1). math/rand, seeded
+	//	again, then draws the host bits of the address (hostOffsetV1).
+	//	Unweighted selection includes groups of weight 0. It needs the
+	//	seed, so it isn't supported by SelectPhantomWithRand and
+	//	SelectPhantomFromReader, and it knows none of AlignV6To64,
+	//	SkipNetworkAndBroadcast, AlwaysInclude and SubnetWeights, so
+	//	configs using them are refused.
+	AlgVersion1 uint32 = 1
+	// AlgVersion2 - labelAddressID picks an address uniformly from all
+	//	addresses of the group's subnets.
+	AlgVersion2 uint32 = 2
 
-func V4Only(obj []*net.IPNet) ([]*net.IPNet, error) {
-	var out []*net.IPNet = []*net.IPNet{}
+	// LatestAlgVersion - the version used when SubnetConfig.AlgVersion is 0.
+	LatestAlgVersion = AlgVersion2
+)
 
-	for _, _net := range obj {
-		if ipv4net := _net.IP.To4(); ipv4net != nil {
-			out = append(out, _net)
+// ErrUnsupportedAlgVersion is returned when selecting with, or validating, a
+// config whose AlgVersion is not implemented.
+var ErrUnsupportedAlgVersion = errors.New("unsupported phantom selection algorithm version")
+
+// algVersion - the selection algorithm version of the config, resolving 0 to
+//		LatestAlgVersion. An AlgVersion1 config using options that version
+//		doesn't know is refused.
+func (sc *SubnetConfig) algVersion() (uint32, error) {
+	switch sc.AlgVersion {
+	case 0:
+		return LatestAlgVersion, nil
+	case AlgVersion1:
+		if option := sc.algVersion1Unsupported(); option != "" {
+			return 0, fmt.Errorf("%w %d with %s", ErrUnsupportedAlgVersion, AlgVersion1, option)
 		}
+		return AlgVersion1, nil
+	case AlgVersion2:
+		return sc.AlgVersion, nil
 	}
-	return out, nil
+	return 0, fmt.Errorf("%w %d", ErrUnsupportedAlgVersion, sc.AlgVersion)
 }
 
-func V6Only(obj []*net.IPNet) ([]*net.IPNet, error) {
-	var out []*net.IPNet = []*net.IPNet{}
+// algVersion1Unsupported - the first option set in the config that
+//		AlgVersion1 predates, or "" if there is none.
+func (sc *SubnetConfig) algVersion1Unsupported() string {
+	if sc.AlignV6To64 {
+		return "AlignV6To64"
+	} else if sc.SkipNetworkAndBroadcast {
+		return "SkipNetworkAndBroadcast"
+	}
+	for i, cjSubnet := range sc.WeightedSubnets {
+		if cjSubnet.AlwaysInclude {
+			return fmt.Sprintf("AlwaysInclude (group %d)", i)
+		} else if len(cjSubnet.SubnetWeights) > 0 {
+			return fmt.Sprintf("SubnetWeights (group %d)", i)
+		}
+	}
+	return ""
+}
 
-	for _, _net := range obj {
-		if ipv6net := _net.IP.To16(); ipv6net != nil {
-			out = append(out, _net)
+type SubnetConfig struct {
+	WeightedSubnets []ConjurePhantomSubnet
+
+	// Strict makes selection fail if any subnets overlap, see ValidateNoOverlap.
+	Strict bool
+
+	// AlignV6To64 makes selection from IPv6 subnets shorter than /64 first
+	// pick a /64 (SelectSlash64) and then a host within it.
+	AlignV6To64 bool
+
+	// SkipNetworkAndBroadcast makes selection avoid the network and broadcast
+	// addresses of IPv4 subnets and the subnet-router anycast address of
+	// IPv6 subnets, see usableHost. /31, /32, /127 and /128 are unaffected.
+	SkipNetworkAndBroadcast bool
+
+	// WeightPrecision is the total fractional group weights are normalized
+	// to before a group is drawn, see NormalizeWeights. 0 means
+	// DefaultWeightPrecision. Whole weights are never normalized.
+	WeightPrecision uint64
+
+	// AlgVersion is the selection algorithm version to derive phantoms
+	// with, see AlgVersion1 and AlgVersion2. 0 means LatestAlgVersion.
+	AlgVersion uint32
+
+	// MinSelectPrefixV4 and MinSelectPrefixV6 are the shortest prefixes
+	// selection accepts, wider subnets are refused with ErrSubnetTooWide.
+	// 0 means DefaultMinSelectPrefixV4 and DefaultMinSelectPrefixV6.
+	MinSelectPrefixV4 int
+	MinSelectPrefixV6 int
+
+	// AllowWideSubnets lifts those limits, for configs that really mean to
+	// select from subnets like 0.0.0.0/0 or ::/0.
+	AllowWideSubnets bool
+}
+
+// options - a config with the options of sc and no groups, to build a config
+//		from the groups of sc with.
+func (sc *SubnetConfig) options() SubnetConfig {
+	out := *sc
+	out.WeightedSubnets = nil
+	return out
+}
+
+type jsonPhantomSubnet struct {
+	Weight        float32   `json:"weight"`
+	Subnets       []string  `json:"subnets"`
+	SubnetWeights []float32 `json:"subnet_weights,omitempty"`
+	Tags          []string  `json:"tags,omitempty"`
+
+	AlwaysInclude bool `json:"always_include,omitempty"`
+}
+
+type jsonSubnetConfig struct {
+	WeightedSubnets []jsonPhantomSubnet `json:"weighted_subnets"`
+	Strict          bool                `json:"strict,omitempty"`
+	AlignV6To64     bool                `json:"align_v6_to_64,omitempty"`
+
+	SkipNetworkAndBroadcast bool   `json:"skip_network_and_broadcast,omitempty"`
+	WeightPrecision         uint64 `json:"weight_precision,omitempty"`
+	AlgVersion              uint32 `json:"alg_version,omitempty"`
+	MinSelectPrefixV4       int    `json:"min_select_prefix_v4,omitempty"`
+	MinSelectPrefixV6       int    `json:"min_select_prefix_v6,omitempty"`
+	AllowWideSubnets        bool   `json:"allow_wide_subnets,omitempty"`
+}
+
+// MarshalJSON - encode the config in the format read by ParseSubnetConfig.
+func (sc SubnetConfig) MarshalJSON() ([]byte, error) {
+	out := jsonSubnetConfig{
+		WeightedSubnets: make([]jsonPhantomSubnet, 0, len(sc.WeightedSubnets)),
+		Strict:          sc.Strict,
+		AlignV6To64:     sc.AlignV6To64,
+
+		SkipNetworkAndBroadcast: sc.SkipNetworkAndBroadcast,
+		WeightPrecision:         sc.WeightPrecision,
+		AlgVersion:              sc.AlgVersion,
+		MinSelectPrefixV4:       sc.MinSelectPrefixV4,
+		MinSelectPrefixV6:       sc.MinSelectPrefixV6,
+		AllowWideSubnets:        sc.AllowWideSubnets,
+	}
+	for _, cjSubnet := range sc.WeightedSubnets {
+		out.WeightedSubnets = append(out.WeightedSubnets, jsonPhantomSubnet(cjSubnet))
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON - decode a config and check it with Validate, see
+//		ParseSubnetConfig.
+func (sc *SubnetConfig) UnmarshalJSON(data []byte) error {
+	var in jsonSubnetConfig
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	parsed := SubnetConfig{
+		Strict:                  in.Strict,
+		AlignV6To64:             in.AlignV6To64,
+		SkipNetworkAndBroadcast: in.SkipNetworkAndBroadcast,
+		WeightPrecision:         in.WeightPrecision,
+		AlgVersion:              in.AlgVersion,
+		MinSelectPrefixV4:       in.MinSelectPrefixV4,
+		MinSelectPrefixV6:       in.MinSelectPrefixV6,
+		AllowWideSubnets:        in.AllowWideSubnets,
+	}
+	for _, cjSubnet := range in.WeightedSubnets {
+		parsed.WeightedSubnets = append(parsed.WeightedSubnets, ConjurePhantomSubnet(cjSubnet))
+	}
+	if err := parsed.Validate(); err != nil {
+		return err
+	}
+	*sc = parsed
+	return nil
+}
+
+// ParseSubnetConfig - read a JSON encoded config such as
+//
+//	{"weighted_subnets": [{"weight": 9, "subnets": ["192.122.190.0/24"]}]}
+//
+//		and check it with Validate. Malformed JSON is reported with the
+//		line and column it was found at, and subnets that fail to parse
+//		with their group and index, see InvalidSubnetError.
+func ParseSubnetConfig(r io.Reader) (SubnetConfig, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return SubnetConfig{}, fmt.Errorf("failed to read subnet config: %w", err)
+	}
+	var sc SubnetConfig
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&sc); err != nil {
+		if offset, ok := jsonErrorOffset(err); ok {
+			line, column := lineAndColumn(data, offset)
+			return SubnetConfig{}, fmt.Errorf("failed to parse subnet config at line %d, column %d: %w", line, column, err)
 		}
+		return SubnetConfig{}, fmt.Errorf("failed to parse subnet config: %w", err)
 	}
-	return out, nil
+	return sc, nil
 }
 
-func parseSubnets(phantomSubnets []string) ([]*net.IPNet, error) {
-	var subnets []*net.IPNet = []*net.IPNet{}
+// jsonErrorOffset - the input offset a JSON decoding error was found at, if
+//		it has one.
+func jsonErrorOffset(err error) (int64, bool) {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) {
+		return syntaxErr.Offset, true
+	} else if errors.As(err, &typeErr) {
+		return typeErr.Offset, true
+	}
+	return 0, false
+}
 
-	if len(phantomSubnets) == 0 {
-		return nil, fmt.Errorf("parseSubnets - no subnets provided")
+// lineAndColumn - the 1-based line and column of the last byte before offset
+//		in data, which the JSON decoder reports an error after reading.
+func lineAndColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
 	}
+	if offset > 0 {
+		offset--
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
 
-	for _, strNet := range phantomSubnets {
-		_, parsedNet, err := net.ParseCIDR(strNet)
-		if err != nil {
-			return nil, err
+// Validate - check every invariant selection relies on, reporting all the
+//		problems found at once rather than just the first: every weight is
+//		non-negative, every selectable group has subnets, every subnet is a
+//		valid CIDR block, AlgVersion is supported and, for a Strict config,
+//		no subnets overlap. The problems are returned as a *ConfigError.
+func (sc *SubnetConfig) Validate() error {
+	var problems []string
+	var invalid []*InvalidSubnetError
+	if _, err := sc.algVersion(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	hasSubnets := false
+	for i, cjSubnet := range sc.WeightedSubnets {
+		if !(cjSubnet.Weight >= 0) {
+			problems = append(problems, fmt.Sprintf("subnet group %d has invalid weight %v", i, cjSubnet.Weight))
+		}
+		// groups without subnets are skipped by selection
+		if len(cjSubnet.Subnets) == 0 {
+			continue
+		}
+		hasSubnets = true
+		if _, err := parseSubnets(cjSubnet.Subnets); err != nil {
+			problems = append(problems, fmt.Sprintf("subnet group %d: %v", i, err))
+			for j, subnet := range cjSubnet.Subnets {
+				if _, err := parseSubnet(subnet); err != nil {
+					invalid = append(invalid, &InvalidSubnetError{Group: i, Index: j, Subnet: subnet, Err: err})
+				}
+			}
 		}
-		if parsedNet == nil {
-			return nil, fmt.Errorf("failed to parse %v as subnet", parsedNet)
+		if err := cjSubnet.validateSubnetWeights(); err != nil {
+			problems = append(problems, fmt.Sprintf("subnet group %d: %v", i, err))
 		}
+	}
+	if len(sc.WeightedSubnets) > 0 && !hasSubnets {
+		problems = append(problems, "all subnet groups have no subnets")
+	}
 
-		subnets = append(subnets, parsedNet)
+	if sc.Strict && len(problems) == 0 {
+		if err := sc.ValidateNoOverlap(); err != nil {
+			problems = append(problems, err.Error())
+		}
 	}
 
-	return subnets, nil
-	// return nil, fmt.Errorf("parseSubnets not implemented yet")
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems, Subnets: invalid}
+	}
+	return nil
 }
 
-// SelectAddrFromSubnet - given a seed and a CIDR block choose an address.
-// 		This is done by generating a seeded random bytes up to teh length of the
-//		full address then using the net mask to zero out any bytes that are
-//		already specified by the CIDR block. Tde masked random value is then
-//		added to the cidr block base giving the final randomly selected address.
-func SelectAddrFromSubnet(seed []byte, net1 *net.IPNet) (net.IP, error) {
-	bits, addrLen := net1.Mask.Size()
+// FilterByTag - return a config holding only the groups tagged with tag.
+func (sc *SubnetConfig) FilterByTag(tag string) SubnetConfig {
+	out := sc.options()
+	for _, cjSubnet := range sc.WeightedSubnets {
+		for _, t := range cjSubnet.Tags {
+			if t == tag {
+				out.WeightedSubnets = append(out.WeightedSubnets, cjSubnet)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// FilterByMinWeight - return a config without the groups weighing less than
+//		min, e.g. to ignore a long tail of rarely selected groups. The
+//		remaining groups keep their weights, so their relative shares are
+//		unchanged. Unlike a SubnetFilter this applies before groups are
+//		chosen, as the weights are gone once subnets are parsed.
+func (sc *SubnetConfig) FilterByMinWeight(min float32) SubnetConfig {
+	out := sc.options()
+	for _, cjSubnet := range sc.WeightedSubnets {
+		if cjSubnet.Weight >= min {
+			out.WeightedSubnets = append(out.WeightedSubnets, cjSubnet)
+		}
+	}
+	return out
+}
+
+// Merge - return a config holding the groups of sc followed by those of
+//		other, for assembling phantom subnets from several sources. A subnet
+//		already in an earlier group (compared in canonical form, so
+//		"192.122.190.1/24" matches "192.122.190.0/24") is dropped, and groups
+//		left without subnets are removed. Overlapping but different subnets
+//		are kept, see Canonicalize. SubnetWeights follow their subnets.
+//		Strict, AlignV6To64 and SkipNetworkAndBroadcast are set if set in
+//		either config, AllowWideSubnets only if set in both, and the higher
+//		WeightPrecision is kept. The AlgVersion and minimum prefixes of sc
+//		are kept, or those of other where sc leaves them unset.
+func (sc *SubnetConfig) Merge(other SubnetConfig) SubnetConfig {
+	out := SubnetConfig{
+		Strict:                  sc.Strict || other.Strict,
+		AlignV6To64:             sc.AlignV6To64 || other.AlignV6To64,
+		SkipNetworkAndBroadcast: sc.SkipNetworkAndBroadcast || other.SkipNetworkAndBroadcast,
+		WeightPrecision:         sc.WeightPrecision,
+		AlgVersion:              sc.AlgVersion,
+		MinSelectPrefixV4:       sc.MinSelectPrefixV4,
+		MinSelectPrefixV6:       sc.MinSelectPrefixV6,
+		AllowWideSubnets:        sc.AllowWideSubnets && other.AllowWideSubnets,
+	}
+	if other.WeightPrecision > out.WeightPrecision {
+		out.WeightPrecision = other.WeightPrecision
+	}
+	if out.AlgVersion == 0 {
+		out.AlgVersion = other.AlgVersion
+	}
+	if out.MinSelectPrefixV4 == 0 {
+		out.MinSelectPrefixV4 = other.MinSelectPrefixV4
+	}
+	if out.MinSelectPrefixV6 == 0 {
+		out.MinSelectPrefixV6 = other.MinSelectPrefixV6
+	}
+
+	seen := make(map[string]bool)
+	groups := append(append([]ConjurePhantomSubnet{}, sc.WeightedSubnets...), other.WeightedSubnets...)
+	for _, cjSubnet := range groups {
+		merged := cjSubnet
+		merged.Subnets = []string{}
+		merged.SubnetWeights = nil
+		for j, subnet := range cjSubnet.Subnets {
+			key := subnet
+			if parsed, err := parseSubnets([]string{subnet}); err == nil {
+				_, zone := SplitSubnetZone(subnet)
+				key = parsed[0].String() + "%" + zone
+			}
+			if !seen[key] {
+				seen[key] = true
+				merged.Subnets = append(merged.Subnets, subnet)
+				if len(cjSubnet.SubnetWeights) == len(cjSubnet.Subnets) {
+					merged.SubnetWeights = append(merged.SubnetWeights, cjSubnet.SubnetWeights[j])
+				}
+			}
+		}
+		if len(merged.Subnets) > 0 || len(cjSubnet.Subnets) == 0 {
+			out.WeightedSubnets = append(out.WeightedSubnets, merged)
+		}
+	}
+	return out
+}
 
-	ipBigInt := &big.Int{}
-	if v4net := net1.IP.To4(); v4net != nil {
-		ipBigInt.SetBytes(net1.IP.To4())
-	} else if v6net := net1.IP.To16(); v6net != nil {
-		ipBigInt.SetBytes(net1.IP.To16())
+// ParsedSubnets - return every subnet of the non excluded groups, parsed. Parsing results
+//		are cached, see parseSubnetsCached.
+func (sc *SubnetConfig) ParsedSubnets() ([]*net.IPNet, error) {
+	var all []string
+	for _, cjSubnet := range sc.WeightedSubnets {
+		if cjSubnet.Excluded() {
+			continue
+		}
+		all = append(all, cjSubnet.Subnets...)
 	}
+	return parseSubnetsCached(all)
+}
 
-	seedInt, err := binary.ReadVarint(bytes.NewBuffer(seed))
+// AddressCount - number of addresses selection can choose from across all
+//		subnets in the config that pass transform (nil keeps all of them).
+func (sc *SubnetConfig) AddressCount(transform SubnetFilter) (*big.Int, error) {
+	subnets, err := sc.ParsedSubnets()
 	if err != nil {
 		return nil, err
 	}
+	if transform != nil {
+		subnets, err = transform(subnets)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return addressCount(subnets), nil
+}
 
-	rand.Seed(seedInt)
-	randBytes := make([]byte, addrLen/8)
-	_, err = rand.Read(randBytes)
+// Contains - whether ip could have been selected from the config for some
+//		seed, and the subnet holding it: the first subnet of the non excluded
+//		groups, after transform (nil keeps all of them), that ip falls in.
+//		With SkipNetworkAndBroadcast, the addresses usableHost replaces are
+//		not contained. An invalid config, or a transform failing, contains
+//		no address.
+func (sc *SubnetConfig) Contains(ip net.IP, transform SubnetFilter) (bool, *net.IPNet) {
+	subnets, err := sc.ParsedSubnets()
 	if err != nil {
-		return nil, err
+		return false, nil
 	}
-	randBigInt := &big.Int{}
-	randBigInt.SetBytes(randBytes)
+	if transform != nil {
+		subnets, err = transform(subnets)
+		if err != nil {
+			return false, nil
+		}
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) && !(sc.SkipNetworkAndBroadcast && unusableHost(ip, subnet)) {
+			return true, subnet
+		}
+	}
+	return false, nil
+}
 
-	mask := make([]byte, addrLen/8)
-	for i := 0; i < addrLen/8; i++ {
-		mask[i] = 0xff
+// Summary - structural view of the config complementing AddressCount: the
+//		number of groups and subnets, with the subnets broken down by address
+//		family. Excluded groups are counted too. Returns an error if any subnet
+//		fails to parse.
+func (sc *SubnetConfig) Summary() (totalGroups, totalSubnets, v4Subnets, v6Subnets int, err error) {
+	for _, cjSubnet := range sc.WeightedSubnets {
+		subnets, err := parseSubnetsCached(cjSubnet.Subnets)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+		for _, subnet := range subnets {
+			if isIPv6(subnet.IP) {
+				v6Subnets++
+			} else {
+				v4Subnets++
+			}
+		}
+		totalSubnets += len(subnets)
 	}
-	maskBigInt := &big.Int{}
-	maskBigInt.SetBytes(mask)
-	maskBigInt.Rsh(maskBigInt, uint(bits))
+	return len(sc.WeightedSubnets), totalSubnets, v4Subnets, v6Subnets, nil
+}
 
-	randBigInt.And(randBigInt, maskBigInt)
-	ipBigInt.Add(ipBigInt, randBigInt)
+// Equal - whether both configs select the same phantoms for every seed, so a
+//		caller can skip re-parsing or rebuilding anything derived from a config
+//		that did not actually change. Comparison is order sensitive, as the
+//		order of groups and of the subnets in them decides which address an id
+//		refers to: the same subnets reordered are a different config. Subnets
+//		are compared by their parsed form, so host bits and spelling of
+//		addresses don't matter, and unset WeightPrecision, AlgVersion and
+//		minimum prefixes equal their defaults. Tags don't affect selection and are ignored.
+func (sc *SubnetConfig) Equal(other SubnetConfig) bool {
+	return sc.normalizedForm() == other.normalizedForm()
+}
 
-	return net.IP(ipBigInt.Bytes()), nil
+// Hash - a stable hash of the config, in hex, equal for configs that are
+//		Equal and different otherwise, to key caches by or detect changes
+//		across reloads without keeping the old config around.
+func (sc *SubnetConfig) Hash() string {
+	sum := sha256.Sum256([]byte(sc.normalizedForm()))
+	return hex.EncodeToString(sum[:])
 }
 
-func selectIPAddr(seed []byte, subnets []*net.IPNet) (*net.IP, error) {
+// normalizedForm - everything about the config that affects selection, in
+//		order, as text. Subnets that fail to parse are kept as they are.
+func (sc *SubnetConfig) normalizedForm() string {
+	precision := sc.WeightPrecision
+	if precision == 0 {
+		precision = DefaultWeightPrecision
+	}
+	version := sc.AlgVersion
+	if version == 0 {
+		version = LatestAlgVersion
+	}
 
-	addresses_total := big.NewInt(0)
+	width := sc.subnetWidth()
 
-	type idNet struct {
-		min, max big.Int
-		net      *net.IPNet
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "strict=%t align=%t skip=%t precision=%d version=%d\n",
+		sc.Strict, sc.AlignV6To64, sc.SkipNetworkAndBroadcast, precision, version)
+	if width != defaultSubnetWidth {
+		fmt.Fprintf(&b, "min_v4=%d min_v6=%d allow_wide=%t\n", width.minV4, width.minV6, width.allowWide)
 	}
-	var idNets []idNet
-
-	for _, _net := range subnets {
-		netMaskOnes, _ := _net.Mask.Size()
-		if ipv4net := _net.IP.To4(); ipv4net != nil {
-			_idNet := idNet{}
-			_idNet.min.Set(addresses_total)
-			addresses_total.Add(addresses_total, big.NewInt(2).Exp(big.NewInt(2), big.NewInt(int64(32-netMaskOnes)), nil))
-			addresses_total.Sub(addresses_total, big.NewInt(1))
-			_idNet.max.Set(addresses_total)
-			_idNet.net = _net
-			idNets = append(idNets, _idNet)
-		} else if ipv6net := _net.IP.To16(); ipv6net != nil {
-			_idNet := idNet{}
-			_idNet.min.Set(addresses_total)
-			addresses_total.Add(addresses_total, big.NewInt(2).Exp(big.NewInt(2), big.NewInt(int64(128-netMaskOnes)), nil))
-			addresses_total.Sub(addresses_total, big.NewInt(1))
-			_idNet.max.Set(addresses_total)
-			_idNet.net = _net
-			idNets = append(idNets, _idNet)
-		} else {
-			return nil, fmt.Errorf("failed to parse %v", _net)
-		}
-	}
-
-	if addresses_total.Cmp(big.NewInt(0)) <= 0 {
-		return nil, fmt.Errorf("No valid addresses specified")
-	}
-
-	id := &big.Int{}
-	id.SetBytes(seed)
-	if id.Cmp(addresses_total) > 0 {
-		id.Mod(id, addresses_total)
-	}
-
-	var result net.IP
-	var err error
-	for _, _idNet := range idNets {
-		if _idNet.max.Cmp(id) >= 0 && _idNet.min.Cmp(id) == -1 {
-			result, err = SelectAddrFromSubnet(seed, _idNet.net)
-			if err != nil {
-				return nil, fmt.Errorf("Failed to chose IP address: %v", err)
+	for _, cjSubnet := range sc.WeightedSubnets {
+		fmt.Fprintf(&b, "group weight=%v always=%t subnet_weights=%v\n",
+			cjSubnet.Weight, cjSubnet.AlwaysInclude, cjSubnet.SubnetWeights)
+		for _, strNet := range cjSubnet.Subnets {
+			if _net, err := parseSubnet(strNet); err == nil {
+				strNet = canonicalSubnet(strNet, _net)
 			}
+			fmt.Fprintf(&b, "\t%s\n", strNet)
 		}
 	}
-	if result == nil {
-		return nil, errors.New("let's rewrite the phantom address selector")
-	}
-	return &result, nil
+	return b.String()
 }
 
-// SelectPhantom - select one phantom IP address based on shared secret
-func SelectPhantom(seed []byte, subnets SubnetConfig, transform SubnetFilter, weighted bool) (*net.IP, error) {
+// SelectionHistogram - run weighted selection over samples random seeds and
+//		count how often each subnet (by its String form) was selected from,
+//		to compare the empirical distribution with the configured weights.
+func SelectionHistogram(subnets SubnetConfig, transform SubnetFilter, samples int) (map[string]int, error) {
+	return SelectionHistogramContext(context.Background(), subnets, transform, samples)
+}
 
-	s, err := parseSubnets(subnets.getSubnets(seed, weighted))
-	if err != nil {
-		return nil, fmt.Errorf("Failed to parse subnets: %v", err)
+// SelectionHistogramContext - SelectionHistogram, giving up with ctx.Err()
+//		once ctx is done. ctx is checked before every sample.
+func SelectionHistogramContext(ctx context.Context, subnets SubnetConfig, transform SubnetFilter, samples int) (map[string]int, error) {
+	if samples <= 0 {
+		return nil, fmt.Errorf("invalid number of samples %d", samples)
 	}
 
-	if transform != nil {
-		s, err = transform(s)
+	histogram := make(map[string]int)
+	seed := make([]byte, 32)
+	for i := 0; i < samples; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, err := crand.Read(seed); err != nil {
+			return nil, err
+		}
+		_, subnet, err := SelectPhantomWithSubnet(seed, subnets, transform, true)
 		if err != nil {
 			return nil, err
 		}
+		histogram[subnet.String()]++
+	}
+	return histogram, nil
+}
+
+// ValidateNoOverlap - parse all subnets in the config and report every pair
+//		that overlaps. Overlapping subnets are counted twice when selecting an
+//		address which biases selection towards the shared addresses.
+func (sc *SubnetConfig) ValidateNoOverlap() error {
+	subnets, err := sc.ParsedSubnets()
+	if err != nil {
+		return err
 	}
 
-	return selectIPAddr(seed, s)
+	var overlaps []string
+	for i := 0; i < len(subnets); i++ {
+		for j := i + 1; j < len(subnets); j++ {
+			if subnetsOverlap(subnets[i], subnets[j]) {
+				overlaps = append(overlaps, fmt.Sprintf("%v and %v", subnets[i], subnets[j]))
+			}
+		}
+	}
+	if len(overlaps) > 0 {
+		return fmt.Errorf("overlapping phantom subnets: %v", strings.Join(overlaps, ", "))
+	}
+	return nil
 }
 
-// SelectPhantomUnweighted - select one phantom IP address based on shared secret
-func SelectPhantomUnweighted(seed []byte, subnets SubnetConfig, transform SubnetFilter) (*net.IP, error) {
-	return SelectPhantom(seed, subnets, transform, false)
+// ErrCoveredGroup is returned by Canonicalize when every subnet of a group is
+// held by earlier groups.
+var ErrCoveredGroup = errors.New("subnet group covered by earlier groups")
+
+// Canonicalize - return a copy of the config with overlapping subnets
+//		collapsed, so every address is held by exactly one subnet and is
+//		counted once by selection. Within a group a subnet contained in
+//		another is dropped. An address held by more than one group stays in
+//		the first of them: later subnets containing an earlier one are split
+//		around it and later subnets inside an earlier one are dropped. A group
+//		whose subnets are all held by earlier groups would be dropped along
+//		with its weight, so such configs are refused with ErrCoveredGroup.
+//		Excluded groups, including those without subnets, are kept as they
+//		are and never collapse others. With SubnetWeights,
+//		dropped subnets lose their weight and the pieces of a split subnet
+//		share its weight in proportion to their size.
+func (sc *SubnetConfig) Canonicalize() (SubnetConfig, error) {
+	out := sc.options()
+
+	var taken []*net.IPNet
+	for g, cjSubnet := range sc.WeightedSubnets {
+		if cjSubnet.Excluded() {
+			out.WeightedSubnets = append(out.WeightedSubnets, cjSubnet)
+			continue
+		}
+		subnets, err := parseSubnets(cjSubnet.Subnets)
+		if err != nil {
+			return SubnetConfig{}, err
+		}
+
+		weighted := len(cjSubnet.SubnetWeights) == len(subnets)
+		var kept []*net.IPNet
+		var keptWeights []float32
+		for i, _net := range subnets {
+			if subnetCovered(_net, subnets[:i], subnets[i+1:]) {
+				continue
+			}
+			pieces := []*net.IPNet{_net}
+			for _, hole := range taken {
+				var remaining []*net.IPNet
+				for _, piece := range pieces {
+					remaining = append(remaining, subtractSubnet(piece, hole)...)
+				}
+				pieces = remaining
+			}
+			kept = append(kept, pieces...)
+			if weighted {
+				// pieces share the weight of the subnet by size
+				ones, _ := _net.Mask.Size()
+				for _, piece := range pieces {
+					pieceOnes, _ := piece.Mask.Size()
+					keptWeights = append(keptWeights, cjSubnet.SubnetWeights[i]/float32(math.Exp2(float64(pieceOnes-ones))))
+				}
+			}
+		}
+		if len(kept) == 0 {
+			return SubnetConfig{}, fmt.Errorf("%w: group %d", ErrCoveredGroup, g)
+		}
+		taken = append(taken, kept...)
+
+		canonical := cjSubnet
+		canonical.SubnetWeights = keptWeights
+		canonical.Subnets = make([]string, 0, len(kept))
+		for _, _net := range kept {
+			canonical.Subnets = append(canonical.Subnets, _net.String())
+		}
+		out.WeightedSubnets = append(out.WeightedSubnets, canonical)
+	}
+	return out, nil
 }
 
-// SelectPhantomWeighted - select one phantom IP address based on shared secret
-func SelectPhantomWeighted(seed []byte, subnets SubnetConfig, transform SubnetFilter) (*net.IP, error) {
-	return SelectPhantom(seed, subnets, transform, true)
+// Normalize - return a copy of the config with every subnet in canonical
+//		form, its masked network address and prefix length, sorted within its
+//		group with exact duplicates dropped, so configs that differ only
+//		cosmetically are Equal once normalized. IPv4 subnets sort before IPv6
+//		ones, then by address and prefix length. With SubnetWeights, weights
+//		move with their subnets and a dropped duplicate adds its weight to the
+//		one kept.
+//
+//		The normalized config is only for comparing configs with each other
+//		and must never be distributed to clients or stations in place of the
+//		original. Sorting and dropping duplicates change the order ids map
+//		to addresses in, so it selects different phantoms than the original
+//		for the same seed and is not Equal to it; a client using it would
+//		register phantoms the station doesn't derive. Equal and Hash keep
+//		order and are safe to use on the original.
+func (sc *SubnetConfig) Normalize() (SubnetConfig, error) {
+	out := sc.options()
+
+	for _, cjSubnet := range sc.WeightedSubnets {
+		subnets, err := parseSubnets(cjSubnet.Subnets)
+		if err != nil {
+			return SubnetConfig{}, err
+		}
+		weighted := len(cjSubnet.SubnetWeights) == len(subnets)
+
+		order := make([]int, len(subnets))
+		for i := range order {
+			order[i] = i
+		}
+		canonical := make([]string, len(subnets))
+		for i, _net := range subnets {
+			canonical[i] = canonicalSubnet(cjSubnet.Subnets[i], _net)
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			a, b := order[i], order[j]
+			if subnetLess(subnets[a], subnets[b]) || subnetLess(subnets[b], subnets[a]) {
+				return subnetLess(subnets[a], subnets[b])
+			}
+			// the same subnet on different zones
+			return canonical[a] < canonical[b]
+		})
+
+		normalized := cjSubnet
+		normalized.Subnets = make([]string, 0, len(subnets))
+		normalized.SubnetWeights = nil
+		for _, i := range order {
+			strNet := canonical[i]
+			last := len(normalized.Subnets) - 1
+			if last >= 0 && normalized.Subnets[last] == strNet {
+				if weighted {
+					normalized.SubnetWeights[last] += cjSubnet.SubnetWeights[i]
+				}
+				continue
+			}
+			normalized.Subnets = append(normalized.Subnets, strNet)
+			if weighted {
+				normalized.SubnetWeights = append(normalized.SubnetWeights, cjSubnet.SubnetWeights[i])
+			}
+		}
+		out.WeightedSubnets = append(out.WeightedSubnets, normalized)
+	}
+	return out, nil
+}
+
+// canonicalSubnet - the canonical form of strNet, parsed as _net: the masked
+//		network address and prefix length, keeping any zone identifier.
+func canonicalSubnet(strNet string, _net *net.IPNet) string {
+	if _, zone := SplitSubnetZone(strNet); zone != "" {
+		return _net.String() + "%" + zone
+	}
+	return _net.String()
+}
+
+// subnetLess - the order of Normalize: IPv4 before IPv6, then by network
+//		address and prefix length.
+func subnetLess(a, b *net.IPNet) bool {
+	if isIPv6(a.IP) != isIPv6(b.IP) {
+		return !isIPv6(a.IP)
+	}
+	if c := bytes.Compare(subnetBase(a).To16(), subnetBase(b).To16()); c != 0 {
+		return c < 0
+	}
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	return aOnes < bOnes
+}
+
+// subnetCovered - whether _net lies within one of the subnets before it, or
+//		strictly within one of the subnets after it, so of several identical
+//		subnets only the first is kept.
+func subnetCovered(_net *net.IPNet, before, after []*net.IPNet) bool {
+	ones, bits := _net.Mask.Size()
+	for _, other := range before {
+		otherOnes, otherBits := other.Mask.Size()
+		if otherBits == bits && otherOnes <= ones && other.Contains(_net.IP) {
+			return true
+		}
+	}
+	for _, other := range after {
+		otherOnes, otherBits := other.Mask.Size()
+		if otherBits == bits && otherOnes < ones && other.Contains(_net.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// subtractSubnet - the subnets covering every address of _net not in hole.
+//		Splitting _net in halves until each half either misses the hole or is
+//		inside it yields at most one subnet per prefix bit between the two.
+func subtractSubnet(_net, hole *net.IPNet) []*net.IPNet {
+	if !subnetsOverlap(_net, hole) {
+		return []*net.IPNet{_net}
+	}
+	ones, bits := _net.Mask.Size()
+	holeOnes, holeBits := hole.Mask.Size()
+	if holeBits != bits {
+		// an IPv4 subnet and an IPv6 one never share addresses
+		return []*net.IPNet{_net}
+	} else if holeOnes <= ones {
+		return nil
+	}
+
+	mask := net.CIDRMask(ones+1, bits)
+	lower := &net.IPNet{IP: subnetBase(_net), Mask: mask}
+	upper := &net.IPNet{
+		IP:   addrAtOffset(_net, big.NewInt(0).Lsh(big.NewInt(1), uint(bits-ones-1))),
+		Mask: mask,
+	}
+	return append(subtractSubnet(lower, hole), subtractSubnet(upper, hole)...)
+}
+
+// ValidateMinSize returns an error listing every subnet too small to be hard
+// to block wholesale: IPv4 subnets with a prefix longer than minV4Bits and
+// IPv6 subnets with a prefix longer than minV6Bits. With minV4Bits of 24 a
+// /24 passes and a /25 does not.
+func (sc *SubnetConfig) ValidateMinSize(minV4Bits, minV6Bits int) error {
+	subnets, err := sc.ParsedSubnets()
+	if err != nil {
+		return err
+	}
+
+	var small []string
+	for _, _net := range subnets {
+		ones, _ := _net.Mask.Size()
+		limit := minV4Bits
+		if isIPv6(_net.IP) {
+			limit = minV6Bits
+		}
+		if ones > limit {
+			small = append(small, _net.String())
+		}
+	}
+	if len(small) > 0 {
+		return fmt.Errorf("phantom subnets smaller than minimum size: %v", strings.Join(small, ", "))
+	}
+	return nil
+}
+
+// groupIndex - the index of the group selected by seed based on the weights
+//		of the groups, or -1 if every group is excluded. Group i is chosen
+//		when the drawn value falls in [w_0 + ... + w_i-1, w_0 + ... + w_i),
+//		summing the weights of selectable groups in config order, so equal
+//		weights never tie. Weights are those of groupWeights. The draw is
+//		recorded in trace, if not nil.
+func (sc *SubnetConfig) groupIndex(exp seedExpander, trace *SelectionTrace) (int, error) {
+	if sc.AlgVersion == AlgVersion1 {
+		return sc.groupIndexV1(exp, trace)
+	}
+	randBytes, err := exp(labelSubnetGroup, 8)
+	if err != nil {
+		return -1, err
+	}
+
+	weights := sc.groupWeights()
+	var totalWeight uint64
+	for _, w := range weights {
+		totalWeight += w
+	}
+	if totalWeight == 0 {
+		return -1, nil
+	}
+
+	// walk the cumulative weights, picking the first group whose upper
+	// bound exceeds the drawn value.
+	r := binary.BigEndian.Uint64(randBytes) % totalWeight
+	trace.recordGroupDraw(totalWeight, r)
+	for i, w := range weights {
+		if r < w {
+			return i, nil
+		}
+		r -= w
+	}
+	return -1, nil
+}
+
+// seedIntV1 - the seed read as a varint, which seeds math/rand under
+//		AlgVersion1.
+func seedIntV1(seed []byte) (int64, error) {
+	seedInt, err := binary.ReadVarint(bytes.NewReader(seed))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read seed %x as varint: %w", seed, err)
+	}
+	return seedInt, nil
+}
+
+// groupWeightsV1 - the AlgVersion1 weight of each group, its weight truncated
+//		to a whole number, or 0 if it isn't positive, and the indexes of
+//		the groups sorted by ascending weight, the order groups are drawn
+//		from.
+func (sc *SubnetConfig) groupWeightsV1() ([]int, []int) {
+	weights := make([]int, len(sc.WeightedSubnets))
+	order := make([]int, len(sc.WeightedSubnets))
+	for i, cjSubnet := range sc.WeightedSubnets {
+		if cjSubnet.Weight > 0 {
+			weights[i] = int(cjSubnet.Weight)
+		}
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return weights[order[i]] < weights[order[j]] })
+	return weights, order
+}
+
+// groupIndexV1 - groupIndex under AlgVersion1: math/rand seeded with the
+//		seed draws r from [1, total weight], and the first group, in
+//		order of ascending weight, whose cumulative weight reaches r is
+//		chosen. Groups of equal weight stay in config order. -1 if no
+//		group has a whole weight of at least 1.
+func (sc *SubnetConfig) groupIndexV1(exp seedExpander, trace *SelectionTrace) (int, error) {
+	seed, err := exp(rawSeed, 0)
+	if err != nil {
+		return -1, err
+	}
+	seedInt, err := seedIntV1(seed)
+	if err != nil {
+		return -1, err
+	}
+
+	weights, order := sc.groupWeightsV1()
+	totalWeight := 0
+	for _, w := range weights {
+		totalWeight += w
+	}
+	if totalWeight < 1 {
+		return -1, nil
+	}
+
+	r := rand.New(rand.NewSource(seedInt)).Intn(totalWeight) + 1
+	trace.recordGroupDraw(uint64(totalWeight), uint64(r))
+	for _, i := range order {
+		if r <= weights[i] {
+			return i, nil
+		}
+		r -= weights[i]
+	}
+	return -1, nil
+}
+
+// validateSubnetWeights - check that SubnetWeights, if set, has a
+//		non-negative weight for each subnet.
+func (cjSubnet *ConjurePhantomSubnet) validateSubnetWeights() error {
+	if len(cjSubnet.SubnetWeights) == 0 {
+		return nil
+	}
+	if len(cjSubnet.SubnetWeights) != len(cjSubnet.Subnets) {
+		return fmt.Errorf("%d subnet weights for %d subnets", len(cjSubnet.SubnetWeights), len(cjSubnet.Subnets))
+	}
+	for j, w := range cjSubnet.SubnetWeights {
+		if !(w >= 0) {
+			return fmt.Errorf("subnet %d has invalid weight %v", j, w)
+		}
+	}
+	return nil
+}
+
+// subnetIndex - the index of the subnet of group selected by seed based on
+//		its SubnetWeights, or -1 if no group was chosen or it has no subnet
+//		weights. The weights are normalized with NormalizeWeights, so if all
+//		are 0 the subnets are equally likely. Subnets are chosen like groups
+//		(groupIndex), with labelSubnet.
+func (sc *SubnetConfig) subnetIndex(exp seedExpander, group int) (int, error) {
+	if group < 0 || len(sc.WeightedSubnets[group].SubnetWeights) == 0 {
+		return -1, nil
+	}
+	cjSubnet := sc.WeightedSubnets[group]
+	if err := cjSubnet.validateSubnetWeights(); err != nil {
+		return -1, fmt.Errorf("subnet group %d: %w", group, err)
+	}
+	randBytes, err := exp(labelSubnet, 8)
+	if err != nil {
+		return -1, err
+	}
+
+	weights := NormalizeWeights(cjSubnet.SubnetWeights, sc.WeightPrecision)
+	var totalWeight uint64
+	for _, w := range weights {
+		totalWeight += w
+	}
+	r := binary.BigEndian.Uint64(randBytes) % totalWeight
+	for j, w := range weights {
+		if r < w {
+			return j, nil
+		}
+		r -= w
+	}
+	return -1, nil
+}
+
+// weightedGroupSubnets - the subnets to select from for weighted selection of
+//		group: those of the group and of every AlwaysInclude group, in config
+//		order. group is -1 if no group was chosen by weight. If subnet is not
+//		-1, only that subnet of group is used (subnetIndex).
+func (sc *SubnetConfig) weightedGroupSubnets(group, subnet int) []string {
+	out := []string{}
+	for i, cjSubnet := range sc.WeightedSubnets {
+		if cjSubnet.Excluded() || !(cjSubnet.AlwaysInclude || i == group) {
+			continue
+		}
+		if i == group && subnet >= 0 {
+			out = append(out, cjSubnet.Subnets[subnet])
+			continue
+		}
+		out = append(out, cjSubnet.Subnets...)
+	}
+	return out
+}
+
+// getSubnets - return EITHER all subnet strings as one composite array if we are
+//		selecting unweighted, or return the array associated with the (seed) selected
+//		array of subnet strings based on the associated weights, along with
+//		those of AlwaysInclude groups
+func (sc *SubnetConfig) getSubnets(seed []byte, weighted bool) []string {
+	exp := hkdfExpander(seed)
+	return sc.getSubnetsWith(seedChooser{sc: sc, exp: exp}, exp, weighted)
+}
+
+// getSubnetsWith - getSubnets, with chooser picking the weighted group.
+func (sc *SubnetConfig) getSubnetsWith(chooser groupChooser, exp seedExpander, weighted bool) []string {
+	out, _, err := sc.chooseGroupSubnets(chooser, exp, weighted)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// groupChooser - picks the index of the weighted group to select from, or
+//		-1 if there is none. Selection uses seedChooser; the interface lets
+//		tests check group choice apart from the rest of selection.
+type groupChooser interface {
+	Pick() (int, error)
+}
+
+// seedChooser - the groupChooser of selection: groupIndex over the
+//		expansion of the seed, so a given seed always picks the same group.
+//		The draw is recorded in trace, if not nil.
+type seedChooser struct {
+	sc    *SubnetConfig
+	exp   seedExpander
+	trace *SelectionTrace
+}
+
+func (c seedChooser) Pick() (int, error) {
+	return c.sc.groupIndex(c.exp, c.trace)
+}
+
+func (sc *SubnetConfig) groupSubnets(exp seedExpander, weighted bool) ([]string, int, error) {
+	return sc.chooseGroupSubnets(seedChooser{sc: sc, exp: exp}, exp, weighted)
+}
+
+func (sc *SubnetConfig) chooseGroupSubnets(chooser groupChooser, exp seedExpander, weighted bool) ([]string, int, error) {
+
+	var out []string = []string{}
+
+	if weighted {
+		i, err := chooser.Pick()
+		if err != nil {
+			return nil, -1, err
+		}
+		j, err := sc.subnetIndex(exp, i)
+		if err != nil {
+			return nil, -1, err
+		}
+		return sc.weightedGroupSubnets(i, j), i, nil
+	} else {
+
+		// Use unweighted config for subnets, concat all into one array and
+		// return. AlgVersion1 includes groups of weight 0.
+		for _, cjSubnet := range sc.WeightedSubnets {
+			if cjSubnet.Excluded() && sc.AlgVersion != AlgVersion1 {
+				continue
+			}
+			for _, subnet := range cjSubnet.Subnets {
+				out = append(out, subnet)
+			}
+		}
+	}
+
+	return out, -1, nil
+}
+
+// filteredSubnets - parse the subnets and apply transform (if any) to them.
+func filteredSubnets(subnets []string, transform SubnetFilter) ([]*net.IPNet, error) {
+	s, err := parseSubnetsCached(subnets)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse subnets: %w", err)
+	}
+	return applyFilter(s, transform)
+}
+
+// applyFilter - apply transform (if any) to parsed subnets, failing with
+//		ErrNoSubnetsAfterFilter if it removes them all, or ErrNoSubnets if
+//		there were none to begin with.
+func applyFilter(s []*net.IPNet, transform SubnetFilter) ([]*net.IPNet, error) {
+	if len(s) == 0 {
+		return nil, ErrNoSubnets
+	} else if transform == nil {
+		return s, nil
+	}
+	s, err := transform(s)
+	if err != nil {
+		return nil, err
+	} else if len(s) == 0 {
+		return nil, ErrNoSubnetsAfterFilter
+	}
+	return s, nil
+}
+
+// selectFromParsed - the core of selection: filter the parsed subnets and
+//		select an address from the rest with the given algorithm version,
+//		uniformly from all of their addresses since AlgVersion2, refusing
+//		subnets wider than width allows. The draw is recorded in trace, if
+//		not nil.
+func selectFromParsed(exp seedExpander, subnets []*net.IPNet, transform SubnetFilter, version uint32, width subnetWidth, trace *SelectionTrace) (*net.IP, *net.IPNet, error) {
+	s, err := applyFilter(subnets, transform)
+	if err != nil {
+		return nil, nil, err
+	}
+	sel, err := newAddrSelector(s, width)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sel.selectAddrAlg(exp, version, trace)
+}
+
+// SubnetFilter - Filter IP subnets based on whatever to prevent specific subnets from
+//		inclusion in choice. See v4Only and v6Only for reference.
+type SubnetFilter func([]*net.IPNet) ([]*net.IPNet, error)
+
+// isIPv6 - true for addresses that are not representable as IPv4. IPv4-mapped
+//		IPv6 addresses (::ffff:a.b.c.d) are treated as IPv4. Subnets are
+//		classified by their network address, so a v4-mapped range such as
+//		::ffff:10.0.0.0/104 is IPv4, while one wider than ::ffff:0:0/96 is
+//		IPv6. Every filter and selection path goes through this, so V4Only
+//		and V6Only always agree.
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil && ip.To16() != nil
+}
+
+// V4Only - keep only IPv4 subnets, including v4-mapped IPv6 ranges (see
+//		isIPv6). If none remain the result is empty (not nil) and no error is
+//		returned, SelectPhantom reports the empty set.
+func V4Only(obj []*net.IPNet) ([]*net.IPNet, error) {
+	var out []*net.IPNet = []*net.IPNet{}
+
+	for _, _net := range obj {
+		if ipv4net := _net.IP.To4(); ipv4net != nil {
+			out = append(out, _net)
+		}
+	}
+	return out, nil
+}
+
+// V6Only - keep only IPv6 subnets. If none remain the result is empty (not
+//		nil) and no error is returned, SelectPhantom reports the empty set.
+func V6Only(obj []*net.IPNet) ([]*net.IPNet, error) {
+	var out []*net.IPNet = []*net.IPNet{}
+
+	for _, _net := range obj {
+		if isIPv6(_net.IP) {
+			out = append(out, _net)
+		}
+	}
+	return out, nil
+}
+
+// AllFamilies - build a SubnetFilter keeping both IPv4 and IPv6 subnets. The
+//		filter returns its input unchanged, order and all, so it selects the
+//		same addresses as a nil filter while giving composition a concrete
+//		filter to work with.
+func AllFamilies() SubnetFilter {
+	return func(obj []*net.IPNet) ([]*net.IPNet, error) {
+		return obj, nil
+	}
+}
+
+// AndFilters - build a SubnetFilter keeping only subnets kept by every filter.
+//		Filters are applied in order, each to the output of the previous one.
+func AndFilters(filters ...SubnetFilter) SubnetFilter {
+	return func(obj []*net.IPNet) ([]*net.IPNet, error) {
+		out := obj
+		for _, filter := range filters {
+			var err error
+			out, err = filter(out)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+}
+
+// OrFilters - build a SubnetFilter keeping subnets kept by any of the filters.
+//		The result keeps the order of the input.
+func OrFilters(filters ...SubnetFilter) SubnetFilter {
+	return func(obj []*net.IPNet) ([]*net.IPNet, error) {
+		kept := make(map[string]bool)
+		for _, filter := range filters {
+			filtered, err := filter(obj)
+			if err != nil {
+				return nil, err
+			}
+			for _, _net := range filtered {
+				kept[_net.String()] = true
+			}
+		}
+
+		var out []*net.IPNet = []*net.IPNet{}
+		for _, _net := range obj {
+			if kept[_net.String()] {
+				out = append(out, _net)
+			}
+		}
+		return out, nil
+	}
+}
+
+// NotFilter - build a SubnetFilter keeping exactly the subnets filter removes.
+func NotFilter(filter SubnetFilter) SubnetFilter {
+	return func(obj []*net.IPNet) ([]*net.IPNet, error) {
+		filtered, err := filter(obj)
+		if err != nil {
+			return nil, err
+		}
+		removed := make(map[string]bool)
+		for _, _net := range filtered {
+			removed[_net.String()] = true
+		}
+
+		var out []*net.IPNet = []*net.IPNet{}
+		for _, _net := range obj {
+			if !removed[_net.String()] {
+				out = append(out, _net)
+			}
+		}
+		return out, nil
+	}
+}
+
+// subnetsOverlap - true if the two subnets share any address.
+func subnetsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// DenySubnets - build a SubnetFilter removing every subnet that overlaps
+//		(including being contained in) one of the denied ranges.
+func DenySubnets(denied []*net.IPNet) SubnetFilter {
+	return func(obj []*net.IPNet) ([]*net.IPNet, error) {
+		var out []*net.IPNet = []*net.IPNet{}
+
+		for _, _net := range obj {
+			allowed := true
+			for _, deniedNet := range denied {
+				if subnetsOverlap(_net, deniedNet) {
+					allowed = false
+					break
+				}
+			}
+			if allowed {
+				out = append(out, _net)
+			}
+		}
+		return out, nil
+	}
+}
+
+// FilterByASN - build a SubnetFilter keeping only subnets whose network
+//		address lookup maps to one of the allowed ASNs. The lookup is
+//		supplied by the caller so no geo/ASN database is bundled here.
+func FilterByASN(allowed []uint32, lookup func(net.IP) uint32) SubnetFilter {
+	allowedSet := make(map[uint32]bool, len(allowed))
+	for _, asn := range allowed {
+		allowedSet[asn] = true
+	}
+	return func(obj []*net.IPNet) ([]*net.IPNet, error) {
+		var out []*net.IPNet = []*net.IPNet{}
+
+		for _, _net := range obj {
+			if allowedSet[lookup(subnetBase(_net))] {
+				out = append(out, _net)
+			}
+		}
+		return out, nil
+	}
+}
+
+// FilterByCountry - build a SubnetFilter keeping only subnets whose network
+//		address lookup maps to one of the allowed country codes. Codes are
+//		compared case-insensitively.
+func FilterByCountry(allowed []string, lookup func(net.IP) string) SubnetFilter {
+	allowedSet := make(map[string]bool, len(allowed))
+	for _, country := range allowed {
+		allowedSet[strings.ToUpper(country)] = true
+	}
+	return func(obj []*net.IPNet) ([]*net.IPNet, error) {
+		var out []*net.IPNet = []*net.IPNet{}
+
+		for _, _net := range obj {
+			if allowedSet[strings.ToUpper(lookup(subnetBase(_net)))] {
+				out = append(out, _net)
+			}
+		}
+		return out, nil
+	}
+}
+
+// FilterByPrefixLen - build a SubnetFilter keeping only subnets with a
+//		prefix length of at most maxV4 (IPv4) or maxV6 (IPv6), dropping
+//		ranges too small to hide in, e.g. maxV4 = 24 keeps a /24 and drops
+//		a /28.
+func FilterByPrefixLen(maxV4, maxV6 int) SubnetFilter {
+	return func(obj []*net.IPNet) ([]*net.IPNet, error) {
+		var out []*net.IPNet = []*net.IPNet{}
+
+		for _, _net := range obj {
+			ones, bits := _net.Mask.Size()
+			maxLen := maxV6
+			if !isIPv6(_net.IP) {
+				maxLen = maxV4
+				// an IPv4 subnet may carry a 16 byte mask
+				ones -= bits - 8*net.IPv4len
+			}
+			if ones <= maxLen {
+				out = append(out, _net)
+			}
+		}
+		return out, nil
+	}
+}
+
+// ReservedSubnets - private, loopback, link-local, multicast, documentation
+//		and other reserved or bogon ranges that ExcludeReserved removes.
+//		Extend it to exclude more ranges.
+var ReservedSubnets = mustParseSubnets(
+	// IPv4
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16",
+	"198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4",
+	"240.0.0.0/4",
+	// IPv6
+	"::/128", "::1/128", "100::/64", "2001:db8::/32", "fc00::/7", "fe80::/10",
+	"ff00::/8",
+)
+
+// ExcludeReserved - build a SubnetFilter removing every subnet that overlaps
+//		one of ReservedSubnets.
+func ExcludeReserved() SubnetFilter {
+	return func(obj []*net.IPNet) ([]*net.IPNet, error) {
+		return DenySubnets(ReservedSubnets)(obj)
+	}
+}
+
+var linkLocalAndMulticastSubnets = mustParseSubnets(
+	"169.254.0.0/16", "224.0.0.0/4", "fe80::/10", "ff00::/8",
+)
+
+// ExcludeLinkLocalAndMulticast - build a SubnetFilter removing every subnet
+//		that overlaps a link-local or multicast range of either family.
+func ExcludeLinkLocalAndMulticast() SubnetFilter {
+	return DenySubnets(linkLocalAndMulticastSubnets)
+}
+
+var ulaSubnets = mustParseSubnets("fc00::/7")
+
+// ExcludeULA - build a SubnetFilter removing every subnet that overlaps the
+//		IPv6 unique local address range fc00::/7, which is not routable on
+//		the internet.
+func ExcludeULA() SubnetFilter {
+	return DenySubnets(ulaSubnets)
+}
+
+// DefaultPhantomFilter - build the hygiene SubnetFilter most callers want,
+//		keeping only globally routable unicast subnets, for selection from
+//		configs that aren't vetted by hand. It combines ExcludeReserved,
+//		ExcludeLinkLocalAndMulticast and ExcludeULA, removing every subnet
+//		overlapping one of
+//		  IPv4: 0.0.0.0/8 (this network), 10.0.0.0/8, 172.16.0.0/12 and
+//		    192.168.0.0/16 (private), 100.64.0.0/10 (shared/CGN),
+//		    127.0.0.0/8 (loopback), 169.254.0.0/16 (link-local),
+//		    192.0.0.0/24 (protocol assignments), 192.0.2.0/24,
+//		    198.51.100.0/24 and 203.0.113.0/24 (documentation),
+//		    198.18.0.0/15 (benchmarking), 224.0.0.0/4 (multicast) and
+//		    240.0.0.0/4 (reserved, incl. broadcast)
+//		  IPv6: ::/128 (unspecified), ::1/128 (loopback), 100::/64 (discard),
+//		    2001:db8::/32 (documentation), fc00::/7 (ULA),
+//		    fe80::/10 (link-local) and ff00::/8 (multicast)
+//		plus whatever is added to ReservedSubnets. The link-local, multicast
+//		and ULA ranges are still removed if ReservedSubnets is changed.
+func DefaultPhantomFilter() SubnetFilter {
+	return AndFilters(ExcludeReserved(), ExcludeLinkLocalAndMulticast(), ExcludeULA())
+}
+
+func mustParseSubnets(subnets ...string) []*net.IPNet {
+	parsed, err := parseSubnets(subnets)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// parseSubnets - parse every entry rather than stopping at the first bad CIDR,
+//		so a config with several typos can be fixed in one pass. Any failure
+//		still fails the whole parse with a SubnetParseError listing them all.
+func parseSubnets(phantomSubnets []string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet = []*net.IPNet{}
+
+	if len(phantomSubnets) == 0 {
+		return nil, fmt.Errorf("parseSubnets - no subnets provided")
+	}
+
+	var failures []string
+	for i, strNet := range phantomSubnets {
+		parsedNet, err := parseSubnet(strNet)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("[%d] %q: %v", i, strNet, err))
+			continue
+		}
+
+		subnets = append(subnets, parsedNet)
+	}
+
+	if len(failures) > 0 {
+		return nil, &SubnetParseError{Failures: failures}
+	}
+
+	return subnets, nil
+}
+
+// parseSubnet - parse one subnet string, which may carry a zone identifier
+//		if it is an IPv6 link-local subnet.
+func parseSubnet(strNet string) (*net.IPNet, error) {
+	cidr, zone := SplitSubnetZone(strNet)
+	_, parsedNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	} else if parsedNet == nil {
+		return nil, fmt.Errorf("failed to parse as subnet")
+	}
+	if cidr != strNet {
+		if zone == "" {
+			return nil, fmt.Errorf("empty zone identifier")
+		} else if !isIPv6(parsedNet.IP) || !parsedNet.IP.IsLinkLocalUnicast() {
+			return nil, fmt.Errorf("zone %q is only meaningful on an IPv6 link-local subnet", zone)
+		}
+	}
+	return parsedNet, nil
+}
+
+// SplitSubnetZone - separate an IPv6 zone identifier from a subnet string.
+//		Both "fe80::/64%eth0" and "fe80::%eth0/64" yield ("fe80::/64", "eth0").
+//		net.ParseCIDR rejects zones, and a net.IP has nowhere to keep one, so
+//		callers dialing a link-local phantom should reattach the zone via
+//		net.IPAddr{IP: ip, Zone: zone}. Strings without a zone are returned as-is.
+func SplitSubnetZone(subnet string) (cidr string, zone string) {
+	pct := strings.IndexByte(subnet, '%')
+	if pct < 0 {
+		return subnet, ""
+	}
+	slash := strings.IndexByte(subnet, '/')
+	if slash > pct {
+		// "addr%zone/len"
+		return subnet[:pct] + subnet[slash:], subnet[pct+1 : slash]
+	}
+	// "addr/len%zone"
+	return subnet[:pct], subnet[pct+1:]
+}
+
+// InvalidSubnetError locates a subnet string of a config that failed to
+// parse by the index of its group and its index within the group.
+type InvalidSubnetError struct {
+	Group  int
+	Index  int
+	Subnet string
+	Err    error
+}
+
+func (e *InvalidSubnetError) Error() string {
+	return fmt.Sprintf("subnet group %d, subnet %d %q: %v", e.Group, e.Index, e.Subnet, e.Err)
+}
+
+func (e *InvalidSubnetError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError reports every problem Validate found with a config. Subnets
+// holds the subnets that failed to parse, in config order, and the first of
+// them is what errors.As finds when looking for an *InvalidSubnetError.
+type ConfigError struct {
+	Problems []string
+	Subnets  []*InvalidSubnetError
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid subnet config: %s", strings.Join(e.Problems, "; "))
+}
+
+func (e *ConfigError) Unwrap() error {
+	if len(e.Subnets) == 0 {
+		return nil
+	}
+	return e.Subnets[0]
+}
+
+// SubnetParseError reports every entry that failed to parse in a single call
+// to parseSubnets, each formatted as "[index] \"subnet\": reason".
+type SubnetParseError struct {
+	Failures []string
+}
+
+func (e *SubnetParseError) Error() string {
+	return fmt.Sprintf("failed to parse %d subnet(s): %s", len(e.Failures), strings.Join(e.Failures, "; "))
+}
+
+// maxParsedSubnetsCache bounds the number of subnets kept parsed, across all
+// cached lists.
+const maxParsedSubnetsCache = 4096
+
+var (
+	parsedSubnetsMu    sync.RWMutex
+	parsedSubnetsCache = make(map[string][]*net.IPNet)
+	parsedSubnetsCount int
+)
+
+// parseSubnetsCached - parseSubnets, remembering the result for the exact list
+//		of subnet strings so repeated selections from the same config skip
+//		net.ParseCIDR. A config whose strings change simply misses the cache.
+//		The cache is reset once it would hold more than maxParsedSubnetsCache
+//		subnets, and longer lists aren't cached at all. Callers get copies,
+//		so they can't change the cached subnets.
+func parseSubnetsCached(phantomSubnets []string) ([]*net.IPNet, error) {
+	key := strings.Join(phantomSubnets, ",")
+
+	parsedSubnetsMu.RLock()
+	cached, ok := parsedSubnetsCache[key]
+	parsedSubnetsMu.RUnlock()
+
+	if !ok {
+		parsed, err := parseSubnets(phantomSubnets)
+		if err != nil {
+			return nil, err
+		} else if len(parsed) > maxParsedSubnetsCache {
+			return parsed, nil
+		}
+
+		parsedSubnetsMu.Lock()
+		if _, ok := parsedSubnetsCache[key]; !ok {
+			if parsedSubnetsCount+len(parsed) > maxParsedSubnetsCache {
+				parsedSubnetsCache = make(map[string][]*net.IPNet)
+				parsedSubnetsCount = 0
+			}
+			parsedSubnetsCache[key] = parsed
+			parsedSubnetsCount += len(parsed)
+		}
+		parsedSubnetsMu.Unlock()
+		cached = parsed
+	}
+
+	out := make([]*net.IPNet, len(cached))
+	for i, _net := range cached {
+		out[i] = &net.IPNet{
+			IP:   append(net.IP{}, _net.IP...),
+			Mask: append(net.IPMask{}, _net.Mask...),
+		}
+	}
+	return out, nil
+}
+
+// SelectAddrFromSubnet - given a seed and a CIDR block choose an address.
+// 		This is done by deriving random bytes from the seed up to the length of
+//		the full address then using the net mask to zero out any bytes that are
+//		already specified by the CIDR block. Tde masked random value is then
+//		added to the cidr block base giving the final randomly selected address.
+//
+//		Subnets wider than DefaultMinSelectPrefixV4 or
+//		DefaultMinSelectPrefixV6 are refused with ErrSubnetTooWide, select
+//		through a SubnetConfig setting AllowWideSubnets to use them.
+func SelectAddrFromSubnet(seed []byte, net1 *net.IPNet) (net.IP, error) {
+	if err := defaultSubnetWidth.check(net1); err != nil {
+		return nil, err
+	}
+	addr, err := selectAddrFromSubnet(hkdfExpander(seed), net1)
+	if err != nil && !errors.Is(err, ErrInvalidSubnet) && !errors.Is(err, ErrOutsideSubnet) {
+		return nil, fmt.Errorf("selecting from %v with a %d byte seed: %w", net1, len(seed), err)
+	}
+	return addr, err
+}
+
+// DefaultMinSelectPrefixV4 and DefaultMinSelectPrefixV6 are the shortest
+// prefixes selection accepts unless a SubnetConfig sets others. A wider subnet
+// such as 0.0.0.0/0 or ::/0 is almost certainly a config error and would
+// yield addresses anywhere, reserved ranges included, so it is refused unless
+// SubnetConfig.AllowWideSubnets is set.
+const (
+	DefaultMinSelectPrefixV4 = 8
+	DefaultMinSelectPrefixV6 = 16
+)
+
+// ErrSubnetTooWide is returned when selecting from a subnet with a prefix
+// shorter than the minimum of its family, see DefaultMinSelectPrefixV4.
+var ErrSubnetTooWide = errors.New("phantom subnet too wide to select from")
+
+// subnetWidth - the shortest prefixes selection accepts, see
+//		SubnetConfig.MinSelectPrefixV4.
+type subnetWidth struct {
+	minV4, minV6 int
+	allowWide    bool
+}
+
+// defaultSubnetWidth - the limits of selection without a config, and of a
+//		config leaving them unset.
+var defaultSubnetWidth = subnetWidth{minV4: DefaultMinSelectPrefixV4, minV6: DefaultMinSelectPrefixV6}
+
+// subnetWidth - the limits the config selects with.
+func (sc *SubnetConfig) subnetWidth() subnetWidth {
+	width := defaultSubnetWidth
+	if sc.MinSelectPrefixV4 != 0 {
+		width.minV4 = sc.MinSelectPrefixV4
+	}
+	if sc.MinSelectPrefixV6 != 0 {
+		width.minV6 = sc.MinSelectPrefixV6
+	}
+	width.allowWide = sc.AllowWideSubnets
+	return width
+}
+
+// check - refuse subnets shorter than the minimum prefix of their family.
+//		IPv4-mapped IPv6 subnets are measured as the IPv4 range they map.
+//		Invalid subnets are left to the caller.
+func (width subnetWidth) check(net1 *net.IPNet) error {
+	if width.allowWide || net1 == nil {
+		return nil
+	}
+	ones, bits := net1.Mask.Size()
+	if bits == 0 {
+		return nil
+	}
+	if isIPv6(net1.IP) {
+		if ones < width.minV6 {
+			return fmt.Errorf("%w: %v is shorter than /%d, set AllowWideSubnets if intended", ErrSubnetTooWide, net1, width.minV6)
+		}
+		return nil
+	}
+	if prefix := ones - (bits - 8*net.IPv4len); prefix < width.minV4 {
+		return fmt.Errorf("%w: %v is shorter than /%d, set AllowWideSubnets if intended", ErrSubnetTooWide, net1, width.minV4)
+	}
+	return nil
+}
+
+func selectAddrFromSubnet(exp seedExpander, net1 *net.IPNet) (net.IP, error) {
+	if net1 == nil {
+		return nil, fmt.Errorf("%w: nil subnet", ErrInvalidSubnet)
+	}
+	bits, addrLen := net1.Mask.Size()
+	if addrLen == 0 {
+		return nil, fmt.Errorf("%w %v", ErrInvalidSubnet, net1)
+	} else if bits == addrLen {
+		// single address subnet (/32 or /128), nothing to choose
+		return addrAtOffset(net1, big.NewInt(0)), nil
+	}
+
+	ipBigInt := big.NewInt(0).SetBytes(subnetBase(net1))
+
+	randBytes, err := exp(labelAddress, addrLen/8)
+	if err != nil {
+		return nil, err
+	}
+	randBigInt := &big.Int{}
+	randBigInt.SetBytes(randBytes)
+
+	mask := make([]byte, addrLen/8)
+	for i := 0; i < addrLen/8; i++ {
+		mask[i] = 0xff
+	}
+	// addrLen ones shifted right by the prefix length leaves exactly the
+	// host bits set, whether or not the prefix is byte aligned
+	maskBigInt := &big.Int{}
+	maskBigInt.SetBytes(mask)
+	maskBigInt.Rsh(maskBigInt, uint(bits))
+
+	randBigInt.And(randBigInt, maskBigInt)
+	ipBigInt.Add(ipBigInt, randBigInt)
+
+	// big.Int.Bytes() drops leading zero bytes, left pad back to full width
+	ipBytes := ipBigInt.Bytes()
+	addr := make([]byte, addrLen/8)
+	copy(addr[len(addr)-len(ipBytes):], ipBytes)
+
+	result := normalizeAddr(net1, net.IP(addr))
+	if !net1.Contains(result) {
+		return nil, fmt.Errorf("%w: %v not in %v", ErrOutsideSubnet, result, net1)
+	}
+	return result, nil
+}
+
+// addressCount - total number of addresses in the subnets.
+func addressCount(subnets []*net.IPNet) *big.Int {
+	total := big.NewInt(0)
+	for _, _net := range subnets {
+		ones, bits := _net.Mask.Size()
+		total.Add(total, big.NewInt(0).Lsh(big.NewInt(1), uint(bits-ones)))
+	}
+	return total
+}
+
+// addrAtOffset - the address offset addresses after the base of the subnet.
+func addrAtOffset(net1 *net.IPNet, offset *big.Int) net.IP {
+	_, bits := net1.Mask.Size()
+	ipBigInt := big.NewInt(0).SetBytes(subnetBase(net1))
+	ipBigInt.Add(ipBigInt, offset)
+
+	// big.Int.Bytes() drops leading zero bytes, left pad back to full width
+	ipBytes := ipBigInt.Bytes()
+	addr := make(net.IP, bits/8)
+	copy(addr[len(addr)-len(ipBytes):], ipBytes)
+	return normalizeAddr(net1, addr)
+}
+
+// subnetBase - the network address of the subnet, with any host bits of
+//		net1.IP cleared, as long as the mask.
+func subnetBase(net1 *net.IPNet) net.IP {
+	base := net1.IP.Mask(net1.Mask)
+	if len(base) != len(net1.Mask) {
+		if len(net1.Mask) == net.IPv6len {
+			return base.To16()
+		}
+		return base.To4()
+	}
+	return base
+}
+
+// normalizeAddr - return addr as 4 bytes if the subnet is IPv4 (including
+//		IPv4-mapped IPv6 subnets) and as 16 bytes otherwise. An IPv6 address
+//		shorter than 16 bytes, as from big.Int.Bytes dropping leading zero
+//		bytes, is left padded rather than read as IPv4.
+func normalizeAddr(net1 *net.IPNet, addr net.IP) net.IP {
+	if !isIPv6(net1.IP) {
+		if v4 := addr.To4(); v4 != nil {
+			return v4
+		}
+	} else if len(addr) < net.IPv6len {
+		padded := make(net.IP, net.IPv6len)
+		copy(padded[net.IPv6len-len(addr):], addr)
+		return padded
+	}
+	return addr.To16()
+}
+
+// addrSelector - subnets to select an address from with the range of ids each
+//		one covers precomputed, so it can be reused across seeds.
+type addrSelector struct {
+	subnets []*net.IPNet
+	// ends[i] is the first id past subnets[i], which covers [ends[i-1], ends[i])
+	ends  []*big.Int
+	total *big.Int
+}
+
+func newAddrSelector(subnets []*net.IPNet, width subnetWidth) (*addrSelector, error) {
+	if len(subnets) == 0 {
+		return nil, ErrNoSubnets
+	}
+	for _, _net := range subnets {
+		if err := width.check(_net); err != nil {
+			return nil, err
+		}
+	}
+	sel := &addrSelector{
+		subnets: subnets,
+		ends:    make([]*big.Int, 0, len(subnets)),
+		total:   big.NewInt(0),
+	}
+	for _, _net := range subnets {
+		if _, netMaskBits := _net.Mask.Size(); netMaskBits == 0 {
+			return nil, fmt.Errorf("%w %v", ErrInvalidSubnet, _net)
+		}
+		sel.total.Add(sel.total, addressCount([]*net.IPNet{_net}))
+		sel.ends = append(sel.ends, big.NewInt(0).Set(sel.total))
+	}
+
+	if sel.total.Cmp(big.NewInt(0)) <= 0 {
+		return nil, fmt.Errorf("No valid addresses specified in %v", subnets)
+	}
+	return sel, nil
+}
+
+// subnetForID - find the subnet holding the id-th address of all the subnets
+//		taken in order, and the offset of that address within the subnet.
+func (sel *addrSelector) subnetForID(id *big.Int) (*net.IPNet, *big.Int, error) {
+	i := sort.Search(len(sel.ends), func(i int) bool { return sel.ends[i].Cmp(id) > 0 })
+	if id.Sign() < 0 || i == len(sel.ends) {
+		return nil, nil, fmt.Errorf("no subnet found for selected id %v of %v", id, sel.total)
+	}
+
+	offset := big.NewInt(0).Set(id)
+	if i > 0 {
+		offset.Sub(offset, sel.ends[i-1])
+	}
+	return sel.subnets[i], offset, nil
+}
+
+// selectAddr - derive an id uniformly distributed over all addresses in the
+//		subnets and return the address it refers to, so every address is
+//		equally likely regardless of which subnet holds it. The id is
+//		recorded in trace, if not nil.
+func (sel *addrSelector) selectAddr(exp seedExpander, trace *SelectionTrace) (*net.IP, *net.IPNet, error) {
+	// 64 bits more than needed make the modulo bias negligible
+	idBytes, err := exp(labelAddressID, (sel.total.BitLen()+7)/8+8)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to chose IP address from %v: %w", sel.subnets, err)
+	}
+	id := big.NewInt(0).SetBytes(idBytes)
+	id.Mod(id, sel.total)
+
+	subnet, offset, err := sel.subnetForID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	trace.recordAddress(sel.subnets, sel.total, id, offset)
+	result := addrAtOffset(subnet, offset)
+	if !subnet.Contains(result) {
+		return nil, nil, fmt.Errorf("%w: %v not in %v", ErrOutsideSubnet, result, subnet)
+	}
+	return &result, subnet, nil
+}
+
+// selectAddrAlg - select an address with the given algorithm version, see
+//		AlgVersion1 and AlgVersion2. The draw is recorded in trace, if not
+//		nil.
+func (sel *addrSelector) selectAddrAlg(exp seedExpander, version uint32, trace *SelectionTrace) (*net.IP, *net.IPNet, error) {
+	if version != AlgVersion1 {
+		return sel.selectAddr(exp, trace)
+	}
+	seed, err := exp(rawSeed, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	subnet, total, id, err := subnetForSeedV1(seed, sel.subnets)
+	if err != nil {
+		return nil, nil, err
+	}
+	offset, err := hostOffsetV1(seed, subnet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to chose IP address from %v: %w", subnet, err)
+	}
+	trace.recordAddress(sel.subnets, total, id, offset)
+	result := addrAtOffset(subnet, offset)
+	if !subnet.Contains(result) {
+		return nil, nil, fmt.Errorf("%w: %v not in %v", ErrOutsideSubnet, result, subnet)
+	}
+	return &result, subnet, nil
+}
+
+// subnetForSeedV1 - the subnet the seed picks under AlgVersion1, along with
+//		the total number of ids and the id. Subnet i covers the ids in
+//		(min_i, min_i + 2^h_i - 1], where min_i is the end of the range of
+//		the subnet before it (0 for the first) and h_i its host bits, so a
+//		/32 or /128 is never picked. The id is the seed read big endian,
+//		reduced modulo the total only if larger; an id of 0 picks nothing.
+func subnetForSeedV1(seed []byte, subnets []*net.IPNet) (*net.IPNet, *big.Int, *big.Int, error) {
+	ends := make([]*big.Int, 0, len(subnets))
+	total := big.NewInt(0)
+	for _, _net := range subnets {
+		ones, bits := _net.Mask.Size()
+		total.Add(total, big.NewInt(0).Lsh(big.NewInt(1), uint(bits-ones)))
+		total.Sub(total, big.NewInt(1))
+		ends = append(ends, big.NewInt(0).Set(total))
+	}
+	if total.Sign() <= 0 {
+		return nil, nil, nil, fmt.Errorf("No valid addresses specified in %v", subnets)
+	}
+
+	id := big.NewInt(0).SetBytes(seed)
+	if id.Cmp(total) > 0 {
+		id.Mod(id, total)
+	}
+	i := sort.Search(len(ends), func(i int) bool { return ends[i].Cmp(id) >= 0 })
+	if id.Sign() == 0 || i == len(ends) {
+		return nil, nil, nil, fmt.Errorf("no subnet found for selected id %v of %v", id, total)
+	}
+	return subnets[i], total, id, nil
+}
+
+// hostOffsetV1 - the offset of the address within subnet under AlgVersion1:
+//		math/rand seeded with the seed fills as many bytes as the address
+//		is long, read big endian and masked to the host bits.
+func hostOffsetV1(seed []byte, subnet *net.IPNet) (*big.Int, error) {
+	seedInt, err := seedIntV1(seed)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := subnet.Mask.Size()
+	randBytes := make([]byte, bits/8)
+	rand.New(rand.NewSource(seedInt)).Read(randBytes)
+
+	hostMask := big.NewInt(0).Lsh(big.NewInt(1), uint(bits-ones))
+	hostMask.Sub(hostMask, big.NewInt(1))
+	offset := big.NewInt(0).SetBytes(randBytes)
+	return offset.And(offset, hostMask), nil
+}
+
+// selectIPAddr - select an address uniformly from all addresses in subnets.
+func selectIPAddr(seed []byte, subnets []*net.IPNet) (*net.IP, *net.IPNet, error) {
+	sel, err := newAddrSelector(subnets, defaultSubnetWidth)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sel.selectAddr(hkdfExpander(seed), nil)
+}
+
+// alignV6 - with AlignV6To64 set, replace an address selected from an IPv6
+//		subnet shorter than /64 by a host within a seed selected /64.
+func (sc *SubnetConfig) alignV6(exp seedExpander, addr *net.IP, subnet *net.IPNet) (*net.IP, error) {
+	if !sc.AlignV6To64 || !isIPv6(subnet.IP) {
+		return addr, nil
+	}
+	if ones, _ := subnet.Mask.Size(); ones >= 64 {
+		return addr, nil
+	}
+
+	prefix, err := selectSlash64(exp, subnet)
+	if err != nil {
+		return nil, err
+	}
+	hostBytes, err := exp(labelHost64, 8)
+	if err != nil {
+		return nil, err
+	}
+	host := addrAtOffset(prefix, big.NewInt(0).SetBytes(hostBytes))
+	return &host, nil
+}
+
+// unusableHost - whether ip is one of the addresses of subnet usableHost
+//		replaces.
+func unusableHost(ip net.IP, subnet *net.IPNet) bool {
+	ones, bits := subnet.Mask.Size()
+	hostBits := bits - ones
+	if hostBits <= 1 {
+		return false
+	}
+	offset := big.NewInt(0).Sub(
+		big.NewInt(0).SetBytes(ip.To16()),
+		big.NewInt(0).SetBytes(subnetBase(subnet).To16()))
+	broadcast := big.NewInt(0).Lsh(big.NewInt(1), uint(hostBits))
+	broadcast.Sub(broadcast, big.NewInt(1))
+	return offset.Sign() == 0 || (!isIPv6(subnet.IP) && offset.Cmp(broadcast) == 0)
+}
+
+// usableHost - with SkipNetworkAndBroadcast set, replace a selected IPv4
+//		network or broadcast address, or IPv6 subnet-router anycast (all
+//		zero host) address, by a host derived from the seed among the
+//		usable ones. Other addresses are returned as they are, so enabling
+//		the option only changes selections that landed on one of these.
+func (sc *SubnetConfig) usableHost(exp seedExpander, addr *net.IP, subnet *net.IPNet) (*net.IP, error) {
+	if !sc.SkipNetworkAndBroadcast {
+		return addr, nil
+	}
+	ones, bits := subnet.Mask.Size()
+	hostBits := bits - ones
+	if hostBits <= 1 {
+		// a /31 or /127 has no network or broadcast address, a /32 or
+		// /128 just the one address
+		return addr, nil
+	}
+
+	size := big.NewInt(0).Lsh(big.NewInt(1), uint(hostBits))
+	offset := big.NewInt(0).Sub(
+		big.NewInt(0).SetBytes(addr.To16()),
+		big.NewInt(0).SetBytes(subnetBase(subnet).To16()))
+	broadcast := big.NewInt(0).Sub(size, big.NewInt(1))
+
+	// hosts 1 to size-2 are usable for IPv4, 1 to size-1 for IPv6
+	usable := big.NewInt(0).Sub(size, big.NewInt(1))
+	reserved := offset.Sign() == 0
+	if !isIPv6(subnet.IP) {
+		usable.Sub(usable, big.NewInt(1))
+		reserved = reserved || offset.Cmp(broadcast) == 0
+	}
+	if !reserved {
+		return addr, nil
+	}
+
+	hostBytes, err := exp(labelUsableHost, 8)
+	if err != nil {
+		return nil, err
+	}
+	offset.Mod(big.NewInt(0).SetBytes(hostBytes), usable)
+	host := addrAtOffset(subnet, offset.Add(offset, big.NewInt(1)))
+	return &host, nil
+}
+
+// SelectPhantomFromSecret - select one phantom IP address based on a full
+//		32 byte Conjure shared secret. Every byte of the secret feeds the
+//		HKDF expansion, so this selects the same address as SelectPhantom
+//		given secret[:].
+func SelectPhantomFromSecret(secret [32]byte, subnets SubnetConfig, transform SubnetFilter, weighted bool) (*net.IP, error) {
+	return SelectPhantom(secret[:], subnets, transform, weighted)
+}
+
+// SelectPhantom - select one phantom IP address based on shared secret
+//		SelectPhantom and its variants are safe for concurrent use: they keep
+//		no state between calls apart from the read-locked cache of parsed
+//		subnets, which is never modified by selection or filters.
+func SelectPhantom(seed []byte, subnets SubnetConfig, transform SubnetFilter, weighted bool) (*net.IP, error) {
+	addr, _, err := SelectPhantomWithSubnet(seed, subnets, transform, weighted)
+	return addr, err
+}
+
+// SelectPhantomWithSubnet - select one phantom IP address based on shared
+//		secret and also return the subnet it was drawn from.
+func SelectPhantomWithSubnet(seed []byte, subnets SubnetConfig, transform SubnetFilter, weighted bool) (*net.IP, *net.IPNet, error) {
+
+	if len(seed) < MinSeedLen {
+		return nil, nil, shortSeedError(seed)
+	}
+
+	return selectPhantom(hkdfExpander(seed), subnets, transform, weighted)
+}
+
+// SelectPhantomFromParsed - select one phantom IP address based on shared
+//		secret from subnets already parsed, for callers selecting at a high
+//		rate. All subnets form a single group, so the result is that of
+//		SelectPhantom over a config holding them in one group. transform is
+//		given a copy of subnets.
+func SelectPhantomFromParsed(seed []byte, subnets []*net.IPNet, transform SubnetFilter) (*net.IP, error) {
+	if len(seed) < MinSeedLen {
+		return nil, shortSeedError(seed)
+	}
+	addr, _, err := selectFromParsed(hkdfExpander(seed), append([]*net.IPNet{}, subnets...), transform, LatestAlgVersion, defaultSubnetWidth, nil)
+	return addr, err
+}
+
+// SelectPhantomRoute - select one phantom IP address based on shared secret,
+//		using weighted selection, along with the subnet containing it, for
+//		clients installing a route to the phantom. The subnet is a copy the
+//		caller may modify, e.g. to narrow it to a host route.
+func SelectPhantomRoute(seed []byte, subnets SubnetConfig, transform SubnetFilter) (net.IP, net.IPNet, error) {
+	addr, subnet, err := SelectPhantomWithSubnet(seed, subnets, transform, true)
+	if err != nil {
+		return nil, net.IPNet{}, err
+	}
+	route := net.IPNet{
+		IP:   append(net.IP{}, subnet.IP...),
+		Mask: append(net.IPMask{}, subnet.Mask...),
+	}
+	return *addr, route, nil
+}
+
+// SelectPhantomWithRand - select one phantom IP address drawing all
+//		randomness from src rather than deriving it from the seed. With a nil
+//		src this is SelectPhantom, which uses the seed.
+func SelectPhantomWithRand(seed []byte, subnets SubnetConfig, transform SubnetFilter, weighted bool, src rand.Source) (*net.IP, error) {
+	if src == nil {
+		return SelectPhantom(seed, subnets, transform, weighted)
+	}
+	addr, _, err := selectPhantom(sourceExpander(src), subnets, transform, weighted)
+	return addr, err
+}
+
+// SelectPhantomFromReader - select one phantom IP address using weighted
+//		selection, reading the bytes that drive it from r (e.g. an HKDF
+//		reader) instead of deriving them from a seed. Bytes are read in the
+//		order they are used: the group choice, then the address id, if
+//		AlignV6To64 applies the /64 and host, and if SkipNetworkAndBroadcast
+//		applies the usable host. Partial reads are retried; running out of
+//		bytes, or any read error, is returned.
+func SelectPhantomFromReader(r io.Reader, subnets SubnetConfig, transform SubnetFilter) (*net.IP, error) {
+	addr, _, err := selectPhantom(readerExpander(r), subnets, transform, true)
+	return addr, err
+}
+
+// PhantomSelection - a selected phantom address along with where it came from.
+type PhantomSelection struct {
+	Addr   net.IP
+	Subnet *net.IPNet
+
+	// Weighted is whether a single group was chosen by weight, rather than
+	// selecting from the subnets of every group.
+	Weighted bool
+
+	// Group is the index in WeightedSubnets of the group chosen by weight, or
+	// -1 for unweighted selection.
+	Group int
+
+	// Index is the position of Subnet in the Subnets of the group, preceded
+	// and followed by those of AlwaysInclude groups in config order, or, for
+	// unweighted selection, in the Subnets of every non excluded group
+	// taken in order.
+	Index int
+
+	// SeedHash identifies the seed without revealing it, see seedHash. It is
+	// only set by SelectPhantomDetailed.
+	SeedHash string
+}
+
+// String - a single line for logs and bug reports, pinning down how the
+//		address was chosen, e.g.
+//		"192.122.190.84 from 192.122.190.0/24 (weighted, group 0, subnet 0, seed 1a2b3c4d5e6f7081)".
+func (sel *PhantomSelection) String() string {
+	how := "unweighted"
+	if sel.Weighted {
+		how = fmt.Sprintf("weighted, group %d", sel.Group)
+	}
+	seed := sel.SeedHash
+	if seed == "" {
+		seed = "unknown"
+	}
+	return fmt.Sprintf("%v from %v (%s, subnet %d, seed %s)", sel.Addr, sel.Subnet, how, sel.Index, seed)
+}
+
+// seedHash - the first 8 bytes of the SHA-256 of the seed, in hex. Enough to
+//		tell seeds apart in logs, too little to help recover the seed.
+func seedHash(seed []byte) string {
+	sum := sha256.Sum256(seed)
+	return hex.EncodeToString(sum[:8])
+}
+
+// SelectPhantomDetailed - select one phantom IP address based on shared
+//		secret, exactly as SelectPhantom does, and report the subnet, group
+//		and subnet index it was drawn from, and a hash of the seed. Log the
+//		result with its String method.
+func SelectPhantomDetailed(seed []byte, subnets SubnetConfig, transform SubnetFilter, weighted bool) (*PhantomSelection, error) {
+	if len(seed) < MinSeedLen {
+		return nil, shortSeedError(seed)
+	}
+	selection, err := selectPhantomDetailed(hkdfExpander(seed), subnets, transform, weighted, nil)
+	if err != nil {
+		return nil, err
+	}
+	selection.SeedHash = seedHash(seed)
+	return selection, nil
+}
+
+func selectPhantom(exp seedExpander, subnets SubnetConfig, transform SubnetFilter, weighted bool) (*net.IP, *net.IPNet, error) {
+	selection, err := selectPhantomDetailed(exp, subnets, transform, weighted, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &selection.Addr, selection.Subnet, nil
+}
+
+// selectPhantomDetailed - the selection behind SelectPhantomDetailed and
+//		SelectPhantomTraced, recording the draws in trace, if not nil.
+func selectPhantomDetailed(exp seedExpander, subnets SubnetConfig, transform SubnetFilter, weighted bool, trace *SelectionTrace) (*PhantomSelection, error) {
+	version, err := subnets.algVersion()
+	if err != nil {
+		return nil, err
+	}
+	if subnets.Strict {
+		if err := subnets.ValidateNoOverlap(); err != nil {
+			return nil, err
+		}
+	}
+
+	groupSubnets, group, err := subnets.chooseGroupSubnets(seedChooser{sc: &subnets, exp: exp, trace: trace}, exp, weighted)
+	if err != nil {
+		return nil, err
+	} else if len(groupSubnets) == 0 {
+		return nil, ErrEmptySubnetConfig
+	}
+	parsed, err := parseSubnetsCached(groupSubnets)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse subnets: %w", err)
+	}
+	addr, subnet, err := selectFromParsed(exp, parsed, transform, version, subnets.subnetWidth(), trace)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err = subnets.alignV6(exp, addr, subnet)
+	if err != nil {
+		return nil, err
+	}
+	addr, err = subnets.usableHost(exp, addr, subnet)
+	if err != nil {
+		return nil, err
+	} else if !subnet.Contains(*addr) {
+		return nil, fmt.Errorf("%w: %v not in %v", ErrOutsideSubnet, addr, subnet)
+	}
+
+	// filters only drop subnets, so the selected one is among the parsed
+	// ones. Parse again, as a filter may have reordered them, and with all
+	// subnets of the group, as only one may have been selected from.
+	index := -1
+	if weighted {
+		groupSubnets = subnets.weightedGroupSubnets(group, -1)
+	}
+	parsed, err = parseSubnetsCached(groupSubnets)
+	if err != nil {
+		return nil, err
+	}
+	for i, _net := range parsed {
+		if _net.String() == subnet.String() {
+			index = i
+			break
+		}
+	}
+
+	return &PhantomSelection{
+		Addr:     *addr,
+		Subnet:   subnet,
+		Weighted: weighted,
+		Group:    group,
+		Index:    index,
+	}, nil
+}
+
+// SelectPhantomWithFamilyBias - select one phantom IP address based on shared
+//		secret, first choosing IPv6 with probability v6Fraction (IPv4
+//		otherwise) and then an address from all subnets of that family. If
+//		the config has no subnets of the chosen family the other one is used.
+func SelectPhantomWithFamilyBias(seed []byte, subnets SubnetConfig, v6Fraction float64) (*net.IP, error) {
+	if !(v6Fraction >= 0 && v6Fraction <= 1) {
+		return nil, fmt.Errorf("invalid IPv6 fraction %v", v6Fraction)
+	}
+	if len(seed) < MinSeedLen {
+		return nil, shortSeedError(seed)
+	}
+
+	familyBytes, err := ExpandSeed(seed, labelFamily, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	chosen, other := SubnetFilter(V4Only), SubnetFilter(V6Only)
+	if drawV6(binary.BigEndian.Uint64(familyBytes), v6Fraction) {
+		chosen, other = other, chosen
+	}
+	addr, err := SelectPhantom(seed, subnets, chosen, false)
+	if errors.Is(err, ErrNoSubnetsAfterFilter) {
+		return SelectPhantom(seed, subnets, other, false)
+	}
+	return addr, err
+}
+
+// drawV6 - whether the uniform draw picks IPv6 with probability v6Fraction.
+//		Draws close to 1<<64 round to 1.0 as a float64, so a fraction of 1 is
+//		decided without the comparison.
+func drawV6(draw uint64, v6Fraction float64) bool {
+	if v6Fraction >= 1 {
+		return true
+	}
+	return float64(draw)/(1<<64) < v6Fraction
+}
+
+// SelectSlash64 - deterministically choose one /64 of an IPv6 subnet shorter
+//		than /64 based on shared secret. Any other subnet is returned as is.
+func SelectSlash64(seed []byte, net1 *net.IPNet) (*net.IPNet, error) {
+	return selectSlash64(hkdfExpander(seed), net1)
+}
+
+func selectSlash64(exp seedExpander, net1 *net.IPNet) (*net.IPNet, error) {
+	ones, bits := net1.Mask.Size()
+	if bits != 8*net.IPv6len || ones >= 64 {
+		return net1, nil
+	}
+
+	prefixCount := big.NewInt(0).Lsh(big.NewInt(1), uint(64-ones))
+	idBytes, err := exp(labelPrefix64, (prefixCount.BitLen()+7)/8+8)
+	if err != nil {
+		return nil, err
+	}
+	id := big.NewInt(0).SetBytes(idBytes)
+	id.Mod(id, prefixCount)
+
+	prefix := addrAtOffset(net1, id.Lsh(id, 64))
+	return &net.IPNet{IP: prefix, Mask: net.CIDRMask(64, 8*net.IPv6len)}, nil
+}
+
+// SubnetConfigByGeneration - phantom subnet configs keyed by the generation
+//		they were introduced in.
+type SubnetConfigByGeneration map[uint]SubnetConfig
+
+// ForGeneration - return the config for gen, or the config of the latest
+//		generation before it if gen has no config of its own.
+func (c SubnetConfigByGeneration) ForGeneration(gen uint) (SubnetConfig, uint, error) {
+	if sc, ok := c[gen]; ok {
+		return sc, gen, nil
+	}
+
+	found := false
+	var best uint
+	for g := range c {
+		if g <= gen && (!found || g > best) {
+			best = g
+			found = true
+		}
+	}
+	if !found {
+		return SubnetConfig{}, 0, fmt.Errorf("no phantom subnet config for generation %d or earlier", gen)
+	}
+	return c[best], best, nil
+}
+
+// SelectPhantomForGeneration - select one phantom IP address based on shared
+//		secret from the subnet config matching the registration generation.
+func SelectPhantomForGeneration(seed []byte, gen uint, configs SubnetConfigByGeneration, transform SubnetFilter, weighted bool) (*net.IP, error) {
+	sc, _, err := configs.ForGeneration(gen)
+	if err != nil {
+		return nil, err
+	}
+	return SelectPhantom(seed, sc, transform, weighted)
+}
+
+// SelectPhantomUnweighted - select one phantom IP address based on shared secret
+//		ignoring group weights. The subnets of all groups are flattened and
+//		every address is equally likely, so selection is weighted by subnet
+//		size: "unweighted" refers to groups only, a /16 is still 256 times as
+//		likely as a /24. See SelectPhantomSizeWeighted, and
+//		SelectPhantomAddressUniform to make every subnet equally likely.
+func SelectPhantomUnweighted(seed []byte, subnets SubnetConfig, transform SubnetFilter) (*net.IP, error) {
+	return SelectPhantom(seed, subnets, transform, false)
+}
+
+// SelectPhantomWeighted - select one phantom IP address based on shared secret
+//		choosing a group by weight first and then an address uniformly within
+//		it, so a small group is as likely as a large one of equal weight.
+func SelectPhantomWeighted(seed []byte, subnets SubnetConfig, transform SubnetFilter) (*net.IP, error) {
+	return SelectPhantom(seed, subnets, transform, true)
+}
+
+// SelectPhantomV4 - select one IPv4 phantom address based on shared secret,
+//		see SelectPhantomWeighted with V4Only.
+func SelectPhantomV4(seed []byte, subnets SubnetConfig) (*net.IP, error) {
+	return selectPhantomFamily(seed, subnets, V4Only)
+}
+
+// SelectPhantomV6 - select one IPv6 phantom address based on shared secret,
+//		see SelectPhantomWeighted with V6Only.
+func SelectPhantomV6(seed []byte, subnets SubnetConfig) (*net.IP, error) {
+	return selectPhantomFamily(seed, subnets, V6Only)
+}
+
+// SelectPhantomPair - select one IPv4 and one IPv6 phantom address based on
+//		shared secret, e.g. for dual-stack clients. Each is selected like
+//		SelectPhantomV4 or SelectPhantomV6, from its own seed derived from
+//		seed with labelPairV4 or labelPairV6, so the two selections are
+//		independent. If the config lacks one family, the other address is
+//		still returned, along with an error wrapping ErrNoSubnetsForFamily.
+func SelectPhantomPair(seed []byte, subnets SubnetConfig) (v4 net.IP, v6 net.IP, err error) {
+	if len(seed) < MinSeedLen {
+		return nil, nil, shortSeedError(seed)
+	}
+
+	selectFamily := func(label string, selectPhantom func([]byte, SubnetConfig) (*net.IP, error)) (net.IP, error) {
+		familySeed, err := ExpandSeed(seed, label, 32)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := selectPhantom(familySeed, subnets)
+		if err != nil {
+			return nil, err
+		}
+		return *addr, nil
+	}
+	v4, errV4 := selectFamily(labelPairV4, SelectPhantomV4)
+	v6, errV6 := selectFamily(labelPairV6, SelectPhantomV6)
+	switch {
+	case errV4 != nil && errV6 != nil:
+		return nil, nil, fmt.Errorf("no IPv4 phantom (%v) and no IPv6 phantom: %w", errV4, errV6)
+	case errV4 != nil:
+		return nil, v6, fmt.Errorf("no IPv4 phantom: %w", errV4)
+	case errV6 != nil:
+		return v4, nil, fmt.Errorf("no IPv6 phantom: %w", errV6)
+	}
+	return v4, v6, nil
+}
+
+// selectPhantomFamily - weighted selection through the family filter, failing
+//		with ErrNoSubnetsForFamily if no group has subnets of the family. If
+//		only some do, selection may still fail with ErrNoSubnetsAfterFilter.
+func selectPhantomFamily(seed []byte, subnets SubnetConfig, family SubnetFilter) (*net.IP, error) {
+	all, err := subnets.ParsedSubnets()
+	if err != nil {
+		return nil, err
+	}
+	if filtered, err := family(all); err != nil {
+		return nil, err
+	} else if len(filtered) == 0 {
+		return nil, ErrNoSubnetsForFamily
+	}
+	return SelectPhantom(seed, subnets, family, true)
+}
+
+// SelectPhantomSizeWeighted - select one phantom IP address based on shared
+//		secret with each subnet as likely as its share of the address space.
+//		Group weights are ignored, which suits configs that don't specify any.
+//		This is the unweighted selection of SelectPhantomUnweighted, named for
+//		what it does: no subnet is favored beyond its size.
+func SelectPhantomSizeWeighted(seed []byte, subnets SubnetConfig, transform SubnetFilter) (*net.IP, error) {
+	return SelectPhantom(seed, subnets, transform, false)
+}
+
+// SelectPhantomAddressUniform - select one phantom IP address based on shared
+//		secret by picking one of the (filtered) subnets of all groups with
+//		equal probability, whatever its size, and then an address within it.
+//		Unlike SelectPhantomSizeWeighted, where a /16 is 256 times as likely
+//		as a /24, each subnet is equally likely here, so an address in a small
+//		subnet is far more likely than one in a large subnet. Group weights
+//		are ignored. The subnet is picked with labelUniformSubnet; the address
+//		within it like any other selection, honouring AlgVersion, AlignV6To64
+//		and SkipNetworkAndBroadcast.
+func SelectPhantomAddressUniform(seed []byte, subnets SubnetConfig, transform SubnetFilter) (*net.IP, error) {
+	if len(seed) < MinSeedLen {
+		return nil, shortSeedError(seed)
+	}
+	version, err := subnets.algVersion()
+	if err != nil {
+		return nil, err
+	}
+	if subnets.Strict {
+		if err := subnets.ValidateNoOverlap(); err != nil {
+			return nil, err
+		}
+	}
+
+	exp := hkdfExpander(seed)
+	all, _, err := subnets.groupSubnets(exp, false)
+	if err != nil {
+		return nil, err
+	} else if len(all) == 0 {
+		return nil, ErrEmptySubnetConfig
+	}
+	filtered, err := filteredSubnets(all, transform)
+	if err != nil {
+		return nil, err
+	}
+
+	randBytes, err := exp(labelUniformSubnet, 8)
+	if err != nil {
+		return nil, err
+	}
+	subnet := filtered[binary.BigEndian.Uint64(randBytes)%uint64(len(filtered))]
+
+	addr, _, err := selectFromParsed(exp, []*net.IPNet{subnet}, nil, version, subnets.subnetWidth(), nil)
+	if err != nil {
+		return nil, err
+	}
+	addr, err = subnets.alignV6(exp, addr, subnet)
+	if err != nil {
+		return nil, err
+	}
+	return subnets.usableHost(exp, addr, subnet)
+}
+
+// SelectPhantomPort - select a phantom port in [min, max] based on shared
+//		secret. The port is derived independently of the phantom address.
+func SelectPhantomPort(seed []byte, min, max uint16) uint16 {
+	if min > max {
+		min, max = max, min
+	}
+
+	randBytes, err := ExpandSeed(seed, labelPort, 8)
+	if err != nil {
+		return min
+	}
+	r := binary.BigEndian.Uint64(randBytes) % (uint64(max-min) + 1)
+	return min + uint16(r)
 }
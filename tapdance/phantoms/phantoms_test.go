@@ -1,10 +1,29 @@
 package phantoms
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"math/bits"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 )
 
 func TestIPSelectionAlt(t *testing.T) {
@@ -24,8 +43,8 @@ func TestIPSelectionAlt(t *testing.T) {
 	addr, err := SelectAddrFromSubnet(seed, net1)
 	if err != nil {
 		t.Fatal(err)
-	} else if addr.String() != "2001:48a8:687f:1:5fa4:c34c:434e:ddd" {
-		t.Fatalf("Wrong Address Selected: %v -> expected (%v)", addr, "2001:48a8:687f:1:5fa4:c34c:434e:ddd")
+	} else if addr.String() != "2001:48a8:687f:1:1c06:5e31:52cb:4546" {
+		t.Fatalf("Wrong Address Selected: %v -> expected (%v)", addr, "2001:48a8:687f:1:1c06:5e31:52cb:4546")
 	}
 
 }
@@ -34,7 +53,7 @@ func TestSelectWeightedMany(t *testing.T) {
 
 	count := []int{0, 0}
 	loops := 1000
-	rand.Seed(12345)
+	r := rand.New(rand.NewSource(12345))
 	_, net1, err := net.ParseCIDR("192.122.190.0/24")
 	if err != nil {
 		t.Fatal(err)
@@ -53,7 +72,7 @@ func TestSelectWeightedMany(t *testing.T) {
 
 	for i := 1; i <= loops; i++ {
 		seed := make([]byte, 16)
-		_, err := rand.Read(seed)
+		_, err := r.Read(seed)
 		if err != nil {
 			t.Fatalf("Failed to generate seed: %v", err)
 		}
@@ -78,7 +97,7 @@ func TestWeightedSelection(t *testing.T) {
 
 	count := []int{0, 0}
 	loops := 1000
-	rand.Seed(5421212341231)
+	r := rand.New(rand.NewSource(5421212341231))
 
 	var ps = SubnetConfig{
 		WeightedSubnets: []ConjurePhantomSubnet{
@@ -89,7 +108,7 @@ func TestWeightedSelection(t *testing.T) {
 
 	for i := 1; i <= loops; i++ {
 		seed := make([]byte, 16)
-		_, err := rand.Read(seed)
+		_, err := r.Read(seed)
 		if err != nil {
 			t.Fatalf("Failed to generate seed: %v", err)
 		}
@@ -108,6 +127,187 @@ func TestWeightedSelection(t *testing.T) {
 	t.Logf("%.2f%%, %.2f%%", float32(count[0])/float32(loops)*100.0, float32(count[1])/float32(loops)*100.0)
 }
 
+func TestAlwaysIncludeSelection(t *testing.T) {
+	r := rand.New(rand.NewSource(5421212341231))
+
+	var sc = SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: []string{"always"}, AlwaysInclude: true},
+			{Weight: 9, Subnets: []string{"1"}},
+			{Weight: 1, Subnets: []string{"2"}},
+			{Weight: 0, Subnets: []string{"excluded"}, AlwaysInclude: true},
+		},
+	}
+
+	count := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		seed := make([]byte, 16)
+		if _, err := r.Read(seed); err != nil {
+			t.Fatalf("Failed to generate seed: %v", err)
+		}
+
+		sa := sc.getSubnets(seed, true)
+		if len(sa) != 2 || sa[0] != "always" {
+			t.Fatalf("expected the always included subnet and one weighted group, got %v", sa)
+		}
+		count[sa[1]]++
+	}
+	if count["1"] == 0 || count["2"] == 0 || count["1"] < count["2"] || len(count) != 2 {
+		t.Fatalf("unexpected weighted choice among the remaining groups: %v", count)
+	}
+
+	parsed, err := ParseSubnetConfig(strings.NewReader(`{"weighted_subnets": [
+		{"weight": 1, "subnets": ["192.122.190.0/24"], "always_include": true},
+		{"weight": 1, "subnets": ["141.219.0.0/16"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	} else if !parsed.WeightedSubnets[0].AlwaysInclude || parsed.WeightedSubnets[1].AlwaysInclude {
+		t.Fatalf("always_include not parsed: %+v", parsed.WeightedSubnets)
+	}
+
+	// unweighted selection pools every selectable group as before
+	if sa := sc.getSubnets([]byte("seedseedseedseed"), false); len(sa) != 3 {
+		t.Fatalf("unweighted selection returned %v", sa)
+	}
+
+	// with only always included groups, they are all that is selected from
+	onlyAlways := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: []string{"192.122.190.0/24"}, AlwaysInclude: true},
+			{Weight: 1, Subnets: []string{"2001:48a8:687f:1::/64"}, AlwaysInclude: true},
+		},
+	}
+	selection, err := SelectPhantomDetailed([]byte("seedseedseedseed"), onlyAlways, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if selection.Group != -1 {
+		t.Fatalf("expected no group chosen by weight, got %v", selection.Group)
+	}
+
+	// mixing in always included groups must not shift the weighted choice
+	for i := 0; i < 100; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+		withAlways := SubnetConfig{WeightedSubnets: append([]ConjurePhantomSubnet{
+			{Weight: 5, Subnets: []string{"35.8.0.0/16"}, AlwaysInclude: true},
+		}, phantomSubnets.WeightedSubnets...)}
+		plain, _, err := phantomSubnets.groupSubnets(hkdfExpander(seed), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mixed, _, err := withAlways.groupSubnets(hkdfExpander(seed), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mixed) != len(plain)+1 || mixed[1] != plain[0] {
+			t.Fatalf("weighted choice changed from %v to %v", plain, mixed)
+		}
+	}
+}
+
+func TestEqualWeightGroups(t *testing.T) {
+	sc := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 2, Subnets: []string{"192.122.190.0/24"}},
+			{Weight: 2, Subnets: []string{"141.219.0.0/16"}},
+			{Weight: 2, Subnets: []string{"35.8.0.0/16"}},
+		},
+	}
+
+	count := make([]int, len(sc.WeightedSubnets))
+	for i := 0; i < 300; i++ {
+		seed := []byte(fmt.Sprintf("seedseedseedse%03d", i))
+		group, err := sc.groupIndex(hkdfExpander(seed), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the documented rule: each group takes a range as wide as its
+		// weight, in config order
+		randBytes, err := ExpandSeed(seed, labelSubnetGroup, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := int(binary.BigEndian.Uint64(randBytes) % 6 / 2)
+		if group != expected {
+			t.Fatalf("%s chose group %d, expected %d", seed, group, expected)
+		}
+
+		for j := 0; j < 3; j++ {
+			again, err := sc.groupIndex(hkdfExpander(seed), nil)
+			if err != nil {
+				t.Fatal(err)
+			} else if again != group {
+				t.Fatalf("%s chose group %d, then %d", seed, group, again)
+			}
+		}
+		count[group]++
+	}
+	for group, n := range count {
+		if n == 0 {
+			t.Fatalf("group %d of equal weight never chosen: %v", group, count)
+		}
+	}
+}
+
+// fixedChooser - a groupChooser always picking the same group, or failing.
+type fixedChooser struct {
+	group int
+	err   error
+}
+
+func (c fixedChooser) Pick() (int, error) {
+	return c.group, c.err
+}
+
+func TestGroupChooser(t *testing.T) {
+	sc := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: []string{"192.122.190.0/24"}},
+			{Weight: 1, Subnets: []string{"141.219.0.0/16"}},
+			{Weight: 1, Subnets: []string{"35.8.0.0/16"}},
+		},
+	}
+
+	// seed X always picks group Y
+	for _, c := range []struct {
+		seed  string
+		group int
+	}{
+		{"seedseedseedseed", 1},
+		{"0123456789abcdef", 0},
+		{"another phantom seed", 2},
+		{"yet another seed", 0},
+		{"phantom seed five", 1},
+	} {
+		for i := 0; i < 3; i++ {
+			exp := hkdfExpander([]byte(c.seed))
+			group, err := seedChooser{sc: &sc, exp: exp}.Pick()
+			if err != nil {
+				t.Fatal(err)
+			} else if group != c.group {
+				t.Fatalf("%q picked group %d, expected %d", c.seed, group, c.group)
+			}
+			if subnets := sc.getSubnets([]byte(c.seed), true); !reflect.DeepEqual(subnets, sc.WeightedSubnets[c.group].Subnets) {
+				t.Fatalf("%q selects from %v, expected group %d", c.seed, subnets, c.group)
+			}
+		}
+	}
+
+	// an injected chooser decides the group, whatever the seed
+	exp := hkdfExpander([]byte("seedseedseedseed"))
+	if subnets := sc.getSubnetsWith(fixedChooser{group: 2}, exp, true); !reflect.DeepEqual(subnets, []string{"35.8.0.0/16"}) {
+		t.Fatalf("fixed chooser selects from %v", subnets)
+	}
+	if subnets := sc.getSubnetsWith(fixedChooser{group: -1, err: errors.New("no pick")}, exp, true); subnets != nil {
+		t.Fatalf("failed pick selects from %v", subnets)
+	}
+	if subnets := sc.getSubnetsWith(fixedChooser{group: 2}, exp, false); len(subnets) != 3 {
+		t.Fatalf("unweighted selection used the chooser: %v", subnets)
+	}
+}
+
 var phantomSubnets = SubnetConfig{
 	WeightedSubnets: []ConjurePhantomSubnet{
 		{Weight: 9, Subnets: []string{"192.122.190.0/24", "2001:48a8:687f:1::/64"}},
@@ -139,3 +339,3182 @@ func TestSelectFilter(t *testing.T) {
 	}
 	t.Logf("%v\n", p)
 }
+
+func TestSelectPhantomConcurrent(t *testing.T) {
+	seeds := make([][]byte, 64)
+	expected := make([]string, len(seeds))
+	r := rand.New(rand.NewSource(98765))
+	for i := range seeds {
+		seeds[i] = make([]byte, 32)
+		r.Read(seeds[i])
+		addr, err := SelectPhantom(seeds[i], phantomSubnets, nil, true)
+		if err != nil {
+			t.Fatalf("Failed to select phantom: %v", err)
+		}
+		expected[i] = addr.String()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(seeds)*8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, seed := range seeds {
+				addr, err := SelectPhantom(seed, phantomSubnets, nil, true)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if addr.String() != expected[i] {
+					errs <- fmt.Errorf("seed %x selected %v, expected %v", seed, addr, expected[i])
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestSelectAddrFromSubnetWidth(t *testing.T) {
+	seed, err := hex.DecodeString("5a87133b68da3468988a21659a12ed2ece07345c8c1a5b08459ffdea4218d12f")
+	if err != nil {
+		t.Fatalf("Issue decoding seedStr")
+	}
+
+	for _, netStr := range []string{"10.0.0.0/8", "0.0.0.0/16", "::/64", "::/120"} {
+		_, net1, err := net.ParseCIDR(netStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr, err := SelectAddrFromSubnet(seed, net1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, addrLen := net1.Mask.Size()
+		if len(addr) != addrLen/8 {
+			t.Fatalf("%v: selected address %v has length %d, expected %d", netStr, addr, len(addr), addrLen/8)
+		} else if !net1.Contains(addr) {
+			t.Fatalf("%v: selected address %v is not in subnet", netStr, addr)
+		}
+	}
+}
+
+func TestV6OnlyFilter(t *testing.T) {
+	subnets, err := parseSubnets([]string{"192.122.190.0/24", "2001:48a8:687f:1::/64", "141.219.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdout := os.Stdout
+	os.Stdout = w
+	out, err := V6Only(subnets)
+	os.Stdout = oldStdout
+	w.Close()
+	printed, _ := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(printed) != 0 {
+		t.Fatalf("V6Only wrote to stdout: %q", printed)
+	}
+	if len(out) != 1 || out[0].String() != "2001:48a8:687f:1::/64" {
+		t.Fatalf("V6Only returned %v, expected only the IPv6 subnet", out)
+	}
+
+	out, err = V6Only(subnets[:1])
+	if err != nil {
+		t.Fatal(err)
+	} else if out == nil || len(out) != 0 {
+		t.Fatalf("V6Only on IPv4 subnets returned %v, expected an empty result", out)
+	}
+
+	v4Conf := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.122.190.0/24"}}}}
+	_, err = SelectPhantom([]byte("seedseedseedseed"), v4Conf, V6Only, true)
+	if err == nil {
+		t.Fatal("selected a phantom after all subnets were filtered out")
+	}
+}
+
+func TestIsIPv6(t *testing.T) {
+	cases := []struct {
+		cidr string
+		v6   bool
+	}{
+		{"192.122.190.0/24", false},
+		{"10.0.0.0/8", false},
+		{"2001:48a8:687f:1::/64", true},
+		{"::/64", true},
+		{"::ffff:192.122.190.0/120", false},
+		{"::ffff:10.0.0.0/104", false},
+		{"::ffff:0:0/96", false},
+		{"::fffe:0:0/95", true},
+	}
+
+	for _, c := range cases {
+		_, n, err := net.ParseCIDR(c.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isIPv6(n.IP) != c.v6 {
+			t.Fatalf("isIPv6(%v) = %v, expected %v", c.cidr, !c.v6, c.v6)
+		}
+
+		v4, _ := V4Only([]*net.IPNet{n})
+		v6, _ := V6Only([]*net.IPNet{n})
+		if c.v6 && (len(v4) != 0 || len(v6) != 1) {
+			t.Fatalf("%v misclassified by filters: V4Only %v, V6Only %v", c.cidr, v4, v6)
+		} else if !c.v6 && (len(v4) != 1 || len(v6) != 0) {
+			t.Fatalf("%v misclassified by filters: V4Only %v, V6Only %v", c.cidr, v4, v6)
+		}
+	}
+
+	// a v4-mapped range selects like the IPv4 range it maps
+	mapped := mustParseSubnets("::ffff:10.0.0.0/104")[0]
+	addr, err := SelectAddrFromSubnet([]byte("seedseedseedseed"), mapped)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(addr) != net.IPv4len || !mustParseSubnets("10.0.0.0/8")[0].Contains(addr) {
+		t.Fatalf("selected %v from %v, expected an IPv4 address in 10.0.0.0/8", addr, mapped)
+	}
+}
+
+func TestSelectIPAddrAllIds(t *testing.T) {
+	subnets, err := parseSubnets([]string{"192.122.190.0/30", "141.219.0.0/31", "2001:48a8:687f:1::/125"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bucket sizes 4, 2 and 8 give 14 ids in total
+	bucketOf := func(id int64) int {
+		switch {
+		case id < 4:
+			return 0
+		case id < 6:
+			return 1
+		default:
+			return 2
+		}
+	}
+
+	sel, err := newAddrSelector(subnets, defaultSubnetWidth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for id := int64(0); id < 14; id++ {
+		subnet, offset, err := sel.subnetForID(big.NewInt(id))
+		if err != nil {
+			t.Fatalf("id %d: %v", id, err)
+		}
+		if subnet != subnets[bucketOf(id)] {
+			t.Fatalf("id %d: reported subnet %v, expected %v", id, subnet, subnets[bucketOf(id)])
+		}
+		addr := addrAtOffset(subnet, offset)
+		if !subnet.Contains(addr) {
+			t.Fatalf("id %d: selected %v, expected an address in %v", id, addr, subnet)
+		} else if seen[addr.String()] {
+			t.Fatalf("id %d: address %v already used by another id", id, addr)
+		}
+		seen[addr.String()] = true
+	}
+	if _, _, err = sel.subnetForID(big.NewInt(14)); err == nil {
+		t.Fatal("id past the last subnet was mapped to a subnet")
+	}
+}
+
+func TestSelectIPAddrUniform(t *testing.T) {
+	// 8 + 4 + 2 + 2 addresses of both families
+	subnets, err := parseSubnets([]string{"192.122.190.0/29", "141.219.0.0/30", "2001:48a8:687f:1::/127", "35.8.0.0/31"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := subnetAddresses(subnets)
+	counts := make(map[string]int)
+
+	samples := 16000
+	r := rand.New(rand.NewSource(424242))
+	for i := 0; i < samples; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+		addr, _, err := selectIPAddr(seed, subnets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[addr.String()]++
+	}
+	if len(counts) != len(all) {
+		t.Fatalf("selected %d distinct addresses, expected %d", len(counts), len(all))
+	}
+
+	expected := float64(samples) / float64(len(all))
+	chiSquare := 0.0
+	for _, addr := range all {
+		diff := float64(counts[addr.String()]) - expected
+		chiSquare += diff * diff / expected
+	}
+	// critical value for 15 degrees of freedom at p = 0.001
+	if chiSquare > 37.70 {
+		t.Fatalf("address distribution is not uniform, chi-square %.2f: %v", chiSquare, counts)
+	}
+}
+
+func TestSelectPhantomWithSubnet(t *testing.T) {
+	r := rand.New(rand.NewSource(2468))
+	for i := 0; i < 100; i++ {
+		seed := make([]byte, 32)
+		r.Read(seed)
+
+		addr, subnet, err := SelectPhantomWithSubnet(seed, phantomSubnets, nil, true)
+		if err != nil {
+			t.Fatalf("Failed to select phantom: %v", err)
+		}
+		if !subnet.Contains(*addr) {
+			t.Fatalf("selected %v is not in reported subnet %v", addr, subnet)
+		}
+
+		plain, err := SelectPhantom(seed, phantomSubnets, nil, true)
+		if err != nil {
+			t.Fatalf("Failed to select phantom: %v", err)
+		} else if !plain.Equal(*addr) {
+			t.Fatalf("SelectPhantom selected %v, SelectPhantomWithSubnet %v", plain, addr)
+		}
+	}
+}
+
+func TestSelectPhantomRoute(t *testing.T) {
+	r := rand.New(rand.NewSource(2468))
+	for i := 0; i < 100; i++ {
+		seed := make([]byte, 32)
+		r.Read(seed)
+
+		addr, route, err := SelectPhantomRoute(seed, phantomSubnets, nil)
+		if err != nil {
+			t.Fatalf("Failed to select phantom: %v", err)
+		}
+		if !route.Contains(addr) {
+			t.Fatalf("selected %v is not in route %v", addr, route)
+		}
+		plain, subnet, err := SelectPhantomWithSubnet(seed, phantomSubnets, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		} else if !plain.Equal(addr) || subnet.String() != route.String() {
+			t.Fatalf("route selected %v in %v, SelectPhantomWithSubnet %v in %v", addr, route.String(), plain, subnet)
+		}
+
+		// narrowing the route to the host must leave the config untouched
+		for j := range route.Mask {
+			route.Mask[j] = 0xff
+		}
+		if subnet.String() == route.String() {
+			t.Fatal("narrowing the returned route changed the selected subnet")
+		}
+	}
+}
+
+func TestDenySubnets(t *testing.T) {
+	_, blocked, err := net.ParseCIDR("192.122.190.0/25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, unrelated, err := net.ParseCIDR("8.8.8.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny := DenySubnets([]*net.IPNet{blocked, unrelated})
+	v4Deny := func(obj []*net.IPNet) ([]*net.IPNet, error) {
+		obj, err := V4Only(obj)
+		if err != nil {
+			return nil, err
+		}
+		return deny(obj)
+	}
+
+	selected := 0
+	r := rand.New(rand.NewSource(1357))
+	for i := 0; i < 500; i++ {
+		seed := make([]byte, 32)
+		r.Read(seed)
+
+		addr, err := SelectPhantom(seed, phantomSubnets, v4Deny, true)
+		if err != nil {
+			// the heavier group only has the denied v4 subnet
+			continue
+		}
+		if addr.To4() == nil {
+			t.Fatalf("selected non IPv4 address %v", addr)
+		} else if blocked.Contains(*addr) {
+			t.Fatalf("selected %v from denied subnet %v", addr, blocked)
+		}
+		selected++
+	}
+	if selected == 0 {
+		t.Fatal("no phantom was selected with the deny filter")
+	}
+
+	subnets, err := parseSubnets([]string{"192.122.190.0/24", "141.219.0.0/16", "2001:48a8:687f:1::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := deny(subnets)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(out) != 2 || out[0] != subnets[1] || out[1] != subnets[2] {
+		t.Fatalf("DenySubnets returned %v, expected %v", out, subnets[1:])
+	}
+}
+
+// Golden vectors for the HKDF based derivation, the station must select the
+// same addresses for these seeds.
+func TestSelectPhantomGolden(t *testing.T) {
+	vectors := []struct {
+		seed   string
+		filter SubnetFilter
+		addr   string
+	}{
+		{"00000000000000000000000000000000", nil, "2001:48a8:687f:1:fbad:6c8:eb0a:b29c"},
+		{"00000000000000000000000000000000", V4Only, "192.122.190.238"},
+		{"00000000000000000000000000000000", V6Only, "2001:48a8:687f:1:ee18:974f:1d70:669c"},
+		{"000102030405060708090a0b0c0d0e0f", V4Only, "192.122.190.1"},
+		{"000102030405060708090a0b0c0d0e0f", V6Only, "2001:48a8:687f:1:18b:4a7c:32c9:4da7"},
+		{"1f3c5e7a9b0d2c4e6f8091a2b3c4d5e6", nil, "2001:48a8:687f:1:b7e2:ae8:bc9d:bc0f"},
+		{"1f3c5e7a9b0d2c4e6f8091a2b3c4d5e6", V4Only, "192.122.190.6"},
+		{"5a87133b68ea3468988a21659a12ed2ece07345c8c1a5b08459ffdea4218d12f", nil, "2001:48a8:687f:1:c8b6:c51e:a3df:4585"},
+		{"5a87133b68ea3468988a21659a12ed2ece07345c8c1a5b08459ffdea4218d12f", V4Only, "192.122.190.66"},
+		{"05050505050505050505050505050505", nil, "35.8.219.241"},
+	}
+
+	for _, v := range vectors {
+		seed, err := hex.DecodeString(v.seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := SelectPhantom(seed, phantomSubnets, v.filter, true)
+		if err != nil {
+			t.Fatalf("%v: Failed to select phantom: %v", v.seed, err)
+		} else if addr.String() != v.addr {
+			t.Fatalf("%v: Wrong Address Selected: %v -> expected (%v)", v.seed, addr, v.addr)
+		}
+	}
+}
+
+// The vectors in testdata are meant for other implementations as well, so
+// they are kept in a language neutral format.
+func TestSelectionVectors(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/selection_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors struct {
+		Configs []SubnetConfig `json:"configs"`
+		Expand  []struct {
+			Seed   string `json:"seed"`
+			Label  string `json:"label"`
+			Length int    `json:"length"`
+			Output string `json:"output"`
+		} `json:"expand"`
+		Select []struct {
+			Config int    `json:"config"`
+			Seed   string `json:"seed"`
+			Filter string `json:"filter"`
+			Addr   string `json:"addr"`
+		} `json:"select"`
+	}
+	if err = json.Unmarshal(buf, &vectors); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range vectors.Expand {
+		seed, err := hex.DecodeString(v.Seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ExpandSeed(seed, v.Label, v.Length)
+		if err != nil {
+			t.Fatalf("%v %v: %v", v.Seed, v.Label, err)
+		} else if hex.EncodeToString(out) != v.Output {
+			t.Fatalf("%v %v: expanded to %x, expected %v", v.Seed, v.Label, out, v.Output)
+		}
+	}
+
+	filters := map[string]SubnetFilter{"": nil, "v4": V4Only, "v6": V6Only}
+	for _, v := range vectors.Select {
+		seed, err := hex.DecodeString(v.Seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter, ok := filters[v.Filter]
+		if !ok {
+			t.Fatalf("unknown filter %q", v.Filter)
+		}
+		addr, err := SelectPhantom(seed, vectors.Configs[v.Config], filter, true)
+		if err != nil {
+			t.Fatalf("config %v, %v: %v", v.Config, v.Seed, err)
+		} else if addr.String() != v.Addr {
+			t.Fatalf("config %v, %v, filter %q: selected %v, expected %v", v.Config, v.Seed, v.Filter, addr, v.Addr)
+		}
+	}
+	if len(vectors.Expand) == 0 || len(vectors.Select) == 0 {
+		t.Fatal("no vectors read")
+	}
+}
+
+func TestSelectionHistogram(t *testing.T) {
+	sc := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 9, Subnets: []string{"192.122.190.0/24", "192.122.191.0/25"}},
+			{Weight: 1, Subnets: []string{"141.219.0.0/16"}},
+		},
+	}
+	const samples = 20000
+	histogram, err := SelectionHistogram(sc, nil, samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, n := range histogram {
+		total += n
+	}
+	if total != samples || len(histogram) != 3 {
+		t.Fatalf("histogram %v does not cover %d samples of 3 subnets", histogram, samples)
+	}
+
+	// groups by weight, subnets within a group by size
+	for subnet, expected := range map[string]float64{
+		"192.122.190.0/24": 0.9 * 2 / 3,
+		"192.122.191.0/25": 0.9 * 1 / 3,
+		"141.219.0.0/16":   0.1,
+	} {
+		share := float64(histogram[subnet]) / samples
+		if share < expected-0.02 || share > expected+0.02 {
+			t.Fatalf("%v selected %.3f of the time, expected %.3f: %v", subnet, share, expected, histogram)
+		}
+	}
+
+	if _, err := SelectionHistogram(sc, nil, 0); err == nil {
+		t.Fatal("histogram of no samples did not fail")
+	}
+	if _, err := SelectionHistogram(sc, V6Only, 10); err == nil {
+		t.Fatal("histogram of a config filtered empty did not fail")
+	}
+}
+
+func TestValidateNoOverlap(t *testing.T) {
+	if err := phantomSubnets.ValidateNoOverlap(); err != nil {
+		t.Fatalf("disjoint config reported as overlapping: %v", err)
+	}
+
+	overlapping := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 9, Subnets: []string{"192.122.190.0/24", "2001:48a8:687f:1::/64"}},
+			{Weight: 1, Subnets: []string{"192.122.190.128/25", "2001:48a8:687f::/48"}},
+		},
+	}
+	err := overlapping.ValidateNoOverlap()
+	if err == nil {
+		t.Fatal("overlapping config was not reported")
+	}
+	for _, pair := range []string{"192.122.190.0/24 and 192.122.190.128/25", "2001:48a8:687f:1::/64 and 2001:48a8:687f::/48"} {
+		if !strings.Contains(err.Error(), pair) {
+			t.Fatalf("overlap %v missing from error: %v", pair, err)
+		}
+	}
+
+	seed := []byte("seedseedseedseed")
+	if _, err = SelectPhantom(seed, overlapping, nil, true); err != nil {
+		t.Fatalf("non strict selection failed: %v", err)
+	}
+	overlapping.Strict = true
+	if _, err = SelectPhantom(seed, overlapping, nil, true); err == nil {
+		t.Fatal("strict selection accepted overlapping subnets")
+	}
+}
+
+func TestSelectPhantomPort(t *testing.T) {
+	seed, err := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := SelectPhantomPort(seed, 1024, 65535); port != 6445 {
+		t.Fatalf("Wrong port selected: %v -> expected (%v)", port, 6445)
+	}
+	if port := SelectPhantomPort([]byte{0}, 1, 65535); port != 56533 {
+		t.Fatalf("Wrong port selected: %v -> expected (%v)", port, 56533)
+	}
+	if port := SelectPhantomPort(seed, 443, 443); port != 443 {
+		t.Fatalf("Wrong port selected from single port range: %v", port)
+	}
+	if SelectPhantomPort(seed, 65535, 1024) != SelectPhantomPort(seed, 1024, 65535) {
+		t.Fatal("reversed port range selected a different port")
+	}
+
+	r := rand.New(rand.NewSource(8642))
+	for i := 0; i < 1000; i++ {
+		r.Read(seed)
+		port := SelectPhantomPort(seed, 2000, 2010)
+		if port < 2000 || port > 2010 {
+			t.Fatalf("port %v outside of [2000, 2010]", port)
+		} else if port != SelectPhantomPort(seed, 2000, 2010) {
+			t.Fatalf("port selection for %x is not deterministic", seed)
+		}
+	}
+}
+
+func TestExpandSeed(t *testing.T) {
+	vectors := []struct {
+		secret string
+		label  string
+		n      int
+		out    string
+	}{
+		{"", "phantom-address", 16, "44211b3de9a82e42458c696d9f031ce2"},
+		{"000102030405060708090a0b0c0d0e0f", "test-label", 40, "33df7e0bafc005aca612e862ccaaf0791ad5901a3dd4e87c4d6390d0c8e2124320f181233cbdb2f4"},
+	}
+	for _, v := range vectors {
+		secret, err := hex.DecodeString(v.secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ExpandSeed(secret, v.label, v.n)
+		if err != nil {
+			t.Fatal(err)
+		} else if hex.EncodeToString(out) != v.out {
+			t.Fatalf("ExpandSeed(%v, %v, %v) = %x, expected %v", v.secret, v.label, v.n, out, v.out)
+		}
+	}
+
+	a, _ := ExpandSeed([]byte{1}, "label-a", 16)
+	b, _ := ExpandSeed([]byte{1}, "label-b", 16)
+	if hex.EncodeToString(a) == hex.EncodeToString(b) {
+		t.Fatal("distinct labels expanded to the same bytes")
+	}
+
+	if _, err := ExpandSeed([]byte{1}, "too-long", 255*32+1); err == nil {
+		t.Fatal("expanded past the HKDF output limit")
+	}
+
+	// seeds that are not valid varints used to fail selection
+	overflow, _ := hex.DecodeString("ffffffffffffffffffffffffffffffff")
+	continued, _ := hex.DecodeString("80808080808080808080808080808002")
+	for _, seed := range [][]byte{overflow, continued} {
+		if _, err := SelectPhantom(seed, phantomSubnets, nil, true); err != nil {
+			t.Fatalf("Failed to select phantom for seed %x: %v", seed, err)
+		}
+	}
+}
+
+func TestParsedSubnetsAfterChange(t *testing.T) {
+	sc := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: []string{"192.122.190.0/24"}},
+		},
+	}
+	seed := []byte("seedseedseedseed")
+
+	addr, err := SelectPhantom(seed, sc, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, first, _ := net.ParseCIDR("192.122.190.0/24")
+	if !first.Contains(*addr) {
+		t.Fatalf("selected %v outside of %v", addr, first)
+	}
+
+	sc.WeightedSubnets[0].Subnets[0] = "141.219.0.0/16"
+	addr, err = SelectPhantom(seed, sc, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, _ := net.ParseCIDR("141.219.0.0/16")
+	if !second.Contains(*addr) {
+		t.Fatalf("selected %v outside of %v after changing the config", addr, second)
+	}
+
+	parsed, err := sc.ParsedSubnets()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(parsed) != 1 || parsed[0].String() != "141.219.0.0/16" {
+		t.Fatalf("ParsedSubnets returned %v after changing the config", parsed)
+	}
+
+	sc.WeightedSubnets[0].Subnets[0] = "not a subnet"
+	if _, err = SelectPhantom(seed, sc, nil, true); err == nil {
+		t.Fatal("selected a phantom from an invalid subnet")
+	}
+}
+
+func TestParseSubnetsCached(t *testing.T) {
+	subnets := []string{"192.122.190.0/24", "2001:48a8:687f:1::/64"}
+	first, err := parseSubnetsCached(subnets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changing a returned subnet must not change the cached one
+	first[0].IP[0] = 10
+	first[1].Mask[0] = 0
+	second, err := parseSubnetsCached(subnets)
+	if err != nil {
+		t.Fatal(err)
+	} else if second[0].String() != subnets[0] || second[1].String() != subnets[1] {
+		t.Fatalf("cached subnets changed to %v", second)
+	}
+
+	long := make([]string, maxParsedSubnetsCache+1)
+	for i := range long {
+		long[i] = fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)
+	}
+	for _, list := range [][]string{long, long[:maxParsedSubnetsCache/2+1], long[1 : maxParsedSubnetsCache/2+2]} {
+		if _, err := parseSubnetsCached(list); err != nil {
+			t.Fatal(err)
+		}
+		parsedSubnetsMu.RLock()
+		count := parsedSubnetsCount
+		parsedSubnetsMu.RUnlock()
+		if count > maxParsedSubnetsCache {
+			t.Fatalf("%d subnets cached, at most %d expected", count, maxParsedSubnetsCache)
+		}
+	}
+}
+
+func BenchmarkSubnetParsing(b *testing.B) {
+	subnets := []string{"192.122.190.0/24", "2001:48a8:687f:1::/64", "141.219.0.0/16", "35.8.0.0/16"}
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := parseSubnets(subnets); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := parseSubnetsCached(subnets); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestWeightedSelectionDeterministic(t *testing.T) {
+	r := rand.New(rand.NewSource(97531))
+	for i := 0; i < 1000; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+
+		first := phantomSubnets.getSubnets(seed, true)
+		if first == nil {
+			t.Fatalf("no subnets selected for seed %x", seed)
+		}
+		// unrelated use of the global source must not affect the choice
+		rand.Int63()
+		copied := SubnetConfig{WeightedSubnets: append([]ConjurePhantomSubnet{}, phantomSubnets.WeightedSubnets...)}
+		second := copied.getSubnets(seed, true)
+		if fmt.Sprint(first) != fmt.Sprint(second) {
+			t.Fatalf("seed %x selected %v then %v", seed, first, second)
+		}
+	}
+}
+
+func TestSelectPhantomForGeneration(t *testing.T) {
+	configs := SubnetConfigByGeneration{
+		1: {WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.122.190.0/24"}}}},
+		5: {WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"141.219.0.0/16"}}}},
+		9: {WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"35.8.0.0/16"}}}},
+	}
+	seed := []byte("seedseedseedseed")
+
+	cases := []struct {
+		gen    uint
+		cfgGen uint
+		subnet string
+	}{
+		{1, 1, "192.122.190.0/24"}, // exact
+		{5, 5, "141.219.0.0/16"},   // exact
+		{7, 5, "141.219.0.0/16"},   // fallback
+		{100, 9, "35.8.0.0/16"},    // fallback to latest
+	}
+	for _, c := range cases {
+		_, cfgGen, err := configs.ForGeneration(c.gen)
+		if err != nil {
+			t.Fatalf("generation %d: %v", c.gen, err)
+		} else if cfgGen != c.cfgGen {
+			t.Fatalf("generation %d used config of generation %d, expected %d", c.gen, cfgGen, c.cfgGen)
+		}
+
+		addr, err := SelectPhantomForGeneration(seed, c.gen, configs, nil, true)
+		if err != nil {
+			t.Fatalf("generation %d: %v", c.gen, err)
+		}
+		_, subnet, _ := net.ParseCIDR(c.subnet)
+		if !subnet.Contains(*addr) {
+			t.Fatalf("generation %d selected %v outside of %v", c.gen, addr, subnet)
+		}
+	}
+
+	if _, err := SelectPhantomForGeneration(seed, 0, configs, nil, true); err == nil {
+		t.Fatal("selected a phantom for a generation older than every config")
+	}
+	if _, err := SelectPhantomForGeneration(seed, 3, SubnetConfigByGeneration{}, nil, true); err == nil {
+		t.Fatal("selected a phantom without any config")
+	}
+}
+
+func TestFilterCombinators(t *testing.T) {
+	subnets, err := parseSubnets([]string{"192.122.190.0/24", "2001:48a8:687f:1::/64", "141.219.0.0/16", "2001:48a8:687f:2::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, denied, _ := net.ParseCIDR("2001:48a8:687f:2::/64")
+	deny := DenySubnets([]*net.IPNet{denied})
+	failing := func([]*net.IPNet) ([]*net.IPNet, error) {
+		return nil, errors.New("filter failed")
+	}
+
+	cases := []struct {
+		name     string
+		filter   SubnetFilter
+		expected []*net.IPNet
+	}{
+		{"and", AndFilters(V6Only, deny), []*net.IPNet{subnets[1]}},
+		{"and none", AndFilters(), subnets},
+		{"or", OrFilters(V4Only, deny), []*net.IPNet{subnets[0], subnets[1], subnets[2]}},
+		{"or disjoint", OrFilters(V6Only, V4Only), subnets},
+		{"not", NotFilter(V4Only), []*net.IPNet{subnets[1], subnets[3]}},
+		{"not deny", NotFilter(deny), []*net.IPNet{subnets[3]}},
+		{"nested", AndFilters(NotFilter(V4Only), NotFilter(deny)), []*net.IPNet{subnets[3]}},
+	}
+	for _, c := range cases {
+		out, err := c.filter(subnets)
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if fmt.Sprint(out) != fmt.Sprint(c.expected) {
+			t.Fatalf("%v: filtered to %v, expected %v", c.name, out, c.expected)
+		}
+	}
+
+	for name, filter := range map[string]SubnetFilter{
+		"and": AndFilters(V4Only, failing),
+		"or":  OrFilters(V4Only, failing),
+		"not": NotFilter(failing),
+	} {
+		if _, err := filter(subnets); err == nil {
+			t.Fatalf("%v: filter error was not propagated", name)
+		}
+	}
+}
+
+func TestParseSubnetConfig(t *testing.T) {
+	valid := `{"weighted_subnets": [
+		{"weight": 9, "subnets": ["192.122.190.0/24", "2001:48a8:687f:1::/64"]},
+		{"weight": 1, "subnets": ["141.219.0.0/16", "35.8.0.0/16"]}
+	]}`
+	sc, err := ParseSubnetConfig(strings.NewReader(valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sc) != fmt.Sprint(phantomSubnets) {
+		t.Fatalf("parsed %v, expected %v", sc, phantomSubnets)
+	}
+
+	encoded, err := json.Marshal(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip, err := ParseSubnetConfig(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(roundTrip) != fmt.Sprint(sc) {
+		t.Fatalf("config changed in round trip: %s -> %v", encoded, roundTrip)
+	}
+
+	for name, bad := range map[string]string{
+		"malformed cidr":  `{"weighted_subnets": [{"weight": 1, "subnets": ["192.122.190.0/33"]}]}`,
+		"not a cidr":      `{"weighted_subnets": [{"weight": 1, "subnets": ["192.122.190.1"]}]}`,
+		"negative weight": `{"weighted_subnets": [{"weight": -1, "subnets": ["192.122.190.0/24"]}]}`,
+		"not json":        `weighted_subnets`,
+	} {
+		if _, err := ParseSubnetConfig(strings.NewReader(bad)); err == nil {
+			t.Fatalf("%v: invalid config was accepted", name)
+		}
+	}
+}
+
+func TestParseSubnetConfigErrorLocation(t *testing.T) {
+	_, err := ParseSubnetConfig(strings.NewReader(`{"weighted_subnets": [
+		{"weight": 1, "subnets": ["192.122.190.0/24"]},
+		{"weight": 1, "subnets": ["141.219.0.0/16"]},
+		{"weight": 1, "subnets": ["35.8.0.0/16", "35.9.0.0/33"]}
+	]}`))
+	var subnetErr *InvalidSubnetError
+	if !errors.As(err, &subnetErr) {
+		t.Fatalf("expected an InvalidSubnetError, got %T: %v", err, err)
+	} else if subnetErr.Group != 2 || subnetErr.Index != 1 || subnetErr.Subnet != "35.9.0.0/33" {
+		t.Fatalf("located the bad subnet at group %d, subnet %d %q", subnetErr.Group, subnetErr.Index, subnetErr.Subnet)
+	}
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) || len(configErr.Subnets) != 1 {
+		t.Fatalf("expected a ConfigError with one bad subnet, got %v", err)
+	}
+	for _, s := range []string{"subnet group 2", `"35.9.0.0/33"`} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("%q missing from %v", s, err)
+		}
+	}
+
+	_, err = ParseSubnetConfig(strings.NewReader(`{"weighted_subnets": [
+		{"weight": 1, "subnets": ["192.122.190.0/24"]},
+		{"weight": 1 "subnets": ["141.219.0.0/16"]}
+	]}`))
+	if err == nil || !strings.Contains(err.Error(), "line 3, column 16") {
+		t.Fatalf("expected a syntax error at line 3, column 16, got %v", err)
+	}
+	_, err = ParseSubnetConfig(strings.NewReader(`{"weighted_subnets": [{"weight": "heavy", "subnets": []}]}`))
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) || !strings.Contains(err.Error(), "line 1, column 40") {
+		t.Fatalf("expected a type error at line 1, column 40, got %v", err)
+	}
+}
+
+func TestExcludeReserved(t *testing.T) {
+	reserved := []string{
+		"10.1.0.0/16", "172.20.0.0/24", "192.168.1.0/24", "127.0.0.0/8",
+		"169.254.10.0/24", "224.0.0.0/24", "192.0.2.0/28", "0.0.0.0/0",
+		"fe80::/64", "fd00::/64", "::1/128", "ff02::/16", "2001:db8:1::/48",
+	}
+	public := []string{"192.122.190.0/24", "141.219.0.0/16", "35.8.0.0/16", "2001:48a8:687f:1::/64"}
+
+	subnets, err := parseSubnets(append(append([]string{}, reserved...), public...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ExcludeReserved()(subnets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(out) != fmt.Sprint(subnets[len(reserved):]) {
+		t.Fatalf("ExcludeReserved kept %v, expected %v", out, public)
+	}
+
+	_, extra, _ := net.ParseCIDR("35.8.0.0/16")
+	oldReserved := ReservedSubnets
+	ReservedSubnets = append(append([]*net.IPNet{}, oldReserved...), extra)
+	defer func() { ReservedSubnets = oldReserved }()
+
+	out, err = ExcludeReserved()(subnets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, _net := range out {
+		if _net.String() == "35.8.0.0/16" {
+			t.Fatal("subnet added to ReservedSubnets was not excluded")
+		}
+	}
+}
+
+func TestSelectPhantomShortSeed(t *testing.T) {
+	for _, seed := range [][]byte{nil, {}, {0x1}, make([]byte, MinSeedLen-1)} {
+		_, err := SelectPhantom(seed, phantomSubnets, nil, true)
+		if !errors.Is(err, ErrSeedTooShort) {
+			t.Fatalf("seed of length %d: got error %v, expected %v", len(seed), err, ErrSeedTooShort)
+		} else if !strings.Contains(err.Error(), fmt.Sprintf("got %d", len(seed))) {
+			t.Fatalf("seed length missing from error: %v", err)
+		}
+	}
+	if _, err := SelectPhantom(make([]byte, MinSeedLen), phantomSubnets, nil, true); err != nil {
+		t.Fatalf("seed of length %d was rejected: %v", MinSeedLen, err)
+	}
+}
+
+func TestSingleAddressSubnets(t *testing.T) {
+	r := rand.New(rand.NewSource(1122))
+	for _, c := range []struct{ cidr, addr string }{
+		{"192.122.190.7/32", "192.122.190.7"},
+		{"2001:48a8:687f:1::7/128", "2001:48a8:687f:1::7"},
+	} {
+		_, net1, err := net.ParseCIDR(c.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{c.cidr}}}}
+
+		for i := 0; i < 20; i++ {
+			seed := make([]byte, 16)
+			r.Read(seed)
+
+			addr, err := SelectAddrFromSubnet(seed, net1)
+			if err != nil {
+				t.Fatal(err)
+			} else if addr.String() != c.addr {
+				t.Fatalf("%v: SelectAddrFromSubnet returned %v", c.cidr, addr)
+			}
+
+			phantom, err := SelectPhantom(seed, sc, nil, true)
+			if err != nil {
+				t.Fatal(err)
+			} else if phantom.String() != c.addr {
+				t.Fatalf("%v: SelectPhantom returned %v", c.cidr, phantom)
+			}
+		}
+	}
+}
+
+// Selections from the IPv6 documentation range, and from low ranges whose
+// addresses start with zero bytes, must come back as full 16 byte addresses.
+func TestSelectV6DocumentationRange(t *testing.T) {
+	doc := mustParseSubnets("2001:db8::/32")[0]
+	docConfig := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"2001:db8::/32"}}}}
+	for _, v := range []struct {
+		seed       string
+		fromSubnet string
+		phantom    string
+	}{
+		{"00000000000000000000000000000000", "2001:db8:7955:78d8:30ee:347e:56a3:38e0", "2001:db8:ee18:974f:1d70:669c:9dc3:6924"},
+		{"000102030405060708090a0b0c0d0e0f", "2001:db8:3b39:32c3:b239:1074:ed9b:8f2e", "2001:db8:18b:4a7c:32c9:4da7:c47f:b4b"},
+		{"5a87133b68ea3468988a21659a12ed2ece07345c8c1a5b08459ffdea4218d12f", "2001:db8:d4fe:3ffc:a14e:8884:54d0:b757", "2001:db8:422f:c35b:7a89:1885:8c71:49ba"},
+	} {
+		seed, err := hex.DecodeString(v.seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := SelectAddrFromSubnet(seed, doc)
+		if err != nil {
+			t.Fatal(err)
+		} else if addr.String() != v.fromSubnet {
+			t.Fatalf("%v: selected %v from %v, expected %v", v.seed, addr, doc, v.fromSubnet)
+		}
+		phantom, err := SelectPhantom(seed, docConfig, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		} else if phantom.String() != v.phantom {
+			t.Fatalf("%v: selected phantom %v, expected %v", v.seed, phantom, v.phantom)
+		}
+		for _, ip := range []net.IP{addr, *phantom} {
+			if len(ip) != net.IPv6len || ip.To4() != nil || !ip.To16().Equal(ip) {
+				t.Fatalf("%v: %v is not a 16 byte IPv6 address: %x", v.seed, ip, []byte(ip))
+			}
+		}
+	}
+
+	low := mustParseSubnets("0:0:1::/48")[0]
+	r := rand.New(rand.NewSource(1357))
+	for i := 0; i < 100; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+		addr, err := SelectAddrFromSubnet(seed, low)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(addr) != net.IPv6len || addr.To4() != nil || !low.Contains(addr) {
+			t.Fatalf("selected %v (%x) from %v", addr, []byte(addr), low)
+		}
+	}
+
+	if padded := normalizeAddr(low, net.IP{1, 2, 3, 4}); len(padded) != net.IPv6len || padded.String() != "::102:304" {
+		t.Fatalf("short IPv6 address normalized to %v (%x)", padded, []byte(padded))
+	}
+}
+
+func TestSelectedAddressLength(t *testing.T) {
+	sc := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: []string{"0.0.0.0/8", "192.122.190.0/24", "::ffff:141.219.0.0/112", "::/64", "2001:48a8:687f:1::/64"}},
+		},
+	}
+
+	r := rand.New(rand.NewSource(3344))
+	for i := 0; i < 500; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+
+		for _, filter := range []SubnetFilter{V4Only, V6Only} {
+			addr, subnet, err := SelectPhantomWithSubnet(seed, sc, filter, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := 16
+			if !isIPv6(subnet.IP) {
+				expected = 4
+			}
+			if len(*addr) != expected {
+				t.Fatalf("%v from %v has length %d, expected %d", addr, subnet, len(*addr), expected)
+			} else if !subnet.Contains(*addr) {
+				t.Fatalf("%v is not in %v", addr, subnet)
+			}
+		}
+	}
+}
+
+func TestHostBitsSetSubnets(t *testing.T) {
+	seed, err := hex.DecodeString("5a87133b68da3468988a21659a12ed2ece07345c8c1a5b08459ffdea4218d12f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		ip   string
+		mask net.IPMask
+		base string
+	}{
+		{"10.1.2.255", net.CIDRMask(24, 32), "10.1.2.0/24"},
+		{"192.122.190.201", net.CIDRMask(28, 32), "192.122.190.192/28"},
+		{"2001:48a8:687f:1:ffff:ffff:ffff:ffff", net.CIDRMask(64, 128), "2001:48a8:687f:1::/64"},
+	} {
+		// built by hand as ParseCIDR already clears the host bits
+		hostBits := &net.IPNet{IP: net.ParseIP(c.ip), Mask: c.mask}
+		_, intended, _ := net.ParseCIDR(c.base)
+
+		addr, err := SelectAddrFromSubnet(seed, hostBits)
+		if err != nil {
+			t.Fatal(err)
+		} else if !intended.Contains(addr) {
+			t.Fatalf("SelectAddrFromSubnet selected %v outside of %v", addr, intended)
+		}
+
+		for i := byte(0); i < 50; i++ {
+			seed[0] = i
+			phantom, _, err := selectIPAddr(seed, []*net.IPNet{hostBits})
+			if err != nil {
+				t.Fatal(err)
+			} else if !intended.Contains(*phantom) {
+				t.Fatalf("selectIPAddr selected %v outside of %v", phantom, intended)
+			}
+		}
+	}
+
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"10.1.2.3/24"}}}}
+	_, intended, _ := net.ParseCIDR("10.1.2.0/24")
+	phantom, err := SelectPhantom(seed, sc, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if !intended.Contains(*phantom) {
+		t.Fatalf("SelectPhantom selected %v outside of %v", phantom, intended)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	groups, total, v4, v6, err := phantomSubnets.Summary()
+	if err != nil {
+		t.Fatal(err)
+	} else if groups != 2 || total != 4 || v4 != 3 || v6 != 1 {
+		t.Fatalf("Summary returned %d groups, %d subnets (%d v4, %d v6)", groups, total, v4, v6)
+	}
+
+	bad := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{"192.122.190.0/24"}},
+		{Weight: 1, Subnets: []string{"2001:48a8:687f:1::/64", "not a subnet"}},
+	}}
+	if _, _, _, _, err := bad.Summary(); err == nil {
+		t.Fatal("summarized an invalid config")
+	}
+}
+
+func TestSubnetConfigContains(t *testing.T) {
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 9, Subnets: []string{"192.122.190.0/24", "2001:48a8:687f:1::/64"}},
+		{Weight: 1, Subnets: []string{"141.219.0.0/16", "35.8.0.0/16"}},
+		{Weight: 0, Subnets: []string{"10.0.0.0/8"}},
+	}}
+
+	for _, c := range []struct {
+		ip       string
+		filter   SubnetFilter
+		expected string
+	}{
+		{"192.122.190.7", nil, "192.122.190.0/24"},
+		{"::ffff:192.122.190.7", nil, "192.122.190.0/24"},
+		{"35.8.255.255", nil, "35.8.0.0/16"},
+		{"2001:48a8:687f:1:ffff::1", nil, "2001:48a8:687f:1::/64"},
+		{"192.122.191.0", nil, ""},
+		{"2001:48a8:687f:2::1", nil, ""},
+		// excluded groups are never selected from
+		{"10.1.2.3", nil, ""},
+		{"192.122.190.7", V6Only, ""},
+		{"2001:48a8:687f:1::1", V4Only, ""},
+		{"2001:48a8:687f:1::1", V6Only, "2001:48a8:687f:1::/64"},
+	} {
+		ok, subnet := sc.Contains(net.ParseIP(c.ip), c.filter)
+		if c.expected == "" {
+			if ok || subnet != nil {
+				t.Fatalf("%s contained in %v", c.ip, subnet)
+			}
+		} else if !ok || subnet == nil || subnet.String() != c.expected {
+			t.Fatalf("%s contained in %v, expected %s", c.ip, subnet, c.expected)
+		}
+	}
+
+	// every selected address is contained
+	for i := 0; i < 100; i++ {
+		seed := []byte(fmt.Sprintf("contains seed %d.......", i))
+		addr, subnet, err := SelectPhantomWithSubnet(seed, sc, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, in := sc.Contains(*addr, nil); !ok || in.String() != subnet.String() {
+			t.Fatalf("selected %v from %v, contained in %v", addr, subnet, in)
+		}
+	}
+
+	skip := sc
+	skip.SkipNetworkAndBroadcast = true
+	for _, ip := range []string{"192.122.190.0", "192.122.190.255", "2001:48a8:687f:1::"} {
+		if ok, _ := skip.Contains(net.ParseIP(ip), nil); ok {
+			t.Fatalf("%s contained with SkipNetworkAndBroadcast", ip)
+		}
+	}
+	if ok, _ := skip.Contains(net.ParseIP("2001:48a8:687f:1:ffff:ffff:ffff:ffff"), nil); !ok {
+		t.Fatal("IPv6 all ones host not contained with SkipNetworkAndBroadcast")
+	}
+
+	bad := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"not a subnet"}}}}
+	if ok, subnet := bad.Contains(net.ParseIP("192.122.190.7"), nil); ok || subnet != nil {
+		t.Fatal("invalid config contains an address")
+	}
+}
+
+func TestSubnetConfigEqual(t *testing.T) {
+	same := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 9, Subnets: []string{"192.122.190.7/24", "2001:48a8:687f:0001::/64"}, Tags: []string{"a"}},
+			{Weight: 1, Subnets: []string{"141.219.0.0/16", "35.8.0.0/16"}},
+		},
+		WeightPrecision:   DefaultWeightPrecision,
+		AlgVersion:        LatestAlgVersion,
+		MinSelectPrefixV4: DefaultMinSelectPrefixV4,
+	}
+	if !phantomSubnets.Equal(same) || phantomSubnets.Hash() != same.Hash() {
+		t.Fatal("equivalent configs differ")
+	}
+	if phantomSubnets.Hash() != phantomSubnets.Hash() {
+		t.Fatal("hash is not stable")
+	}
+
+	// order decides which address an id refers to, so reordering changes
+	// the config
+	reordered := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		phantomSubnets.WeightedSubnets[1],
+		phantomSubnets.WeightedSubnets[0],
+	}}
+	swapped := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		phantomSubnets.WeightedSubnets[0],
+		{Weight: 1, Subnets: []string{"35.8.0.0/16", "141.219.0.0/16"}},
+	}}
+	reweighted := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		phantomSubnets.WeightedSubnets[0],
+		{Weight: 2, Subnets: []string{"141.219.0.0/16", "35.8.0.0/16"}},
+	}}
+	v1 := phantomSubnets
+	v1.AlgVersion = AlgVersion1
+	aligned := phantomSubnets
+	aligned.AlignV6To64 = true
+	wide := phantomSubnets
+	wide.AllowWideSubnets = true
+
+	for name, other := range map[string]SubnetConfig{
+		"reordered groups":  reordered,
+		"reordered subnets": swapped,
+		"weight":            reweighted,
+		"version":           v1,
+		"alignment":         aligned,
+		"wide subnets":      wide,
+	} {
+		if phantomSubnets.Equal(other) {
+			t.Fatalf("%s: configs equal", name)
+		} else if phantomSubnets.Hash() == other.Hash() {
+			t.Fatalf("%s: hashes equal", name)
+		}
+	}
+}
+
+func TestAddressCount(t *testing.T) {
+	v4 := big.NewInt(256 + 65536 + 65536)
+	v6 := big.NewInt(0).Lsh(big.NewInt(1), 64)
+
+	for _, c := range []struct {
+		filter   SubnetFilter
+		expected *big.Int
+	}{
+		{nil, big.NewInt(0).Add(v4, v6)},
+		{V4Only, v4},
+		{V6Only, v6},
+		{DenySubnets(mustParseSubnets("141.219.0.0/16", "35.8.0.0/16")), big.NewInt(0).Add(big.NewInt(256), v6)},
+	} {
+		count, err := phantomSubnets.AddressCount(c.filter)
+		if err != nil {
+			t.Fatal(err)
+		} else if count.Cmp(c.expected) != 0 {
+			t.Fatalf("AddressCount returned %v, expected %v", count, c.expected)
+		}
+	}
+
+	bad := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"not a subnet"}}}}
+	if _, err := bad.AddressCount(nil); err == nil {
+		t.Fatal("counted addresses of an invalid config")
+	}
+}
+
+func TestZeroWeightExcluded(t *testing.T) {
+	sc := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 0, Subnets: []string{"141.219.0.0/16"}},
+			{Weight: 3, Subnets: []string{"192.122.190.0/24"}},
+			{Weight: 0, Subnets: []string{"35.8.0.0/16"}},
+		},
+	}
+	_, included, _ := net.ParseCIDR("192.122.190.0/24")
+
+	r := rand.New(rand.NewSource(5566))
+	for i := 0; i < 200; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+		for _, weighted := range []bool{true, false} {
+			addr, err := SelectPhantom(seed, sc, nil, weighted)
+			if err != nil {
+				t.Fatal(err)
+			} else if !included.Contains(*addr) {
+				t.Fatalf("selected %v from a zero weight group (weighted: %v)", addr, weighted)
+			}
+		}
+	}
+
+	count, err := sc.AddressCount(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if count.Int64() != 256 {
+		t.Fatalf("AddressCount included zero weight groups: %v", count)
+	}
+
+	sc.WeightedSubnets[1].Weight = 0
+	if _, err = SelectPhantom([]byte("seedseedseedseed"), sc, nil, false); err == nil {
+		t.Fatal("selected a phantom when every group has zero weight")
+	}
+}
+
+func TestFilterByMinWeight(t *testing.T) {
+	sc := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 9, Subnets: []string{"192.122.190.0/24"}},
+			{Weight: 1, Subnets: []string{"141.219.0.0/16"}},
+			{Weight: 3, Subnets: []string{"35.8.0.0/16"}},
+			{Weight: 2, Subnets: []string{"2001:48a8:687f:1::/64"}},
+		},
+		AlignV6To64: true,
+	}
+
+	heavy := sc.FilterByMinWeight(3)
+	if len(heavy.WeightedSubnets) != 2 || !heavy.AlignV6To64 {
+		t.Fatalf("FilterByMinWeight(3) kept %+v", heavy)
+	}
+	for i, weight := range []float32{9, 3} {
+		if heavy.WeightedSubnets[i].Weight != weight {
+			t.Fatalf("FilterByMinWeight(3) kept %+v", heavy.WeightedSubnets)
+		}
+	}
+
+	_, light, _ := net.ParseCIDR("141.219.0.0/16")
+	r := rand.New(rand.NewSource(7788))
+	for i := 0; i < 200; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+		addr, err := SelectPhantom(seed, heavy, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		} else if light.Contains(*addr) || isIPv6(*addr) {
+			t.Fatalf("selected %v from a group below the threshold", addr)
+		}
+	}
+
+	if all := sc.FilterByMinWeight(0); len(all.WeightedSubnets) != len(sc.WeightedSubnets) {
+		t.Fatalf("FilterByMinWeight(0) dropped groups: %+v", all.WeightedSubnets)
+	}
+	if none := sc.FilterByMinWeight(10); len(none.WeightedSubnets) != 0 {
+		t.Fatalf("FilterByMinWeight(10) kept %+v", none.WeightedSubnets)
+	}
+}
+
+func TestFilterByTag(t *testing.T) {
+	sc, err := ParseSubnetConfig(strings.NewReader(`{"weighted_subnets": [
+		{"weight": 9, "subnets": ["192.122.190.0/24"], "tags": ["provider-a"]},
+		{"weight": 1, "subnets": ["141.219.0.0/16"], "tags": ["provider-b", "cgnat"]},
+		{"weight": 1, "subnets": ["35.8.0.0/16"], "tags": ["provider-b"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tagged := sc.FilterByTag("provider-b")
+	if len(tagged.WeightedSubnets) != 2 {
+		t.Fatalf("FilterByTag kept %v", tagged.WeightedSubnets)
+	}
+	count, err := tagged.AddressCount(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if count.Int64() != 2*65536 {
+		t.Fatalf("AddressCount of tagged config was %v", count)
+	}
+
+	_, untagged, _ := net.ParseCIDR("192.122.190.0/24")
+	r := rand.New(rand.NewSource(7788))
+	for i := 0; i < 100; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+		addr, err := SelectPhantom(seed, tagged, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		} else if untagged.Contains(*addr) {
+			t.Fatalf("selected %v from a group without the tag", addr)
+		}
+	}
+
+	if cgnat := sc.FilterByTag("cgnat"); len(cgnat.WeightedSubnets) != 1 || cgnat.WeightedSubnets[0].Subnets[0] != "141.219.0.0/16" {
+		t.Fatalf("FilterByTag(cgnat) kept %v", cgnat.WeightedSubnets)
+	}
+	if none := sc.FilterByTag("missing"); len(none.WeightedSubnets) != 0 {
+		t.Fatalf("FilterByTag(missing) kept %v", none.WeightedSubnets)
+	}
+}
+
+func TestExcludeLinkLocalAndMulticast(t *testing.T) {
+	subnets := mustParseSubnets(
+		"169.254.1.0/24", "fe80::/64", "224.1.1.0/24", "ff05::/16",
+		"10.0.0.0/8", "192.122.190.0/24", "2001:48a8:687f:1::/64", "fd00::/64",
+	)
+	out, err := AndFilters(V6Only, ExcludeLinkLocalAndMulticast())(subnets)
+	if err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(out) != fmt.Sprint([]*net.IPNet{subnets[6], subnets[7]}) {
+		t.Fatalf("kept %v, expected %v", out, subnets[6:])
+	}
+
+	out, err = ExcludeLinkLocalAndMulticast()(subnets)
+	if err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(out) != fmt.Sprint(subnets[4:]) {
+		t.Fatalf("kept %v, expected %v", out, subnets[4:])
+	}
+}
+
+func TestExcludeULA(t *testing.T) {
+	subnets := mustParseSubnets("fd00:1::/64", "fc00::/8", "2001:48a8:687f:1::/64", "192.122.190.0/24", "fc00::/6")
+	out, err := ExcludeULA()(subnets)
+	if err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(out) != fmt.Sprint(subnets[2:4]) {
+		t.Fatalf("kept %v, expected %v", out, subnets[2:4])
+	}
+
+	// the default filter drops ULAs even without them in ReservedSubnets
+	oldReserved := ReservedSubnets
+	ReservedSubnets = nil
+	defer func() { ReservedSubnets = oldReserved }()
+	out, err = DefaultPhantomFilter()(mustParseSubnets("fd00:1::/64", "fe80::/64", "2001:48a8:687f:1::/64"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(out) != 1 || out[0].String() != "2001:48a8:687f:1::/64" {
+		t.Fatalf("default filter kept %v, expected 2001:48a8:687f:1::/64", out)
+	}
+}
+
+func TestDefaultPhantomFilter(t *testing.T) {
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{
+			"0.0.0.0/8", "10.1.0.0/16", "100.64.0.0/10", "127.0.0.0/8", "169.254.1.0/24",
+			"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.168.1.0/24", "198.18.0.0/15",
+			"198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/8", "240.0.0.0/4", "255.255.255.255/32",
+			"::/128", "::1/128", "100::/64", "2001:db8:1::/48", "fd00:1::/64", "fe80::/64", "ff02::/16",
+			"192.122.190.0/24",
+		}},
+	}}
+
+	parsed, err := parseSubnets(sc.WeightedSubnets[0].Subnets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := DefaultPhantomFilter()(parsed)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(out) != 1 || out[0].String() != "192.122.190.0/24" {
+		t.Fatalf("kept %v, expected only 192.122.190.0/24", out)
+	}
+
+	addr, err := SelectPhantom([]byte("seedseedseedseed"), sc, DefaultPhantomFilter(), true)
+	if err != nil {
+		t.Fatal(err)
+	} else if !out[0].Contains(*addr) {
+		t.Fatalf("selected %v outside of 192.122.190.0/24", addr)
+	}
+}
+
+func TestAlignV6To64(t *testing.T) {
+	sc := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: []string{"2001:48a8:6800::/40", "2001:48a8:687f:1::/64", "192.122.190.0/24"}},
+		},
+		AlignV6To64: true,
+	}
+
+	aligned := 0
+	r := rand.New(rand.NewSource(9900))
+	for i := 0; i < 200; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+
+		addr, subnet, err := SelectPhantomWithSubnet(seed, sc, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		} else if !subnet.Contains(*addr) {
+			t.Fatalf("selected %v outside of %v", addr, subnet)
+		}
+		if ones, _ := subnet.Mask.Size(); !isIPv6(subnet.IP) || ones >= 64 {
+			continue
+		}
+
+		prefix, err := SelectSlash64(seed, subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ones, _ := prefix.Mask.Size(); ones != 64 || !subnet.Contains(prefix.IP) {
+			t.Fatalf("SelectSlash64 returned %v for %v", prefix, subnet)
+		} else if !prefix.Contains(*addr) {
+			t.Fatalf("selected %v outside of the derived /64 %v", addr, prefix)
+		}
+		again, _ := SelectSlash64(seed, subnet)
+		if again.String() != prefix.String() {
+			t.Fatalf("SelectSlash64 is not deterministic: %v then %v", prefix, again)
+		}
+		aligned++
+	}
+	if aligned == 0 {
+		t.Fatal("never selected from the IPv6 subnet shorter than /64")
+	}
+
+	_, v4, _ := net.ParseCIDR("192.122.190.0/24")
+	if same, _ := SelectSlash64([]byte("seedseedseedseed"), v4); same != v4 {
+		t.Fatalf("SelectSlash64 changed an IPv4 subnet to %v", same)
+	}
+}
+
+func TestSelectPhantomWithFamilyBias(t *testing.T) {
+	loops := 2000
+	r := rand.New(rand.NewSource(1212))
+	for _, fraction := range []float64{0, 0.3, 0.7, 1} {
+		v6 := 0
+		for i := 0; i < loops; i++ {
+			seed := make([]byte, 16)
+			r.Read(seed)
+			addr, err := SelectPhantomWithFamilyBias(seed, phantomSubnets, fraction)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.To4() == nil {
+				v6++
+			}
+		}
+		observed := float64(v6) / float64(loops)
+		if observed < fraction-0.05 || observed > fraction+0.05 {
+			t.Fatalf("requested %.2f IPv6, observed %.2f", fraction, observed)
+		}
+	}
+
+	v4Only := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.122.190.0/24"}}}}
+	addr, err := SelectPhantomWithFamilyBias([]byte("seedseedseedseed"), v4Only, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if addr.To4() == nil {
+		t.Fatalf("selected %v from an IPv4 only config", addr)
+	}
+
+	if _, err = SelectPhantomWithFamilyBias([]byte("seedseedseedseed"), phantomSubnets, 1.5); err == nil {
+		t.Fatal("accepted an IPv6 fraction above 1")
+	}
+
+	// the largest draw rounds to 1.0 but still picks IPv6 when asked for
+	// all IPv6, and never when asked for none
+	for _, draw := range []uint64{0, math.MaxUint64} {
+		if !drawV6(draw, 1) || drawV6(draw, 0) {
+			t.Fatalf("draw %v ignored an IPv6 fraction of 0 or 1", draw)
+		}
+	}
+}
+
+func BenchmarkSelectPhantom(b *testing.B) {
+	seed := []byte("seedseedseedseed")
+	for _, c := range []struct {
+		name     string
+		filter   SubnetFilter
+		weighted bool
+	}{
+		{"weighted-all", nil, true},
+		{"weighted-v4", V4Only, true},
+		{"unweighted-v4", V4Only, false},
+		{"unweighted-v6", V6Only, false},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				seed[0] = byte(i)
+				if _, err := SelectPhantom(seed, phantomSubnets, c.filter, c.weighted); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectPhantomFromParsed(t *testing.T) {
+	subnets := []string{"192.122.190.0/24", "2001:48a8:687f:1::/64", "141.219.0.0/16"}
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: subnets}}}
+	parsed := mustParseSubnets(subnets...)
+
+	r := rand.New(rand.NewSource(4455))
+	for i := 0; i < 100; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+		for _, filter := range []SubnetFilter{nil, V4Only, V6Only} {
+			fromParsed, err := SelectPhantomFromParsed(seed, parsed, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, weighted := range []bool{true, false} {
+				addr, err := SelectPhantom(seed, sc, filter, weighted)
+				if err != nil {
+					t.Fatal(err)
+				} else if !addr.Equal(*fromParsed) {
+					t.Fatalf("SelectPhantomFromParsed selected %v, SelectPhantom %v", fromParsed, addr)
+				}
+			}
+		}
+	}
+
+	if _, err := SelectPhantomFromParsed([]byte("short"), parsed, nil); !errors.Is(err, ErrSeedTooShort) {
+		t.Fatalf("short seed: got error %v, expected %v", err, ErrSeedTooShort)
+	}
+	if _, err := SelectPhantomFromParsed([]byte("seedseedseedseed"), parsed[:1], V6Only); err != ErrNoSubnetsAfterFilter {
+		t.Fatalf("filtered out: got error %v, expected %v", err, ErrNoSubnetsAfterFilter)
+	}
+}
+
+func BenchmarkSelectPhantomFromParsed(b *testing.B) {
+	seed := []byte("seedseedseedseed")
+	subnets := []string{"192.122.190.0/24", "2001:48a8:687f:1::/64", "141.219.0.0/16", "35.8.0.0/16"}
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: subnets}}}
+	parsed := mustParseSubnets(subnets...)
+
+	b.Run("parsed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			seed[0] = byte(i)
+			if _, err := SelectPhantomFromParsed(seed, parsed, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("config", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			seed[0] = byte(i)
+			if _, err := SelectPhantom(seed, sc, nil, true); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Selection never touches the global math/rand source: no non-test file in
+// the package calls a package-level math/rand function.
+func TestSelectPhantomLeavesGlobalRand(t *testing.T) {
+	// Only constructing a private generator is allowed; every other
+	// package-level math/rand function draws from, or reseeds, the
+	// global source.
+	allowed := map[string]bool{"New": true, "NewSource": true, "Rand": true, "Source": true}
+
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		randName := ""
+		for _, imp := range f.Imports {
+			if imp.Path.Value != `"math/rand"` {
+				continue
+			}
+			randName = "rand"
+			if imp.Name != nil {
+				randName = imp.Name.Name
+			}
+		}
+		if randName == "" {
+			continue
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if id, ok := sel.X.(*ast.Ident); ok && id.Name == randName && id.Obj == nil && !allowed[sel.Sel.Name] {
+				t.Errorf("%v: package-level math/rand %s.%s used", fset.Position(sel.Pos()), randName, sel.Sel.Name)
+			}
+			return true
+		})
+	}
+}
+
+// Concurrent selections with independent seeds and configs, run under -race,
+// share no mutable state and each select what they would alone.
+func TestSelectPhantomConcurrentConfigs(t *testing.T) {
+	configs := []SubnetConfig{
+		phantomSubnets,
+		{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.122.190.0/24", "2001:48a8:687f:1::/64"}}}},
+		{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"10.0.0.0/8"}}}, SkipNetworkAndBroadcast: true},
+		{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"2001:db8::/32"}}}, AlignV6To64: true},
+	}
+	filters := []SubnetFilter{nil, V4Only, nil, V6Only}
+
+	type job struct {
+		seed   []byte
+		config int
+	}
+	var jobs []job
+	expected := make(map[string]string)
+	for i := 0; i < 64; i++ {
+		j := job{seed: bytes.Repeat([]byte{byte(i), byte(i * 37)}, 8), config: i % len(configs)}
+		addr, subnet, err := SelectPhantomWithSubnet(j.seed, configs[j.config], filters[j.config], true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, j)
+		expected[string(j.seed)] = addr.String() + " " + subnet.String()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(jobs))
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			for k := 0; k < 20; k++ {
+				addr, subnet, err := SelectPhantomWithSubnet(j.seed, configs[j.config], filters[j.config], true)
+				if err != nil {
+					errs <- err
+					return
+				} else if got := addr.String() + " " + subnet.String(); got != expected[string(j.seed)] {
+					errs <- fmt.Errorf("seed %x selected %v, expected %v", j.seed, got, expected[string(j.seed)])
+					return
+				}
+				if _, err := SelectPhantom(j.seed, configs[j.config], filters[j.config], false); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(j)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// Selection keeps no package-level random state, so concurrent selections, and
+// concurrent use of the global math/rand, can't change each other's results.
+func TestSelectPhantomParallel(t *testing.T) {
+	type result struct {
+		addr     string
+		withRand string
+	}
+	selectAll := func(seed []byte) (result, error) {
+		addr, err := SelectPhantom(seed, phantomSubnets, nil, true)
+		if err != nil {
+			return result{}, err
+		}
+		withRand, err := SelectPhantomWithRand(seed, phantomSubnets, nil, false, rand.NewSource(int64(seed[0])))
+		if err != nil {
+			return result{}, err
+		}
+		return result{addr.String(), withRand.String()}, nil
+	}
+
+	seeds := make([][]byte, 8)
+	expected := make([]result, len(seeds))
+	for i := range seeds {
+		seeds[i] = bytes.Repeat([]byte{byte(i)}, 16)
+		var err error
+		if expected[i], err = selectAll(seeds[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range seeds {
+		i := i
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			t.Parallel()
+			for j := 0; j < 100; j++ {
+				rand.Int63()
+				got, err := selectAll(seeds[i])
+				if err != nil {
+					t.Fatal(err)
+				} else if got != expected[i] {
+					t.Fatalf("seed %x selected %v, expected %v", seeds[i], got, expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSelectPhantomWithRand(t *testing.T) {
+	seed := []byte("seedseedseedseed")
+
+	first, err := SelectPhantomWithRand(seed, phantomSubnets, nil, true, rand.NewSource(2020))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		again, err := SelectPhantomWithRand(seed, phantomSubnets, nil, true, rand.NewSource(2020))
+		if err != nil {
+			t.Fatal(err)
+		} else if !again.Equal(*first) {
+			t.Fatalf("fixed source selected %v then %v", first, again)
+		}
+	}
+
+	v4Subnets, err := V4Only(mustParseSubnets("192.122.190.0/24", "141.219.0.0/16", "35.8.0.0/16"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(3030))
+	for i := 0; i < 50; i++ {
+		addr, err := SelectPhantomWithRand(nil, phantomSubnets, V4Only, false, rand.NewSource(r.Int63()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, subnet := range v4Subnets {
+			found = found || subnet.Contains(*addr)
+		}
+		if !found {
+			t.Fatalf("selected %v outside of the IPv4 subnets", addr)
+		}
+	}
+
+	fromSeed, err := SelectPhantomWithRand(seed, phantomSubnets, nil, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := SelectPhantom(seed, phantomSubnets, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if !fromSeed.Equal(*expected) {
+		t.Fatalf("nil source selected %v, SelectPhantom %v", fromSeed, expected)
+	}
+}
+
+func TestSelectPhantomFromReader(t *testing.T) {
+	entropy, err := ExpandSeed([]byte("seedseedseedseed"), "reader-test", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := SelectPhantomFromReader(bytes.NewReader(entropy), phantomSubnets, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := SelectPhantomFromReader(bytes.NewReader(entropy), phantomSubnets, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if !again.Equal(*first) {
+		t.Fatalf("same entropy selected %v then %v", first, again)
+	}
+
+	// the group choice takes 8 bytes, leaving too few for the address id
+	_, err = SelectPhantomFromReader(bytes.NewReader(entropy[:10]), phantomSubnets, nil)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("short reader returned %v", err)
+	}
+	_, err = SelectPhantomFromReader(bytes.NewReader(nil), phantomSubnets, nil)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("empty reader returned %v", err)
+	}
+
+	// partial reads are completed, not mistaken for a lack of entropy
+	for name, reader := range map[string]io.Reader{
+		"one byte": iotest.OneByteReader(bytes.NewReader(entropy)),
+		"half":     iotest.HalfReader(bytes.NewReader(entropy)),
+		"data err": iotest.DataErrReader(bytes.NewReader(entropy)),
+	} {
+		addr, err := SelectPhantomFromReader(reader, phantomSubnets, nil)
+		if err != nil {
+			t.Fatalf("%v reader: %v", name, err)
+		} else if !addr.Equal(*first) {
+			t.Fatalf("%v reader selected %v, expected %v", name, addr, first)
+		}
+	}
+
+	failing := errors.New("entropy source failed")
+	_, err = SelectPhantomFromReader(io.MultiReader(iotest.OneByteReader(bytes.NewReader(entropy[:9])), &failingReader{failing}), phantomSubnets, nil)
+	if !errors.Is(err, failing) {
+		t.Fatalf("failing reader returned %v, expected %v", err, failing)
+	} else if !strings.Contains(err.Error(), labelAddressID) {
+		t.Fatalf("error %v does not say what the bytes were for", err)
+	}
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestParseSubnetsReportsAll(t *testing.T) {
+	_, err := parseSubnets([]string{"192.122.190.0/24", "192.122.190.0/33", "not-a-subnet", "2001:48a8:687f:1::/64", "10.0.0.1"})
+	if err == nil {
+		t.Fatal("malformed subnets parsed without error")
+	}
+
+	var parseErr *SubnetParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("expected *SubnetParseError, got %T: %v", err, err)
+	}
+	if len(parseErr.Failures) != 3 {
+		t.Fatalf("expected 3 failures, got %d: %v", len(parseErr.Failures), err)
+	}
+	for _, want := range []string{`[1] "192.122.190.0/33"`, `[2] "not-a-subnet"`, `[4] "10.0.0.1"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+}
+
+func TestZonedSubnets(t *testing.T) {
+	for _, in := range []string{"fe80::/64%eth0", "fe80::%eth0/64"} {
+		cidr, zone := SplitSubnetZone(in)
+		if cidr != "fe80::/64" || zone != "eth0" {
+			t.Fatalf("SplitSubnetZone(%q) = %q, %q", in, cidr, zone)
+		}
+
+		subnets, err := parseSubnets([]string{in})
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", in, err)
+		} else if subnets[0].String() != "fe80::/64" {
+			t.Fatalf("parsed %q as %v", in, subnets[0])
+		}
+	}
+
+	addr, err := SelectAddrFromSubnet([]byte("seedseedseedseed"), mustParseSubnets("fe80::/64")[0])
+	if err != nil {
+		t.Fatal(err)
+	} else if !addr.IsLinkLocalUnicast() {
+		t.Fatalf("selected %v outside fe80::/64", addr)
+	}
+
+	for _, bad := range []string{"2001:48a8:687f:1::/64%eth0", "fe80::/64%"} {
+		_, err := parseSubnets([]string{bad})
+		if err == nil || !strings.Contains(err.Error(), "zone") {
+			t.Fatalf("expected a zone error for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestValidateMinSize(t *testing.T) {
+	if err := phantomSubnets.ValidateMinSize(24, 64); err != nil {
+		t.Fatalf("subnets at the minimum size rejected: %v", err)
+	}
+
+	err := phantomSubnets.ValidateMinSize(23, 48)
+	if err == nil {
+		t.Fatal("subnets below the minimum size were not reported")
+	}
+	for _, small := range []string{"192.122.190.0/24", "2001:48a8:687f:1::/64"} {
+		if !strings.Contains(err.Error(), small) {
+			t.Fatalf("subnet %v missing from error: %v", small, err)
+		}
+	}
+	for _, large := range []string{"141.219.0.0/16", "35.8.0.0/16"} {
+		if strings.Contains(err.Error(), large) {
+			t.Fatalf("subnet %v above the minimum size reported: %v", large, err)
+		}
+	}
+}
+
+func TestSelectPhantomFromSecret(t *testing.T) {
+	var secret [32]byte
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+
+	vectors := []struct {
+		filter SubnetFilter
+		addr   string
+	}{
+		{nil, "2001:48a8:687f:1:51:dfb8:7d6f:af66"},
+		{V4Only, "192.122.190.84"},
+		{V6Only, "2001:48a8:687f:1:5472:75ea:c5e5:9e66"},
+	}
+	for _, v := range vectors {
+		addr, err := SelectPhantomFromSecret(secret, phantomSubnets, v.filter, true)
+		if err != nil {
+			t.Fatal(err)
+		} else if addr.String() != v.addr {
+			t.Fatalf("Wrong Address Selected: %v -> expected (%v)", addr, v.addr)
+		}
+	}
+
+	// the trailing bytes of the secret matter, unlike a varint of its head
+	secret[31] ^= 0xff
+	addr, err := SelectPhantomFromSecret(secret, phantomSubnets, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if addr.String() == vectors[0].addr {
+		t.Fatalf("changing the last secret byte still selected %v", addr)
+	}
+}
+
+func TestFilterByASNAndCountry(t *testing.T) {
+	subnets := mustParseSubnets("192.122.190.0/24", "141.219.0.0/16", "35.8.0.0/16", "2001:48a8:687f:1::/64")
+	asns := map[string]uint32{"192.122.190.0": 237, "141.219.0.0": 36375, "35.8.0.0": 237, "2001:48a8:687f:1::": 237}
+	countries := map[string]string{"192.122.190.0": "US", "141.219.0.0": "us", "35.8.0.0": "CA", "2001:48a8:687f:1::": "DE"}
+
+	byASN, err := FilterByASN([]uint32{237}, func(ip net.IP) uint32 { return asns[ip.String()] })(subnets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"192.122.190.0/24", "35.8.0.0/16", "2001:48a8:687f:1::/64"}
+	if len(byASN) != len(expected) {
+		t.Fatalf("kept %v, expected %v", byASN, expected)
+	}
+	for i := range expected {
+		if byASN[i].String() != expected[i] {
+			t.Fatalf("kept %v, expected %v", byASN, expected)
+		}
+	}
+
+	byCountry, err := FilterByCountry([]string{"US"}, func(ip net.IP) string { return countries[ip.String()] })(subnets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byCountry) != 2 || byCountry[0].String() != "192.122.190.0/24" || byCountry[1].String() != "141.219.0.0/16" {
+		t.Fatalf("kept %v, expected the two US subnets", byCountry)
+	}
+}
+
+func TestFilterByPrefixLen(t *testing.T) {
+	subnets := mustParseSubnets("192.122.190.0/24", "192.122.191.0/28", "141.219.0.0/16",
+		"2001:48a8:687f:1::/64", "2001:48a8:687f:2::/96")
+	// a v4 subnet with a 16 byte mask must be judged by its v4 prefix length
+	subnets = append(subnets, &net.IPNet{IP: net.IPv4(35, 8, 0, 0), Mask: net.CIDRMask(96+30, 128)})
+
+	out, err := FilterByPrefixLen(24, 64)(subnets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"192.122.190.0/24", "141.219.0.0/16", "2001:48a8:687f:1::/64"}
+	if len(out) != len(expected) {
+		t.Fatalf("kept %v, expected %v", out, expected)
+	}
+	for i := range expected {
+		if out[i].String() != expected[i] {
+			t.Fatalf("kept %v, expected %v", out, expected)
+		}
+	}
+
+	// composed with a family filter
+	out, err = AndFilters(V4Only, FilterByPrefixLen(16, 128))(subnets)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(out) != 1 || out[0].String() != "141.219.0.0/16" {
+		t.Fatalf("composed filter kept %v, expected 141.219.0.0/16", out)
+	}
+}
+
+func TestSkipNetworkAndBroadcast(t *testing.T) {
+	r := rand.New(rand.NewSource(5421212341231))
+	config := func(skip bool, subnets ...string) SubnetConfig {
+		return SubnetConfig{
+			WeightedSubnets:         []ConjurePhantomSubnet{{Weight: 1, Subnets: subnets}},
+			SkipNetworkAndBroadcast: skip,
+		}
+	}
+
+	reserved := map[string]bool{"192.122.190.0": true, "192.122.190.7": true, "2001:48a8:687f:1::": true}
+	seen := make(map[string]bool)
+	landed := 0
+	for i := 0; i < 1000; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+
+		plain, err := SelectPhantom(seed, config(false, "192.122.190.0/29", "2001:48a8:687f:1::/126"), nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := SelectPhantom(seed, config(true, "192.122.190.0/29", "2001:48a8:687f:1::/126"), nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reserved[addr.String()] {
+			t.Fatalf("selected reserved address %v", addr)
+		}
+		if reserved[plain.String()] {
+			landed++
+		} else if !plain.Equal(*addr) {
+			t.Fatalf("usable address %v changed to %v", plain, addr)
+		}
+		seen[addr.String()] = true
+	}
+	if landed == 0 {
+		t.Fatal("no selection landed on a reserved address, the test proves nothing")
+	}
+	// 6 usable v4 hosts and 3 usable v6 hosts
+	if len(seen) != 9 {
+		t.Fatalf("selected %v distinct addresses, expected 9: %v", len(seen), seen)
+	}
+
+	// tiny subnets keep every address they have
+	for subnet, expected := range map[string]int{"192.122.190.8/31": 2, "192.122.190.9/32": 1, "2001:48a8:687f:1::/128": 1} {
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			seed := make([]byte, 16)
+			r.Read(seed)
+			addr, err := SelectPhantom(seed, config(true, subnet), nil, true)
+			if err != nil {
+				t.Fatalf("%v: %v", subnet, err)
+			}
+			seen[addr.String()] = true
+		}
+		if len(seen) != expected {
+			t.Fatalf("%v: selected %v, expected %v distinct addresses", subnet, seen, expected)
+		}
+	}
+}
+
+func TestSelectAddrFromUnalignedSubnet(t *testing.T) {
+	r := rand.New(rand.NewSource(5421212341231))
+
+	for _, c := range []struct {
+		subnet string
+		// host bits within the prefix's partial byte, which must take
+		// every combination of values
+		byteIndex int
+		hostMask  byte
+	}{
+		{"192.122.190.0/23", 2, 0x01},
+		{"192.122.188.0/22", 2, 0x03},
+		{"141.219.128.0/17", 2, 0x60},
+		{"2001:48a8:687f:1::/70", 8, 0x03},
+		{"2001:48a8:687f:1:fc00::/70", 8, 0x03},
+		{"2001:48a8:6800::/37", 4, 0x07},
+	} {
+		subnet := mustParseSubnets(c.subnet)[0]
+		seen := make(map[byte]bool)
+		for i := 0; i < 200; i++ {
+			seed := make([]byte, 16)
+			r.Read(seed)
+			addr, err := SelectAddrFromSubnet(seed, subnet)
+			if err != nil {
+				t.Fatalf("%v: %v", c.subnet, err)
+			} else if !subnet.Contains(addr) {
+				t.Fatalf("%v: selected %v outside of the subnet", c.subnet, addr)
+			}
+			full := addr.To16()
+			if addr.To4() != nil {
+				full = addr.To4()
+			}
+			seen[full[c.byteIndex]&c.hostMask] = true
+		}
+		if len(seen) != 1<<bits.OnesCount8(c.hostMask) {
+			t.Fatalf("%v: host bits of byte %d only took values %v", c.subnet, c.byteIndex, seen)
+		}
+	}
+}
+
+func TestSelectionErrors(t *testing.T) {
+	seed := []byte("seedseedseedseed")
+
+	_, err := SelectAddrFromSubnet(seed, &net.IPNet{})
+	if !errors.Is(err, ErrInvalidSubnet) {
+		t.Fatalf("zero subnet: got error %v, expected %v", err, ErrInvalidSubnet)
+	}
+	_, err = SelectAddrFromSubnet(seed, nil)
+	if !errors.Is(err, ErrInvalidSubnet) {
+		t.Fatalf("nil subnet: got error %v, expected %v", err, ErrInvalidSubnet)
+	}
+
+	_, _, err = selectIPAddr(seed, []*net.IPNet{mustParseSubnets("192.122.190.0/24")[0], {IP: net.IPv4(10, 0, 0, 0)}})
+	if !errors.Is(err, ErrInvalidSubnet) {
+		t.Fatalf("unmasked subnet: got error %v, expected %v", err, ErrInvalidSubnet)
+	}
+
+	_, _, err = selectIPAddr(seed, nil)
+	if err != ErrNoSubnets {
+		t.Fatalf("no subnets: got error %v, expected %v", err, ErrNoSubnets)
+	}
+
+	bad := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: []string{"192.122.190.0/24", "192.122.999.0/24"}},
+		},
+	}
+	_, err = SelectPhantom(seed, bad, nil, true)
+	var parseErr *SubnetParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("malformed subnet: got error %T %v, expected a SubnetParseError", err, err)
+	} else if !strings.Contains(err.Error(), "192.122.999.0/24") {
+		t.Fatalf("malformed subnet missing from error: %v", err)
+	}
+
+	v4 := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.122.190.0/24"}}}}
+	_, err = SelectPhantom(seed, v4, V6Only, true)
+	if !errors.Is(err, ErrNoSubnetsAfterFilter) {
+		t.Fatalf("filtered out: got error %v, expected %v", err, ErrNoSubnetsAfterFilter)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	other := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 5, Subnets: []string{"100.64.0.0/16"}, Tags: []string{"b"}},
+		},
+		AlignV6To64: true,
+	}
+
+	// disjoint configs keep every group, in order
+	merged := phantomSubnets.Merge(other)
+	if len(merged.WeightedSubnets) != 3 || !merged.AlignV6To64 || merged.Strict {
+		t.Fatalf("merged disjoint configs into %+v", merged)
+	}
+	for i, expected := range append(append([]ConjurePhantomSubnet{}, phantomSubnets.WeightedSubnets...), other.WeightedSubnets...) {
+		if fmt.Sprint(merged.WeightedSubnets[i]) != fmt.Sprint(expected) {
+			t.Fatalf("group %d merged as %v, expected %v", i, merged.WeightedSubnets[i], expected)
+		}
+	}
+	if err := merged.Validate(); err != nil {
+		t.Fatalf("merged config is invalid: %v", err)
+	}
+
+	// duplicates are dropped from later groups, emptied groups removed
+	overlapping := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 3, Subnets: []string{"192.122.190.7/24", "192.122.191.0/24"}},
+			{Weight: 2, Subnets: []string{"35.8.0.0/16"}},
+			{Weight: 1, Subnets: []string{"fe80::/64%eth0", "fe80::/64%eth1", "fe80::/64%eth0"}},
+		},
+	}
+	merged = phantomSubnets.Merge(overlapping)
+	expected := [][]string{
+		phantomSubnets.WeightedSubnets[0].Subnets,
+		phantomSubnets.WeightedSubnets[1].Subnets,
+		{"192.122.191.0/24"},
+		{"fe80::/64%eth0", "fe80::/64%eth1"},
+	}
+	if len(merged.WeightedSubnets) != len(expected) {
+		t.Fatalf("merged overlapping configs into %+v", merged.WeightedSubnets)
+	}
+	for i := range expected {
+		if fmt.Sprint(merged.WeightedSubnets[i].Subnets) != fmt.Sprint(expected[i]) {
+			t.Fatalf("group %d merged as %v, expected %v", i, merged.WeightedSubnets[i].Subnets, expected[i])
+		}
+	}
+	if merged.WeightedSubnets[2].Weight != 3 {
+		t.Fatalf("merged group lost its weight: %v", merged.WeightedSubnets[2])
+	}
+	if err := merged.ValidateNoOverlap(); err == nil {
+		t.Fatal("expected the link-local subnets of different zones to overlap")
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	overlapping := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 9, Subnets: []string{"10.0.1.0/24", "10.0.0.0/16", "10.0.0.0/16", "2001:48a8:687f:1::/64"}, Tags: []string{"a"}},
+			{Weight: 3, Subnets: []string{"10.0.5.0/24", "172.16.0.0/12"}},
+			{Weight: 0, Subnets: []string{"192.168.0.0/16"}},
+			{Weight: 1, Subnets: []string{"192.168.0.0/22", "2001:48a8:687f::/62"}},
+		},
+		Strict: true,
+	}
+	canonical, err := overlapping.Canonicalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"10.0.0.0/16", "2001:48a8:687f:1::/64"},
+		{"172.16.0.0/12"},
+		{"192.168.0.0/16"},
+		{"192.168.0.0/22", "2001:48a8:687f::/64", "2001:48a8:687f:2::/63"},
+	}
+	if len(canonical.WeightedSubnets) != len(expected) {
+		t.Fatalf("canonical config %+v, expected groups %v", canonical.WeightedSubnets, expected)
+	}
+	for i, group := range canonical.WeightedSubnets {
+		if strings.Join(group.Subnets, " ") != strings.Join(expected[i], " ") {
+			t.Fatalf("group %d: got %v, expected %v", i, group.Subnets, expected[i])
+		}
+	}
+	if canonical.WeightedSubnets[0].Weight != 9 || canonical.WeightedSubnets[0].Tags[0] != "a" || !canonical.Strict {
+		t.Fatalf("group settings not kept: %+v", canonical)
+	}
+
+	if err := canonical.ValidateNoOverlap(); err != nil {
+		t.Fatalf("canonical config overlaps: %v", err)
+	}
+	count, err := canonical.AddressCount(V4Only)
+	if err != nil {
+		t.Fatal(err)
+	} else if count.Int64() != 1<<16+1<<20+1<<10 {
+		t.Fatalf("canonical config counts %v IPv4 addresses, expected %v", count, 1<<16+1<<20+1<<10)
+	}
+	count, err = canonical.AddressCount(V6Only)
+	if err != nil {
+		t.Fatal(err)
+	} else if count.Cmp(big.NewInt(0).Lsh(big.NewInt(1), 66)) != 0 {
+		t.Fatalf("canonical config counts %v IPv6 addresses, expected 2^66", count)
+	}
+
+	seed := []byte("seedseedseedseed")
+	if _, err := SelectPhantom(seed, canonical, nil, true); err != nil {
+		t.Fatalf("strict selection from canonical config failed: %v", err)
+	}
+
+	// dropping a covered group would drop its weight with it
+	covered := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{"10.0.0.0/16"}},
+		{Weight: 9, Subnets: []string{"10.0.5.0/24", "10.0.0.0/17"}},
+	}}
+	if _, err := covered.Canonicalize(); !errors.Is(err, ErrCoveredGroup) {
+		t.Fatalf("canonicalized a covered group: %v", err)
+	}
+
+	// a group without subnets is excluded and kept as it is
+	empty := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{"10.0.0.0/16"}},
+		{Weight: 5, Tags: []string{"empty"}},
+		{Weight: 1, Subnets: []string{"10.0.5.0/24", "10.1.0.0/16"}},
+	}}
+	canonical, err = empty.Canonicalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedGroups := []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{"10.0.0.0/16"}},
+		{Weight: 5, Tags: []string{"empty"}},
+		{Weight: 1, Subnets: []string{"10.1.0.0/16"}},
+	}
+	if !reflect.DeepEqual(canonical.WeightedSubnets, expectedGroups) {
+		t.Fatalf("canonicalized to %+v, expected %+v", canonical.WeightedSubnets, expectedGroups)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	cosmetic := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 9, Subnets: []string{"2001:48A8:687F:0001:0:0:0:7/64", "192.122.190.200/24", "192.122.190.0/24"}, SubnetWeights: []float32{1, 2, 3}},
+			{Weight: 1, Subnets: []string{"35.8.0.0/16", "141.219.7.7/16", "fe80::1%eth0/64", "fe80::/64%eth0"}},
+		},
+		AlignV6To64: true,
+	}
+	normalized, err := cosmetic.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ConjurePhantomSubnet{
+		{Weight: 9, Subnets: []string{"192.122.190.0/24", "2001:48a8:687f:1::/64"}, SubnetWeights: []float32{5, 1}},
+		{Weight: 1, Subnets: []string{"35.8.0.0/16", "141.219.0.0/16", "fe80::/64%eth0"}},
+	}
+	if !reflect.DeepEqual(normalized.WeightedSubnets, expected) {
+		t.Fatalf("normalized to %+v, expected %+v", normalized.WeightedSubnets, expected)
+	} else if !normalized.AlignV6To64 {
+		t.Fatal("options not kept")
+	}
+
+	// sorting and merging duplicates changes selection, so the normalized
+	// config is not Equal to the original
+	if normalized.Equal(cosmetic) {
+		t.Fatal("reordered normalized config equal to the original")
+	}
+
+	// equivalent configs normalize to Equal ones, however they are spelled
+	// and ordered within their groups
+	sorted := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 9, Subnets: []string{"192.122.190.0/24", "2001:48a8:687f:1::/64"}},
+		{Weight: 1, Subnets: []string{"35.8.0.0/16", "141.219.0.0/16"}},
+	}}
+	shuffled := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 9, Subnets: []string{"2001:48a8:687f:1:0::1/64", "192.122.190.1/24"}},
+		{Weight: 1, Subnets: []string{"141.219.255.255/16", "35.8.0.0/16", "35.8.1.0/16"}},
+	}}
+	if sorted.Equal(shuffled) {
+		t.Fatal("differently ordered configs equal before normalizing")
+	}
+	a, err := sorted.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := shuffled.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	} else if !a.Equal(b) || a.Hash() != b.Hash() {
+		t.Fatalf("normalized configs differ: %+v, %+v", a, b)
+	}
+
+	bad := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"not a subnet"}}}}
+	if _, err := bad.Normalize(); err == nil {
+		t.Fatal("normalized an invalid config")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := phantomSubnets.Validate(); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+
+	for name, v := range map[string]struct {
+		sc      SubnetConfig
+		problem string
+	}{
+		"negative weight": {
+			SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: -1, Subnets: []string{"192.122.190.0/24"}}}},
+			"subnet group 0 has invalid weight -1",
+		},
+		"all groups empty": {
+			SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1}, {Weight: 2, Subnets: []string{}}}},
+			"all subnet groups have no subnets",
+		},
+		"malformed cidr": {
+			SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.122.190.0/24", "192.122.190.1"}}}},
+			`subnet group 0: failed to parse 1 subnet(s): [1] "192.122.190.1"`,
+		},
+		"strict overlap": {
+			SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.122.190.0/24", "192.122.190.0/25"}}}, Strict: true},
+			"overlapping phantom subnets",
+		},
+	} {
+		err := v.sc.Validate()
+		if err == nil {
+			t.Fatalf("%v: invalid config accepted", name)
+		} else if !strings.Contains(err.Error(), v.problem) {
+			t.Fatalf("%v: %q missing from error: %v", name, v.problem, err)
+		}
+	}
+
+	// overlap is only a problem for strict configs, and groups may be empty
+	// as long as some aren't
+	loose := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{"192.122.190.0/24", "192.122.190.0/25"}},
+		{Weight: 0},
+		{Weight: 1},
+	}}
+	if err := loose.Validate(); err != nil {
+		t.Fatalf("non strict config rejected: %v", err)
+	}
+
+	several := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: -1, Subnets: []string{"192.122.190.0/33"}},
+		{Weight: 1, Subnets: []string{"192.122.190.0/24", "192.122.191.0"}},
+	}}
+	err := several.Validate()
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	for _, problem := range []string{"invalid weight", "/33", "group 1: failed to parse"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("%q missing from error: %v", problem, err)
+		}
+	}
+
+	_, err = ParseSubnetConfig(strings.NewReader(`{"weighted_subnets": [{"weight": 1, "subnets": []}]}`))
+	if err == nil || !strings.Contains(err.Error(), "have no subnets") {
+		t.Fatalf("ParseSubnetConfig accepted an empty group: %v", err)
+	}
+}
+
+func TestAllFamilies(t *testing.T) {
+	subnets := mustParseSubnets("2001:48a8:687f:1::/64", "192.122.190.0/24", "141.219.0.0/16")
+	kept, err := AllFamilies()(subnets)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(kept) != len(subnets) {
+		t.Fatalf("kept %v, expected %v", kept, subnets)
+	}
+	for i := range subnets {
+		if kept[i] != subnets[i] {
+			t.Fatalf("kept %v, expected %v", kept, subnets)
+		}
+	}
+
+	seed := []byte("seedseedseedseed")
+	unfiltered, err := SelectPhantom(seed, phantomSubnets, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := SelectPhantom(seed, phantomSubnets, AllFamilies(), true)
+	if err != nil {
+		t.Fatal(err)
+	} else if !all.Equal(*unfiltered) {
+		t.Fatalf("AllFamilies selected %v, nil filter selected %v", all, unfiltered)
+	}
+}
+
+func TestPhantomSelectionString(t *testing.T) {
+	secret := make([]byte, 32)
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+
+	selection, err := SelectPhantomDetailed(secret, phantomSubnets, V4Only, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "192.122.190.84 from 192.122.190.0/24 (weighted, group 0, subnet 0, seed 630dcd2966c43366)"
+	if selection.String() != expected {
+		t.Fatalf("formatted as %q, expected %q", selection.String(), expected)
+	}
+
+	selection, err = SelectPhantomDetailed(secret, phantomSubnets, V4Only, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(selection.String(), "(unweighted, subnet ") {
+		t.Fatalf("unweighted selection formatted as %q", selection.String())
+	}
+}
+
+func TestSelectPhantomDetailed(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		seed := []byte(fmt.Sprintf("seedseedseedse%02d", i))
+
+		for _, weighted := range []bool{true, false} {
+			addr, subnet, err := SelectPhantomWithSubnet(seed, phantomSubnets, V4Only, weighted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			detail, err := SelectPhantomDetailed(seed, phantomSubnets, V4Only, weighted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !detail.Addr.Equal(*addr) || detail.Subnet.String() != subnet.String() {
+				t.Fatalf("detailed selection %v in %v differs from %v in %v", detail.Addr, detail.Subnet, addr, subnet)
+			} else if !detail.Subnet.Contains(detail.Addr) {
+				t.Fatalf("selected %v outside of %v", detail.Addr, detail.Subnet)
+			} else if detail.Weighted != weighted {
+				t.Fatalf("weighted reported as %v, expected %v", detail.Weighted, weighted)
+			}
+
+			var subnets []string
+			if weighted {
+				if detail.Group < 0 || detail.Group >= len(phantomSubnets.WeightedSubnets) {
+					t.Fatalf("invalid group %d", detail.Group)
+				}
+				subnets = phantomSubnets.WeightedSubnets[detail.Group].Subnets
+			} else {
+				if detail.Group != -1 {
+					t.Fatalf("unweighted selection reported group %d", detail.Group)
+				}
+				for _, group := range phantomSubnets.WeightedSubnets {
+					subnets = append(subnets, group.Subnets...)
+				}
+			}
+			if detail.Index < 0 || detail.Index >= len(subnets) || subnets[detail.Index] != detail.Subnet.String() {
+				t.Fatalf("index %d into %v does not refer to %v", detail.Index, subnets, detail.Subnet)
+			}
+		}
+	}
+}
+
+func TestSelectedAddressInSubnet(t *testing.T) {
+	// leading zero bytes, host bits set and prefixes off byte boundaries
+	// all tripped up the original big.Int arithmetic
+	subnets := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: []string{"0.1.0.0/16", "0.0.2.77/23", "1.2.3.4/9"}},
+			{Weight: 1, Subnets: []string{"100::/64", "0:0:1::5/47", "2001:48a8:687f:1::1/127"}},
+		},
+	}
+	for _, align := range []bool{false, true} {
+		subnets.AlignV6To64 = align
+		for i := 0; i < 500; i++ {
+			seed := []byte(fmt.Sprintf("seedseedseedse%03d", i))
+			detail, err := SelectPhantomDetailed(seed, subnets, nil, true)
+			if err != nil {
+				t.Fatalf("align %v, seed %d: %v", align, i, err)
+			} else if !detail.Subnet.Contains(detail.Addr) {
+				t.Fatalf("align %v: selected %v outside of %v", align, detail.Addr, detail.Subnet)
+			}
+		}
+	}
+}
+
+// With two equally weighted groups of very different sizes, weighted selection
+// picks either group half the time while size-weighted selection almost
+// always picks the larger one.
+func TestSelectPhantomSizeWeighted(t *testing.T) {
+	small, large := mustParseSubnets("192.122.190.0/24")[0], mustParseSubnets("141.219.0.0/16")[0]
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{small.String()}},
+		{Weight: 1, Subnets: []string{large.String()}},
+	}}
+
+	const samples = 2000
+	var groupUniform, sizeWeighted int
+	for i := 0; i < samples; i++ {
+		seed := make([]byte, 16)
+		binary.BigEndian.PutUint64(seed, uint64(i))
+
+		addr, err := SelectPhantomWeighted(seed, sc, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if small.Contains(*addr) {
+			groupUniform++
+		}
+
+		addr, err = SelectPhantomSizeWeighted(seed, sc, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if small.Contains(*addr) {
+			sizeWeighted++
+		}
+
+		unweighted, err := SelectPhantomUnweighted(seed, sc, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if !unweighted.Equal(*addr) {
+			t.Fatalf("size weighted selected %v, unweighted %v", addr, unweighted)
+		}
+	}
+
+	// the small group holds 1/2 of the weight but only 1/257 of the addresses
+	if groupUniform < samples*4/10 || groupUniform > samples*6/10 {
+		t.Fatalf("weighted selection picked the small group %d/%d times, expected about half", groupUniform, samples)
+	}
+	if sizeWeighted > samples/50 {
+		t.Fatalf("size weighted selection picked the small group %d/%d times, expected about 1/257", sizeWeighted, samples)
+	}
+}
+
+func TestSelectPhantomAddressUniform(t *testing.T) {
+	small, large := mustParseSubnets("192.122.190.0/24")[0], mustParseSubnets("141.219.0.0/16")[0]
+	// one group, so group weights play no part
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{small.String(), large.String()}},
+	}}
+
+	const samples = 2000
+	var subnetUniform, sizeWeighted int
+	for i := 0; i < samples; i++ {
+		seed := make([]byte, 16)
+		binary.BigEndian.PutUint64(seed, uint64(i))
+
+		addr, err := SelectPhantomAddressUniform(seed, sc, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if small.Contains(*addr) {
+			subnetUniform++
+		} else if !large.Contains(*addr) {
+			t.Fatalf("selected %v outside of the config", addr)
+		}
+		again, err := SelectPhantomAddressUniform(seed, sc, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if !again.Equal(*addr) {
+			t.Fatalf("seed %x selected %v, then %v", seed, addr, again)
+		}
+
+		addr, err = SelectPhantomSizeWeighted(seed, sc, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if small.Contains(*addr) {
+			sizeWeighted++
+		}
+	}
+
+	// the /24 is one of two subnets but only 1/257 of the addresses
+	if subnetUniform < samples*4/10 || subnetUniform > samples*6/10 {
+		t.Fatalf("address uniform selection picked the /24 %d/%d times, expected about half", subnetUniform, samples)
+	}
+	if sizeWeighted > samples/50 {
+		t.Fatalf("size weighted selection picked the /24 %d/%d times, expected about 1/257", sizeWeighted, samples)
+	}
+
+	seed := []byte("seedseedseedseed")
+	if addr, err := SelectPhantomAddressUniform(seed, sc, DenySubnets([]*net.IPNet{large})); err != nil {
+		t.Fatal(err)
+	} else if !small.Contains(*addr) {
+		t.Fatalf("selected %v from a denied subnet", addr)
+	}
+	if _, err := SelectPhantomAddressUniform(seed, sc, V6Only); err != ErrNoSubnetsAfterFilter {
+		t.Fatalf("filtered out: got error %v, expected %v", err, ErrNoSubnetsAfterFilter)
+	}
+	if _, err := SelectPhantomAddressUniform(seed, SubnetConfig{}, nil); !errors.Is(err, ErrNoSubnets) {
+		t.Fatalf("empty config: got error %v, expected %v", err, ErrNoSubnets)
+	}
+	if _, err := SelectPhantomAddressUniform([]byte("short"), sc, nil); !errors.Is(err, ErrSeedTooShort) {
+		t.Fatalf("short seed: got error %v, expected %v", err, ErrSeedTooShort)
+	}
+}
+
+func TestSelectPhantomFamily(t *testing.T) {
+	seed := []byte("seedseedseedseed")
+	mixed := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{"192.122.190.0/24", "2001:48a8:687f:1::/64"}},
+	}}
+
+	v4, err := SelectPhantomV4(seed, mixed)
+	if err != nil {
+		t.Fatal(err)
+	} else if v4.To4() == nil {
+		t.Fatalf("SelectPhantomV4 selected %v", v4)
+	}
+	if expected, _ := SelectPhantom(seed, mixed, V4Only, true); !v4.Equal(*expected) {
+		t.Fatalf("SelectPhantomV4 selected %v, SelectPhantom with V4Only %v", v4, expected)
+	}
+	v6, err := SelectPhantomV6(seed, mixed)
+	if err != nil {
+		t.Fatal(err)
+	} else if !isIPv6(*v6) {
+		t.Fatalf("SelectPhantomV6 selected %v", v6)
+	}
+
+	v4Config := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{"192.122.190.0/24"}},
+	}}
+	if _, err = SelectPhantomV6(seed, v4Config); err != ErrNoSubnetsForFamily {
+		t.Fatalf("IPv6 from an IPv4 only config: got error %v, expected %v", err, ErrNoSubnetsForFamily)
+	}
+	v6Config := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{"2001:48a8:687f:1::/64"}},
+	}}
+	if _, err = SelectPhantomV4(seed, v6Config); err != ErrNoSubnetsForFamily {
+		t.Fatalf("IPv4 from an IPv6 only config: got error %v, expected %v", err, ErrNoSubnetsForFamily)
+	}
+	if _, err = SelectPhantomV4([]byte("short"), v4Config); !errors.Is(err, ErrSeedTooShort) {
+		t.Fatalf("short seed: got error %v, expected %v", err, ErrSeedTooShort)
+	}
+}
+
+func TestSelectPhantomPair(t *testing.T) {
+	v4Net, v6Net := mustParseSubnets("192.122.190.0/24")[0], mustParseSubnets("2001:48a8:687f:1::/64")[0]
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{v4Net.String(), v6Net.String()}},
+	}}
+
+	r := rand.New(rand.NewSource(6920))
+	for i := 0; i < 50; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+		v4, v6, err := SelectPhantomPair(seed, sc)
+		if err != nil {
+			t.Fatal(err)
+		} else if !v4Net.Contains(v4) || !v6Net.Contains(v6) {
+			t.Fatalf("selected %v and %v, expected addresses in %v and %v", v4, v6, v4Net, v6Net)
+		}
+		againV4, againV6, err := SelectPhantomPair(seed, sc)
+		if err != nil {
+			t.Fatal(err)
+		} else if !againV4.Equal(v4) || !againV6.Equal(v6) {
+			t.Fatalf("selected %v and %v, then %v and %v from the same seed", v4, v6, againV4, againV6)
+		}
+	}
+
+	// a missing family still yields the other address
+	seed := []byte("seedseedseedseed")
+	v4Only := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{v4Net.String()}}}}
+	v4, v6, err := SelectPhantomPair(seed, v4Only)
+	if !errors.Is(err, ErrNoSubnetsForFamily) {
+		t.Fatalf("pair from an IPv4 only config: got error %v, expected %v", err, ErrNoSubnetsForFamily)
+	} else if !v4Net.Contains(v4) || v6 != nil {
+		t.Fatalf("pair from an IPv4 only config: selected %v and %v", v4, v6)
+	}
+	v6Only := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{v6Net.String()}}}}
+	if v4, v6, err = SelectPhantomPair(seed, v6Only); !errors.Is(err, ErrNoSubnetsForFamily) || v4 != nil || !v6Net.Contains(v6) {
+		t.Fatalf("pair from an IPv6 only config: selected %v and %v, error %v", v4, v6, err)
+	}
+	if _, _, err = SelectPhantomPair([]byte("short"), sc); !errors.Is(err, ErrSeedTooShort) {
+		t.Fatalf("short seed: got error %v, expected %v", err, ErrSeedTooShort)
+	}
+}
+
+func TestEmptySubnetGroups(t *testing.T) {
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 5},
+		{Weight: 1, Subnets: []string{"192.122.190.0/24"}},
+		{Weight: 5, Subnets: []string{}},
+		{Weight: 1, Subnets: []string{"2001:48a8:687f:1::/64"}},
+	}}
+	if err := sc.Validate(); err != nil {
+		t.Fatalf("config mixing empty and non-empty groups rejected: %v", err)
+	}
+	nonEmpty := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{sc.WeightedSubnets[1], sc.WeightedSubnets[3]}}
+
+	r := rand.New(rand.NewSource(6930))
+	for i := 0; i < 200; i++ {
+		seed := make([]byte, 16)
+		r.Read(seed)
+		for _, weighted := range []bool{true, false} {
+			addr, err := SelectPhantom(seed, sc, nil, weighted)
+			if err != nil {
+				t.Fatalf("weighted %v: %v", weighted, err)
+			}
+			// empty groups are ignored altogether
+			expected, err := SelectPhantom(seed, nonEmpty, nil, weighted)
+			if err != nil {
+				t.Fatal(err)
+			} else if !addr.Equal(*expected) {
+				t.Fatalf("weighted %v: selected %v, expected %v as without the empty groups", weighted, addr, expected)
+			}
+		}
+	}
+
+	empty := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1}, {Weight: 2, Subnets: []string{}}}}
+	for _, weighted := range []bool{true, false} {
+		if _, err := SelectPhantom([]byte("seedseedseedseed"), empty, nil, weighted); err != ErrEmptySubnetConfig {
+			t.Fatalf("weighted %v: got error %v, expected %v", weighted, err, ErrEmptySubnetConfig)
+		}
+	}
+}
+
+func TestNoSubnetsErrors(t *testing.T) {
+	seed := []byte("seedseedseedseed")
+	v4 := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.122.190.0/24"}}}}
+
+	// the filter emptied the set
+	_, err := SelectPhantom(seed, v4, V6Only, true)
+	if !errors.Is(err, ErrNoSubnetsAfterFilter) || errors.Is(err, ErrNoSubnets) {
+		t.Fatalf("filtered out: got error %v, expected %v", err, ErrNoSubnetsAfterFilter)
+	}
+
+	// nothing to filter in the first place
+	for _, transform := range []SubnetFilter{nil, V6Only} {
+		_, err = SelectPhantom(seed, SubnetConfig{}, transform, true)
+		if !errors.Is(err, ErrNoSubnets) || errors.Is(err, ErrNoSubnetsAfterFilter) {
+			t.Fatalf("empty config: got error %v, expected %v", err, ErrNoSubnets)
+		}
+		_, err = SelectPhantomFromParsed(seed, nil, transform)
+		if err != ErrNoSubnets {
+			t.Fatalf("no parsed subnets: got error %v, expected %v", err, ErrNoSubnets)
+		}
+	}
+}
+
+func TestAlgVersions(t *testing.T) {
+	// golden vectors for every supported version, v1 as derived by the
+	// original implementation, which the stations still using it run
+	for _, c := range []struct {
+		seed   string
+		v1, v2 string
+	}{
+		{"seedseedseedseed", "2001:48a8:687f:1:175e:205b:75f1:3694", "141.219.163.82"},
+		{"0123456789abcdef0123456789abcdef", "2001:48a8:687f:1:ee94:8e44:13ce:4e81", "141.219.6.36"},
+		{"another phantom selection seed!!", "2001:48a8:687f:1:830b:8087:fb7a:a4ab", "35.8.87.116"},
+		{"phantom seed number four........", "2001:48a8:687f:1:f90b:1f7c:5e04:6b88", "2001:48a8:687f:1:24ee:9577:98ca:8311"},
+	} {
+		for _, v := range []struct {
+			version  uint32
+			expected string
+		}{
+			{AlgVersion1, c.v1},
+			{AlgVersion2, c.v2},
+			{0, c.v2},
+		} {
+			sc := phantomSubnets
+			sc.AlgVersion = v.version
+			addr, err := SelectPhantom([]byte(c.seed), sc, nil, true)
+			if err != nil {
+				t.Fatal(err)
+			} else if addr.String() != v.expected {
+				t.Fatalf("version %d, seed %q: selected %v, expected %v", v.version, c.seed, addr, v.expected)
+			}
+			batch, err := SelectPhantomBatch([][]byte{[]byte(c.seed)}, sc, nil)
+			if err != nil {
+				t.Fatal(err)
+			} else if batch[0].String() != v.expected {
+				t.Fatalf("version %d, seed %q: batch selected %v, expected %v", v.version, c.seed, batch[0], v.expected)
+			}
+		}
+	}
+
+	// v1 draws groups in order of ascending weight and, unweighted,
+	// includes groups of weight 0
+	zero := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{
+			{Weight: 1, Subnets: []string{"192.122.190.0/24"}},
+			{Weight: 0, Subnets: []string{"141.219.0.0/16"}},
+			{Weight: 2, Subnets: []string{"35.8.0.0/16"}},
+		},
+		AlgVersion: AlgVersion1,
+	}
+	v1 := phantomSubnets
+	v1.AlgVersion = AlgVersion1
+	for _, c := range []struct {
+		seed      string
+		sc        SubnetConfig
+		transform SubnetFilter
+		weighted  bool
+		expected  string
+	}{
+		{"seedseedseedseed", v1, nil, false, "2001:48a8:687f:1:175e:205b:75f1:3694"},
+		{"seedseedseedseed", v1, V4Only, true, "192.122.190.36"},
+		{"seedseedseedseed", v1, V4Only, false, "141.219.201.36"},
+		{"0123456789abcdef0123456789abcdef", v1, V4Only, true, "192.122.190.147"},
+		{"0123456789abcdef0123456789abcdef", v1, V4Only, false, "35.8.12.147"},
+		{"seedseedseedseed", zero, nil, true, "192.122.190.36"},
+		{"seedseedseedseed", zero, nil, false, "141.219.201.36"},
+		{"0123456789abcdef0123456789abcdef", zero, nil, true, "35.8.12.147"},
+		{"phantom seed number four........", zero, nil, false, "141.219.187.99"},
+	} {
+		addr, err := SelectPhantom([]byte(c.seed), c.sc, c.transform, c.weighted)
+		if err != nil {
+			t.Fatal(err)
+		} else if addr.String() != c.expected {
+			t.Fatalf("v1, seed %q, weighted %v: selected %v, expected %v", c.seed, c.weighted, addr, c.expected)
+		}
+	}
+
+	// options v1 predates are refused rather than ignored
+	aligned := v1
+	aligned.AlignV6To64 = true
+	subnetWeighted := SubnetConfig{
+		WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"192.122.190.0/24"}, SubnetWeights: []float32{1}}},
+		AlgVersion:      AlgVersion1,
+	}
+	for _, sc := range []SubnetConfig{aligned, subnetWeighted} {
+		if _, err := SelectPhantom([]byte("seedseedseedseed"), sc, nil, true); !errors.Is(err, ErrUnsupportedAlgVersion) {
+			t.Fatalf("v1 with newer options: got error %v, expected %v", err, ErrUnsupportedAlgVersion)
+		} else if err := sc.Validate(); err == nil {
+			t.Fatal("validated v1 with newer options")
+		}
+	}
+
+	data, err := json.Marshal(v1)
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(string(data), `"alg_version":1`) {
+		t.Fatalf("alg_version missing from %s", data)
+	}
+	var parsed SubnetConfig
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	} else if parsed.AlgVersion != AlgVersion1 {
+		t.Fatalf("parsed version %d, expected %d", parsed.AlgVersion, AlgVersion1)
+	}
+
+	// version 1 needs the seed itself
+	if _, err := SelectPhantomWithRand([]byte("seedseedseedseed"), v1, nil, true, rand.NewSource(1)); !errors.Is(err, ErrUnsupportedAlgVersion) {
+		t.Fatalf("v1 with rand source: got error %v, expected %v", err, ErrUnsupportedAlgVersion)
+	}
+
+	unknown := phantomSubnets
+	unknown.AlgVersion = LatestAlgVersion + 1
+	if _, err := SelectPhantom([]byte("seedseedseedseed"), unknown, nil, true); !errors.Is(err, ErrUnsupportedAlgVersion) {
+		t.Fatalf("unknown version: got error %v, expected %v", err, ErrUnsupportedAlgVersion)
+	}
+	if _, err := SelectPhantomBatch([][]byte{[]byte("seedseedseedseed")}, unknown, nil); !errors.Is(err, ErrUnsupportedAlgVersion) {
+		t.Fatalf("unknown version batch: got error %v, expected %v", err, ErrUnsupportedAlgVersion)
+	}
+	if err := unknown.Validate(); err == nil {
+		t.Fatal("validated an unknown algorithm version")
+	}
+}
+
+func TestSelectAddrFromWideSubnet(t *testing.T) {
+	seed := []byte("seedseedseedseed")
+	for _, cidr := range []string{"0.0.0.0/0", "::/0", "128.0.0.0/7", "2000::/15", "::ffff:0.0.0.0/96"} {
+		subnet := mustParseSubnets(cidr)[0]
+		_, err := SelectAddrFromSubnet(seed, subnet)
+		if !errors.Is(err, ErrSubnetTooWide) {
+			t.Fatalf("%v: got error %v, expected %v", cidr, err, ErrSubnetTooWide)
+		} else if !strings.Contains(err.Error(), subnet.String()) {
+			t.Fatalf("%v missing from error: %v", subnet, err)
+		}
+	}
+	for _, cidr := range []string{"192.122.190.0/24", "10.0.0.0/8", "2001::/16", "2001:48a8:687f:1::/64", "::ffff:10.0.0.0/104"} {
+		subnet := mustParseSubnets(cidr)[0]
+		if addr, err := SelectAddrFromSubnet(seed, subnet); err != nil {
+			t.Fatalf("%v: %v", cidr, err)
+		} else if !subnet.Contains(addr) {
+			t.Fatalf("%v: selected %v outside of the subnet", cidr, addr)
+		}
+	}
+
+	// every selection path refuses them, unless the config allows them
+	for _, cidr := range []string{"0.0.0.0/0", "::/0"} {
+		wide := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{cidr}}}}
+		if _, err := SelectPhantom(seed, wide, nil, true); !errors.Is(err, ErrSubnetTooWide) {
+			t.Fatalf("%v: got error %v, expected %v", cidr, err, ErrSubnetTooWide)
+		} else if _, err := SelectPhantomBatch([][]byte{seed}, wide, nil); !errors.Is(err, ErrSubnetTooWide) {
+			t.Fatalf("%v batch: got error %v, expected %v", cidr, err, ErrSubnetTooWide)
+		} else if _, err := SelectPhantomAddressUniform(seed, wide, nil); !errors.Is(err, ErrSubnetTooWide) {
+			t.Fatalf("%v uniform: got error %v, expected %v", cidr, err, ErrSubnetTooWide)
+		} else if _, err := SelectPhantomFromParsed(seed, mustParseSubnets(cidr), nil); !errors.Is(err, ErrSubnetTooWide) {
+			t.Fatalf("%v parsed: got error %v, expected %v", cidr, err, ErrSubnetTooWide)
+		}
+
+		wide.AllowWideSubnets = true
+		if addr, err := SelectPhantom(seed, wide, nil, true); err != nil {
+			t.Fatalf("%v refused with AllowWideSubnets set: %v", cidr, err)
+		} else if batch, err := SelectPhantomBatch([][]byte{seed}, wide, nil); err != nil || !batch[0].Equal(*addr) {
+			t.Fatalf("%v batch selected %v (%v), expected %v", cidr, batch, err, addr)
+		}
+	}
+
+	// the limits are per config
+	strict := SubnetConfig{
+		WeightedSubnets:   []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{"10.0.0.0/8"}}},
+		MinSelectPrefixV4: 16,
+	}
+	if _, err := SelectPhantom(seed, strict, nil, true); !errors.Is(err, ErrSubnetTooWide) {
+		t.Fatalf("/8 with a /16 minimum: got error %v, expected %v", err, ErrSubnetTooWide)
+	}
+	strict.MinSelectPrefixV4 = 0
+	if _, err := SelectPhantom(seed, strict, nil, true); err != nil {
+		t.Fatalf("/8 with the default minimum: %v", err)
+	}
+}
+
+func TestFractionalWeights(t *testing.T) {
+	quarter, threeQuarters := mustParseSubnets("192.122.190.0/24")[0], mustParseSubnets("141.219.0.0/16")[0]
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 0.25, Subnets: []string{quarter.String()}},
+		{Weight: 0.75, Subnets: []string{threeQuarters.String()}},
+	}}
+
+	const samples = 4000
+	fromQuarter := 0
+	for i := 0; i < samples; i++ {
+		seed := make([]byte, 16)
+		binary.BigEndian.PutUint64(seed, uint64(i))
+		addr, err := SelectPhantom(seed, sc, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quarter.Contains(*addr) {
+			fromQuarter++
+		} else if !threeQuarters.Contains(*addr) {
+			t.Fatalf("selected %v outside of both groups", addr)
+		}
+	}
+	if ratio := float64(fromQuarter) / samples; ratio < 0.22 || ratio > 0.28 {
+		t.Fatalf("group of weight 0.25 selected %d/%d times, expected about a quarter", fromQuarter, samples)
+	}
+
+	// whole weights aren't normalized, so their selections don't change
+	for i, w := range phantomSubnets.groupWeights() {
+		if cjSubnet := phantomSubnets.WeightedSubnets[i]; w != uint64(cjSubnet.Weight) {
+			t.Fatalf("whole weight %v used as %d", cjSubnet.Weight, w)
+		}
+	}
+	if weights := sc.groupWeights(); weights[0] != DefaultWeightPrecision/4 || weights[1] != 3*DefaultWeightPrecision/4 {
+		t.Fatalf("fractional weights normalized to %v", weights)
+	}
+}
+
+func TestNormalizeWeights(t *testing.T) {
+	cases := []struct {
+		weights   []float32
+		precision uint64
+		expected  []uint64
+	}{
+		{[]float32{0.1, 0.2, 0.7}, 1000, []uint64{100, 200, 700}},
+		{[]float32{1, 2, 7}, 1000, []uint64{100, 200, 700}},
+		{[]float32{0.5, 0, 0.5}, 10, []uint64{5, 0, 5}},
+		{[]float32{0.999, 0.0001}, 100, []uint64{100, 1}},
+		{[]float32{0, 0, 0}, 1000, []uint64{1, 1, 1}},
+		{[]float32{-1, 0}, 1000, []uint64{1, 1}},
+		{[]float32{0.25, 0.75}, 0, []uint64{DefaultWeightPrecision / 4, 3 * DefaultWeightPrecision / 4}},
+	}
+	for _, c := range cases {
+		if got := NormalizeWeights(c.weights, c.precision); !reflect.DeepEqual(got, c.expected) {
+			t.Fatalf("NormalizeWeights(%v, %d) = %v, expected %v", c.weights, c.precision, got, c.expected)
+		}
+	}
+}
+
+func TestAllZeroWeights(t *testing.T) {
+	// subnet weights that are all 0 fall back to uniform subnet selection
+	subnets := []string{"192.122.190.0/24", "141.219.0.0/24"}
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: subnets, SubnetWeights: []float32{0, 0}},
+	}}
+	parsed := mustParseSubnets(subnets...)
+
+	const samples = 5000
+	fromFirst := 0
+	for i := 0; i < samples; i++ {
+		seed := make([]byte, 16)
+		binary.BigEndian.PutUint64(seed, uint64(i))
+		addr, err := SelectPhantom(seed, sc, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		} else if parsed[0].Contains(*addr) {
+			fromFirst++
+		} else if !parsed[1].Contains(*addr) {
+			t.Fatalf("selected %v outside of %v", addr, subnets)
+		}
+	}
+	if ratio := float64(fromFirst) / samples; math.Abs(ratio-0.5) > 0.03 {
+		t.Fatalf("first of two subnets of weight 0 selected %d/%d times", fromFirst, samples)
+	}
+
+	// groups of weight 0 are excluded rather than selected uniformly
+	sc.WeightedSubnets[0].Weight = 0
+	if _, err := SelectPhantom([]byte("seedseedseedseed"), sc, nil, true); !errors.Is(err, ErrNoSubnets) {
+		t.Fatalf("selected from groups of weight 0: %v", err)
+	}
+}
+
+func TestProportionalWeights(t *testing.T) {
+	subnets := []string{"192.122.190.0/24", "141.219.0.0/16", "10.0.0.0/8"}
+	proportions := []float64{0.1, 0.2, 0.7}
+	for _, precision := range []uint64{0, 1000} {
+		sc := SubnetConfig{WeightPrecision: precision}
+		for i, subnet := range subnets {
+			sc.WeightedSubnets = append(sc.WeightedSubnets, ConjurePhantomSubnet{Weight: float32(proportions[i]), Subnets: []string{subnet}})
+		}
+		parsed := mustParseSubnets(subnets...)
+
+		const samples = 10000
+		counts := make([]int, len(subnets))
+		for i := 0; i < samples; i++ {
+			seed := make([]byte, 16)
+			binary.BigEndian.PutUint64(seed, uint64(i))
+			addr, err := SelectPhantom(seed, sc, nil, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j, subnet := range parsed {
+				if subnet.Contains(*addr) {
+					counts[j]++
+				}
+			}
+		}
+		for i, p := range proportions {
+			if ratio := float64(counts[i]) / samples; math.Abs(ratio-p) > 0.02 {
+				t.Fatalf("precision %d: group of weight %v selected %d/%d times", precision, p, counts[i], samples)
+			}
+		}
+	}
+}
+
+func TestSubnetWeights(t *testing.T) {
+	large, small, unused := "141.219.0.0/16", "192.122.190.0/24", "35.8.0.0/16"
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{large, small, unused}, SubnetWeights: []float32{0.2, 0.8, 0}},
+	}}
+	if err := sc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	parsed := mustParseSubnets(large, small)
+
+	// the small subnet gets most selections despite its size
+	const samples = 5000
+	seeds := make([][]byte, samples)
+	fromSmall := 0
+	for i := range seeds {
+		seeds[i] = make([]byte, 16)
+		binary.BigEndian.PutUint64(seeds[i], uint64(i))
+		selection, err := SelectPhantomDetailed(seeds[i], sc, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case parsed[1].Contains(selection.Addr):
+			fromSmall++
+			if selection.Index != 1 {
+				t.Fatalf("selection from %v has index %d, expected 1", small, selection.Index)
+			}
+		case !parsed[0].Contains(selection.Addr):
+			t.Fatalf("selected %v from a subnet of weight 0", selection.Addr)
+		}
+	}
+	if ratio := float64(fromSmall) / samples; math.Abs(ratio-0.8) > 0.03 {
+		t.Fatalf("subnet of weight 0.8 selected %d/%d times", fromSmall, samples)
+	}
+
+	batch, err := SelectPhantomBatch(seeds, sc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, seed := range seeds {
+		addr, err := SelectPhantom(seed, sc, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		} else if !addr.Equal(batch[i]) {
+			t.Fatalf("seed %d: batch selected %v, SelectPhantom %v", i, batch[i], addr)
+		}
+	}
+
+	// without subnet weights selection is unchanged
+	plain := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{large, small, unused}}}}
+	for _, seed := range seeds[:100] {
+		withNil, err := SelectPhantom(seed, plain, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := SelectPhantomFromParsed(seed, mustParseSubnets(large, small, unused), nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if !addr.Equal(*withNil) {
+			t.Fatalf("group without subnet weights selected %v, expected %v", withNil, addr)
+		}
+	}
+
+	buf, err := json.Marshal(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded SubnetConfig
+	if err = json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(decoded, sc) {
+		t.Fatalf("decoded %+v from %s, expected %+v", decoded, buf, sc)
+	}
+
+	mismatched := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{{Weight: 1, Subnets: []string{large, small}, SubnetWeights: []float32{1}}}}
+	if err := mismatched.Validate(); err == nil || !strings.Contains(err.Error(), "1 subnet weights for 2 subnets") {
+		t.Fatalf("mismatched subnet weights: got error %v", err)
+	}
+	if _, err := SelectPhantom(seeds[0], mismatched, nil, true); err == nil {
+		t.Fatal("selected from a group with mismatched subnet weights")
+	}
+}
+
+func TestSubnetWeightsMergeAndCanonicalize(t *testing.T) {
+	sc := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{"192.122.190.0/25"}},
+	}}
+	other := SubnetConfig{WeightedSubnets: []ConjurePhantomSubnet{
+		{Weight: 1, Subnets: []string{"192.122.190.0/25", "192.122.190.0/24", "141.219.0.0/16"}, SubnetWeights: []float32{1, 2, 3}},
+	}}
+
+	merged := sc.Merge(other)
+	if w := merged.WeightedSubnets[1]; !reflect.DeepEqual(w.Subnets, []string{"192.122.190.0/24", "141.219.0.0/16"}) || !reflect.DeepEqual(w.SubnetWeights, []float32{2, 3}) {
+		t.Fatalf("merged group %v with weights %v", w.Subnets, w.SubnetWeights)
+	}
+
+	canonical, err := merged.Canonicalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the /24 loses its lower half to the first group, keeping half its weight
+	if w := canonical.WeightedSubnets[1]; !reflect.DeepEqual(w.Subnets, []string{"192.122.190.128/25", "141.219.0.0/16"}) || !reflect.DeepEqual(w.SubnetWeights, []float32{1, 3}) {
+		t.Fatalf("canonical group %v with weights %v", w.Subnets, w.SubnetWeights)
+	}
+	if err := canonical.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
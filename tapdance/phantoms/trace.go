@@ -0,0 +1,106 @@
+package phantoms
+
+import (
+	"math/big"
+	"net"
+)
+
+// TraceStep - the bytes derived for one label, see the labels in the package
+//		documentation. The seed itself, read by AlgVersion1, is recorded with
+//		an empty label.
+type TraceStep struct {
+	Label string
+	Bytes []byte
+}
+
+// SelectionTrace - the derived bytes and intermediate values a selection went
+//		through, for comparing against another implementation, such as the
+//		station's, and finding the first step where they diverge.
+type SelectionTrace struct {
+	// Steps holds every expansion in the order selection made them.
+	Steps []TraceStep
+
+	// TotalWeight is the total of the group weights, after normalization,
+	// and GroupDraw the labelSubnetGroup value reduced modulo it, or under
+	// AlgVersion1 the value drawn from [1, TotalWeight]. Both are 0 for
+	// unweighted selection.
+	TotalWeight uint64
+	GroupDraw   uint64
+
+	// Subnets are the subnets the address was selected from, after the
+	// SubnetFilter, in order.
+	Subnets []*net.IPNet
+
+	// AddressTotal is the number of addresses in Subnets, AddressID the
+	// drawn id reduced modulo it, and Offset the offset of the address
+	// within the selected subnet: that of the id, or under AlgVersion1,
+	// where AddressTotal is the number of ids (subnetForSeedV1), the host
+	// bits drawn within it. The address at Offset may still be replaced
+	// under AlignV6To64 or SkipNetworkAndBroadcast.
+	AddressTotal *big.Int
+	AddressID    *big.Int
+	Offset       *big.Int
+}
+
+// Step - the bytes of the first expansion for label, or nil if there was none.
+func (trace *SelectionTrace) Step(label string) []byte {
+	for _, step := range trace.Steps {
+		if step.Label == label {
+			return step.Bytes
+		}
+	}
+	return nil
+}
+
+// tracingExpander - exp, recording every expansion in trace.
+func tracingExpander(exp seedExpander, trace *SelectionTrace) seedExpander {
+	return func(label string, n int) ([]byte, error) {
+		out, err := exp(label, n)
+		if err == nil {
+			trace.Steps = append(trace.Steps, TraceStep{Label: label, Bytes: append([]byte{}, out...)})
+		}
+		return out, err
+	}
+}
+
+// recordGroupDraw - note the total weight and the value drawn from it to
+//		choose the group. Does nothing on a nil trace.
+func (trace *SelectionTrace) recordGroupDraw(totalWeight, draw uint64) {
+	if trace == nil {
+		return
+	}
+	trace.TotalWeight = totalWeight
+	trace.GroupDraw = draw
+}
+
+// recordAddress - note the subnets an address is selected from, the id drawn
+//		and the offset of the address within the subnet it picks. Does
+//		nothing on a nil trace.
+func (trace *SelectionTrace) recordAddress(subnets []*net.IPNet, total, id, offset *big.Int) {
+	if trace == nil {
+		return
+	}
+	trace.Subnets = subnets
+	trace.AddressTotal = total
+	trace.AddressID = id
+	trace.Offset = offset
+}
+
+// SelectPhantomTraced - SelectPhantomDetailed, also returning a trace of the
+//		derived bytes and intermediate values. If selection fails, the trace
+//		holds the expansions and values recorded up to the failure. This
+//		does extra work over SelectPhantom, so it's meant for debugging, not
+//		the hot path.
+func SelectPhantomTraced(seed []byte, subnets SubnetConfig, transform SubnetFilter, weighted bool) (*PhantomSelection, *SelectionTrace, error) {
+	if len(seed) < MinSeedLen {
+		return nil, nil, shortSeedError(seed)
+	}
+
+	trace := &SelectionTrace{}
+	selection, err := selectPhantomDetailed(tracingExpander(hkdfExpander(seed), trace), subnets, transform, weighted, trace)
+	if err != nil {
+		return nil, trace, err
+	}
+	selection.SeedHash = seedHash(seed)
+	return selection, trace, nil
+}
@@ -0,0 +1,118 @@
+package phantoms
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/big"
+	"testing"
+)
+
+func TestSelectPhantomTraced(t *testing.T) {
+	seeds := []string{
+		"seedseedseedseed",
+		"0123456789abcdef0123456789abcdef",
+		"another phantom selection seed!!",
+		"phantom seed number four........",
+	}
+	for _, version := range []uint32{AlgVersion1, AlgVersion2} {
+		for _, weighted := range []bool{true, false} {
+			sc := phantomSubnets
+			sc.AlgVersion = version
+			for _, s := range seeds {
+				seed := []byte(s)
+				selection, trace, err := SelectPhantomTraced(seed, sc, nil, weighted)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				expected, err := SelectPhantom(seed, sc, nil, weighted)
+				if err != nil {
+					t.Fatal(err)
+				} else if !selection.Addr.Equal(*expected) {
+					t.Fatalf("traced %v, SelectPhantom %v", selection.Addr, expected)
+				}
+
+				for _, step := range trace.Steps {
+					if step.Label == rawSeed {
+						if !bytes.Equal(step.Bytes, seed) {
+							t.Fatalf("raw seed step %x, expected the seed", step.Bytes)
+						}
+						continue
+					}
+					derived, err := ExpandSeed(seed, step.Label, len(step.Bytes))
+					if err != nil {
+						t.Fatal(err)
+					} else if !bytes.Equal(step.Bytes, derived) {
+						t.Fatalf("step %q: traced %x, expanded %x", step.Label, step.Bytes, derived)
+					}
+				}
+
+				if weighted && version == AlgVersion1 {
+					// v1 draws from [1, total weight] with math/rand
+					if trace.TotalWeight == 0 || trace.GroupDraw == 0 || trace.GroupDraw > trace.TotalWeight {
+						t.Fatalf("group draw %d of %d", trace.GroupDraw, trace.TotalWeight)
+					}
+				} else if weighted {
+					draw := trace.Step(labelSubnetGroup)
+					if draw == nil || trace.TotalWeight == 0 {
+						t.Fatalf("weighted trace without a group draw: %+v", trace)
+					} else if trace.GroupDraw != binary.BigEndian.Uint64(draw)%trace.TotalWeight {
+						t.Fatalf("group draw %d from %x", trace.GroupDraw, draw)
+					}
+				}
+				if weighted {
+					group, err := sc.groupIndex(hkdfExpander(seed), nil)
+					if err != nil {
+						t.Fatal(err)
+					} else if group != selection.Group {
+						t.Fatalf("group %d, selected from %d", group, selection.Group)
+					}
+				} else if trace.TotalWeight != 0 || trace.GroupDraw != 0 {
+					t.Fatalf("unweighted trace with a group draw: %+v", trace)
+				}
+
+				if version == AlgVersion1 {
+					// v1 ids run from 1 to the total
+					if trace.AddressID.Sign() <= 0 || trace.AddressID.Cmp(trace.AddressTotal) > 0 {
+						t.Fatalf("address id %v out of %v", trace.AddressID, trace.AddressTotal)
+					}
+				} else if trace.AddressID.Cmp(trace.AddressTotal) >= 0 {
+					t.Fatalf("address id %v out of %v", trace.AddressID, trace.AddressTotal)
+				}
+				// without alignment or skipping, the address is the
+				// subnet base plus the offset
+				base := big.NewInt(0).SetBytes(selection.Subnet.IP)
+				addr := big.NewInt(0).SetBytes(selection.Addr)
+				if len(selection.Subnet.IP) == 4 {
+					addr.SetBytes(selection.Addr.To4())
+				}
+				if addr.Sub(addr, base).Cmp(trace.Offset) != 0 {
+					t.Fatalf("%v is %v into %v, traced offset %v", selection.Addr, addr, selection.Subnet, trace.Offset)
+				}
+			}
+		}
+	}
+
+	// the trace holds the subnets selection used, after the filter
+	selection, trace, err := SelectPhantomTraced([]byte("seedseedseedseed"), phantomSubnets, V4Only, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(trace.Subnets) != 3 {
+		t.Fatalf("traced subnets %v, expected the 3 IPv4 ones", trace.Subnets)
+	}
+	for _, subnet := range trace.Subnets {
+		if isIPv6(subnet.IP) {
+			t.Fatalf("traced filtered out subnet %v", subnet)
+		}
+	}
+	if !selection.Subnet.Contains(selection.Addr) {
+		t.Fatalf("%v not in %v", selection.Addr, selection.Subnet)
+	}
+
+	_, trace, err = SelectPhantomTraced([]byte("seedseedseedseed"), SubnetConfig{}, nil, true)
+	if err == nil {
+		t.Fatal("selected from an empty config")
+	} else if trace == nil {
+		t.Fatal("no trace for a failed selection")
+	}
+}
@@ -34,6 +34,24 @@ func aesGcmEncrypt(plaintext []byte, key []byte, iv []byte) ([]byte, error) {
 	return aesGcmCipher.Seal(nil, iv, plaintext, nil), nil
 }
 
+func aesGcmDecrypt(ciphertext []byte, key []byte, iv []byte) (plaintext []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+
+	aesGcmCipher, err := cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+
+	plaintext, err = aesGcmCipher.Open(nil, iv, ciphertext, nil)
+	if err != nil {
+		return
+	}
+	return
+}
+
 // Tries to get crypto random int in range [min, max]
 // In case of crypto failure -- return insecure pseudorandom
 func getRandInt(min int, max int) int {
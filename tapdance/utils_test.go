@@ -1,8 +1,6 @@
 package tapdance
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
@@ -24,25 +22,6 @@ func (z TestRandReader) Read(b []byte) (n int, err error) {
 
 var testRandReader TestRandReader
 
-// this function is only currently used in testing
-func aesGcmDecrypt(ciphertext []byte, key []byte, iv []byte) (plaintext []byte, err error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return
-	}
-
-	aesGcmCipher, err := cipher.NewGCM(block)
-	if err != nil {
-		return
-	}
-
-	plaintext, err = aesGcmCipher.Open(nil, iv, ciphertext, nil)
-	if err != nil {
-		return
-	}
-	return
-}
-
 func TestAES_GCM_EncryptDecrypt(t *testing.T) {
 	iv, _ := hex.DecodeString("156738805e207a6f2c50413a")
 	key, _ := hex.DecodeString("13c8ff335b01aaf970cbc7b7e3072249")